@@ -0,0 +1,115 @@
+// Package assertion implements the statement uberich passes back to an
+// application to say that a user has logged in.
+//
+// An assertion is a JWT signed by uberich naming the user, the application it
+// was issued to, when it was issued, when it stops being valid and a nonce that
+// allows it to be used only once. Applications only need uberich's public keys
+// to check it.
+package assertion
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"hawx.me/code/uberich/jwt"
+)
+
+// Lifetime is how long an assertion is valid for after being issued.
+const Lifetime = 2 * time.Minute
+
+var (
+	ErrUnverified = errors.New("assertion: not from a verified source")
+	ErrAudience   = errors.New("assertion: issued to a different application")
+	ErrExpired    = errors.New("assertion: expired")
+	ErrReplayed   = errors.New("assertion: already used")
+)
+
+type Assertion struct {
+	Email     string
+	Audience  string
+	Nonce     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+
+	// Session is the Sid of the user's session with uberich, if it is to be
+	// passed on, so that sessions started with the assertion end with it.
+	Session string
+}
+
+// New creates an assertion for the user with email to present to the
+// application named audience.
+func New(email, audience string, now time.Time) (Assertion, error) {
+	nonce, err := randomString(24)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	return Assertion{
+		Email:     email,
+		Audience:  audience,
+		Nonce:     nonce,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(Lifetime),
+	}, nil
+}
+
+// Sign returns the assertion as a JWT signed with key, stating that it was
+// issued by issuer.
+func (a Assertion) Sign(key *jwt.Key, issuer string) (string, error) {
+	return key.Sign(jwt.Claims{
+		Issuer:        issuer,
+		Subject:       a.Email,
+		Audience:      a.Audience,
+		IssuedAt:      a.IssuedAt.Unix(),
+		Expiry:        a.ExpiresAt.Unix(),
+		ID:            a.Nonce,
+		Email:         a.Email,
+		EmailVerified: true,
+		SessionID:     a.Session,
+	})
+}
+
+// Parse reads an assertion from token, checking that it was signed by one of
+// keys, was issued by issuer to audience and has not expired at now. It does
+// not check whether the assertion has been used before, see NonceCache.
+func Parse(token string, keys jwt.KeySet, issuer, audience string, now time.Time) (Assertion, error) {
+	var claims jwt.Claims
+	if err := keys.Verify(token, &claims); err != nil {
+		return Assertion{}, err
+	}
+
+	switch claims.Validate(issuer, audience, now) {
+	case nil:
+	case jwt.ErrAudience:
+		return Assertion{}, ErrAudience
+	case jwt.ErrExpired:
+		return Assertion{}, ErrExpired
+	default:
+		return Assertion{}, ErrUnverified
+	}
+
+	if claims.Email == "" || claims.Subject != claims.Email || claims.ID == "" || len(claims.Events) > 0 ||
+		time.Duration(claims.Expiry-claims.IssuedAt)*time.Second > Lifetime {
+		return Assertion{}, ErrUnverified
+	}
+
+	return Assertion{
+		Email:     claims.Email,
+		Audience:  claims.Audience,
+		Nonce:     claims.ID,
+		IssuedAt:  time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.Expiry, 0),
+		Session:   claims.SessionID,
+	}, nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
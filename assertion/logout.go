@@ -0,0 +1,87 @@
+package assertion
+
+import (
+	"time"
+
+	"hawx.me/code/uberich/jwt"
+)
+
+// logoutEvent is the event that marks a JWT as a logout token.
+const logoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// Logout tells an application that a user has signed out of uberich, so that
+// any session they started with the application before IssuedAt should end.
+//
+// It is sent as a back-channel logout token, which is a JWT like an assertion
+// but without an email claim and with an events claim, so that one can never be
+// mistaken for the other.
+type Logout struct {
+	Email     string
+	Audience  string
+	ID        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// NewLogout creates a logout for the user with email to send to the application
+// named audience.
+func NewLogout(email, audience string, now time.Time) (Logout, error) {
+	id, err := randomString(24)
+	if err != nil {
+		return Logout{}, err
+	}
+
+	return Logout{
+		Email:     email,
+		Audience:  audience,
+		ID:        id,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(Lifetime),
+	}, nil
+}
+
+// Sign returns the logout as a JWT signed with key, stating that it was issued
+// by issuer.
+func (l Logout) Sign(key *jwt.Key, issuer string) (string, error) {
+	return key.Sign(jwt.Claims{
+		Issuer:   issuer,
+		Subject:  l.Email,
+		Audience: l.Audience,
+		IssuedAt: l.IssuedAt.Unix(),
+		Expiry:   l.ExpiresAt.Unix(),
+		ID:       l.ID,
+		Events:   map[string]struct{}{logoutEvent: {}},
+	})
+}
+
+// ParseLogout reads a logout from token, checking that it was signed by one of
+// keys, was issued by issuer to audience and has not expired at now.
+func ParseLogout(token string, keys jwt.KeySet, issuer, audience string, now time.Time) (Logout, error) {
+	var claims jwt.Claims
+	if err := keys.Verify(token, &claims); err != nil {
+		return Logout{}, err
+	}
+
+	switch claims.Validate(issuer, audience, now) {
+	case nil:
+	case jwt.ErrAudience:
+		return Logout{}, ErrAudience
+	case jwt.ErrExpired:
+		return Logout{}, ErrExpired
+	default:
+		return Logout{}, ErrUnverified
+	}
+
+	if _, ok := claims.Events[logoutEvent]; !ok || claims.Subject == "" || claims.Email != "" || claims.Nonce != "" ||
+		time.Duration(claims.Expiry-claims.IssuedAt)*time.Second > Lifetime {
+		return Logout{}, ErrUnverified
+	}
+
+	return Logout{
+		Email:     claims.Subject,
+		Audience:  claims.Audience,
+		ID:        claims.ID,
+		IssuedAt:  time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.Expiry, 0),
+	}, nil
+}
@@ -0,0 +1,41 @@
+package assertion
+
+import (
+	"sync"
+	"time"
+
+	"hawx.me/code/uberich/jwt"
+)
+
+// NonceCache remembers the nonces of assertions until they can no longer be
+// parsed, so that each can only be used once.
+type NonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{seen: map[string]time.Time{}}
+}
+
+// Use records that the assertion has been used. It returns ErrReplayed if the
+// nonce has been seen before.
+func (c *NonceCache) Use(a Assertion, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for nonce, expires := range c.seen {
+		if now.After(expires) {
+			delete(c.seen, nonce)
+		}
+	}
+
+	if _, ok := c.seen[a.Nonce]; ok {
+		return ErrReplayed
+	}
+
+	// Parse accepts an assertion for a while after it expires, in case clocks
+	// disagree, so the nonce must be kept for at least as long.
+	c.seen[a.Nonce] = a.ExpiresAt.Add(jwt.Skew)
+	return nil
+}
@@ -1,57 +1,476 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"sync"
 	"time"
 
-	"golang.org/x/time/rate"
-
 	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+	"hawx.me/code/uberich/totp"
 )
 
+// The limits used when they are not set.
+const (
+	DefaultEmailLimit    = 3
+	DefaultIPLimit       = 20
+	DefaultSubnetLimit   = 60
+	DefaultInterval      = 30 * time.Second
+	DefaultBuckets       = 10000
+	DefaultMaxConcurrent = 4
+
+	DefaultLockoutAfter     = 5
+	DefaultLockoutBackoff   = time.Minute
+	DefaultLockoutThreshold = 20
+)
+
+// The limits on emails sent to each address, so that no one can have many sent
+// to a user.
+const (
+	mailLimit    = 3
+	mailInterval = 10 * time.Minute
+)
+
+// maxLockoutBackoff is the longest a user is locked out for before reaching the
+// threshold, however many attempts have failed.
+const maxLockoutBackoff = 24 * time.Hour
+
+// Checker checks passwords and second factors. Attempts are rate limited for
+// each email, client IP and subnet, so that neither a single user nor a single
+// network can make many guesses. Failed attempts are also counted for each
+// email, whether or not it has an account, and once there are too many it is
+// locked out.
 type Checker struct {
-	conf   *config.Config
+	db     storage.Storage
 	logger *log.Logger
+	now    func() time.Time
+	limits config.RateLimits
+	onLock func(email string, lockout config.Lockout)
+
+	emails  *buckets
+	ips     *buckets
+	subnets *buckets
+	mails   *buckets
+
+	// unknown are the lockouts for emails without an account, as they can't be
+	// kept with the user.
+	unknown *lockouts
 
-	mu       sync.Mutex
-	bucketFn func() *rate.Limiter
-	buckets  map[string]*rate.Limiter
+	// checking limits how many passwords are compared at once, as each takes a
+	// noticeable amount of CPU.
+	checking chan struct{}
+
+	// using is held while recording that a second factor has been used, so that
+	// two attempts with the same code can't both succeed.
+	using sync.Mutex
+
+	// dummy has a password that no one knows. It is checked in place of users
+	// that don't exist, so that refusing them takes as long as refusing a real
+	// user and the time taken doesn't reveal who has an account.
+	dummy *config.User
 }
 
-func NewChecker(conf *config.Config, logger *log.Logger) *Checker {
+func NewChecker(db storage.Storage, limits config.RateLimits, logger *log.Logger) *Checker {
+	if limits.Email <= 0 {
+		limits.Email = DefaultEmailLimit
+	}
+	if limits.IP <= 0 {
+		limits.IP = DefaultIPLimit
+	}
+	if limits.Subnet <= 0 {
+		limits.Subnet = DefaultSubnetLimit
+	}
+	if limits.Interval <= 0 {
+		limits.Interval = DefaultInterval
+	}
+	if limits.Buckets <= 0 {
+		limits.Buckets = DefaultBuckets
+	}
+	if limits.MaxConcurrent <= 0 {
+		limits.MaxConcurrent = DefaultMaxConcurrent
+	}
+	if limits.LockoutAfter <= 0 {
+		limits.LockoutAfter = DefaultLockoutAfter
+	}
+	if limits.LockoutBackoff <= 0 {
+		limits.LockoutBackoff = DefaultLockoutBackoff
+	}
+	if limits.LockoutThreshold <= 0 {
+		limits.LockoutThreshold = DefaultLockoutThreshold
+	}
+
+	dummy := &config.User{}
+	if err := dummy.SetPassword(randomPassword()); err != nil {
+		logger.Println("checker:", err)
+	}
+
 	return &Checker{
-		conf:     conf,
+		dummy:    dummy,
+		db:       db,
 		logger:   logger,
-		bucketFn: func() *rate.Limiter { return rate.NewLimiter(rate.Every(time.Second*30), 3) },
-		buckets:  map[string]*rate.Limiter{},
+		now:      time.Now,
+		limits:   limits,
+		emails:   newBuckets(limits.Interval, limits.Email, limits.Buckets),
+		ips:      newBuckets(limits.Interval, limits.IP, limits.Buckets),
+		subnets:  newBuckets(limits.Interval, limits.Subnet, limits.Buckets),
+		mails:    newBuckets(mailInterval, mailLimit, limits.Buckets),
+		unknown:  newLockouts(limits.Buckets),
+		checking: make(chan struct{}, limits.MaxConcurrent),
 	}
 }
 
-func (c *Checker) IsAuthorised(email, password string) bool {
-	c.mu.Lock()
-	bucket, ok := c.buckets[email]
-	if !ok {
-		bucket = c.bucketFn()
-		c.buckets[email] = bucket
+func randomPassword() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// subnet returns the network that ip is in: the /24 for IPv4, or the /64 for
+// IPv6 as that is usually what is given to a single customer.
+func subnet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// Client describes where an attempt came from, so that it can be rate limited
+// and recorded.
+type Client struct {
+	IP        string
+	UserAgent string
+	RequestID string
+}
+
+// record adds an event to the audit log.
+func (c *Checker) record(client Client, typ, email, detail string) {
+	err := c.db.AddEvent(&storage.Event{
+		Time:      c.now(),
+		Type:      typ,
+		Email:     email,
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		RequestID: client.RequestID,
+		Detail:    detail,
+	})
+	if err != nil {
+		c.logger.Println("checker: could not record event:", err)
+	}
+}
+
+// limited returns why another attempt can't be made for email from ip, or an
+// empty string if it can. The limits for the client are checked first, so that
+// a client that has run out can't use up the attempts for the user it is
+// guessing at.
+func (c *Checker) limited(ip, email string) string {
+	if reason := c.limitedClient(ip); reason != "" {
+		return reason
 	}
-	c.mu.Unlock()
 
-	if !bucket.Allow() {
+	if !c.emails.allow(email, c.now()) {
 		c.logger.Println("checker: rate limit exceeded for", email)
+		return "rate limit exceeded for user"
+	}
+
+	return ""
+}
+
+// limitedClient returns why another attempt can't be made from ip, or an empty
+// string if it can.
+func (c *Checker) limitedClient(ip string) string {
+	if ip == "" {
+		return ""
+	}
+
+	now := c.now()
+
+	if !c.ips.allow(ip, now) {
+		c.logger.Println("checker: rate limit exceeded for ip", ip)
+		return "rate limit exceeded for ip"
+	}
+
+	if network := subnet(ip); !c.subnets.allow(network, now) {
+		c.logger.Println("checker: rate limit exceeded for subnet", network)
+		return "rate limit exceeded for subnet"
+	}
+
+	return ""
+}
+
+// CanMail reports whether an email can be sent to email at the request of
+// client. Requests are limited for each client as attempts to sign in are, and
+// only a few emails are sent to each address, whether or not it has an account.
+func (c *Checker) CanMail(client Client, email string) bool {
+	if c.limitedClient(client.IP) != "" {
+		return false
+	}
+
+	if !c.mails.allow(email, c.now()) {
+		c.logger.Println("checker: mail limit exceeded for", email)
 		return false
 	}
 
-	user := c.conf.GetUser(email)
+	return true
+}
+
+// OnLock sets a function to call when a user is locked out.
+func (c *Checker) OnLock(f func(email string, lockout config.Lockout)) {
+	c.onLock = f
+}
+
+// IsLocked reports whether the user with email is locked out. Emails without an
+// account can be locked out too, so that this doesn't reveal which have one.
+func (c *Checker) IsLocked(email string) bool {
+	user, err := c.db.GetUser(email)
+	if err == storage.ErrNotFound {
+		return c.unknown.get(email).IsLocked(c.now())
+	}
+	if err != nil {
+		return false
+	}
+
+	return user.IsLocked(c.now())
+}
+
+// backoff returns how long a user is locked out for after failed attempts.
+func (c *Checker) backoff(failed int) time.Duration {
+	backoff := c.limits.LockoutBackoff
+	for i := c.limits.LockoutAfter; i < failed && backoff < maxLockoutBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxLockoutBackoff {
+		return maxLockoutBackoff
+	}
+	return backoff
+}
+
+// fail records a failed attempt by the user with email, locking them out if
+// there have been too many. Emails without an account are counted the same
+// way, but by the checker, and only after trying the storage so that it takes
+// about as long.
+func (c *Checker) fail(client Client, email string) {
+	now := c.now()
+
+	update := func(lockout *config.Lockout) {
+		lockout.FailedAttempts++
+		switch {
+		case lockout.FailedAttempts >= c.limits.LockoutThreshold:
+			lockout.Locked = true
+		case lockout.FailedAttempts >= c.limits.LockoutAfter:
+			lockout.LockedUntil = now.Add(c.backoff(lockout.FailedAttempts))
+		}
+	}
+
+	known := true
+	lockout, err := c.db.UpdateLockout(email, update)
+	if err == storage.ErrNotFound {
+		known = false
+		lockout, err = c.unknown.update(email, update), nil
+	}
+	if err != nil {
+		c.logger.Println("checker:", err)
+		return
+	}
+
+	if lockout.IsLocked(now) {
+		c.logger.Println("checker: locked out", email, "after", lockout.FailedAttempts, "failed attempts")
+		c.record(client, storage.EventLockedOut, email, fmt.Sprintf("after %d failed attempts", lockout.FailedAttempts))
+
+		if known && c.onLock != nil {
+			c.onLock(email, lockout)
+		}
+	}
+}
+
+// succeed clears the failed attempts recorded for user.
+func (c *Checker) succeed(user *config.User) {
+	if user.FailedAttempts == 0 {
+		return
+	}
+
+	if _, err := c.db.UpdateLockout(user.Email, (*config.Lockout).Unlock); err != nil {
+		c.logger.Println("checker:", err)
+	}
+}
+
+// isPassword compares password with the user's, waiting until there are fewer
+// than the maximum comparisons running.
+func (c *Checker) isPassword(user *config.User, password string) bool {
+	c.checking <- struct{}{}
+	defer func() { <-c.checking }()
+
+	return user.IsPassword(password)
+}
+
+// recoveryCode is like isPassword, but checks code against each of the user's
+// recovery codes and returns the hash of the one it matches.
+func (c *Checker) recoveryCode(user *config.User, code string) (string, bool) {
+	c.checking <- struct{}{}
+	defer func() { <-c.checking }()
+
+	return user.RecoveryCode(code)
+}
+
+// IsAuthorised checks that password is correct for the user with email, for a
+// request from client. Attempts that are refused are recorded, with why.
+func (c *Checker) IsAuthorised(client Client, email, password string) bool {
+	if reason := c.limited(client.IP, email); reason != "" {
+		c.record(client, storage.EventLoginFailed, email, reason)
+		return false
+	}
+
+	// Users that can't sign in with a password are checked against the dummy, so
+	// that they take as long to refuse as a wrong password.
+	refuse := func(reason string) bool {
+		c.isPassword(c.dummy, password)
+		c.record(client, storage.EventLoginFailed, email, reason)
+		return false
+	}
+
+	user, err := c.db.GetUser(email)
+	if err != nil && err != storage.ErrNotFound {
+		c.logger.Println("checker:", err)
+		return refuse("could not get user")
+	}
+
+	// An email without an account is treated as a user who always gives the
+	// wrong password, so is locked out in the same way.
+	lockout := c.unknown.get(email)
+	if user != nil {
+		lockout = user.Lockout
+	}
+
+	if lockout.IsLocked(c.now()) {
+		c.logger.Println("checker: locked out", email)
+		return refuse("locked out")
+	}
+
 	if user == nil {
 		c.logger.Println("checker: no such user", email)
+		refuse("no such user")
+		c.fail(client, email)
 		return false
 	}
 
-	if !user.IsPassword(password) {
+	if user.IsPending() {
+		c.logger.Println("checker: not registered", email)
+		refuse("not registered")
+		c.fail(client, email)
+		return false
+	}
+
+	if !c.isPassword(user, password) {
 		c.logger.Println("checker: password incorrect", email)
+		c.record(client, storage.EventLoginFailed, email, "password incorrect")
+		c.fail(client, email)
 		return false
 	}
 
+	// A user with a second factor hasn't finished signing in, so their failed
+	// attempts are kept until they give it.
+	if !user.HasTwoFactor() {
+		c.succeed(user)
+	}
+
 	return true
 }
+
+// IsSecondFactor checks code against the user's authenticator, or failing that
+// their recovery codes. Codes are only accepted once, so the user is updated to
+// record that it has been used.
+func (c *Checker) IsSecondFactor(client Client, email, code string) bool {
+	if reason := c.limited(client.IP, email); reason != "" {
+		c.record(client, storage.EventSecondFactorFailed, email, reason)
+		return false
+	}
+
+	user, err := c.db.GetUser(email)
+	if err != nil {
+		c.logger.Println("checker:", err)
+		return false
+	}
+
+	if !user.HasTwoFactor() {
+		c.logger.Println("checker: no second factor for", email)
+		return false
+	}
+
+	if user.IsLocked(c.now()) {
+		c.logger.Println("checker: locked out", email)
+		c.record(client, storage.EventSecondFactorFailed, email, "locked out")
+		return false
+	}
+
+	step, ok := totp.Check(user.TOTPSecret, code, c.now(), user.TOTPStep)
+	var recoveryCode string
+	if !ok {
+		recoveryCode, ok = c.recoveryCode(user, code)
+	}
+
+	if !ok {
+		c.logger.Println("checker: second factor incorrect", email)
+		c.record(client, storage.EventSecondFactorFailed, email, "code incorrect")
+		c.fail(client, email)
+		return false
+	}
+
+	// Checking takes a while, so the user is read again and only the code used is
+	// changed. If it has been used since it was checked it is refused.
+	if err := c.useCode(email, step, recoveryCode); err == errCodeUsed {
+		c.logger.Println("checker: second factor already used", email)
+		c.record(client, storage.EventSecondFactorFailed, email, "code incorrect")
+		c.fail(client, email)
+		return false
+	} else if err != nil {
+		c.logger.Println("checker:", err)
+		return false
+	}
+	if recoveryCode != "" {
+		c.logger.Println("checker: recovery code used for", email)
+	}
+
+	c.succeed(user)
+	return true
+}
+
+// errCodeUsed is returned by useCode when the code has already been used.
+var errCodeUsed = errors.New("code already used")
+
+// useCode records that the user with email has used the one-time password for
+// step, or the recovery code with hash if it is not empty, so that it can't be
+// used again.
+func (c *Checker) useCode(email string, step int64, hash string) error {
+	c.using.Lock()
+	defer c.using.Unlock()
+
+	user, err := c.db.GetUser(email)
+	if err != nil {
+		return err
+	}
+
+	if hash != "" {
+		if !user.RemoveRecoveryCode(hash) {
+			return errCodeUsed
+		}
+	} else {
+		if step <= user.TOTPStep {
+			return errCodeUsed
+		}
+		user.TOTPStep = step
+	}
+
+	return c.db.SetUser(user)
+}
@@ -0,0 +1,446 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+var discardLogger = log.New(ioutil.Discard, "", 0)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+
+func testChecker(t *testing.T, limits config.RateLimits) (*Checker, *fakeClock) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.toml")
+	ioutil.WriteFile(path, []byte{}, 0600)
+
+	conf, _ := config.Read(path)
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		user := &config.User{Email: email}
+		user.SetPassword("password")
+		conf.SetUser(user)
+	}
+
+	clock := &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	checker := NewChecker(storage.NewTOML(conf, filepath.Join(dir, "audit.log")), limits, discardLogger)
+	checker.now = clock.now
+
+	return checker, clock
+}
+
+func TestCheckerLimitsEmail(t *testing.T) {
+	checker, clock := testChecker(t, config.RateLimits{Email: 2, Interval: time.Minute})
+
+	assert := assert.New(t)
+
+	assert.False(checker.IsAuthorised(Client{IP: "192.0.2.1"}, "a@example.com", "wrong"))
+	assert.False(checker.IsAuthorised(Client{IP: "198.51.100.1"}, "a@example.com", "wrong"))
+	assert.False(checker.IsAuthorised(Client{IP: "203.0.113.1"}, "a@example.com", "password"))
+
+	// Other users are unaffected.
+	assert.True(checker.IsAuthorised(Client{IP: "203.0.113.1"}, "b@example.com", "password"))
+
+	clock.add(time.Minute)
+	assert.True(checker.IsAuthorised(Client{IP: "203.0.113.1"}, "a@example.com", "password"))
+	assert.False(checker.IsAuthorised(Client{IP: "203.0.113.1"}, "a@example.com", "password"))
+}
+
+func TestCheckerLimitsUnknownEmail(t *testing.T) {
+	checker, _ := testChecker(t, config.RateLimits{Email: 2, Interval: time.Minute})
+
+	assert := assert.New(t)
+
+	for _, email := range []string{"a@example.com", "nobody@example.com"} {
+		assert.Equal("", checker.limited("", email), email)
+		assert.Equal("", checker.limited("", email), email)
+		assert.NotEqual("", checker.limited("", email), email)
+	}
+
+	assert.Equal(2, checker.emails.len())
+}
+
+func TestCheckerLimitsIP(t *testing.T) {
+	checker, clock := testChecker(t, config.RateLimits{IP: 3, Interval: time.Minute})
+
+	assert := assert.New(t)
+
+	for i := 0; i < 3; i++ {
+		assert.False(checker.IsAuthorised(Client{IP: "192.0.2.1"}, fmt.Sprintf("%d@example.com", i), "wrong"))
+	}
+	assert.False(checker.IsAuthorised(Client{IP: "192.0.2.1"}, "a@example.com", "password"))
+
+	// Other addresses in the subnet are unaffected, as is the user.
+	assert.True(checker.IsAuthorised(Client{IP: "192.0.2.2"}, "a@example.com", "password"))
+
+	clock.add(time.Minute)
+	assert.True(checker.IsAuthorised(Client{IP: "192.0.2.1"}, "b@example.com", "password"))
+}
+
+func TestCheckerLimitsSubnet(t *testing.T) {
+	checker, clock := testChecker(t, config.RateLimits{IP: 10, Subnet: 3, Interval: time.Minute})
+
+	assert := assert.New(t)
+
+	for i := 0; i < 3; i++ {
+		assert.False(checker.IsAuthorised(Client{IP: fmt.Sprintf("192.0.2.%d", i)}, fmt.Sprintf("%d@example.com", i), "wrong"))
+	}
+	assert.False(checker.IsAuthorised(Client{IP: "192.0.2.200"}, "a@example.com", "password"))
+	assert.True(checker.IsAuthorised(Client{IP: "192.0.3.1"}, "a@example.com", "password"))
+
+	for i := 0; i < 3; i++ {
+		assert.False(checker.IsAuthorised(Client{IP: fmt.Sprintf("2001:db8::%d", i)}, fmt.Sprintf("%d@example.com", i), "wrong"))
+	}
+	assert.False(checker.IsAuthorised(Client{IP: "2001:db8::ffff:1"}, "b@example.com", "password"))
+	assert.True(checker.IsAuthorised(Client{IP: "2001:db8:0:1::1"}, "b@example.com", "password"))
+
+	clock.add(time.Minute)
+	assert.True(checker.IsAuthorised(Client{IP: "192.0.2.200"}, "a@example.com", "password"))
+}
+
+func TestCheckerLimitsMail(t *testing.T) {
+	checker, clock := testChecker(t, config.RateLimits{IP: 5, Interval: time.Minute})
+
+	assert := assert.New(t)
+
+	for i := 0; i < mailLimit; i++ {
+		assert.True(checker.CanMail(Client{IP: fmt.Sprintf("192.0.2.%d", i)}, "a@example.com"))
+	}
+	assert.False(checker.CanMail(Client{IP: "198.51.100.1"}, "a@example.com"))
+	assert.True(checker.CanMail(Client{IP: "198.51.100.1"}, "b@example.com"))
+
+	// Clients are limited whoever they ask to email.
+	for i := 0; i < 4; i++ {
+		checker.CanMail(Client{IP: "198.51.100.1"}, fmt.Sprintf("%d@example.com", i))
+	}
+	assert.False(checker.CanMail(Client{IP: "198.51.100.1"}, "nobody@example.com"))
+
+	clock.add(mailInterval)
+	assert.True(checker.CanMail(Client{IP: "203.0.113.1"}, "a@example.com"))
+}
+
+func TestCheckerLimitsConcurrentChecks(t *testing.T) {
+	checker, _ := testChecker(t, config.RateLimits{MaxConcurrent: 1})
+
+	// Take the only slot, so that the check must wait for it.
+	checker.checking <- struct{}{}
+
+	done := make(chan bool)
+	go func() {
+		done <- checker.IsAuthorised(Client{IP: "192.0.2.1"}, "a@example.com", "password")
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected check to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-checker.checking
+	assert.New(t).True(<-done)
+}
+
+func TestCheckerLimitsConcurrentRecoveryCodes(t *testing.T) {
+	checker, _ := testChecker(t, config.RateLimits{MaxConcurrent: 1})
+
+	user, _ := checker.db.GetUser("a@example.com")
+	user.TOTPSecret = "JBSWY3DPEHPK3PXP"
+	user.SetRecoveryCodes([]string{"abcd-efgh"})
+	checker.db.SetUser(user)
+
+	checker.checking <- struct{}{}
+
+	done := make(chan bool)
+	go func() {
+		done <- checker.IsSecondFactor(Client{IP: "192.0.2.1"}, "a@example.com", "abcd-efgh")
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected check to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-checker.checking
+	assert.New(t).True(<-done)
+}
+
+func TestCheckerLocksOut(t *testing.T) {
+	checker, clock := testChecker(t, config.RateLimits{
+		Email:            100,
+		LockoutAfter:     2,
+		LockoutBackoff:   time.Minute,
+		LockoutThreshold: 4,
+	})
+
+	var locked []config.Lockout
+	checker.OnLock(func(email string, lockout config.Lockout) { locked = append(locked, lockout) })
+
+	assert := assert.New(t)
+
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "wrong"))
+	assert.False(checker.IsLocked("a@example.com"))
+	assert.Len(locked, 0)
+
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "wrong"))
+	assert.True(checker.IsLocked("a@example.com"))
+	assert.Len(locked, 1)
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "password"))
+
+	// Each further failure doubles the time locked out.
+	clock.add(time.Minute)
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "wrong"))
+	clock.add(time.Minute)
+	assert.True(checker.IsLocked("a@example.com"))
+	clock.add(time.Minute)
+	assert.False(checker.IsLocked("a@example.com"))
+
+	// Until the threshold, after which it is only unlocked by hand.
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "wrong"))
+	assert.Len(locked, 3)
+	assert.True(locked[2].Locked)
+	clock.add(48 * time.Hour)
+	assert.True(checker.IsLocked("a@example.com"))
+
+	checker.db.UpdateLockout("a@example.com", (*config.Lockout).Unlock)
+	assert.True(checker.IsAuthorised(Client{}, "a@example.com", "password"))
+}
+
+func TestCheckerLocksOutUnknownEmails(t *testing.T) {
+	checker, clock := testChecker(t, config.RateLimits{
+		Email:            100,
+		LockoutAfter:     2,
+		LockoutBackoff:   time.Minute,
+		LockoutThreshold: 3,
+	})
+	checker.db.SetUser(&config.User{Email: "pending@example.com", Invitation: "xyz"})
+
+	var locked []string
+	checker.OnLock(func(email string, lockout config.Lockout) { locked = append(locked, email) })
+
+	assert := assert.New(t)
+
+	// Emails without an account, or that haven't registered, are locked out just
+	// as a user giving the wrong password is.
+	for _, email := range []string{"a@example.com", "nobody@example.com", "pending@example.com"} {
+		assert.False(checker.IsAuthorised(Client{}, email, "wrong"))
+		assert.False(checker.IsLocked(email))
+		assert.False(checker.IsAuthorised(Client{}, email, "wrong"))
+		assert.True(checker.IsLocked(email))
+	}
+
+	clock.add(time.Minute)
+	for _, email := range []string{"a@example.com", "nobody@example.com", "pending@example.com"} {
+		assert.False(checker.IsLocked(email))
+		assert.False(checker.IsAuthorised(Client{}, email, "wrong"))
+		clock.add(48 * time.Hour)
+		assert.True(checker.IsLocked(email))
+	}
+
+	// Only those with an account are told.
+	assert.Equal([]string{"a@example.com", "pending@example.com", "a@example.com", "pending@example.com"}, locked)
+}
+
+func TestLockoutsEvictLeastRecentlyUsed(t *testing.T) {
+	l := newLockouts(2)
+	lock := func(lockout *config.Lockout) { lockout.Locked = true }
+
+	assert := assert.New(t)
+
+	l.update("a", lock)
+	l.update("b", lock)
+	l.update("a", lock)
+	l.update("c", lock)
+
+	assert.Equal(2, l.len())
+	assert.True(l.get("a").Locked)
+	assert.False(l.get("b").Locked)
+	assert.True(l.get("c").Locked)
+}
+
+func TestCheckerRecordsEvents(t *testing.T) {
+	checker, _ := testChecker(t, config.RateLimits{Email: 2, LockoutAfter: 1})
+
+	client := Client{IP: "192.0.2.1", UserAgent: "test", RequestID: "abc"}
+
+	assert := assert.New(t)
+
+	checker.IsAuthorised(client, "nobody@example.com", "password")
+	checker.IsAuthorised(client, "a@example.com", "wrong")
+	checker.IsAuthorised(client, "a@example.com", "password")
+	checker.IsAuthorised(client, "a@example.com", "password")
+
+	events, err := checker.db.ListEvents("", time.Time{})
+	assert.Nil(err)
+
+	expected := []struct{ typ, email, detail string }{
+		{storage.EventLoginFailed, "nobody@example.com", "no such user"},
+		{storage.EventLockedOut, "nobody@example.com", "after 1 failed attempts"},
+		{storage.EventLoginFailed, "a@example.com", "password incorrect"},
+		{storage.EventLockedOut, "a@example.com", "after 1 failed attempts"},
+		{storage.EventLoginFailed, "a@example.com", "locked out"},
+		{storage.EventLoginFailed, "a@example.com", "rate limit exceeded for user"},
+	}
+
+	if assert.Len(events, len(expected)) {
+		for i, e := range expected {
+			assert.Equal(e.typ, events[i].Type)
+			assert.Equal(e.email, events[i].Email)
+			assert.Equal(e.detail, events[i].Detail)
+			assert.Equal("192.0.2.1", events[i].IP)
+			assert.Equal("test", events[i].UserAgent)
+			assert.Equal("abc", events[i].RequestID)
+		}
+	}
+}
+
+func TestCheckerClearsFailedAttempts(t *testing.T) {
+	checker, _ := testChecker(t, config.RateLimits{Email: 100, LockoutAfter: 3})
+
+	assert := assert.New(t)
+
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "wrong"))
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "wrong"))
+	assert.True(checker.IsAuthorised(Client{}, "a@example.com", "password"))
+
+	user, _ := checker.db.GetUser("a@example.com")
+	assert.Equal(0, user.FailedAttempts)
+
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "wrong"))
+	assert.False(checker.IsLocked("a@example.com"))
+}
+
+// changingStorage changes the user's password just after it is first read, as
+// if it were changed while their attempt was being checked.
+type changingStorage struct {
+	storage.Storage
+	changed bool
+}
+
+func (s *changingStorage) GetUser(email string) (*config.User, error) {
+	user, err := s.Storage.GetUser(email)
+	if err != nil || s.changed {
+		return user, err
+	}
+	s.changed = true
+
+	changed := *user
+	changed.SetPassword("changed")
+	return user, s.Storage.SetUser(&changed)
+}
+
+func TestCheckerKeepsChangesMadeWhileChecking(t *testing.T) {
+	checker, _ := testChecker(t, config.RateLimits{Email: 100, LockoutAfter: 1})
+	checker.db = &changingStorage{Storage: checker.db}
+
+	assert := assert.New(t)
+
+	assert.False(checker.IsAuthorised(Client{}, "a@example.com", "wrong"))
+	assert.True(checker.IsLocked("a@example.com"))
+
+	user, _ := checker.db.GetUser("a@example.com")
+	assert.Equal(1, user.FailedAttempts)
+	assert.True(user.IsPassword("changed"))
+}
+
+// medianDuration returns the median time taken by n calls to f.
+func medianDuration(n int, f func()) time.Duration {
+	times := make([]time.Duration, n)
+	for i := range times {
+		start := time.Now()
+		f()
+		times[i] = time.Since(start)
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[n/2]
+}
+
+// TestCheckerTimingForUnknownUsers checks that refusing a user that doesn't
+// exist takes about as long as refusing one that does, so that the time taken
+// doesn't reveal who has an account.
+func TestCheckerTimingForUnknownUsers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping timing test in short mode")
+	}
+
+	checker, _ := testChecker(t, config.RateLimits{Email: 1000, LockoutAfter: 1000, LockoutThreshold: 1000})
+	checker.db.SetUser(&config.User{Email: "pending@example.com", Invitation: "xyz"})
+
+	const samples = 15
+
+	known := medianDuration(samples, func() { checker.IsAuthorised(Client{}, "a@example.com", "wrong") })
+
+	for _, email := range []string{"nobody@example.com", "pending@example.com"} {
+		other := medianDuration(samples, func() { checker.IsAuthorised(Client{}, email, "wrong") })
+
+		// Each path compares a password and counts the failure, so the times should
+		// be within noise of each other.
+		if ratio := float64(other) / float64(known); ratio < 0.8 || ratio > 1.25 {
+			t.Errorf("%s took %v, but a known user took %v", email, other, known)
+		}
+	}
+}
+
+func TestBucketsEvictIdle(t *testing.T) {
+	b := newBuckets(time.Minute, 2, 100)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert := assert.New(t)
+
+	for i := 0; i < 50; i++ {
+		b.allow(fmt.Sprintf("garbage-%d", i), now)
+	}
+	assert.Equal(50, b.len())
+
+	assert.True(b.allow("a", now.Add(time.Minute)))
+	assert.True(b.allow("a", now.Add(time.Minute)))
+	assert.False(b.allow("a", now.Add(time.Minute)))
+
+	// Once full again the garbage is dropped, but the bucket still in use is
+	// kept.
+	assert.True(b.allow("a", now.Add(2*time.Minute+time.Second)))
+	assert.Equal(1, b.len())
+}
+
+func TestBucketsEvictLeastRecentlyUsed(t *testing.T) {
+	b := newBuckets(time.Minute, 1, 3)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert := assert.New(t)
+
+	assert.True(b.allow("a", now))
+	assert.True(b.allow("b", now))
+	assert.True(b.allow("c", now))
+	assert.False(b.allow("a", now))
+
+	assert.True(b.allow("d", now))
+	assert.Equal(3, b.len())
+
+	// b was least recently used, so was dropped to make room.
+	assert.True(b.allow("b", now))
+	assert.False(b.allow("a", now))
+}
+
+func TestSubnet(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("192.0.2.0/24", subnet("192.0.2.123"))
+	assert.Equal("2001:db8:1:2::/64", subnet("2001:db8:1:2:3:4:5:6"))
+	assert.Equal("not-an-ip", subnet("not-an-ip"))
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// buckets holds a rate limiter for each key, so that memory used is bounded no
+// matter how many different keys are tried. A bucket left long enough to fill
+// back up is the same as a new one so is dropped, and once there are max the
+// least recently used is dropped to make room.
+type buckets struct {
+	every time.Duration
+	burst int
+	max   int
+
+	mu    sync.Mutex
+	order *list.List
+	index map[string]*list.Element
+}
+
+type bucket struct {
+	key      string
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func newBuckets(every time.Duration, burst, max int) *buckets {
+	return &buckets{
+		every: every,
+		burst: burst,
+		max:   max,
+		order: list.New(),
+		index: map[string]*list.Element{},
+	}
+}
+
+// idle is how long it takes for an emptied bucket to fill up again.
+func (b *buckets) idle() time.Duration {
+	return b.every * time.Duration(b.burst)
+}
+
+// allow takes an attempt from the bucket for key, reporting whether there was
+// one to take.
+func (b *buckets) allow(key string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.evictIdle(now)
+
+	el, ok := b.index[key]
+	if ok {
+		b.order.MoveToFront(el)
+	} else {
+		for b.order.Len() >= b.max {
+			b.remove(b.order.Back())
+		}
+
+		el = b.order.PushFront(&bucket{
+			key:     key,
+			limiter: rate.NewLimiter(rate.Every(b.every), b.burst),
+		})
+		b.index[key] = el
+	}
+
+	bu := el.Value.(*bucket)
+	bu.lastUsed = now
+	return bu.limiter.AllowN(now, 1)
+}
+
+// evictIdle drops the buckets that are full again.
+func (b *buckets) evictIdle(now time.Time) {
+	for el := b.order.Back(); el != nil; el = b.order.Back() {
+		if now.Sub(el.Value.(*bucket).lastUsed) < b.idle() {
+			break
+		}
+		b.remove(el)
+	}
+}
+
+func (b *buckets) remove(el *list.Element) {
+	b.order.Remove(el)
+	delete(b.index, el.Value.(*bucket).key)
+}
+
+// len returns the number of buckets held.
+func (b *buckets) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.order.Len()
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+
+	"hawx.me/code/uberich/config"
+)
+
+// lockouts holds the lockout for each email that doesn't have an account, so
+// that guessing at one is locked out just as a user would be and the response
+// doesn't reveal which emails have accounts. Like buckets, once there are max
+// the least recently used is dropped to make room.
+type lockouts struct {
+	max int
+
+	mu    sync.Mutex
+	order *list.List
+	index map[string]*list.Element
+}
+
+type lockoutEntry struct {
+	email   string
+	lockout config.Lockout
+}
+
+func newLockouts(max int) *lockouts {
+	return &lockouts{
+		max:   max,
+		order: list.New(),
+		index: map[string]*list.Element{},
+	}
+}
+
+// get returns the lockout for email.
+func (l *lockouts) get(email string) config.Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.index[email]; ok {
+		return el.Value.(*lockoutEntry).lockout
+	}
+	return config.Lockout{}
+}
+
+// update applies update to the lockout for email, and returns it as changed.
+func (l *lockouts) update(email string, update func(*config.Lockout)) config.Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.index[email]
+	if ok {
+		l.order.MoveToFront(el)
+	} else {
+		for l.order.Len() >= l.max {
+			back := l.order.Back()
+			l.order.Remove(back)
+			delete(l.index, back.Value.(*lockoutEntry).email)
+		}
+
+		el = l.order.PushFront(&lockoutEntry{email: email})
+		l.index[email] = el
+	}
+
+	entry := el.Value.(*lockoutEntry)
+	update(&entry.lockout)
+	return entry.lockout
+}
+
+// len returns the number of lockouts held.
+func (l *lockouts) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.order.Len()
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
 
 	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/jwt"
+	"hawx.me/code/uberich/storage"
+	"hawx.me/code/uberich/web"
 )
 
 var (
@@ -20,12 +31,247 @@ const usage = `Usage: uberich-admin COMMAND
     list-apps
     set-app NAME ROOTURI SECRET
     remove-app NAME
+    add-redirect NAME URI
+    remove-redirect NAME URI
+    migrate-redirects
+    set-front-channel-logout NAME [URI]
+    set-back-channel-logout NAME [URI]
+    enable-magic-links NAME
+    disable-magic-links NAME
+    allow-user NAME EMAIL
+    disallow-user NAME EMAIL
+    allow-group NAME GROUP
+    disallow-group NAME GROUP
 
     list-users
+    show-user EMAIL
     set-user EMAIL PASSWORD
+    invite EMAIL [--groups GROUP,...]
     remove-user EMAIL
+    require-2fa EMAIL
+    reset-2fa EMAIL
+    unlock-user EMAIL
+    add-to-group EMAIL GROUP
+    remove-from-group EMAIL GROUP
+
+    sessions [EMAIL]
+    revoke-session ID
+    revoke-sessions EMAIL
+
+    list-keys
+    rotate-key
+    remove-key ID
+
+    audit [--user EMAIL] [--since DURATION|DATE]
+
+  Apps use their secret when acting as an OpenID Connect client. Assertions
+  are signed with the newest key, rotate-key generates a new key to replace it
+  but keeps the previous keys so that existing assertions can be checked;
+  remove them once they are no longer needed.
+
+  Users can enable two-factor authentication at /two-factor. require-2fa makes
+  a user enable it the next time they sign in, reset-2fa removes their
+  authenticator and recovery codes so that they can enrol again.
+
+  Apps can only be redirected to URIs added with add-redirect. These must match
+  exactly, unless the path ends in "/*" to match it and anything below it, or
+  the host is localhost, 127.0.0.1 or [::1] and the port is "*" to match any
+  port. Apps with no redirect URIs can be redirected to anything below their
+  ROOTURI; migrate-redirects adds a redirect URI for that to each of them, so
+  that it can be narrowed.
+
+  When a user signs out of uberich each app they signed in to is told, either by
+  loading its front-channel logout URI in a frame or by posting a signed logout
+  token to its back-channel logout URI. Leave out the URI to stop using it.
+
+  Each sign in starts a session that lasts for 8 hours, unless it is revoked
+  first. Users can see and revoke their own sessions at /sessions.
+
+  set-user checks the password against the password policy in the settings
+  file, the same as when users choose their own.
+
+  invite creates a user without a password and prints a link, valid for 7 days,
+  where they can choose one at /register. Inviting them again makes a new link
+  and stops the old one working.
+
+  Apps with magic links enabled let users sign in by following a link emailed to
+  them, instead of giving their password. The link must be opened in the same
+  browser, within 10 minutes, and only works once. An SMTP relay must be set.
+
+  After lockoutAfter failed attempts to sign in a user is locked out for a
+  while, doubling with each further failure, and after lockoutThreshold until
+  unlocked. show-user shows the attempts and lockout, unlock-user clears them.
+
+  audit prints the events recorded in the audit log as JSON, one per line,
+  optionally only those for a user or since a time. The time can be a duration
+  before now, like 24h, a date, or an RFC 3339 time. Changes made with this tool
+  are recorded there too, with any password or secret left out.
+
+  By default any user can sign in to any app. Once an app has allowed a user or
+  group only those users, and members of those groups, can sign in to it.
 `
 
+// randomInvitation returns a new identifier for an invitation.
+func randomInvitation() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// updateUser applies f to the user with the email and saves them.
+func updateUser(db storage.Storage, email string, f func(*config.User)) error {
+	user, err := db.GetUser(email)
+	if err != nil {
+		return err
+	}
+
+	f(user)
+	return db.SetUser(user)
+}
+
+// updateApp applies f to the app with the name and saves it.
+func updateApp(db storage.Storage, name string, f func(*config.App)) error {
+	app, err := db.GetApp(name)
+	if err != nil {
+		return err
+	}
+
+	f(app)
+	return db.SetApp(app)
+}
+
+func printApp(app *config.App) {
+	fmt.Printf("%s uri='%s' secret='%s'", app.Name, app.URI, app.Secret)
+	if len(app.RedirectURIs) > 0 {
+		fmt.Printf(" redirects='%s'", strings.Join(app.RedirectURIs, ","))
+	}
+	if app.FrontChannelLogoutURI != "" {
+		fmt.Printf(" front-channel-logout='%s'", app.FrontChannelLogoutURI)
+	}
+	if app.BackChannelLogoutURI != "" {
+		fmt.Printf(" back-channel-logout='%s'", app.BackChannelLogoutURI)
+	}
+	if len(app.AllowUsers) > 0 {
+		fmt.Printf(" users='%s'", strings.Join(app.AllowUsers, ","))
+	}
+	if len(app.AllowGroups) > 0 {
+		fmt.Printf(" groups='%s'", strings.Join(app.AllowGroups, ","))
+	}
+	if app.MagicLinks {
+		fmt.Print(" magic-links")
+	}
+	fmt.Println()
+}
+
+// userCommands change the user given as their first argument, appCommands the
+// app.
+var (
+	userCommands = map[string]bool{
+		"set-user": true, "invite": true, "remove-user": true, "require-2fa": true,
+		"reset-2fa": true, "unlock-user": true, "add-to-group": true,
+		"remove-from-group": true, "revoke-sessions": true,
+	}
+
+	appCommands = map[string]bool{
+		"set-app": true, "remove-app": true, "add-redirect": true, "remove-redirect": true,
+		"set-front-channel-logout": true, "set-back-channel-logout": true,
+		"enable-magic-links": true, "disable-magic-links": true, "allow-user": true,
+		"disallow-user": true, "allow-group": true, "disallow-group": true,
+	}
+
+	otherCommands = map[string]bool{
+		"migrate-redirects": true, "revoke-session": true, "rotate-key": true, "remove-key": true,
+	}
+)
+
+// adminEvent returns the event to record for running the command in args, or
+// nil if it doesn't change anything.
+func adminEvent(args []string, now time.Time) *storage.Event {
+	command := args[0]
+	if !userCommands[command] && !appCommands[command] && !otherCommands[command] {
+		return nil
+	}
+
+	detail := append([]string{}, args...)
+	switch {
+	case command == "set-user" && len(detail) > 2:
+		detail[2] = "[password]"
+	case command == "set-app" && len(detail) > 3:
+		detail[3] = "[secret]"
+	}
+
+	event := &storage.Event{
+		Time:      now,
+		Type:      storage.EventAdmin,
+		UserAgent: "uberich-admin",
+		Detail:    strings.Join(detail, " "),
+	}
+
+	if u, err := user.Current(); err == nil {
+		event.Detail += " (by " + u.Username + ")"
+	}
+
+	switch {
+	case userCommands[command] && len(args) > 1:
+		event.Email = args[1]
+	case appCommands[command] && len(args) > 1:
+		event.App = args[1]
+		if command == "allow-user" || command == "disallow-user" {
+			if len(args) > 2 {
+				event.Email = args[2]
+			}
+		}
+	}
+
+	return event
+}
+
+// parseSince reads a time given as a duration before now, a date or an RFC
+// 3339 time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func printUser(user *config.User, now time.Time) {
+	fmt.Println("email:", user.Email)
+	if user.IsPending() {
+		fmt.Println("invited: yes")
+	}
+	if len(user.Groups) > 0 {
+		fmt.Println("groups:", strings.Join(user.Groups, ","))
+	}
+	switch {
+	case user.HasTwoFactor():
+		fmt.Println("two-factor: enabled")
+	case user.RequireTwoFactor:
+		fmt.Println("two-factor: required")
+	default:
+		fmt.Println("two-factor: disabled")
+	}
+	fmt.Println("passkeys:", len(user.Credentials))
+	fmt.Println("failed-attempts:", user.FailedAttempts)
+	switch {
+	case user.Locked:
+		fmt.Println("locked: until unlocked")
+	case user.IsLocked(now):
+		fmt.Println("locked: until", user.LockedUntil.Format(time.RFC3339))
+	default:
+		fmt.Println("locked: no")
+	}
+}
+
 func main() {
 	flag.Usage = func() { fmt.Print(usage) }
 	flag.Parse()
@@ -41,10 +287,23 @@ func main() {
 		return
 	}
 
+	db, err := storage.Open(conf)
+	if err != nil {
+		fmt.Println("storage:", err)
+		return
+	}
+	defer db.Close()
+
 	switch flag.Arg(0) {
 	case "list-apps":
-		for _, app := range conf.Apps {
-			fmt.Printf("%s uri='%s' secret='%s'\n", app.Name, app.URI, app.Secret)
+		apps, err := db.ListApps()
+		if err != nil {
+			fmt.Println("list-apps:", err)
+			return
+		}
+
+		for _, app := range apps {
+			printApp(app)
 		}
 
 	case "set-app":
@@ -53,20 +312,24 @@ func main() {
 			return
 		}
 
-		app := &config.App{
-			Name:   flag.Arg(1),
-			URI:    flag.Arg(2),
-			Secret: flag.Arg(3),
+		app, err := db.GetApp(flag.Arg(1))
+		if err == storage.ErrNotFound {
+			app, err = &config.App{Name: flag.Arg(1)}, nil
+		}
+		if err != nil {
+			fmt.Println("set-app:", err)
+			return
 		}
 
-		conf.SetApp(app)
+		app.URI = flag.Arg(2)
+		app.Secret = flag.Arg(3)
 
-		if err := conf.Save(); err != nil {
+		if err := db.SetApp(app); err != nil {
 			fmt.Println("set-app:", err)
 			return
 		}
 
-		fmt.Printf("%s uri='%s' secret='%s'\n", app.Name, app.URI, app.Secret)
+		printApp(app)
 
 	case "remove-app":
 		if len(flag.Args()) < 2 {
@@ -74,51 +337,435 @@ func main() {
 			return
 		}
 
-		conf.RemoveApp(flag.Arg(1))
-
-		if err := conf.Save(); err != nil {
+		if err := db.RemoveApp(flag.Arg(1)); err != nil {
 			fmt.Println("remove-app:", err)
 			return
 		}
+
+	case "add-redirect", "remove-redirect":
+		if len(flag.Args()) < 3 {
+			fmt.Println(flag.Arg(0) + ": missing required arguments")
+			return
+		}
+
+		if flag.Arg(0) == "add-redirect" {
+			if _, err := config.ParseRedirectPattern(flag.Arg(2)); err != nil {
+				fmt.Println("add-redirect:", err)
+				return
+			}
+		}
+
+		err := updateApp(db, flag.Arg(1), func(app *config.App) {
+			if flag.Arg(0) == "add-redirect" {
+				app.AddRedirectURI(flag.Arg(2))
+			} else {
+				app.RemoveRedirectURI(flag.Arg(2))
+			}
+			printApp(app)
+		})
+		if err != nil {
+			fmt.Println(flag.Arg(0)+":", err)
+			return
+		}
+
+	case "migrate-redirects":
+		apps, err := db.ListApps()
+		if err != nil {
+			fmt.Println("migrate-redirects:", err)
+			return
+		}
+
+		for _, app := range apps {
+			if !app.UsesLegacyRedirect() {
+				continue
+			}
+
+			app.MigrateRedirect()
+			if err := db.SetApp(app); err != nil {
+				fmt.Println("migrate-redirects:", err)
+				return
+			}
+			printApp(app)
+		}
+
+	case "set-front-channel-logout", "set-back-channel-logout":
+		if len(flag.Args()) < 2 {
+			fmt.Println(flag.Arg(0) + ": missing required argument")
+			return
+		}
+
+		err := updateApp(db, flag.Arg(1), func(app *config.App) {
+			if flag.Arg(0) == "set-front-channel-logout" {
+				app.FrontChannelLogoutURI = flag.Arg(2)
+			} else {
+				app.BackChannelLogoutURI = flag.Arg(2)
+			}
+			printApp(app)
+		})
+		if err != nil {
+			fmt.Println(flag.Arg(0)+":", err)
+			return
+		}
+
+	case "enable-magic-links", "disable-magic-links":
+		if len(flag.Args()) < 2 {
+			fmt.Println(flag.Arg(0) + ": missing required argument")
+			return
+		}
+
+		err := updateApp(db, flag.Arg(1), func(app *config.App) {
+			app.MagicLinks = flag.Arg(0) == "enable-magic-links"
+			printApp(app)
+		})
+		if err != nil {
+			fmt.Println(flag.Arg(0)+":", err)
+			return
+		}
+
+	case "allow-user", "disallow-user", "allow-group", "disallow-group":
+		if len(flag.Args()) < 3 {
+			fmt.Println(flag.Arg(0) + ": missing required arguments")
+			return
+		}
+
+		change := map[string]func(*config.App, string){
+			"allow-user":     (*config.App).AllowUser,
+			"disallow-user":  (*config.App).DisallowUser,
+			"allow-group":    (*config.App).AllowGroup,
+			"disallow-group": (*config.App).DisallowGroup,
+		}[flag.Arg(0)]
+
+		err := updateApp(db, flag.Arg(1), func(app *config.App) {
+			change(app, flag.Arg(2))
+			printApp(app)
+		})
+		if err != nil {
+			fmt.Println(flag.Arg(0)+":", err)
+			return
+		}
+
 	case "list-users":
-		for _, user := range conf.Users {
-			fmt.Printf("%s\n", user.Email)
+		users, err := db.ListUsers()
+		if err != nil {
+			fmt.Println("list-users:", err)
+			return
 		}
 
+		for _, user := range users {
+			fmt.Print(user.Email)
+			switch {
+			case user.IsPending():
+				fmt.Print(" (invited)")
+			case user.IsLocked(time.Now()):
+				fmt.Print(" (locked)")
+			case user.HasTwoFactor():
+				fmt.Print(" (2fa)")
+			case user.RequireTwoFactor:
+				fmt.Print(" (2fa required)")
+			}
+			if len(user.Groups) > 0 {
+				fmt.Printf(" groups='%s'", strings.Join(user.Groups, ","))
+			}
+			fmt.Println()
+		}
+
+	case "show-user":
+		if len(flag.Args()) < 2 {
+			fmt.Println("show-user: missing required argument")
+			return
+		}
+
+		user, err := db.GetUser(flag.Arg(1))
+		if err != nil {
+			fmt.Println("show-user:", err)
+			return
+		}
+
+		printUser(user, time.Now())
+
 	case "set-user":
 		if len(flag.Args()) < 3 {
 			fmt.Println("set-user: missing required arguments")
 			return
 		}
 
-		user := &config.User{
-			Email: flag.Arg(1),
+		user, err := db.GetUser(flag.Arg(1))
+		if err == storage.ErrNotFound {
+			user, err = &config.User{Email: flag.Arg(1)}, nil
+		}
+		if err != nil {
+			fmt.Println("set-user:", err)
+			return
 		}
-		user.SetPassword(flag.Arg(2))
 
-		conf.SetUser(user)
+		policy, err := conf.PasswordPolicy()
+		if err != nil {
+			fmt.Println("set-user:", err)
+			return
+		}
+		if err := policy.Check(user.Email, flag.Arg(2)); err != nil {
+			fmt.Println("set-user:", err)
+			return
+		}
 
-		if err := conf.Save(); err != nil {
+		if err := user.SetPassword(flag.Arg(2)); err != nil {
+			fmt.Println("set-user:", err)
+			return
+		}
+		user.Invitation = ""
+
+		if err := db.SetUser(user); err != nil {
 			fmt.Println("set-user:", err)
 			return
 		}
 
 		fmt.Printf("%s\n", user.Email)
 
+	case "invite":
+		if len(flag.Args()) < 2 {
+			fmt.Println("invite: missing required argument")
+			return
+		}
+
+		inviteFlags := flag.NewFlagSet("invite", flag.ContinueOnError)
+		groups := inviteFlags.String("groups", "", "")
+		if err := inviteFlags.Parse(flag.Args()[2:]); err != nil {
+			fmt.Println("invite:", err)
+			return
+		}
+
+		user, err := db.GetUser(flag.Arg(1))
+		if err == storage.ErrNotFound {
+			user, err = &config.User{Email: flag.Arg(1)}, nil
+		} else if err == nil && !user.IsPending() {
+			err = errors.New("user has already registered")
+		}
+		if err != nil {
+			fmt.Println("invite:", err)
+			return
+		}
+
+		if user.Invitation, err = randomInvitation(); err != nil {
+			fmt.Println("invite:", err)
+			return
+		}
+		for _, group := range strings.Split(*groups, ",") {
+			if group != "" {
+				user.AddGroup(group)
+			}
+		}
+
+		if err := db.SetUser(user); err != nil {
+			fmt.Println("invite:", err)
+			return
+		}
+
+		link, err := web.InvitationURL(conf, user)
+		if err != nil {
+			fmt.Println("invite:", err)
+			return
+		}
+
+		fmt.Println(link)
+
 	case "remove-user":
 		if len(flag.Args()) < 2 {
 			fmt.Println("remove-user: missing required argument")
 			return
 		}
 
-		conf.RemoveUser(flag.Arg(1))
+		if err := db.RemoveUser(flag.Arg(1)); err != nil {
+			fmt.Println("remove-user:", err)
+			return
+		}
+
+	case "require-2fa":
+		if len(flag.Args()) < 2 {
+			fmt.Println("require-2fa: missing required argument")
+			return
+		}
+
+		err := updateUser(db, flag.Arg(1), func(user *config.User) {
+			user.RequireTwoFactor = true
+		})
+		if err != nil {
+			fmt.Println("require-2fa:", err)
+			return
+		}
+
+	case "reset-2fa":
+		if len(flag.Args()) < 2 {
+			fmt.Println("reset-2fa: missing required argument")
+			return
+		}
+
+		if err := updateUser(db, flag.Arg(1), (*config.User).ResetTwoFactor); err != nil {
+			fmt.Println("reset-2fa:", err)
+			return
+		}
+
+	case "unlock-user":
+		if len(flag.Args()) < 2 {
+			fmt.Println("unlock-user: missing required argument")
+			return
+		}
+
+		if _, err := db.UpdateLockout(flag.Arg(1), (*config.Lockout).Unlock); err != nil {
+			fmt.Println("unlock-user:", err)
+			return
+		}
+
+	case "add-to-group", "remove-from-group":
+		if len(flag.Args()) < 3 {
+			fmt.Println(flag.Arg(0) + ": missing required arguments")
+			return
+		}
+
+		err := updateUser(db, flag.Arg(1), func(user *config.User) {
+			if flag.Arg(0) == "add-to-group" {
+				user.AddGroup(flag.Arg(2))
+			} else {
+				user.RemoveGroup(flag.Arg(2))
+			}
+		})
+		if err != nil {
+			fmt.Println(flag.Arg(0)+":", err)
+			return
+		}
+
+	case "sessions":
+		sessions, err := db.ListSessions(flag.Arg(1))
+		if err != nil {
+			fmt.Println("sessions:", err)
+			return
+		}
+
+		now := time.Now()
+		for _, session := range sessions {
+			if session.Expired(now) {
+				continue
+			}
+
+			fmt.Printf("%s %s ip='%s' created='%s' last-seen='%s' user-agent='%s'\n",
+				session.ID, session.Email, session.IP,
+				session.CreatedAt.Format(time.RFC3339), session.LastSeen.Format(time.RFC3339),
+				session.UserAgent)
+		}
+
+	case "revoke-session":
+		if len(flag.Args()) < 2 {
+			fmt.Println("revoke-session: missing required argument")
+			return
+		}
+
+		if _, err := db.GetSession(flag.Arg(1)); err != nil {
+			fmt.Println("revoke-session:", err)
+			return
+		}
+
+		if err := db.RemoveSession(flag.Arg(1)); err != nil {
+			fmt.Println("revoke-session:", err)
+			return
+		}
+
+	case "revoke-sessions":
+		if len(flag.Args()) < 2 {
+			fmt.Println("revoke-sessions: missing required argument")
+			return
+		}
+
+		sessions, err := db.ListSessions(flag.Arg(1))
+		if err != nil {
+			fmt.Println("revoke-sessions:", err)
+			return
+		}
+
+		for _, session := range sessions {
+			if err := db.RemoveSession(session.ID); err != nil {
+				fmt.Println("revoke-sessions:", err)
+				return
+			}
+		}
+
+	case "list-keys":
+		for i, key := range conf.SigningKeys {
+			if i == len(conf.SigningKeys)-1 {
+				fmt.Printf("%s (signing)\n", key.ID)
+			} else {
+				fmt.Printf("%s\n", key.ID)
+			}
+		}
+
+	case "rotate-key":
+		key, err := jwt.GenerateKey(time.Now().UTC().Format("20060102T150405"))
+		if err != nil {
+			fmt.Println("rotate-key:", err)
+			return
+		}
+
+		encoded, err := key.Encode()
+		if err != nil {
+			fmt.Println("rotate-key:", err)
+			return
+		}
+
+		conf.AddSigningKey(&config.Key{ID: key.ID, Private: encoded})
 
 		if err := conf.Save(); err != nil {
-			fmt.Println("remove-user:", err)
+			fmt.Println("rotate-key:", err)
+			return
+		}
+
+		fmt.Printf("%s (signing)\n", key.ID)
+
+	case "remove-key":
+		if len(flag.Args()) < 2 {
+			fmt.Println("remove-key: missing required argument")
+			return
+		}
+
+		conf.RemoveSigningKey(flag.Arg(1))
+
+		if err := conf.Save(); err != nil {
+			fmt.Println("remove-key:", err)
+			return
+		}
+
+	case "audit":
+		auditFlags := flag.NewFlagSet("audit", flag.ContinueOnError)
+		email := auditFlags.String("user", "", "")
+		since := auditFlags.String("since", "", "")
+		if err := auditFlags.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("audit:", err)
+			return
+		}
+
+		from, err := parseSince(*since, time.Now())
+		if err != nil {
+			fmt.Println("audit: could not parse --since:", err)
+			return
+		}
+
+		events, err := db.ListEvents(*email, from)
+		if err != nil {
+			fmt.Println("audit:", err)
 			return
 		}
 
+		enc := json.NewEncoder(os.Stdout)
+		for _, event := range events {
+			enc.Encode(event)
+		}
+
 	default:
 		fmt.Print(usage)
+		return
+	}
+
+	// Only reached when the command succeeded.
+	if event := adminEvent(flag.Args(), time.Now()); event != nil {
+		if err := db.AddEvent(event); err != nil {
+			fmt.Println("audit:", err)
+		}
 	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+
+	"hawx.me/code/serve"
+	"hawx.me/code/uberich"
+)
+
+const help = `Usage: uberich-proxy [options]
+
+  Sits in front of an app that knows nothing of uberich, and only passes on
+  requests from users that have signed in with it. The app is told who the user
+  is in a header; any copy of that header sent by the user is removed.
+
+  The proxy must be registered with uberich as an app, with a redirect URI for
+  its sign in endpoint:
+
+    uberich-admin set-app NAME https://app.example.com SECRET
+    uberich-admin add-redirect NAME https://app.example.com/_uberich/sign-in
+
+  and, to be told when users sign out, logout URIs for its signed out endpoint:
+
+    uberich-admin set-front-channel-logout NAME https://app.example.com/_uberich/signed-out
+    uberich-admin set-back-channel-logout NAME https://app.example.com/_uberich/signed-out
+
+  Sending users to /_uberich/sign-out signs them out of the app and uberich.
+
+ OPTIONS
+
+   --app NAME           # Name the proxy is registered with in uberich
+   --app-url URL        # URL the proxy is reached at
+   --uberich URL        # URL uberich is running at
+   --upstream URL       # URL of the app to pass requests to
+   --secret SECRET      # Secret used to sign the session cookie
+
+   --header NAME        # Header to give the user's email in
+                        # (default: 'X-Uberich-Email')
+   --public PATTERN     # Let anyone reach paths matching the pattern
+   --allow PATTERN=EMAIL,...
+                        # Only let the users listed reach paths matching the
+                        # pattern
+
+   --port PORT          # Serve on given port (default: '8080')
+   --socket PATH        # Serve at given socket, instead
+
+ RULES
+
+   Any signed in user can reach any path, unless --public or --allow is given
+   for it. A pattern matches a path exactly, unless it ends in "/*" when it
+   matches that path and anything below it. Each option can be given more than
+   once, and the first that matches a path is used:
+
+     uberich-proxy ... --public /healthz --allow '/admin/*=me@example.com'
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, help) }
+
+	var (
+		appName    = flag.String("app", "", "")
+		appURL     = flag.String("app-url", "", "")
+		uberichURL = flag.String("uberich", "", "")
+		upstream   = flag.String("upstream", "", "")
+		secret     = flag.String("secret", "", "")
+		header     = flag.String("header", "X-Uberich-Email", "")
+		port       = flag.String("port", "8080", "")
+		socket     = flag.String("socket", "", "")
+		rs         = &rules{}
+	)
+	flag.Var(publicRules{rs}, "public", "")
+	flag.Var(allowRules{rs}, "allow", "")
+	flag.Parse()
+
+	if *appName == "" || *appURL == "" || *uberichURL == "" || *upstream == "" || *secret == "" {
+		fmt.Fprintln(os.Stderr, "--app, --app-url, --uberich, --upstream and --secret must be given")
+		os.Exit(2)
+	}
+
+	upstreamURL, err := url.Parse(*upstream)
+	if err != nil {
+		log.Println("upstream:", err)
+		return
+	}
+
+	client := uberich.NewClient(*appName, *appURL, *uberichURL, uberich.NewStore(*secret))
+
+	serve.Serve(*port, *socket, newProxy(client, upstreamURL, *header, rs))
+}
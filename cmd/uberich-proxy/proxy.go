@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+
+	"hawx.me/code/uberich"
+)
+
+// proxyPrefix is where the proxy serves its own endpoints, requests below it are
+// never passed upstream.
+const proxyPrefix = "/_uberich/"
+
+// nextCookie holds the path a user was trying to reach while they sign in.
+const nextCookie = "uberich-proxy-next"
+
+// rule decides who can reach the paths matching pattern. A pattern matches
+// exactly, unless it ends in "/*" when it matches that path and anything below
+// it.
+type rule struct {
+	pattern string
+	public  bool
+	emails  []string
+}
+
+func (r rule) matches(p string) bool {
+	if prefix := strings.TrimSuffix(r.pattern, "/*"); prefix != r.pattern {
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+
+	return p == r.pattern
+}
+
+func (r rule) allows(email string) bool {
+	if r.public {
+		return true
+	}
+	if email == "" {
+		return false
+	}
+	if len(r.emails) == 0 {
+		return true
+	}
+
+	for _, allowed := range r.emails {
+		if strings.EqualFold(allowed, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rules is a flag.Value that collects rules, the first rule to match a path
+// is used.
+type rules struct {
+	list []rule
+}
+
+func (rs *rules) String() string {
+	return ""
+}
+
+func (rs *rules) find(p string) rule {
+	for _, r := range rs.list {
+		if r.matches(p) {
+			return r
+		}
+	}
+
+	return rule{}
+}
+
+// publicRules adds a rule for each pattern given that lets anyone reach it.
+type publicRules struct {
+	*rules
+}
+
+func (rs publicRules) Set(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return errors.New("pattern must start with /")
+	}
+
+	rs.list = append(rs.list, rule{pattern: pattern, public: true})
+	return nil
+}
+
+// allowRules adds a rule for each "PATTERN=EMAIL,..." given that lets only
+// those users reach it.
+type allowRules struct {
+	*rules
+}
+
+func (rs allowRules) Set(s string) error {
+	pattern, emails, ok := strings.Cut(s, "=")
+	if !ok || emails == "" {
+		return errors.New("expected PATTERN=EMAIL,...")
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return errors.New("pattern must start with /")
+	}
+
+	rs.list = append(rs.list, rule{pattern: pattern, emails: strings.Split(emails, ",")})
+	return nil
+}
+
+// cleanPath returns p with any "." and ".." elements removed, so that it can be
+// matched against rules in the same way the upstream will see it.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// stripHeader removes every copy of header from h, including those written
+// with underscores that some servers treat as the same header.
+func stripHeader(h http.Header, header string) {
+	canonical := textproto.CanonicalMIMEHeaderKey(header)
+
+	for k := range h {
+		if textproto.CanonicalMIMEHeaderKey(strings.Replace(k, "_", "-", -1)) == canonical {
+			delete(h, k)
+		}
+	}
+}
+
+type proxy struct {
+	client   *uberich.Client
+	upstream *httputil.ReverseProxy
+	header   string
+	rules    *rules
+	mux      *http.ServeMux
+}
+
+// newProxy creates a handler that only passes requests to upstream once the
+// user has signed in with uberich, unless a rule makes the path public. The
+// user's email is given to upstream in header.
+func newProxy(client *uberich.Client, upstream *url.URL, header string, rs *rules) *proxy {
+	p := &proxy{
+		client: client,
+		header: header,
+		rules:  rs,
+		mux:    http.NewServeMux(),
+	}
+
+	p.upstream = httputil.NewSingleHostReverseProxy(upstream)
+	// Flush immediately so that streamed responses, such as server-sent events,
+	// are not held back.
+	p.upstream.FlushInterval = -1
+
+	p.mux.Handle(proxyPrefix+"sign-in", client.SignIn(proxyPrefix+"return"))
+	p.mux.Handle(proxyPrefix+"sign-out", client.SignOut("/"))
+	p.mux.Handle(proxyPrefix+"signed-out", client.SignedOut())
+	p.mux.HandleFunc(proxyPrefix+"return", p.returnToNext)
+
+	return p
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stripHeader(r.Header, p.header)
+
+	if cleaned := cleanPath(r.URL.Path); cleaned != r.URL.Path {
+		u := *r.URL
+		u.Path = cleaned
+		u.RawPath = ""
+		http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, proxyPrefix) {
+		p.mux.ServeHTTP(w, r)
+		return
+	}
+
+	email := p.client.CurrentUser(r)
+	rule := p.rules.find(r.URL.Path)
+
+	if !rule.allows(email) {
+		if email != "" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		} else {
+			p.signIn(w, r)
+		}
+		return
+	}
+
+	if email != "" {
+		r.Header.Set(p.header, email)
+	}
+
+	p.upstream.ServeHTTP(w, r)
+}
+
+// signIn sends the user to sign in, remembering where they were going. Only
+// page loads are redirected, other requests can't follow the user back.
+func (p *proxy) signIn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     nextCookie,
+		Value:    url.QueryEscape(r.URL.RequestURI()),
+		Path:     proxyPrefix,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, proxyPrefix+"sign-in", http.StatusFound)
+}
+
+// isLocal reports whether next is a path on this host, rather than one that a
+// browser would take to another host.
+func isLocal(next string) bool {
+	return strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\")
+}
+
+// returnToNext sends the user back to where they were going before they signed
+// in.
+func (p *proxy) returnToNext(w http.ResponseWriter, r *http.Request) {
+	next := "/"
+	if cookie, err := r.Cookie(nextCookie); err == nil {
+		if v, err := url.QueryUnescape(cookie.Value); err == nil && isLocal(v) {
+			next = v
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   nextCookie,
+		Value:  "",
+		Path:   proxyPrefix,
+		MaxAge: -1,
+	})
+
+	http.Redirect(w, r, next, http.StatusFound)
+}
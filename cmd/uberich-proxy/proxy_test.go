@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich"
+)
+
+const testSecret = "cookie secret"
+
+func testProxy(t *testing.T, upstream http.Handler, rs *rules) (*proxy, func()) {
+	upstreamServer := httptest.NewServer(upstream)
+	upstreamURL, _ := url.Parse(upstreamServer.URL)
+
+	client := uberich.NewClient("app", "http://app.example.com", "http://uberich.example.com", uberich.NewStore(testSecret))
+
+	return newProxy(client, upstreamURL, "X-Uberich-Email", rs), upstreamServer.Close
+}
+
+// signedIn returns the session cookie for a user signed in as email.
+func signedIn(email string) *http.Cookie {
+	rec := httptest.NewRecorder()
+	uberich.NewStore(testSecret).Set(rec, httptest.NewRequest("GET", "/", nil), email)
+
+	return rec.Result().Cookies()[0]
+}
+
+func echoEmail(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, strings.Join(r.Header["X-Uberich-Email"], ",")+strings.Join(r.Header["X_uberich_email"], ","))
+}
+
+func TestProxyWhenSignedIn(t *testing.T) {
+	p, closeUpstream := testProxy(t, http.HandlerFunc(echoEmail), &rules{})
+	defer closeUpstream()
+
+	req := httptest.NewRequest("GET", "/secret", nil)
+	req.AddCookie(signedIn("me@example.com"))
+	req.Header.Set("X-Uberich-Email", "admin@example.com")
+	req.Header["X_uberich_email"] = []string{"admin@example.com"}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("me@example.com", rec.Body.String())
+}
+
+func TestProxyWhenNotSignedIn(t *testing.T) {
+	p, closeUpstream := testProxy(t, http.HandlerFunc(echoEmail), &rules{})
+	defer closeUpstream()
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/secret?a=b", nil))
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusFound, rec.Code)
+	assert.Equal("/_uberich/sign-in", rec.Header().Get("Location"))
+
+	cookies := rec.Result().Cookies()
+	if assert.Len(cookies, 1) {
+		assert.Equal(nextCookie, cookies[0].Name)
+	}
+
+	// Signing in goes to uberich.
+	req := httptest.NewRequest("GET", "/_uberich/sign-in", nil)
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	assert.Equal("uberich.example.com", location.Host)
+	assert.Equal("http://app.example.com/_uberich/sign-in", location.Query().Get("redirect_uri"))
+
+	// Then returns to where the user was going.
+	req = httptest.NewRequest("GET", "/_uberich/return", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusFound, rec.Code)
+	assert.Equal("/secret?a=b", rec.Header().Get("Location"))
+}
+
+func TestProxyWhenNotSignedInAndNotGet(t *testing.T) {
+	p, closeUpstream := testProxy(t, http.HandlerFunc(echoEmail), &rules{})
+	defer closeUpstream()
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("POST", "/secret", nil))
+
+	assert.New(t).Equal(http.StatusUnauthorized, rec.Code)
+}
+
+func TestProxyReturnToOtherHost(t *testing.T) {
+	p, closeUpstream := testProxy(t, http.HandlerFunc(echoEmail), &rules{})
+	defer closeUpstream()
+
+	for _, next := range []string{"//evil.example.com", "/\\evil.example.com", "http://evil.example.com"} {
+		req := httptest.NewRequest("GET", "/_uberich/return", nil)
+		req.AddCookie(&http.Cookie{Name: nextCookie, Value: url.QueryEscape(next)})
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		assert.New(t).Equal("/", rec.Header().Get("Location"))
+	}
+}
+
+func TestProxyRules(t *testing.T) {
+	rs := &rules{}
+	publicRules{rs}.Set("/healthz")
+	allowRules{rs}.Set("/admin/*=me@example.com,other@example.com")
+
+	p, closeUpstream := testProxy(t, http.HandlerFunc(echoEmail), rs)
+	defer closeUpstream()
+
+	testCases := []struct {
+		path  string
+		email string
+		code  int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/healthz/more", "", http.StatusFound},
+		{"/admin", "me@example.com", http.StatusOK},
+		{"/admin/users", "Other@example.com", http.StatusOK},
+		{"/admin/users", "someone@example.com", http.StatusForbidden},
+		{"/admin/users", "", http.StatusFound},
+		{"/healthz/../admin", "", http.StatusMovedPermanently},
+		{"/anything", "someone@example.com", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path+" "+tc.email, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			req.Header.Set("X-Uberich-Email", "admin@example.com")
+			if tc.email != "" {
+				req.AddCookie(signedIn(tc.email))
+			}
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			assert := assert.New(t)
+			assert.Equal(tc.code, rec.Code)
+			if tc.code == http.StatusOK {
+				assert.Equal(tc.email, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestProxyStreaming(t *testing.T) {
+	release := make(chan struct{})
+	p, closeUpstream := testProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second\n")
+	}), &rules{})
+	defer closeUpstream()
+
+	s := httptest.NewServer(p)
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", s.URL+"/events", nil)
+	req.AddCookie(signedIn("me@example.com"))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert := assert.New(t)
+	reader := bufio.NewReader(resp.Body)
+
+	line, _ := reader.ReadString('\n')
+	assert.Equal("first\n", line)
+
+	close(release)
+	line, _ = reader.ReadString('\n')
+	assert.Equal("second\n", line)
+}
+
+func TestProxyWebsocket(t *testing.T) {
+	p, closeUpstream := testProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "expected upgrade", http.StatusBadRequest)
+			return
+		}
+
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.WriteString(r.Header.Get("X-Uberich-Email") + "\n")
+		buf.Flush()
+
+		// Echo a line back, to show the connection goes both ways.
+		line, _ := buf.ReadString('\n')
+		buf.WriteString(line)
+		buf.Flush()
+	}), &rules{})
+	defer closeUpstream()
+
+	s := httptest.NewServer(p)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest("GET", s.URL+"/socket", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.AddCookie(signedIn("me@example.com"))
+	req.Write(conn)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+
+	line, _ := reader.ReadString('\n')
+	assert.Equal("me@example.com\n", line)
+
+	io.WriteString(conn, "hello\n")
+	line, _ = reader.ReadString('\n')
+	assert.Equal("hello\n", line)
+}
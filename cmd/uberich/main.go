@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"hawx.me/code/serve"
 	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
 	"hawx.me/code/uberich/web"
 )
 
@@ -17,7 +21,7 @@ const help = `Usage: uberich [options]
   settings and understands the concept of users and apps.
 
   A user is registered by email address and has a password.
-  An app has a name, a URI and a secret.
+  An app has a name, a URI, a secret and the redirect URIs it can be sent to.
 
   See the correspoding hawx.me/code/uberich/flow package that implements
   helpers for integrating clients with uberich.
@@ -27,6 +31,8 @@ const help = `Usage: uberich [options]
    --settings PATH    # Read settings from path (default: './settings.toml')
    --port PORT        # Serve on given port (default: '8080')
    --socket PATH      # Serve at given socket, instead
+   --reload DURATION  # How often to check the settings file for changes
+                      # (default: '5s')
 
  SETTINGS
 
@@ -47,7 +53,97 @@ const help = `Usage: uberich [options]
      # to select AES-128, AES-192, or AES-256. Given in standard base64.
      blockKey = "..."
 
+   Assertions and OpenID Connect tokens are signed using keys that are also
+   kept in the settings file, at least one must exist. Use
+
+     uberich-admin rotate-key
+
+   to generate one. The URL uberich identifies itself by defaults to the
+   domain, but can be set with
+
+     issuer = "https://my.example.com"
+
+   By default users and apps are also stored in the settings file, with
+   sessions kept in a state file and an audit log written next to it. To use an
+   SQLite database instead
+
+     storage = "sqlite"
+     database = "/var/lib/uberich/uberich.db"
+
+   The state file is only used with the settings file, but the audit log is
+   written either way. To change where they are written
+
+     state = "/var/lib/uberich/state.json"
+     auditLog = "/var/log/uberich/audit.log"
+
+   The audit log records each sign in, failed attempt, assertion issued, password
+   change and revoked session, and changes made with uberich-admin, as JSON. It
+   is rotated once it reaches a size, keeping a number of older files
+
+     auditLogMaxSize = 10 # megabytes
+     auditLogBackups = 5
+
+   Users can be emailed a link to reset their password if an SMTP relay is set
+
+     smtpAddr = "smtp.example.com:587"
+     smtpUsername = "..."
+     smtpPassword = "..."
+
+     # the address emails are sent from (default: uberich@DOMAIN)
+     mailFrom = "uberich@example.com"
+
+   New passwords must meet a policy, which can be changed with
+
+     # the lengths a new password must be between (default: 8 and 72)
+     passwordMinLength = 12
+     passwordMaxLength = 72
+
+     # a file of SHA-1 hashes of breached passwords, one per line, or a
+     # directory of files split by the first 5 characters of the hash
+     breachedPasswords = "/var/lib/uberich/pwned-passwords.txt"
+
+   Attempts to sign in are limited for each user, client address and subnet (a
+   /24, or /64 for IPv6). Each limit is how many attempts can be made at once,
+   with another allowed every rateLimitInterval.
+
+     rateLimitEmail = 3
+     rateLimitIP = 20
+     rateLimitSubnet = 60
+     rateLimitInterval = "30s"
+
+     # the most users, addresses or subnets that are remembered at once
+     rateLimitBuckets = 10000
+
+     # the most passwords that are checked at once
+     maxConcurrentChecks = 4
+
+   Behind a reverse proxy every request comes from the proxy's address, unless
+   the proxy is trusted to give the client's address in the Forwarded or
+   X-Forwarded-For header.
+
+     # addresses or networks of trusted proxies, and "unix" to trust
+     # requests over --socket (default: none)
+     trustedProxies = ["127.0.0.1", "::1"]
+
+   After lockoutAfter failed attempts in a row a user is locked out for
+   lockoutBackoff, doubling with each further failure up to a day. After
+   lockoutThreshold they stay locked out until uberich-admin unlock-user. They
+   can be emailed when locked out, if an SMTP relay is set.
+
+     lockoutAfter = 5
+     lockoutBackoff = "1m"
+     lockoutThreshold = 20
+     lockoutNotify = true
+
    To add users and apps see uberich/cmd/uberich-admin.
+
+ RELOADING
+
+   The settings file is reloaded when it changes, or when uberich receives
+   SIGHUP. If the new settings are not valid they are ignored and the error
+   logged. Changes to domain, secure, hashKey, blockKey, storage, database,
+   state, auditLog, the rate limits, maxConcurrentChecks and the lockout limits
+   only take effect after a restart.
 `
 
 func main() {
@@ -57,6 +153,7 @@ func main() {
 		settingsPath = flag.String("settings", "./settings.toml", "")
 		port         = flag.String("port", "8080", "")
 		socket       = flag.String("socket", "", "")
+		reload       = flag.Duration("reload", 5*time.Second, "")
 	)
 	flag.Parse()
 
@@ -66,11 +163,45 @@ func main() {
 		return
 	}
 
-	handler, err := web.New(conf)
+	db, err := storage.Open(conf)
+	if err != nil {
+		log.Println("storage:", err)
+		return
+	}
+	defer db.Close()
+
+	if apps, err := db.ListApps(); err == nil {
+		for _, app := range apps {
+			if app.UsesLegacyRedirect() {
+				log.Println("config: app", app.Name, "has no redirect URIs, allowing anything below", app.URI)
+			}
+		}
+	}
+
+	handler, err := web.New(conf, db)
 	if err != nil {
 		log.Println("config:", err)
 		return
 	}
 
+	stop := conf.Watch(*reload, logReload)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logReload(conf.Reload())
+		}
+	}()
+
 	serve.Serve(*port, *socket, handler)
 }
+
+func logReload(err error) {
+	if err != nil {
+		log.Println("config: reload:", err)
+	} else {
+		log.Println("config: reloaded")
+	}
+}
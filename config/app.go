@@ -1,26 +1,143 @@
 package config
 
-import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"strings"
-)
-
 type App struct {
 	Name   string `toml:"name"`
 	URI    string `toml:"uri"`
 	Secret string `toml:"secret"`
+
+	// RedirectURIs are the patterns, see RedirectPattern, that the app can be
+	// redirected to. If empty anything below URI is allowed, as it was before
+	// apps registered their redirect URIs.
+	RedirectURIs []string `toml:"redirectURIs,omitempty"`
+
+	// FrontChannelLogoutURI is loaded in a hidden frame, and
+	// BackChannelLogoutURI is sent a signed logout token, when a user who has
+	// signed in to the app signs out of uberich.
+	FrontChannelLogoutURI string `toml:"frontChannelLogoutURI,omitempty"`
+	BackChannelLogoutURI  string `toml:"backChannelLogoutURI,omitempty"`
+
+	// AllowUsers and AllowGroups list who may sign in to the app. If both are
+	// empty anyone may.
+	AllowUsers  []string `toml:"allowUsers,omitempty"`
+	AllowGroups []string `toml:"allowGroups,omitempty"`
+
+	// MagicLinks lets users sign in to the app by following a link emailed to
+	// them, instead of giving their password.
+	MagicLinks bool `toml:"magicLinks,omitempty"`
 }
 
 // CanRedirectTo checks whether the Application can issue a HTTP redirect to the
-// given URI by checking if it shares the same root URI.
+// given URI by checking it against the registered redirect URIs.
 func (a App) CanRedirectTo(uri string) bool {
-	return strings.HasPrefix(uri, a.URI)
+	for _, s := range a.redirectPatterns() {
+		pattern, err := ParseRedirectPattern(s)
+		if err == nil && pattern.Matches(uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesLegacyRedirect reports whether the app has no redirect URIs registered,
+// so is relying on URI instead.
+func (a App) UsesLegacyRedirect() bool {
+	return len(a.RedirectURIs) == 0
+}
+
+// MigrateRedirect registers a redirect URI that allows what URI allowed, so
+// that it will continue to work if URI is changed.
+func (a *App) MigrateRedirect() {
+	if a.UsesLegacyRedirect() && a.URI != "" {
+		a.AddRedirectURI(legacyRedirectPattern(a.URI))
+	}
+}
+
+func (a App) redirectPatterns() []string {
+	if a.UsesLegacyRedirect() {
+		if a.URI == "" {
+			return nil
+		}
+		return []string{legacyRedirectPattern(a.URI)}
+	}
+	return a.RedirectURIs
+}
+
+// AddRedirectURI lets the app be redirected to URIs matching pattern.
+func (a *App) AddRedirectURI(pattern string) {
+	a.RedirectURIs = with(a.RedirectURIs, pattern)
+}
+
+// RemoveRedirectURI removes the pattern from the app's redirect URIs.
+func (a *App) RemoveRedirectURI(pattern string) {
+	a.RedirectURIs = without(a.RedirectURIs, pattern)
+}
+
+// Allows reports whether the user may sign in to the app, either because they
+// are listed or are in one of the listed groups.
+func (a App) Allows(user User) bool {
+	if len(a.AllowUsers) == 0 && len(a.AllowGroups) == 0 {
+		return true
+	}
+
+	if contains(a.AllowUsers, user.Email) {
+		return true
+	}
+
+	for _, group := range a.AllowGroups {
+		if user.InGroup(group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contains reports whether s is in list.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// with returns a copy of list with s added, if it isn't already there.
+func with(list []string, s string) []string {
+	if contains(list, s) {
+		return list
+	}
+
+	return append(append([]string(nil), list...), s)
+}
+
+// without returns a copy of list with s removed.
+func without(list []string, s string) []string {
+	var result []string
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// AllowUser lets the user with the email sign in to the app.
+func (a *App) AllowUser(email string) {
+	a.AllowUsers = with(a.AllowUsers, email)
+}
+
+// DisallowUser removes the email from the users allowed to sign in to the app.
+func (a *App) DisallowUser(email string) {
+	a.AllowUsers = without(a.AllowUsers, email)
+}
+
+// AllowGroup lets members of the group sign in to the app.
+func (a *App) AllowGroup(group string) {
+	a.AllowGroups = with(a.AllowGroups, group)
 }
 
-// HashWithSecret returns a HMAC using the secret for the Application.
-func (a App) HashWithSecret(data []byte) []byte {
-	mac := hmac.New(sha256.New, []byte(a.Secret))
-	mac.Write(data)
-	return mac.Sum(nil)
+// DisallowGroup removes the group from those allowed to sign in to the app.
+func (a *App) DisallowGroup(group string) {
+	a.AllowGroups = without(a.AllowGroups, group)
 }
@@ -1,31 +1,183 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"hawx.me/code/uberich/jwt"
+	"hawx.me/code/uberich/mail"
+	"hawx.me/code/uberich/password"
 )
 
 func Read(path string) (*Config, error) {
 	conf := &Config{path: path}
-	_, err := toml.DecodeFile(path, conf)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+
+	_, err = toml.Decode(string(data), conf)
+	conf.loaded = sha256.Sum256(data)
 	return conf, err
 }
 
 type Config struct {
 	path string
 
-	Apps  []*App  `toml:"app"`
-	Users []*User `toml:"user"`
+	// mu guards the fields below, saveMu ensures only one Save or Reload runs at
+	// a time.
+	mu     sync.RWMutex
+	saveMu sync.Mutex
+
+	// loaded is the hash of the file when last read or written, so that changes
+	// made by something else can be detected.
+	loaded [sha256.Size]byte
+
+	// pending are the changes made since the file was last read or written, so
+	// that they can be reapplied to the file if it has been changed by something
+	// else.
+	pending []func(*Config)
+
+	// breached is the list loaded from breachedPath, kept so that it is only
+	// loaded again if the setting changes.
+	breachedMu   sync.Mutex
+	breached     password.Breached
+	breachedPath string
+
+	Apps        []*App  `toml:"app"`
+	Users       []*User `toml:"user"`
+	SigningKeys []*Key  `toml:"key"`
+
+	Storage  string `toml:"storage"`
+	Database string `toml:"database"`
+	State    string `toml:"state"`
+	AuditLog string `toml:"auditLog"`
+
+	AuditLogMaxSize int `toml:"auditLogMaxSize"`
+	AuditLogBackups int `toml:"auditLogBackups"`
+
+	SMTPAddr     string `toml:"smtpAddr"`
+	SMTPUsername string `toml:"smtpUsername"`
+	SMTPPassword string `toml:"smtpPassword"`
+	MailFrom     string `toml:"mailFrom"`
+
+	PasswordMinLength int    `toml:"passwordMinLength"`
+	PasswordMaxLength int    `toml:"passwordMaxLength"`
+	BreachedPasswords string `toml:"breachedPasswords"`
+
+	RateLimitEmail      int    `toml:"rateLimitEmail"`
+	RateLimitIP         int    `toml:"rateLimitIP"`
+	RateLimitSubnet     int    `toml:"rateLimitSubnet"`
+	RateLimitInterval   string `toml:"rateLimitInterval"`
+	RateLimitBuckets    int    `toml:"rateLimitBuckets"`
+	MaxConcurrentChecks int    `toml:"maxConcurrentChecks"`
+
+	LockoutAfter     int    `toml:"lockoutAfter"`
+	LockoutBackoff   string `toml:"lockoutBackoff"`
+	LockoutThreshold int    `toml:"lockoutThreshold"`
+	LockoutNotify    bool   `toml:"lockoutNotify"`
+
+	TrustedProxies []string `toml:"trustedProxies"`
 
 	Domain   string `toml:"domain"`
 	Secure   bool   `toml:"secure"`
+	Issuer   string `toml:"issuer"`
 	HashKey  string `toml:"hashKey"`
 	BlockKey string `toml:"blockKey"`
 }
 
+// Validate checks that the config could be used: that the keys decode, that
+// redirect URIs parse, and that apps and users are not defined twice.
+func (c *Config) Validate() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if _, err := base64.StdEncoding.DecodeString(c.HashKey); err != nil {
+		return fmt.Errorf("hashKey: %v", err)
+	}
+	if _, err := base64.StdEncoding.DecodeString(c.BlockKey); err != nil {
+		return fmt.Errorf("blockKey: %v", err)
+	}
+
+	if c.PasswordMaxLength > password.MaxLength {
+		return fmt.Errorf("passwordMaxLength: must be at most %d", password.MaxLength)
+	}
+	if c.PasswordMaxLength > 0 && c.PasswordMinLength > c.PasswordMaxLength {
+		return errors.New("passwordMinLength: must not be more than passwordMaxLength")
+	}
+
+	if c.RateLimitInterval != "" {
+		if _, err := time.ParseDuration(c.RateLimitInterval); err != nil {
+			return fmt.Errorf("rateLimitInterval: %v", err)
+		}
+	}
+	if c.LockoutBackoff != "" {
+		if _, err := time.ParseDuration(c.LockoutBackoff); err != nil {
+			return fmt.Errorf("lockoutBackoff: %v", err)
+		}
+	}
+	if _, err := parseProxies(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trustedProxies: %v", err)
+	}
+
+	for _, key := range c.SigningKeys {
+		if _, err := jwt.ParseKey(key.ID, key.Private); err != nil {
+			return fmt.Errorf("key %s: %v", key.ID, err)
+		}
+	}
+
+	apps := map[string]bool{}
+	for _, app := range c.Apps {
+		if app.Name == "" {
+			return errors.New("app with no name")
+		}
+		if apps[app.Name] {
+			return fmt.Errorf("app %s defined twice", app.Name)
+		}
+		apps[app.Name] = true
+
+		for _, pattern := range app.RedirectURIs {
+			if _, err := ParseRedirectPattern(pattern); err != nil {
+				return fmt.Errorf("app %s: %s: %v", app.Name, pattern, err)
+			}
+		}
+	}
+
+	users := map[string]bool{}
+	for _, user := range c.Users {
+		if user.Email == "" {
+			return errors.New("user with no email")
+		}
+		if users[user.Email] {
+			return fmt.Errorf("user %s defined twice", user.Email)
+		}
+		users[user.Email] = true
+	}
+
+	return nil
+}
+
+// Path returns the location of the settings file.
+func (c *Config) Path() string {
+	return c.path
+}
+
 func (c *Config) Keys() (hashKey, blockKey []byte, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	hashKey, err = base64.StdEncoding.DecodeString(c.HashKey)
 	if err != nil {
 		return
@@ -34,7 +186,326 @@ func (c *Config) Keys() (hashKey, blockKey []byte, err error) {
 	return
 }
 
-func (c *Config) GetApp(name string) *App {
+// IssuerURL returns the URL that uberich identifies itself by in tokens. If not
+// set explicitly it is derived from the domain.
+func (c *Config) IssuerURL() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.Issuer != "" {
+		return c.Issuer
+	}
+	if c.Secure {
+		return "https://" + c.Domain
+	}
+	return "http://" + c.Domain
+}
+
+// Mail returns the relay to send emails through, or nil if one has not been
+// set.
+func (c *Config) Mail() *mail.SMTP {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.SMTPAddr == "" {
+		return nil
+	}
+
+	from := c.MailFrom
+	if from == "" {
+		from = "uberich@" + c.Domain
+	}
+
+	return &mail.SMTP{
+		Addr:     c.SMTPAddr,
+		Username: c.SMTPUsername,
+		Password: c.SMTPPassword,
+		From:     from,
+	}
+}
+
+// The rotation used for the audit log when it is not set.
+const (
+	DefaultAuditLogMaxSize = 10
+	DefaultAuditLogBackups = 5
+)
+
+// AuditLogRotation returns the size in bytes that the audit log file is rotated
+// at, and how many of the old files are kept.
+func (c *Config) AuditLogRotation() (maxSize int64, backups int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	megabytes := c.AuditLogMaxSize
+	if megabytes <= 0 {
+		megabytes = DefaultAuditLogMaxSize
+	}
+
+	backups = c.AuditLogBackups
+	if backups <= 0 {
+		backups = DefaultAuditLogBackups
+	}
+
+	return int64(megabytes) << 20, backups
+}
+
+// LockoutMail returns how to email users when they are locked out, or nil if
+// they aren't to be told.
+func (c *Config) LockoutMail() *mail.SMTP {
+	c.mu.RLock()
+	notify := c.LockoutNotify
+	c.mu.RUnlock()
+
+	if !notify {
+		return nil
+	}
+
+	return c.Mail()
+}
+
+// PasswordPolicy returns the policy that new passwords must meet, loading the
+// list of breached passwords if one is set.
+func (c *Config) PasswordPolicy() (password.Policy, error) {
+	c.mu.RLock()
+	policy := password.Policy{
+		MinLength: c.PasswordMinLength,
+		MaxLength: c.PasswordMaxLength,
+	}
+	path := c.BreachedPasswords
+	c.mu.RUnlock()
+
+	if path == "" {
+		return policy, nil
+	}
+
+	c.breachedMu.Lock()
+	defer c.breachedMu.Unlock()
+
+	if c.breached == nil || c.breachedPath != path {
+		breached, err := password.OpenBreached(path)
+		if err != nil {
+			return policy, fmt.Errorf("breachedPasswords: %v", err)
+		}
+
+		c.breached = breached
+		c.breachedPath = path
+	}
+
+	policy.Breached = c.breached
+	return policy, nil
+}
+
+// RateLimits are the limits on attempts to sign in. Each of Email, IP and
+// Subnet is the number of attempts that can be made at once, with another
+// allowed every Interval. Zero values are left for the checker to default.
+type RateLimits struct {
+	Email    int
+	IP       int
+	Subnet   int
+	Interval time.Duration
+
+	// Buckets is the most attempts, of each kind, that are remembered.
+	Buckets int
+
+	// MaxConcurrent is the most passwords that are checked at once.
+	MaxConcurrent int
+
+	// After LockoutAfter failed attempts in a row a user is locked out for
+	// LockoutBackoff, doubling with each further failure, until after
+	// LockoutThreshold they are locked out until unlocked.
+	LockoutAfter     int
+	LockoutBackoff   time.Duration
+	LockoutThreshold int
+}
+
+// RateLimits returns the limits on attempts to sign in.
+func (c *Config) RateLimits() (RateLimits, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	limits := RateLimits{
+		Email:         c.RateLimitEmail,
+		IP:            c.RateLimitIP,
+		Subnet:        c.RateLimitSubnet,
+		Buckets:       c.RateLimitBuckets,
+		MaxConcurrent: c.MaxConcurrentChecks,
+
+		LockoutAfter:     c.LockoutAfter,
+		LockoutThreshold: c.LockoutThreshold,
+	}
+
+	if c.RateLimitInterval != "" {
+		interval, err := time.ParseDuration(c.RateLimitInterval)
+		if err != nil {
+			return limits, fmt.Errorf("rateLimitInterval: %v", err)
+		}
+		limits.Interval = interval
+	}
+
+	if c.LockoutBackoff != "" {
+		backoff, err := time.ParseDuration(c.LockoutBackoff)
+		if err != nil {
+			return limits, fmt.Errorf("lockoutBackoff: %v", err)
+		}
+		limits.LockoutBackoff = backoff
+	}
+
+	return limits, nil
+}
+
+// Proxies are those trusted to say which address a request was made from.
+type Proxies struct {
+	Networks []*net.IPNet
+
+	// Socket is true if requests over a unix socket are from a trusted proxy.
+	Socket bool
+}
+
+// Trusts reports whether a request from ip, or a unix socket when ip is not an
+// address, was made by a trusted proxy.
+func (p Proxies) Trusts(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return p.Socket
+	}
+
+	for _, network := range p.Networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseProxies(list []string) (Proxies, error) {
+	var proxies Proxies
+
+	for _, proxy := range list {
+		if proxy == "unix" {
+			proxies.Socket = true
+			continue
+		}
+
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies.Networks = append(proxies.Networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return proxies, fmt.Errorf("%q is not an address, network or unix", proxy)
+		}
+		proxies.Networks = append(proxies.Networks, network)
+	}
+
+	return proxies, nil
+}
+
+// Proxies returns the proxies trusted to say which address a request was made
+// from.
+func (c *Config) Proxies() (Proxies, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return parseProxies(c.TrustedProxies)
+}
+
+// Signers returns the keys that tokens are signed with. The last key is the one
+// that should be used for new tokens, the others remain so that tokens they
+// signed can still be verified.
+func (c *Config) Signers() ([]*jwt.Key, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.SigningKeys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+
+	keys := make([]*jwt.Key, len(c.SigningKeys))
+	for i, key := range c.SigningKeys {
+		parsed, err := jwt.ParseKey(key.ID, key.Private)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = parsed
+	}
+
+	return keys, nil
+}
+
+// Signer returns the key that new tokens should be signed with.
+func (c *Config) Signer() (*jwt.Key, error) {
+	keys, err := c.Signers()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys[len(keys)-1], nil
+}
+
+// change applies f, keeping it so that it can be reapplied if the file is
+// changed by something else before the config is saved. It must be called with
+// mu held.
+func (c *Config) change(f func(*Config)) {
+	f(c)
+	c.pending = append(c.pending, f)
+}
+
+// AddSigningKey adds a new key, which becomes the one new tokens are signed
+// with.
+func (c *Config) AddSigningKey(key *Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	copied := *key
+	c.change(func(c *Config) { c.addSigningKey(copied) })
+}
+
+func (c *Config) addSigningKey(key Key) {
+	c.SigningKeys = append(c.SigningKeys, &key)
+}
+
+func (c *Config) RemoveSigningKey(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.change(func(c *Config) { c.removeSigningKey(id) })
+}
+
+func (c *Config) removeSigningKey(id string) {
+	idx := -1
+	for i, key := range c.SigningKeys {
+		if key.ID == id {
+			idx = i
+			break
+		}
+	}
+
+	if idx == -1 {
+		return
+	}
+
+	c.SigningKeys = append(c.SigningKeys[:idx], c.SigningKeys[idx+1:]...)
+}
+
+// ListApps returns a copy of each registered app.
+func (c *Config) ListApps() []*App {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	apps := make([]*App, len(c.Apps))
+	for i, app := range c.Apps {
+		copied := *app
+		apps[i] = &copied
+	}
+	return apps
+}
+
+func (c *Config) getApp(name string) *App {
 	for _, app := range c.Apps {
 		if app.Name == name {
 			return app
@@ -43,16 +514,60 @@ func (c *Config) GetApp(name string) *App {
 	return nil
 }
 
+// GetApp returns a copy of the app with the name, or nil if there is no such
+// app. Changes must be made with SetApp.
+func (c *Config) GetApp(name string) *App {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if app := c.getApp(name); app != nil {
+		copied := *app
+		return &copied
+	}
+	return nil
+}
+
+// SetApp adds the app, or replaces the one with the same name. If the file has
+// been changed by something else before being saved, only the fields changed
+// here are applied to the app as read.
 func (c *Config) SetApp(app *App) {
-	if existing := c.GetApp(app.Name); existing != nil {
-		existing.URI = app.URI
-		existing.Secret = app.Secret
-	} else {
-		c.Apps = append(c.Apps, app)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var base *App
+	if existing := c.getApp(app.Name); existing != nil {
+		copied := *existing
+		base = &copied
+	}
+
+	copied := *app
+	c.change(func(c *Config) { c.setApp(base, copied) })
+}
+
+func (c *Config) setApp(base *App, app App) {
+	existing := c.getApp(app.Name)
+
+	switch {
+	case existing != nil && base != nil:
+		mergeChanges(existing, base, &app)
+	case existing != nil:
+		*existing = app
+	case base == nil:
+		c.Apps = append(c.Apps, &app)
 	}
+
+	// An app that existed, but has since been removed by something else, is not
+	// added back.
 }
 
 func (c *Config) RemoveApp(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.change(func(c *Config) { c.removeApp(name) })
+}
+
+func (c *Config) removeApp(name string) {
 	idx := -1
 	for i, app := range c.Apps {
 		if app.Name == name {
@@ -68,7 +583,20 @@ func (c *Config) RemoveApp(name string) {
 	c.Apps = append(c.Apps[:idx], c.Apps[idx+1:]...)
 }
 
-func (c *Config) GetUser(email string) *User {
+// ListUsers returns a copy of each registered user.
+func (c *Config) ListUsers() []*User {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	users := make([]*User, len(c.Users))
+	for i, user := range c.Users {
+		copied := *user
+		users[i] = &copied
+	}
+	return users
+}
+
+func (c *Config) getUser(email string) *User {
 	for _, user := range c.Users {
 		if user.Email == email {
 			return user
@@ -77,15 +605,60 @@ func (c *Config) GetUser(email string) *User {
 	return nil
 }
 
+// GetUser returns a copy of the user with the email, or nil if there is no such
+// user. Changes must be made with SetUser.
+func (c *Config) GetUser(email string) *User {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if user := c.getUser(email); user != nil {
+		copied := *user
+		return &copied
+	}
+	return nil
+}
+
+// SetUser adds the user, or replaces the one with the same email. If the file
+// has been changed by something else before being saved, only the fields
+// changed here are applied to the user as read.
 func (c *Config) SetUser(user *User) {
-	if existing := c.GetUser(user.Email); existing != nil {
-		existing.Hash = user.Hash
-	} else {
-		c.Users = append(c.Users, user)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var base *User
+	if existing := c.getUser(user.Email); existing != nil {
+		copied := *existing
+		base = &copied
 	}
+
+	copied := *user
+	c.change(func(c *Config) { c.setUser(base, copied) })
+}
+
+func (c *Config) setUser(base *User, user User) {
+	existing := c.getUser(user.Email)
+
+	switch {
+	case existing != nil && base != nil:
+		mergeChanges(existing, base, &user)
+	case existing != nil:
+		*existing = user
+	case base == nil:
+		c.Users = append(c.Users, &user)
+	}
+
+	// A user that existed, but has since been removed by something else, is not
+	// added back.
 }
 
 func (c *Config) RemoveUser(email string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.change(func(c *Config) { c.removeUser(email) })
+}
+
+func (c *Config) removeUser(email string) {
 	idx := -1
 	for i, user := range c.Users {
 		if user.Email == email {
@@ -101,11 +674,245 @@ func (c *Config) RemoveUser(email string) {
 	c.Users = append(c.Users[:idx], c.Users[idx+1:]...)
 }
 
+// mergeChanges sets each field of dst, a pointer to a struct, that differs
+// between base and changed to its value in changed. The other fields are left
+// as they are, so that changes made to dst since base aren't lost.
+func mergeChanges(dst, base, changed interface{}) {
+	d := reflect.ValueOf(dst).Elem()
+	b := reflect.ValueOf(base).Elem()
+	ch := reflect.ValueOf(changed).Elem()
+
+	for i := 0; i < d.NumField(); i++ {
+		if !reflect.DeepEqual(b.Field(i).Interface(), ch.Field(i).Interface()) {
+			d.Field(i).Set(ch.Field(i))
+		}
+	}
+}
+
+// Changed reports whether the file has been changed by something else since it
+// was last read or written.
+func (c *Config) Changed() (bool, error) {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	return c.changed()
+}
+
+func (c *Config) changed() (bool, error) {
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return sha256.Sum256(data) != c.loaded, nil
+}
+
+// Reload reads the file again, replacing the config with its contents if they
+// are valid. Any changes that have not yet been saved are reapplied on top. If
+// the contents are not valid an error is returned and the config is unchanged.
+func (c *Config) Reload() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	return c.reload()
+}
+
+func (c *Config) reload() error {
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	fresh := &Config{path: c.path}
+	if _, err := toml.Decode(string(data), fresh); err != nil {
+		return err
+	}
+	if err := fresh.Validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, f := range c.pending {
+		f(fresh)
+	}
+
+	c.Apps = fresh.Apps
+	c.Users = fresh.Users
+	c.SigningKeys = fresh.SigningKeys
+	c.Storage = fresh.Storage
+	c.Database = fresh.Database
+	c.State = fresh.State
+	c.AuditLog = fresh.AuditLog
+	c.AuditLogMaxSize = fresh.AuditLogMaxSize
+	c.AuditLogBackups = fresh.AuditLogBackups
+	c.SMTPAddr = fresh.SMTPAddr
+	c.SMTPUsername = fresh.SMTPUsername
+	c.SMTPPassword = fresh.SMTPPassword
+	c.MailFrom = fresh.MailFrom
+	c.PasswordMinLength = fresh.PasswordMinLength
+	c.PasswordMaxLength = fresh.PasswordMaxLength
+	c.BreachedPasswords = fresh.BreachedPasswords
+	c.RateLimitEmail = fresh.RateLimitEmail
+	c.RateLimitIP = fresh.RateLimitIP
+	c.RateLimitSubnet = fresh.RateLimitSubnet
+	c.RateLimitInterval = fresh.RateLimitInterval
+	c.RateLimitBuckets = fresh.RateLimitBuckets
+	c.MaxConcurrentChecks = fresh.MaxConcurrentChecks
+	c.LockoutAfter = fresh.LockoutAfter
+	c.LockoutBackoff = fresh.LockoutBackoff
+	c.LockoutThreshold = fresh.LockoutThreshold
+	c.LockoutNotify = fresh.LockoutNotify
+	c.TrustedProxies = fresh.TrustedProxies
+	c.Domain = fresh.Domain
+	c.Secure = fresh.Secure
+	c.Issuer = fresh.Issuer
+	c.HashKey = fresh.HashKey
+	c.BlockKey = fresh.BlockKey
+
+	c.loaded = sha256.Sum256(data)
+	return nil
+}
+
+// Watch checks the file every interval and reloads it when it has been changed
+// by something else, calling onReload with the result. Calling the returned
+// function stops watching.
+func (c *Config) Watch(interval time.Duration, onReload func(error)) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.saveMu.Lock()
+				changed, err := c.changed()
+				if err == nil && changed {
+					err = c.reload()
+				}
+				c.saveMu.Unlock()
+
+				if err != nil || changed {
+					onReload(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Save writes the config back to the file it was read from. If the file has
+// been changed by something else since then it is read again and the changes
+// made to this config are reapplied on top, so that neither set is lost. Users
+// and apps are merged field by field, so only where both changed the same field
+// of the same user or app does this config's change win.
+//
+// The new contents are written to a temporary file which then replaces the
+// original, so that the file is never left partially written, and the previous
+// contents are kept in a file with the same path suffixed with ".bak".
 func (c *Config) Save() error {
-	file, err := os.OpenFile(c.path, os.O_TRUNC|os.O_WRONLY, 0600)
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	changed, err := c.changed()
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := c.reload(); err != nil {
+			return fmt.Errorf("merging with changed file: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	c.mu.RLock()
+	err = toml.NewEncoder(&buf).Encode(c)
+	saved := len(c.pending)
+	c.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(c.path)
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := backup(c.path); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.pending = c.pending[saved:]
+	c.mu.Unlock()
+
+	c.loaded = sha256.Sum256(buf.Bytes())
+	return syncDir(dir)
+}
+
+// backup copies the file at path to path + ".bak", if it exists.
+func backup(path string) error {
+	previous, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path+".bak", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(previous); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
+	defer d.Close()
 
-	return toml.NewEncoder(file).Encode(c)
+	return d.Sync()
 }
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/password"
+)
+
+func TestSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte("domain = \"example.com\"\n"), 0600)
+
+	assert := assert.New(t)
+
+	conf, err := Read(path)
+	assert.Nil(err)
+
+	conf.SetUser(&User{Email: "a@example.com", Hash: "1"})
+	assert.Nil(conf.Save())
+
+	conf.SetUser(&User{Email: "b@example.com", Hash: "2"})
+	assert.Nil(conf.Save())
+
+	saved, err := Read(path)
+	assert.Nil(err)
+	assert.Equal("example.com", saved.Domain)
+	assert.Len(saved.Users, 2)
+
+	previous, err := Read(path + ".bak")
+	assert.Nil(err)
+	assert.Len(previous.Users, 1)
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	assert.Len(files, 2)
+
+	info, _ := os.Stat(path)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestGetUserReturnsCopy(t *testing.T) {
+	conf := &Config{}
+	conf.SetUser(&User{Email: "a@example.com", Hash: "1"})
+
+	user := conf.GetUser("a@example.com")
+	user.Hash = "2"
+
+	assert.New(t).Equal("1", conf.GetUser("a@example.com").Hash)
+}
+
+func TestSaveMergesChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte{}, 0600)
+
+	assert := assert.New(t)
+
+	server, _ := Read(path)
+	admin, _ := Read(path)
+
+	server.SetUser(&User{Email: "a@example.com", Hash: "1"})
+	assert.Nil(server.Save())
+
+	admin.SetUser(&User{Email: "b@example.com", Hash: "2"})
+	admin.SetApp(&App{Name: "test"})
+	assert.Nil(admin.Save())
+
+	server.SetUser(&User{Email: "a@example.com", Hash: "3"})
+	assert.Nil(server.Save())
+
+	saved, err := Read(path)
+	assert.Nil(err)
+	assert.Len(saved.Users, 2)
+	assert.Len(saved.Apps, 1)
+	assert.Equal("3", saved.GetUser("a@example.com").Hash)
+	assert.Equal("2", saved.GetUser("b@example.com").Hash)
+
+	assert.NotNil(server.GetApp("test"))
+}
+
+func TestSaveMergesChangedFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte{}, 0600)
+
+	assert := assert.New(t)
+
+	server, _ := Read(path)
+	server.SetUser(&User{Email: "a@example.com", Hash: "1"})
+	server.SetUser(&User{Email: "b@example.com", Hash: "1"})
+	server.SetApp(&App{Name: "test", URI: "http://a"})
+	assert.Nil(server.Save())
+
+	admin, _ := Read(path)
+
+	user := admin.GetUser("a@example.com")
+	user.AddGroup("admins")
+	admin.SetUser(user)
+	admin.RemoveUser("b@example.com")
+	app := admin.GetApp("test")
+	app.Secret = "s"
+	admin.SetApp(app)
+	assert.Nil(admin.Save())
+
+	user = server.GetUser("a@example.com")
+	user.Hash = "2"
+	server.SetUser(user)
+	server.SetUser(&User{Email: "b@example.com", Hash: "2"})
+	app = server.GetApp("test")
+	app.URI = "http://b"
+	server.SetApp(app)
+	assert.Nil(server.Save())
+
+	saved, err := Read(path)
+	assert.Nil(err)
+	assert.Equal("2", saved.GetUser("a@example.com").Hash)
+	assert.Equal([]string{"admins"}, saved.GetUser("a@example.com").Groups)
+	assert.Nil(saved.GetUser("b@example.com"))
+	assert.Equal("http://b", saved.GetApp("test").URI)
+	assert.Equal("s", saved.GetApp("test").Secret)
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte("domain = \"example.com\"\n"), 0600)
+
+	assert := assert.New(t)
+
+	conf, _ := Read(path)
+	conf.SetUser(&User{Email: "a@example.com", Hash: "1"})
+
+	changed, err := conf.Changed()
+	assert.Nil(err)
+	assert.False(changed)
+
+	ioutil.WriteFile(path, []byte("domain = \"other.example.com\"\n[[app]]\nname = \"test\"\n"), 0600)
+
+	changed, err = conf.Changed()
+	assert.Nil(err)
+	assert.True(changed)
+
+	assert.Nil(conf.Reload())
+	assert.Equal("http://other.example.com", conf.IssuerURL())
+	assert.NotNil(conf.GetApp("test"))
+	assert.NotNil(conf.GetUser("a@example.com"))
+
+	ioutil.WriteFile(path, []byte("[[app]]\nname = \"test\"\n[[app]]\nname = \"test\"\n"), 0600)
+
+	assert.NotNil(conf.Reload())
+	assert.Equal("http://other.example.com", conf.IssuerURL())
+	assert.Len(conf.ListApps(), 1)
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte{}, 0600)
+
+	conf, _ := Read(path)
+
+	reloaded := make(chan error, 1)
+	stop := conf.Watch(10*time.Millisecond, func(err error) { reloaded <- err })
+	defer stop()
+
+	ioutil.WriteFile(path, []byte("[[user]]\nemail = \"a@example.com\"\n"), 0600)
+
+	select {
+	case err := <-reloaded:
+		assert.New(t).Nil(err)
+		assert.New(t).NotNil(conf.GetUser("a@example.com"))
+	case <-time.After(time.Second):
+		t.Fatal("expected reload")
+	}
+}
+
+func TestAppAllows(t *testing.T) {
+	assert := assert.New(t)
+
+	user := User{Email: "a@example.com"}
+	app := App{Name: "test"}
+	assert.True(app.Allows(user))
+
+	app.AllowGroup("admins")
+	assert.False(app.Allows(user))
+
+	user.AddGroup("admins")
+	assert.True(app.Allows(user))
+
+	app.DisallowGroup("admins")
+	app.AllowUser("b@example.com")
+	assert.False(app.Allows(user))
+
+	app.AllowUser("a@example.com")
+	assert.True(app.Allows(user))
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	dir := t.TempDir()
+	breached := filepath.Join(dir, "breached.txt")
+	ioutil.WriteFile(breached, []byte("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\n"), 0600)
+
+	conf := &Config{PasswordMinLength: 8, BreachedPasswords: breached}
+
+	assert := assert.New(t)
+
+	policy, err := conf.PasswordPolicy()
+	assert.Nil(err)
+	assert.Equal(8, policy.MinLength)
+	assert.Equal(password.ErrBreached, policy.Check("a@example.com", "password"))
+
+	conf.BreachedPasswords = filepath.Join(dir, "missing.txt")
+	_, err = conf.PasswordPolicy()
+	assert.NotNil(err)
+
+	assert.Nil(conf.Validate())
+	conf.PasswordMaxLength = 100
+	assert.NotNil(conf.Validate())
+	conf.PasswordMaxLength = 7
+	assert.NotNil(conf.Validate())
+}
+
+func TestRateLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &Config{RateLimitEmail: 5, RateLimitInterval: "1m", MaxConcurrentChecks: 2}
+
+	limits, err := conf.RateLimits()
+	assert.Nil(err)
+	assert.Equal(RateLimits{Email: 5, Interval: time.Minute, MaxConcurrent: 2}, limits)
+
+	conf.RateLimitInterval = "soon"
+	_, err = conf.RateLimits()
+	assert.NotNil(err)
+	assert.NotNil(conf.Validate())
+}
+
+func TestProxies(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &Config{TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8", "::1"}}
+
+	proxies, err := conf.Proxies()
+	assert.Nil(err)
+	assert.True(proxies.Trusts("127.0.0.1"))
+	assert.True(proxies.Trusts("10.1.2.3"))
+	assert.True(proxies.Trusts("::1"))
+	assert.False(proxies.Trusts("127.0.0.2"))
+	assert.False(proxies.Trusts("192.0.2.1"))
+	assert.False(proxies.Trusts("@"))
+
+	conf.TrustedProxies = append(conf.TrustedProxies, "unix")
+	proxies, err = conf.Proxies()
+	assert.Nil(err)
+	assert.True(proxies.Trusts("@"))
+
+	conf.TrustedProxies = []string{"proxy.example.com"}
+	_, err = conf.Proxies()
+	assert.NotNil(err)
+	assert.NotNil(conf.Validate())
+}
@@ -0,0 +1,13 @@
+package config
+
+import "time"
+
+// Credential is a passkey registered by a user. The ID and PublicKey are
+// base64url encoded, as given by the webauthn package.
+type Credential struct {
+	ID        string    `toml:"id" json:"id"`
+	Name      string    `toml:"name" json:"name"`
+	PublicKey string    `toml:"publicKey" json:"publicKey"`
+	SignCount uint32    `toml:"signCount" json:"signCount"`
+	CreatedAt time.Time `toml:"createdAt" json:"createdAt"`
+}
@@ -0,0 +1,8 @@
+package config
+
+// Key is a private key that uberich uses to sign tokens, given as a PKCS #8
+// document in standard base64.
+type Key struct {
+	ID      string `toml:"id"`
+	Private string `toml:"private"`
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// A RedirectPattern describes the URIs an app may be redirected to. Most
+// patterns are a single URI that must match exactly, but two wildcards are
+// understood:
+//
+//   - a path ending in "/*" matches that path and anything below it, so
+//     "https://app.example.com/auth/*" matches "/auth" and "/auth/callback" but
+//     not "/authority";
+//
+//   - a port of "*" matches any port, but only for the loopback hosts
+//     "localhost", "127.0.0.1" and "[::1]", so that command line tools can
+//     listen on whatever port is free.
+//
+// A pattern never matches a URI with a different scheme or host, or one with
+// user info or a fragment.
+type RedirectPattern struct {
+	Scheme string
+	Host   string
+	Port   string
+	Path   string
+	Query  string
+
+	// AnyPort is set when the pattern's port is "*".
+	AnyPort bool
+
+	// Prefix is set when the pattern's path ends in "/*", Path then holds the
+	// path without the wildcard or trailing slash.
+	Prefix bool
+}
+
+// ParseRedirectPattern parses s as a RedirectPattern.
+func ParseRedirectPattern(s string) (RedirectPattern, error) {
+	var pattern RedirectPattern
+
+	// url.Parse rejects a port of "*", so take it out and remember that it was
+	// there.
+	if start := strings.Index(s, "://"); start >= 0 {
+		end := len(s)
+		if i := strings.IndexAny(s[start+3:], "/?#"); i >= 0 {
+			end = start + 3 + i
+		}
+
+		if strings.HasSuffix(s[:end], ":*") {
+			s = s[:end-2] + s[end:]
+			pattern.AnyPort = true
+		}
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return pattern, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return pattern, errors.New("redirect uri must be http or https")
+	}
+	if u.Host == "" {
+		return pattern, errors.New("redirect uri must have a host")
+	}
+	if strings.Contains(u.Host, "*") {
+		return pattern, errors.New("redirect uri can not have a wildcard host")
+	}
+	if u.User != nil {
+		return pattern, errors.New("redirect uri must not have user info")
+	}
+	if u.Fragment != "" || strings.Contains(s, "#") {
+		return pattern, errors.New("redirect uri must not have a fragment")
+	}
+
+	pattern.Scheme = u.Scheme
+	pattern.Host = strings.ToLower(u.Hostname())
+	pattern.Port = u.Port()
+	pattern.Path = u.EscapedPath()
+	pattern.Query = u.RawQuery
+
+	if pattern.AnyPort {
+		if !isLoopback(pattern.Host) {
+			return pattern, errors.New("redirect uri can only use any port for loopback hosts")
+		}
+		if pattern.Port != "" {
+			return pattern, errors.New("redirect uri has two ports")
+		}
+	}
+
+	if pattern.Path == "*" || strings.HasSuffix(pattern.Path, "/*") {
+		if pattern.Query != "" {
+			return pattern, errors.New("redirect uri with a path wildcard must not have a query")
+		}
+		pattern.Prefix = true
+		pattern.Path = strings.TrimSuffix(strings.TrimSuffix(pattern.Path, "*"), "/")
+	}
+
+	if strings.Contains(pattern.Path, "*") {
+		return pattern, errors.New("redirect uri can only have a wildcard at the end of its path")
+	}
+
+	return pattern, nil
+}
+
+// Matches reports whether uri is allowed by the pattern.
+func (p RedirectPattern) Matches(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Opaque != "" || u.User != nil || u.Fragment != "" || strings.Contains(uri, "#") {
+		return false
+	}
+
+	if u.Scheme != p.Scheme || strings.ToLower(u.Hostname()) != p.Host {
+		return false
+	}
+	if !p.AnyPort && u.Port() != p.Port {
+		return false
+	}
+
+	path := u.EscapedPath()
+	if !p.Prefix {
+		return path == p.Path && u.RawQuery == p.Query
+	}
+
+	// Treat dot segments as a mismatch rather than resolving them, otherwise
+	// "/auth/../admin" would get out from under "/auth".
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return path == p.Path || strings.HasPrefix(path, p.Path+"/")
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// legacyRedirectPattern turns an app's root URI into the pattern it used to
+// mean: anything below it on the same scheme and host.
+func legacyRedirectPattern(uri string) string {
+	return strings.TrimSuffix(uri, "/") + "/*"
+}
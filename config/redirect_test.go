@@ -0,0 +1,89 @@
+package config
+
+import (
+	"testing"
+
+	"hawx.me/code/assert"
+)
+
+func TestRedirectPattern(t *testing.T) {
+	testCases := []struct {
+		Pattern string
+		URI     string
+		Matches bool
+	}{
+		{"https://app.example.com/callback", "https://app.example.com/callback", true},
+		{"https://app.example.com/callback", "https://APP.example.com/callback", true},
+		{"https://app.example.com/callback", "https://app.example.com/callback/", false},
+		{"https://app.example.com/callback", "https://app.example.com/callback?a=b", false},
+		{"https://app.example.com/callback", "http://app.example.com/callback", false},
+		{"https://app.example.com/callback", "https://app.example.com:8443/callback", false},
+		{"https://app.example.com/callback", "https://app.example.com/callback#x", false},
+		{"https://app.example.com/callback?a=b", "https://app.example.com/callback?a=b", true},
+
+		{"https://app.example.com/*", "https://app.example.com", true},
+		{"https://app.example.com/*", "https://app.example.com/", true},
+		{"https://app.example.com/*", "https://app.example.com/a/b?c=d", true},
+		{"https://app.example.com/*", "https://app.example.com.evil.net/steal", false},
+		{"https://app.example.com/*", "https://app.example.com@evil.net/steal", false},
+		{"https://app.example.com/*", "https://user@app.example.com/", false},
+		{"https://app.example.com/auth/*", "https://app.example.com/auth", true},
+		{"https://app.example.com/auth/*", "https://app.example.com/auth/callback", true},
+		{"https://app.example.com/auth/*", "https://app.example.com/authority", false},
+		{"https://app.example.com/auth/*", "https://app.example.com/auth/../admin", false},
+		{"https://app.example.com/auth/*", "https://app.example.com/auth/%2e%2e/admin", false},
+
+		{"http://127.0.0.1:*/callback", "http://127.0.0.1:51234/callback", true},
+		{"http://127.0.0.1:*/callback", "http://127.0.0.1/callback", true},
+		{"http://127.0.0.1:*/callback", "http://127.0.0.2:51234/callback", false},
+		{"http://127.0.0.1:*/callback", "http://localhost:51234/callback", false},
+		{"http://localhost:*/callback", "http://localhost:51234/callback", true},
+		{"http://[::1]:*/callback", "http://[::1]:51234/callback", true},
+		{"http://localhost:8080/callback", "http://localhost:8081/callback", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Pattern+" "+tc.URI, func(t *testing.T) {
+			pattern, err := ParseRedirectPattern(tc.Pattern)
+			assert.New(t).Nil(err)
+			assert.New(t).Equal(tc.Matches, pattern.Matches(tc.URI))
+		})
+	}
+}
+
+func TestRedirectPatternInvalid(t *testing.T) {
+	for _, s := range []string{
+		"/callback",
+		"javascript:alert(1)",
+		"ftp://app.example.com/",
+		"https://user@app.example.com/",
+		"https://app.example.com/callback#x",
+		"https://app.example.com:*/callback",
+		"https://*.example.com/callback",
+		"https://app.example.com/*/callback",
+		"https://app.example.com/*?a=b",
+	} {
+		t.Run(s, func(t *testing.T) {
+			_, err := ParseRedirectPattern(s)
+			assert.New(t).NotNil(err)
+		})
+	}
+}
+
+func TestAppCanRedirectTo(t *testing.T) {
+	assert := assert.New(t)
+
+	app := App{Name: "test", URI: "https://app.example.com"}
+	assert.True(app.UsesLegacyRedirect())
+	assert.True(app.CanRedirectTo("https://app.example.com/anything"))
+	assert.False(app.CanRedirectTo("https://app.example.com.evil.net/steal"))
+
+	app.MigrateRedirect()
+	assert.False(app.UsesLegacyRedirect())
+	assert.Equal([]string{"https://app.example.com/*"}, app.RedirectURIs)
+
+	app.RemoveRedirectURI("https://app.example.com/*")
+	app.AddRedirectURI("https://app.example.com/callback")
+	assert.True(app.CanRedirectTo("https://app.example.com/callback"))
+	assert.False(app.CanRedirectTo("https://app.example.com/anything"))
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+)
+
+// SessionLifetime is how long a user stays signed in.
+const SessionLifetime = 8 * time.Hour
+
+// MagicLink is the Method of a session started by following an emailed link.
+const MagicLink = "magic-link"
+
+// Session is a login to uberich from a particular browser.
+type Session struct {
+	ID        string    `toml:"id"`
+	Email     string    `toml:"email"`
+	IP        string    `toml:"ip"`
+	UserAgent string    `toml:"userAgent"`
+	CreatedAt time.Time `toml:"createdAt"`
+	LastSeen  time.Time `toml:"lastSeen"`
+
+	// Method is how the user signed in, as recorded with the sign in.
+	Method string `toml:"method,omitempty"`
+
+	// App is set for sessions that only sign the user in to one app, through a
+	// proxy that checks with uberich.
+	App string `toml:"app,omitempty"`
+
+	// Parent is the Sid of the session the user was signed in with when an App
+	// session was started, so that it can end along with it.
+	Parent string `toml:"parent,omitempty"`
+}
+
+// Sid identifies the session without giving away its ID, which would be
+// enough to use it.
+func (s Session) Sid() string {
+	sum := sha256.Sum256([]byte(s.ID))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CanSignInTo reports whether the session is enough to sign the user in to
+// app. A session started by a magic link is only enough for apps that allow
+// them, others need the user to give their password.
+func (s Session) CanSignInTo(app *App) bool {
+	return s.Method != MagicLink || app.MagicLinks
+}
+
+// Expired reports whether the session has ended by now.
+func (s Session) Expired(now time.Time) bool {
+	return now.Sub(s.CreatedAt) > SessionLifetime
+}
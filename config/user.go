@@ -1,10 +1,65 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type User struct {
 	Email string `toml:"email"`
 	Hash  string `toml:"hash"`
+
+	// Groups the user is a member of, used to decide which apps they can sign in
+	// to.
+	Groups []string `toml:"groups,omitempty"`
+
+	// TOTPSecret is set once the user has enrolled an authenticator, TOTPStep is
+	// the time step of the last code they used so that it can't be used again.
+	TOTPSecret string `toml:"totpSecret,omitempty"`
+	TOTPStep   int64  `toml:"totpStep,omitempty"`
+
+	// RequireTwoFactor makes the user enrol an authenticator the next time they
+	// sign in, if they haven't already.
+	RequireTwoFactor bool `toml:"requireTwoFactor,omitempty"`
+
+	// RecoveryCodes are bcrypt hashes of the codes that can be used, once each,
+	// in place of a one-time password.
+	RecoveryCodes []string `toml:"recoveryCodes,omitempty"`
+
+	// Credentials are the passkeys the user can sign in with.
+	Credentials []Credential `toml:"credential,omitempty"`
+
+	// Invitation is set while the user has been invited but has not yet chosen
+	// a password. It identifies the invitation, so that only the latest one sent
+	// can be used.
+	Invitation string `toml:"invitation,omitempty"`
+
+	// Lockout is read along with the rest of the user, but is kept apart from it
+	// as it changes on every failed attempt. It is not saved by SetUser, only by
+	// UpdateLockout, so that an attempt doesn't undo other changes to the user.
+	Lockout `toml:"-"`
+}
+
+// Lockout counts the wrong passwords and codes given since a user last signed
+// in. After a few the user is locked out until LockedUntil, and after too many
+// Locked is set so they are locked out until unlocked.
+type Lockout struct {
+	FailedAttempts int       `json:"failedAttempts,omitempty"`
+	LockedUntil    time.Time `json:"lockedUntil,omitempty"`
+	Locked         bool      `json:"locked,omitempty"`
+}
+
+// IsLocked reports whether the user is locked out at now, after too many
+// failed attempts to sign in.
+func (l Lockout) IsLocked(now time.Time) bool {
+	return l.Locked || now.Before(l.LockedUntil)
+}
+
+// Unlock clears the user's failed attempts, and any lockout.
+func (l *Lockout) Unlock() {
+	*l = Lockout{}
 }
 
 func (u User) IsPassword(password string) bool {
@@ -18,3 +73,127 @@ func (u *User) SetPassword(password string) error {
 	}
 	return err
 }
+
+// IsPending reports whether the user has been invited, but has not registered
+// yet so can't sign in.
+func (u User) IsPending() bool {
+	return u.Invitation != ""
+}
+
+// InGroup reports whether the user is a member of the group.
+func (u User) InGroup(group string) bool {
+	return contains(u.Groups, group)
+}
+
+// AddGroup makes the user a member of the group.
+func (u *User) AddGroup(group string) {
+	u.Groups = with(u.Groups, group)
+}
+
+// RemoveGroup removes the user from the group.
+func (u *User) RemoveGroup(group string) {
+	u.Groups = without(u.Groups, group)
+}
+
+// HasTwoFactor reports whether the user has enrolled an authenticator.
+func (u User) HasTwoFactor() bool {
+	return u.TOTPSecret != ""
+}
+
+// MustEnrolTwoFactor reports whether the user needs to enrol an authenticator
+// before they can sign in.
+func (u User) MustEnrolTwoFactor() bool {
+	return u.RequireTwoFactor && !u.HasTwoFactor()
+}
+
+// SetRecoveryCodes replaces the user's recovery codes with codes.
+func (u *User) SetRecoveryCodes(codes []string) error {
+	hashes := make([]string, len(codes))
+
+	for i, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(normaliseRecoveryCode(code)), -1)
+		if err != nil {
+			return err
+		}
+		hashes[i] = string(hash)
+	}
+
+	u.RecoveryCodes = hashes
+	return nil
+}
+
+// RecoveryCode returns the hash of the user's recovery code that matches code,
+// if there is one.
+func (u User) RecoveryCode(code string) (string, bool) {
+	code = normaliseRecoveryCode(code)
+
+	for _, hash := range u.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			return hash, true
+		}
+	}
+
+	return "", false
+}
+
+// RemoveRecoveryCode removes the recovery code with hash, reporting whether the
+// user had it.
+func (u *User) RemoveRecoveryCode(hash string) bool {
+	for i, existing := range u.RecoveryCodes {
+		if existing == hash {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// ResetTwoFactor removes the user's authenticator and recovery codes.
+func (u *User) ResetTwoFactor() {
+	u.TOTPSecret = ""
+	u.TOTPStep = 0
+	u.RecoveryCodes = nil
+}
+
+// GetCredential returns the user's credential with the id, if they have one.
+func (u User) GetCredential(id string) (Credential, bool) {
+	for _, credential := range u.Credentials {
+		if credential.ID == id {
+			return credential, true
+		}
+	}
+	return Credential{}, false
+}
+
+// SetCredential adds the credential, or replaces the one with the same ID.
+func (u *User) SetCredential(credential Credential) {
+	credentials := make([]Credential, len(u.Credentials), len(u.Credentials)+1)
+	copy(credentials, u.Credentials)
+
+	for i, existing := range credentials {
+		if existing.ID == credential.ID {
+			credentials[i] = credential
+			u.Credentials = credentials
+			return
+		}
+	}
+
+	u.Credentials = append(credentials, credential)
+}
+
+// RemoveCredential removes the credential with the id.
+func (u *User) RemoveCredential(id string) {
+	credentials := make([]Credential, 0, len(u.Credentials))
+	for _, existing := range u.Credentials {
+		if existing.ID != id {
+			credentials = append(credentials, existing)
+		}
+	}
+
+	u.Credentials = credentials
+}
+
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), " ", "", -1))
+}
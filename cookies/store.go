@@ -1,51 +1,156 @@
 package cookies
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/securecookie"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
 )
 
 type Store interface {
-	Set(w http.ResponseWriter, email string) error
-	Unset(w http.ResponseWriter)
+	// Set signs the user in, recording a new session for them started by
+	// method. Unset signs out of the session and removes it.
+	Set(w http.ResponseWriter, r *http.Request, email, method string) error
+	Unset(w http.ResponseWriter, r *http.Request)
+
+	// Get returns the email of the signed in user, and Session the session they
+	// are signed in with. Both fail if the session has expired or been revoked.
 	Get(r *http.Request) (email string, err error)
+	Session(r *http.Request) (*config.Session, error)
+
+	// SetPending, UnsetPending and GetPending track a user who has signed in
+	// with method but has yet to give a second factor.
+	SetPending(w http.ResponseWriter, email, method string) error
+	UnsetPending(w http.ResponseWriter)
+	GetPending(r *http.Request) (email, method string, err error)
+
+	// Visit records that the signed in user has been sent to the app, so that it
+	// can be told when they sign out. Visited returns those apps.
+	Visit(w http.ResponseWriter, r *http.Request, app string) error
+	Visited(r *http.Request) []string
+
+	// SetForApp and GetForApp are like Set and Get, but for a session that only
+	// signs the user in to app. Its cookie is set without a domain, so that it
+	// can be set for an app on another host that is behind a proxy using
+	// uberich's /verify endpoint. The session records parent, the Sid of the
+	// session it was started from.
+	SetForApp(w http.ResponseWriter, r *http.Request, app, email, parent string) error
+	GetForApp(r *http.Request, app string) (email string, err error)
 }
 
+const (
+	// pendingLifetime is how long a user has to give their second factor.
+	pendingLifetime = 5 * time.Minute
+
+	// lastSeenInterval limits how often a session's LastSeen is updated, so that
+	// not every request has to write to storage.
+	lastSeenInterval = 5 * time.Minute
+)
+
+var errInvalidSession = errors.New("invalid session")
+
 type store struct {
-	domain string
-	secure bool
-	cookie *securecookie.SecureCookie
+	domain  string
+	secure  bool
+	db      storage.Storage
+	cookie  *securecookie.SecureCookie
+	pending *securecookie.SecureCookie
 }
 
-func New(domain string, secure bool, hashKey, blockKey []byte) Store {
+// New returns a Store that keeps the ID of the user's session in a cookie, and
+// the session itself in db.
+func New(domain string, secure bool, hashKey, blockKey []byte, db storage.Storage) Store {
 	return &store{
-		domain: domain,
-		secure: secure,
-		cookie: securecookie.New(hashKey, blockKey),
+		domain:  domain,
+		secure:  secure,
+		db:      db,
+		cookie:  securecookie.New(hashKey, blockKey),
+		pending: securecookie.New(hashKey, blockKey).MaxAge(int(pendingLifetime / time.Second)),
 	}
 }
 
-func (s *store) Set(w http.ResponseWriter, email string) error {
-	encoded, err := s.cookie.Encode("uberich", email)
-	if err == nil {
-		http.SetCookie(w, &http.Cookie{
-			Name:     "uberich",
-			Value:    encoded,
-			Path:     "/",
-			Domain:   s.domain,
-			Expires:  time.Now().UTC().Add(8 * 60 * time.Minute),
-			HttpOnly: true,
-			Secure:   s.secure,
-		})
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
 
-	return err
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func (s *store) Unset(w http.ResponseWriter) {
+// ClientIP returns the address the request came from, without the port.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// newSession records session, as started by r, returning its ID.
+func (s *store) newSession(r *http.Request, session config.Session) (string, error) {
+	now := time.Now()
+
+	// Take the chance to forget any of the user's sessions that have expired,
+	// so that they don't build up.
+	if sessions, err := s.db.ListSessions(session.Email); err == nil {
+		for _, old := range sessions {
+			if old.Expired(now) {
+				s.db.RemoveSession(old.ID)
+			}
+		}
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	session.ID = id
+	session.IP = ClientIP(r)
+	session.UserAgent = r.UserAgent()
+	session.CreatedAt = now
+	session.LastSeen = now
+
+	return id, s.db.SetSession(&session)
+}
+
+func (s *store) Set(w http.ResponseWriter, r *http.Request, email, method string) error {
+	id, err := s.newSession(r, config.Session{Email: email, Method: method})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := s.cookie.Encode("uberich", id)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "uberich",
+		Value:    encoded,
+		Path:     "/",
+		Domain:   s.domain,
+		Expires:  time.Now().UTC().Add(config.SessionLifetime),
+		HttpOnly: true,
+		Secure:   s.secure,
+	})
+	s.unsetVisited(w)
+
+	return nil
+}
+
+func (s *store) Unset(w http.ResponseWriter, r *http.Request) {
+	if id, err := s.decodeID(r, "uberich"); err == nil {
+		s.db.RemoveSession(id)
+	}
+
 	http.SetCookie(w, &http.Cookie{
 		Name:    "uberich",
 		Value:   "",
@@ -54,22 +159,215 @@ func (s *store) Unset(w http.ResponseWriter) {
 		Expires: time.Now().UTC().Add(60 * time.Minute),
 		Secure:  s.secure,
 	})
+	s.unsetVisited(w)
+}
+
+// decodeID reads the session ID from the cookie with name.
+func (s *store) decodeID(r *http.Request, name string) (string, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	if err = s.cookie.Decode(name, cookie.Value, &id); err != nil {
+		return "", err
+	}
+
+	if id == "" {
+		return "", errInvalidSession
+	}
+
+	return id, nil
+}
+
+// session returns the session with the ID given in the cookie with name, as
+// long as it is still valid.
+func (s *store) session(r *http.Request, name string) (*config.Session, error) {
+	id, err := s.decodeID(r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.db.GetSession(id)
+	if err == storage.ErrNotFound {
+		return nil, errInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if session.Expired(now) {
+		s.db.RemoveSession(id)
+		return nil, errInvalidSession
+	}
+
+	if now.Sub(session.LastSeen) > lastSeenInterval {
+		session.LastSeen = now
+		session.IP = ClientIP(r)
+		s.db.TouchSession(id, session.IP, now)
+	}
+
+	return session, nil
+}
+
+func (s *store) Session(r *http.Request) (*config.Session, error) {
+	session, err := s.session(r, "uberich")
+	if err != nil {
+		return nil, err
+	}
+
+	if session.App != "" {
+		return nil, errInvalidSession
+	}
+
+	return session, nil
 }
 
 func (s *store) Get(r *http.Request) (string, error) {
-	cookie, err := r.Cookie("uberich")
+	session, err := s.Session(r)
 	if err != nil {
 		return "", err
 	}
 
-	var value string
-	if err = s.cookie.Decode("uberich", cookie.Value, &value); err != nil {
+	return session.Email, nil
+}
+
+func (s *store) SetForApp(w http.ResponseWriter, r *http.Request, app, email, parent string) error {
+	id, err := s.newSession(r, config.Session{Email: email, App: app, Parent: parent})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := s.cookie.Encode("uberich-app", id)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "uberich-app",
+		Value:    encoded,
+		Path:     "/",
+		Expires:  time.Now().UTC().Add(config.SessionLifetime),
+		HttpOnly: true,
+		Secure:   s.secure,
+	})
+
+	return nil
+}
+
+func (s *store) GetForApp(r *http.Request, app string) (string, error) {
+	session, err := s.session(r, "uberich-app")
+	if err != nil {
 		return "", err
 	}
 
-	if value == "" {
-		return "", errors.New("invalid user")
+	if session.App != app {
+		return "", errInvalidSession
+	}
+
+	return session.Email, nil
+}
+
+// pending is the value of the uberich-pending cookie.
+type pending struct {
+	Email  string
+	Method string
+}
+
+func (s *store) SetPending(w http.ResponseWriter, email, method string) error {
+	encoded, err := s.pending.Encode("uberich-pending", pending{Email: email, Method: method})
+	if err == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "uberich-pending",
+			Value:    encoded,
+			Path:     "/",
+			Domain:   s.domain,
+			Expires:  time.Now().UTC().Add(pendingLifetime),
+			HttpOnly: true,
+			Secure:   s.secure,
+		})
+	}
+
+	return err
+}
+
+func (s *store) UnsetPending(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   "uberich-pending",
+		Value:  "",
+		Path:   "/",
+		Domain: s.domain,
+		MaxAge: -1,
+		Secure: s.secure,
+	})
+}
+
+func (s *store) GetPending(r *http.Request) (string, string, error) {
+	cookie, err := r.Cookie("uberich-pending")
+	if err != nil {
+		return "", "", err
+	}
+
+	var value pending
+	if err = s.pending.Decode("uberich-pending", cookie.Value, &value); err != nil {
+		return "", "", err
+	}
+
+	if value.Email == "" {
+		return "", "", errors.New("invalid user")
+	}
+
+	return value.Email, value.Method, nil
+}
+
+func (s *store) Visit(w http.ResponseWriter, r *http.Request, app string) error {
+	apps := s.Visited(r)
+	for _, visited := range apps {
+		if visited == app {
+			return nil
+		}
+	}
+
+	encoded, err := s.cookie.Encode("uberich-apps", append(apps, app))
+	if err == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "uberich-apps",
+			Value:    encoded,
+			Path:     "/",
+			Domain:   s.domain,
+			Expires:  time.Now().UTC().Add(config.SessionLifetime),
+			HttpOnly: true,
+			Secure:   s.secure,
+		})
+	}
+
+	return err
+}
+
+func (s *store) unsetVisited(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   "uberich-apps",
+		Value:  "",
+		Path:   "/",
+		Domain: s.domain,
+		MaxAge: -1,
+		Secure: s.secure,
+	})
+}
+
+func (s *store) Visited(r *http.Request) []string {
+	cookie, err := r.Cookie("uberich-apps")
+	if err != nil {
+		return nil
+	}
+
+	var apps []string
+	if err = s.cookie.Decode("uberich-apps", cookie.Value, &apps); err != nil {
+		return nil
 	}
 
-	return value, nil
+	return apps
 }
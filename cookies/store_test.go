@@ -0,0 +1,145 @@
+package cookies
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+func testStore(t *testing.T) (Store, storage.Storage) {
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte{}, 0600)
+
+	conf, err := config.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := storage.NewTOML(conf, "")
+	return New("", false, []byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef"), db), db
+}
+
+// withCookies returns a request carrying the cookies set on w.
+func withCookies(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Value != "" {
+			r.AddCookie(cookie)
+		}
+	}
+	return r
+}
+
+func TestSession(t *testing.T) {
+	assert := assert.New(t)
+	store, db := testStore(t)
+
+	signIn := httptest.NewRequest("POST", "/login", nil)
+	signIn.RemoteAddr = "192.0.2.1:1234"
+	signIn.Header.Set("User-Agent", "test-agent")
+
+	w := httptest.NewRecorder()
+	assert.Nil(store.Set(w, signIn, "a@example.com", "password"))
+
+	r := withCookies(w)
+
+	email, err := store.Get(r)
+	assert.Nil(err)
+	assert.Equal("a@example.com", email)
+
+	session, err := store.Session(r)
+	assert.Nil(err)
+	assert.Equal("192.0.2.1", session.IP)
+	assert.Equal("test-agent", session.UserAgent)
+
+	sessions, _ := db.ListSessions("a@example.com")
+	assert.Len(sessions, 1)
+
+	assert.Nil(db.RemoveSession(session.ID))
+
+	_, err = store.Get(r)
+	assert.NotNil(err)
+}
+
+func TestSessionWhenExpired(t *testing.T) {
+	assert := assert.New(t)
+	store, db := testStore(t)
+
+	w := httptest.NewRecorder()
+	assert.Nil(store.Set(w, httptest.NewRequest("POST", "/login", nil), "a@example.com", "password"))
+
+	r := withCookies(w)
+
+	session, err := store.Session(r)
+	assert.Nil(err)
+
+	session.CreatedAt = time.Now().Add(-config.SessionLifetime - time.Minute)
+	db.SetSession(session)
+
+	_, err = store.Get(r)
+	assert.NotNil(err)
+
+	_, err = db.GetSession(session.ID)
+	assert.Equal(storage.ErrNotFound, err)
+}
+
+// revokingStorage removes each session just after it is read, as if it were
+// revoked while the request using it was being handled.
+type revokingStorage struct {
+	storage.Storage
+}
+
+func (s revokingStorage) GetSession(id string) (*config.Session, error) {
+	session, err := s.Storage.GetSession(id)
+	if err == nil {
+		s.Storage.RemoveSession(id)
+	}
+	return session, err
+}
+
+func TestSessionWhenRevokedWhileSeen(t *testing.T) {
+	assert := assert.New(t)
+	cookies, db := testStore(t)
+
+	w := httptest.NewRecorder()
+	assert.Nil(cookies.Set(w, httptest.NewRequest("POST", "/login", nil), "a@example.com", "password"))
+
+	r := withCookies(w)
+
+	session, err := cookies.Session(r)
+	assert.Nil(err)
+
+	// Long enough ago that it is updated when next seen.
+	session.LastSeen = time.Now().Add(-time.Hour)
+	db.SetSession(session)
+
+	cookies.(*store).db = revokingStorage{db}
+	cookies.Get(r)
+
+	_, err = db.GetSession(session.ID)
+	assert.Equal(storage.ErrNotFound, err)
+}
+
+func TestSessionUnset(t *testing.T) {
+	assert := assert.New(t)
+	store, db := testStore(t)
+
+	w := httptest.NewRecorder()
+	assert.Nil(store.Set(w, httptest.NewRequest("POST", "/login", nil), "a@example.com", "password"))
+
+	r := withCookies(w)
+	store.Unset(httptest.NewRecorder(), r)
+
+	_, err := store.Get(r)
+	assert.NotNil(err)
+
+	sessions, _ := db.ListSessions("a@example.com")
+	assert.Len(sessions, 0)
+}
@@ -0,0 +1,258 @@
+// Package jwt implements the small part of JSON Web Tokens that uberich needs:
+// creating and checking tokens signed with ES256, and publishing the public
+// keys as a JSON Web Key Set.
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const algorithm = "ES256"
+
+var (
+	ErrMalformed  = errors.New("jwt: malformed token")
+	ErrSignature  = errors.New("jwt: invalid signature")
+	ErrUnknownKey = errors.New("jwt: unknown key")
+	ErrIssuer     = errors.New("jwt: issued by someone else")
+	ErrAudience   = errors.New("jwt: issued to someone else")
+	ErrExpired    = errors.New("jwt: expired")
+)
+
+// Skew is how far clocks are allowed to disagree when checking times, so a
+// token is still accepted for this long after it expires.
+const Skew = 30 * time.Second
+
+// Claims are the contents of a token.
+type Claims struct {
+	Issuer        string `json:"iss,omitempty"`
+	Subject       string `json:"sub,omitempty"`
+	Audience      string `json:"aud,omitempty"`
+	Expiry        int64  `json:"exp,omitempty"`
+	IssuedAt      int64  `json:"iat,omitempty"`
+	ID            string `json:"jti,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	SessionID     string `json:"sid,omitempty"`
+
+	// Events is only used by logout tokens, see
+	// https://openid.net/specs/openid-connect-backchannel-1_0.html.
+	Events map[string]struct{} `json:"events,omitempty"`
+}
+
+// Validate checks that the claims were issued by issuer, to audience, and have
+// not expired at now.
+func (c Claims) Validate(issuer, audience string, now time.Time) error {
+	if c.Issuer != issuer {
+		return ErrIssuer
+	}
+	if c.Audience != audience {
+		return ErrAudience
+	}
+	if now.Add(-Skew).Unix() > c.Expiry || now.Add(Skew).Unix() < c.IssuedAt {
+		return ErrExpired
+	}
+	return nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Key is a private key used to sign tokens.
+type Key struct {
+	ID      string
+	private *ecdsa.PrivateKey
+}
+
+// GenerateKey creates a new random Key.
+func GenerateKey(id string) (*Key, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{ID: id, private: private}, nil
+}
+
+// ParseKey reads a Key from a P-256 private key given as a PKCS #8 document in
+// standard base64.
+func ParseKey(id, encoded string) (*Key, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := private.(*ecdsa.PrivateKey)
+	if !ok || ecdsaKey.Curve != elliptic.P256() {
+		return nil, errors.New("jwt: key must be for ECDSA using P-256")
+	}
+
+	return &Key{ID: id, private: ecdsaKey}, nil
+}
+
+// Encode returns the private key as a PKCS #8 document in standard base64, so
+// that it can be read by ParseKey.
+func (k *Key) Encode() (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// Public returns the public part of the Key.
+func (k *Key) Public() JWK {
+	size := (k.private.Curve.Params().BitSize + 7) / 8
+
+	return JWK{
+		KeyType:   "EC",
+		Curve:     "P-256",
+		X:         base64.RawURLEncoding.EncodeToString(k.private.X.FillBytes(make([]byte, size))),
+		Y:         base64.RawURLEncoding.EncodeToString(k.private.Y.FillBytes(make([]byte, size))),
+		KeyID:     k.ID,
+		Use:       "sig",
+		Algorithm: algorithm,
+	}
+}
+
+// Sign creates a token containing claims.
+func (k *Key) Sign(claims interface{}) (string, error) {
+	h, err := json.Marshal(header{Algorithm: algorithm, Type: "JWT", KeyID: k.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	size := (k.private.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// JWK is the public part of a Key in the format of RFC 7517.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+}
+
+func (k JWK) publicKey() (*ecdsa.PublicKey, error) {
+	if k.KeyType != "EC" || k.Curve != "P-256" {
+		return nil, ErrUnknownKey
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	public := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !public.Curve.IsOnCurve(public.X, public.Y) {
+		return nil, ErrUnknownKey
+	}
+
+	return public, nil
+}
+
+// KeySet is a JSON Web Key Set, the public keys that tokens may be signed with.
+type KeySet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Verify checks that token was signed by one of the keys in the set, and if so
+// reads its claims into v.
+func (s KeySet) Verify(token string, v interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformed
+	}
+
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrMalformed
+	}
+	var hdr header
+	if err := json.Unmarshal(h, &hdr); err != nil {
+		return ErrMalformed
+	}
+	if hdr.Algorithm != algorithm {
+		return ErrSignature
+	}
+
+	var public *ecdsa.PublicKey
+	for _, key := range s.Keys {
+		if key.KeyID == hdr.KeyID {
+			if public, err = key.publicKey(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if public == nil {
+		return ErrUnknownKey
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return ErrSignature
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	ss := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(public, digest[:], r, ss) {
+		return ErrSignature
+	}
+
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrMalformed
+	}
+
+	return json.Unmarshal(c, v)
+}
@@ -0,0 +1,62 @@
+// Package mail sends the emails uberich needs to send users, such as links to
+// reset their password.
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var errHeader = errors.New("mail: header contains a line break")
+
+// SMTP sends emails through a relay.
+type SMTP struct {
+	// Addr is the host:port of the relay.
+	Addr string
+
+	// Username and Password are used to authenticate with the relay, if given.
+	// The relay must then support STARTTLS, unless it is on localhost.
+	Username string
+	Password string
+
+	// From is the address emails are sent from.
+	From string
+}
+
+// Send sends a plain text email to the address given.
+func (s *SMTP) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject+s.From, "\r\n") {
+		return errHeader
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, message(s.From, to, subject, body, time.Now()))
+}
+
+// message formats an email, with the line endings SMTP expects.
+func message(from, to, subject, body string, now time.Time) []byte {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+
+	return []byte(b.String())
+}
@@ -0,0 +1,40 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/mail/mailtest"
+)
+
+func TestSMTPSend(t *testing.T) {
+	server, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	sender := &SMTP{Addr: server.Addr, From: "uberich@example.com"}
+
+	assert := assert.New(t)
+	assert.Nil(sender.Send("me@example.com", "Hello", "Line one\nLine two\n.hidden"))
+
+	select {
+	case msg := <-server.Messages:
+		assert.Equal("uberich@example.com", msg.From)
+		assert.Equal([]string{"me@example.com"}, msg.To)
+		assert.True(strings.Contains(msg.Data, "Subject: Hello\r\n"))
+		assert.True(strings.HasSuffix(msg.Data, "\r\n\r\nLine one\r\nLine two\r\n.hidden\r\n"))
+
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestSMTPSendWithLineBreakInHeader(t *testing.T) {
+	sender := &SMTP{Addr: "127.0.0.1:1", From: "uberich@example.com"}
+
+	assert.New(t).Equal(errHeader, sender.Send("me@example.com\r\nBcc: other@example.com", "Hello", "Hi"))
+}
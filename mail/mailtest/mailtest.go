@@ -0,0 +1,149 @@
+// Package mailtest provides an SMTP server that records the emails it is sent,
+// so that sending email can be tested without a real relay.
+package mailtest
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Message is an email received by the Server.
+type Message struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Server accepts any email sent to it, without authentication or TLS.
+type Server struct {
+	// Addr is the host:port the server is listening on.
+	Addr string
+
+	// Messages receives each email sent to the server.
+	Messages chan Message
+
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a Server listening on a local port. It must be closed once
+// finished with.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		Messages: make(chan Message, 16),
+		listener: listener,
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		reader = bufio.NewReader(conn)
+		msg    Message
+	)
+
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost mailtest")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+
+		case "MAIL":
+			msg = Message{From: address(line)}
+			reply("250 OK")
+
+		case "RCPT":
+			msg.To = append(msg.To, address(line))
+			reply("250 OK")
+
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+
+			msg.Data = data.String()
+			s.Messages <- msg
+			reply("250 OK")
+
+		case "RSET", "NOOP":
+			reply("250 OK")
+
+		case "QUIT":
+			reply("221 Bye")
+			return
+
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// address returns the address given in a MAIL FROM or RCPT TO command.
+func address(line string) string {
+	start := strings.IndexByte(line, '<')
+	end := strings.LastIndexByte(line, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+
+	return line[start+1 : end]
+}
@@ -0,0 +1,116 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prefixLength is the number of hex characters of a hash used to find the range
+// it is in, as in the k-anonymity model used by Pwned Passwords.
+const prefixLength = 5
+
+// Breached is a list of passwords that have appeared in breaches.
+type Breached interface {
+	Contains(password string) (bool, error)
+}
+
+// OpenBreached opens the list of SHA-1 hashes of breached passwords at path.
+//
+// If path is a file each line is a hash, optionally followed by ":" and a
+// count, and the whole list is loaded into memory. If path is a directory it
+// holds a range file for each hash prefix, named by the first five hex
+// characters and optionally ending ".txt", with each line giving the rest of a
+// hash; only the range for a password is read when checking it, so the full
+// Pwned Passwords list can be used.
+func OpenBreached(path string) (Breached, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return rangeDir(path), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := hashList{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash := hashOnLine(scanner.Text())
+		if len(hash) <= prefixLength {
+			continue
+		}
+
+		prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+		if list[prefix] == nil {
+			list[prefix] = map[string]struct{}{}
+		}
+		list[prefix][suffix] = struct{}{}
+	}
+
+	return list, scanner.Err()
+}
+
+// split returns the prefix and suffix of the password's hash.
+func split(password string) (prefix, suffix string) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	return hash[:prefixLength], hash[prefixLength:]
+}
+
+// hashOnLine returns the hash, or part of a hash, on a line of a list.
+func hashOnLine(line string) string {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+
+	return strings.ToUpper(strings.TrimSpace(line))
+}
+
+// hashList holds the suffixes of hashes by their prefix.
+type hashList map[string]map[string]struct{}
+
+func (l hashList) Contains(password string) (bool, error) {
+	prefix, suffix := split(password)
+	_, ok := l[prefix][suffix]
+
+	return ok, nil
+}
+
+// rangeDir is a directory of range files.
+type rangeDir string
+
+func (d rangeDir) Contains(password string) (bool, error) {
+	prefix, suffix := split(password)
+
+	file, err := os.Open(filepath.Join(string(d), prefix))
+	if os.IsNotExist(err) {
+		file, err = os.Open(filepath.Join(string(d), prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if hashOnLine(scanner.Text()) == suffix {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,93 @@
+// Package password decides which passwords users are allowed to choose.
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultMinLength is used when a policy does not set a minimum length.
+	DefaultMinLength = 8
+
+	// MaxLength is the most bytes of a password bcrypt will use, anything after
+	// is ignored so is not allowed.
+	MaxLength = 72
+)
+
+var (
+	ErrTooShort = errors.New("password is too short")
+	ErrTooLong  = errors.New("password is too long")
+	ErrIsEmail  = errors.New("password must not be your email address")
+	ErrBreached = errors.New("password has appeared in a data breach, choose another")
+)
+
+// Policy describes the passwords that are allowed.
+type Policy struct {
+	// MinLength is the fewest characters allowed, DefaultMinLength if zero.
+	MinLength int
+
+	// MaxLength is the most bytes allowed, MaxLength if zero or larger.
+	MaxLength int
+
+	// Breached, if set, is checked to make sure the password has not been seen
+	// in a breach.
+	Breached Breached
+}
+
+// Check returns an error, which can be shown to the user, if the user with
+// email may not choose password.
+func (p Policy) Check(email, password string) error {
+	minLength := p.MinLength
+	if minLength <= 0 {
+		minLength = DefaultMinLength
+	}
+
+	maxLength := p.MaxLength
+	if maxLength <= 0 || maxLength > MaxLength {
+		maxLength = MaxLength
+	}
+
+	if n := len([]rune(password)); n < minLength {
+		return fmt.Errorf("%w, it must be at least %d characters", ErrTooShort, minLength)
+	}
+	if len(password) > maxLength {
+		return fmt.Errorf("%w, it must be at most %d bytes", ErrTooLong, maxLength)
+	}
+
+	if isEmail(email, password) {
+		return ErrIsEmail
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return ErrBreached
+		}
+	}
+
+	return nil
+}
+
+// isEmail reports whether password is the email address, or the part of it
+// before the @.
+func isEmail(email, password string) bool {
+	if email == "" {
+		return false
+	}
+
+	password = strings.TrimSpace(password)
+	if strings.EqualFold(password, email) {
+		return true
+	}
+
+	if i := strings.LastIndexByte(email, '@'); i > 0 {
+		return strings.EqualFold(password, email[:i])
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+package password
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"hawx.me/code/assert"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	testCases := []struct {
+		policy   Policy
+		password string
+		err      error
+	}{
+		{Policy{}, "", ErrTooShort},
+		{Policy{}, "1234567", ErrTooShort},
+		{Policy{}, "ééééééé", ErrTooShort},
+		{Policy{}, "12345678", nil},
+		{Policy{MinLength: 12}, "12345678", ErrTooShort},
+		{Policy{}, strings.Repeat("a", 72), nil},
+		{Policy{}, strings.Repeat("a", 73), ErrTooLong},
+		{Policy{MaxLength: 100}, strings.Repeat("a", 73), ErrTooLong},
+		{Policy{MaxLength: 20}, strings.Repeat("a", 21), ErrTooLong},
+		{Policy{}, "someone@example.com", ErrIsEmail},
+		{Policy{}, "SomeOne@Example.com", ErrIsEmail},
+		{Policy{MinLength: 4}, "someone", ErrIsEmail},
+	}
+
+	for _, tc := range testCases {
+		err := tc.policy.Check("someone@example.com", tc.password)
+
+		if tc.err == nil {
+			assert.New(t).Nil(err)
+		} else {
+			assert.New(t).True(errors.Is(err, tc.err), tc.password)
+		}
+	}
+}
+
+const breachedList = `5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493
+7C4A8D09CA3762AF61E59520943DC26494F8941B:123
+`
+
+func TestBreachedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	ioutil.WriteFile(path, []byte(breachedList), 0600)
+
+	breached, err := OpenBreached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert := assert.New(t)
+
+	ok, err := breached.Contains("password")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = breached.Contains("123456")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = breached.Contains("a much better password")
+	assert.Nil(err)
+	assert.False(ok)
+
+	err = Policy{Breached: breached}.Check("someone@example.com", "password")
+	assert.Equal(ErrBreached, err)
+}
+
+func TestBreachedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "5BAA6"), []byte("1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "7C4A8.txt"), []byte("d09ca3762af61e59520943dc26494f8941b:123\n"), 0600)
+
+	breached, err := OpenBreached(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert := assert.New(t)
+
+	ok, err := breached.Contains("password")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = breached.Contains("123456")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = breached.Contains("a much better password")
+	assert.Nil(err)
+	assert.False(ok)
+}
+
+func TestOpenBreachedWhenMissing(t *testing.T) {
+	_, err := OpenBreached(filepath.Join(t.TempDir(), "missing"))
+	assert.New(t).True(os.IsNotExist(err))
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"hawx.me/code/uberich/config"
+)
+
+// The longest email, user agent and detail recorded, longer ones are cut short.
+// These come from requests, so would otherwise be as long as a client likes. No
+// email address can be longer than 254 bytes.
+const (
+	maxEmail     = 254
+	maxUserAgent = 512
+	maxDetail    = 1024
+)
+
+// truncate returns s cut to at most n bytes, without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// capped returns a copy of event with its fields cut to the longest recorded.
+func capped(event *Event) *Event {
+	copied := *event
+	copied.Email = truncate(copied.Email, maxEmail)
+	copied.UserAgent = truncate(copied.UserAgent, maxUserAgent)
+	copied.Detail = truncate(copied.Detail, maxDetail)
+	return &copied
+}
+
+// eventLog records events in the audit log at path, which is rotated as the
+// settings currently say. It is used by every Storage, so that events are kept
+// the same way whichever is chosen. An empty path records nothing.
+type eventLog struct {
+	conf *config.Config
+	path string
+
+	mu sync.Mutex
+}
+
+// log returns the audit log, with the rotation currently set.
+func (e *eventLog) log() auditLog {
+	maxSize, backups := e.conf.AuditLogRotation()
+
+	return auditLog{path: e.path, maxSize: maxSize, backups: backups}
+}
+
+func (e *eventLog) ListEvents(email string, since time.Time) ([]*Event, error) {
+	if e.path == "" {
+		return nil, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.log().list(email, since)
+}
+
+func (e *eventLog) AddEvent(event *Event) error {
+	if e.path == "" {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.log().add(event)
+}
+
+// auditLog is a file of events, one JSON object per line. Once it grows past
+// maxSize it is moved to path.1, the previous path.1 to path.2, and so on, with
+// only backups of them kept.
+type auditLog struct {
+	path    string
+	maxSize int64
+	backups int
+}
+
+func (l auditLog) backup(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// rotate moves the file, and its backups, along to make way for a new one.
+func (l auditLog) rotate() error {
+	if err := os.Remove(l.backup(l.backups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for n := l.backups - 1; n > 0; n-- {
+		if err := os.Rename(l.backup(n), l.backup(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if l.backups == 0 {
+		return os.Remove(l.path)
+	}
+	return os.Rename(l.path, l.backup(1))
+}
+
+func (l auditLog) add(event *Event) error {
+	line, err := json.Marshal(capped(event))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if info, err := os.Stat(l.path); err == nil && l.maxSize > 0 && info.Size()+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// list returns the events matching email and since, from the backups oldest
+// first and then the file.
+func (l auditLog) list(email string, since time.Time) ([]*Event, error) {
+	var events []*Event
+
+	for n := l.backups; n >= 0; n-- {
+		path := l.path
+		if n > 0 {
+			path = l.backup(n)
+		}
+
+		var err error
+		events, err = readEvents(path, email, since, events)
+		if err != nil {
+			return events, err
+		}
+	}
+
+	return events, nil
+}
+
+func readEvents(path, email string, since time.Time, events []*Event) ([]*Event, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return events, nil
+	}
+	if err != nil {
+		return events, err
+	}
+	defer file.Close()
+
+	// Lines are read whole, however long, and any that can't be read, such as one
+	// left half written, are skipped rather than hiding every event after it.
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return events, err
+		}
+
+		var event Event
+		if line = bytes.TrimSpace(line); len(line) > 0 && json.Unmarshal(line, &event) == nil {
+			if (email == "" || event.Email == email) && !event.Time.Before(since) {
+				events = append(events, &event)
+			}
+		}
+
+		if err == io.EOF {
+			return events, nil
+		}
+	}
+}
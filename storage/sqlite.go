@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"hawx.me/code/uberich/config"
+)
+
+// migrations are run in order to bring a database up to date, the number that
+// have been run is stored as the database's user_version. Once released a
+// migration must not be changed, add a new one instead.
+var migrations = []string{
+	`CREATE TABLE users (
+		email TEXT PRIMARY KEY,
+		hash  TEXT NOT NULL
+	);
+
+	CREATE TABLE apps (
+		name   TEXT PRIMARY KEY,
+		uri    TEXT NOT NULL,
+		secret TEXT NOT NULL
+	);
+
+	CREATE TABLE sessions (
+		id         TEXT PRIMARY KEY,
+		email      TEXT NOT NULL,
+		ip         TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_seen  INTEGER NOT NULL
+	);
+
+	CREATE INDEX sessions_email ON sessions (email);`,
+
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_step INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN require_two_factor INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '[]';`,
+
+	`ALTER TABLE users ADD COLUMN credentials TEXT NOT NULL DEFAULT '[]';`,
+
+	`ALTER TABLE users ADD COLUMN groups TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE apps ADD COLUMN allow_users TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE apps ADD COLUMN allow_groups TEXT NOT NULL DEFAULT '[]';`,
+
+	`ALTER TABLE apps ADD COLUMN redirect_uris TEXT NOT NULL DEFAULT '[]';`,
+
+	`ALTER TABLE apps ADD COLUMN front_channel_logout_uri TEXT NOT NULL DEFAULT '';
+	ALTER TABLE apps ADD COLUMN back_channel_logout_uri TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE sessions ADD COLUMN app TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE apps ADD COLUMN magic_links INTEGER NOT NULL DEFAULT 0;`,
+
+	`ALTER TABLE users ADD COLUMN invitation TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE users ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN locked_until INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN locked INTEGER NOT NULL DEFAULT 0;`,
+
+	`ALTER TABLE sessions ADD COLUMN parent TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE sessions ADD COLUMN method TEXT NOT NULL DEFAULT '';`,
+}
+
+type sqliteStorage struct {
+	*eventLog
+
+	db *sql.DB
+}
+
+// OpenSQLite returns a Storage that uses the SQLite database at path, creating
+// it and running any migrations that are required. Events are written to the
+// audit log at auditLog, as with NewTOML.
+func OpenSQLite(conf *config.Config, path, auditLog string) (Storage, error) {
+	// Transactions take the write lock as they begin, so that those that read
+	// then write, like UpdateLockout, wait for each other rather than fail.
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStorage{eventLog: &eventLog{conf: conf, path: auditLog}, db: db}, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("storage: migration %d: %v", version+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const userColumns = "email, hash, groups, totp_secret, totp_step, require_two_factor, recovery_codes, credentials, invitation"
+
+// lockoutColumns are read with the user, but only written by UpdateLockout.
+const lockoutColumns = "failed_attempts, locked_until, locked"
+
+func scanLockout(row scanner) (config.Lockout, error) {
+	var (
+		lockout     config.Lockout
+		lockedUntil int64
+	)
+
+	if err := row.Scan(&lockout.FailedAttempts, &lockedUntil, &lockout.Locked); err != nil {
+		return lockout, err
+	}
+
+	if lockedUntil != 0 {
+		lockout.LockedUntil = time.Unix(0, lockedUntil)
+	}
+
+	return lockout, nil
+}
+
+func scanUser(row scanner) (*config.User, error) {
+	var (
+		user                               config.User
+		groups, recoveryCodes, credentials string
+		lockedUntil                        int64
+	)
+
+	if err := row.Scan(&user.Email, &user.Hash, &groups, &user.TOTPSecret, &user.TOTPStep, &user.RequireTwoFactor, &recoveryCodes, &credentials, &user.Invitation,
+		&user.FailedAttempts, &lockedUntil, &user.Locked); err != nil {
+		return nil, err
+	}
+
+	if lockedUntil != 0 {
+		user.LockedUntil = time.Unix(0, lockedUntil)
+	}
+
+	if err := json.Unmarshal([]byte(groups), &user.Groups); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(recoveryCodes), &user.RecoveryCodes); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(credentials), &user.Credentials); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *sqliteStorage) ListUsers() ([]*config.User, error) {
+	rows, err := s.db.Query("SELECT " + userColumns + ", " + lockoutColumns + " FROM users ORDER BY email")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*config.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (s *sqliteStorage) GetUser(email string) (*config.User, error) {
+	user, err := scanUser(s.db.QueryRow("SELECT "+userColumns+", "+lockoutColumns+" FROM users WHERE email = ?", email))
+
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return user, err
+}
+
+// jsonList encodes a slice as JSON, using an empty list rather than null.
+func jsonList(v interface{}, n int) (string, error) {
+	if n == 0 {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (s *sqliteStorage) SetUser(user *config.User) error {
+	groups, err := jsonList(user.Groups, len(user.Groups))
+	if err != nil {
+		return err
+	}
+
+	recoveryCodes, err := jsonList(user.RecoveryCodes, len(user.RecoveryCodes))
+	if err != nil {
+		return err
+	}
+
+	credentials, err := jsonList(user.Credentials, len(user.Credentials))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (email) DO UPDATE SET
+			hash = excluded.hash,
+			groups = excluded.groups,
+			totp_secret = excluded.totp_secret,
+			totp_step = excluded.totp_step,
+			require_two_factor = excluded.require_two_factor,
+			recovery_codes = excluded.recovery_codes,
+			credentials = excluded.credentials,
+			invitation = excluded.invitation`,
+		user.Email, user.Hash, groups, user.TOTPSecret, user.TOTPStep, user.RequireTwoFactor, recoveryCodes, credentials, user.Invitation)
+
+	return err
+}
+
+func (s *sqliteStorage) RemoveUser(email string) error {
+	_, err := s.db.Exec("DELETE FROM users WHERE email = ?", email)
+	return err
+}
+
+// UpdateLockout runs the same statements whether or not there is a user with
+// email, so that the time taken doesn't reveal which emails have an account.
+func (s *sqliteStorage) UpdateLockout(email string, update func(*config.Lockout)) (config.Lockout, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return config.Lockout{}, err
+	}
+	defer tx.Rollback()
+
+	lockout, err := scanLockout(tx.QueryRow("SELECT "+lockoutColumns+" FROM users WHERE email = ?", email))
+	found := err != sql.ErrNoRows
+	if err != nil && found {
+		return lockout, err
+	}
+
+	update(&lockout)
+
+	var lockedUntil int64
+	if !lockout.LockedUntil.IsZero() {
+		lockedUntil = lockout.LockedUntil.UnixNano()
+	}
+
+	if _, err := tx.Exec("UPDATE users SET failed_attempts = ?, locked_until = ?, locked = ? WHERE email = ?",
+		lockout.FailedAttempts, lockedUntil, lockout.Locked, email); err != nil {
+		return lockout, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return lockout, err
+	}
+
+	if !found {
+		return config.Lockout{}, ErrNotFound
+	}
+	return lockout, nil
+}
+
+const appColumns = "name, uri, secret, allow_users, allow_groups, redirect_uris, front_channel_logout_uri, back_channel_logout_uri, magic_links"
+
+func scanApp(row scanner) (*config.App, error) {
+	var (
+		app                                   config.App
+		allowUsers, allowGroups, redirectURIs string
+	)
+
+	if err := row.Scan(&app.Name, &app.URI, &app.Secret, &allowUsers, &allowGroups, &redirectURIs,
+		&app.FrontChannelLogoutURI, &app.BackChannelLogoutURI, &app.MagicLinks); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(allowUsers), &app.AllowUsers); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(allowGroups), &app.AllowGroups); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(redirectURIs), &app.RedirectURIs); err != nil {
+		return nil, err
+	}
+
+	return &app, nil
+}
+
+func (s *sqliteStorage) ListApps() ([]*config.App, error) {
+	rows, err := s.db.Query("SELECT " + appColumns + " FROM apps ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apps []*config.App
+	for rows.Next() {
+		app, err := scanApp(rows)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
+
+	return apps, rows.Err()
+}
+
+func (s *sqliteStorage) GetApp(name string) (*config.App, error) {
+	app, err := scanApp(s.db.QueryRow("SELECT "+appColumns+" FROM apps WHERE name = ?", name))
+
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return app, err
+}
+
+func (s *sqliteStorage) SetApp(app *config.App) error {
+	allowUsers, err := jsonList(app.AllowUsers, len(app.AllowUsers))
+	if err != nil {
+		return err
+	}
+
+	allowGroups, err := jsonList(app.AllowGroups, len(app.AllowGroups))
+	if err != nil {
+		return err
+	}
+
+	redirectURIs, err := jsonList(app.RedirectURIs, len(app.RedirectURIs))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO apps (`+appColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			uri = excluded.uri,
+			secret = excluded.secret,
+			allow_users = excluded.allow_users,
+			allow_groups = excluded.allow_groups,
+			redirect_uris = excluded.redirect_uris,
+			front_channel_logout_uri = excluded.front_channel_logout_uri,
+			back_channel_logout_uri = excluded.back_channel_logout_uri,
+			magic_links = excluded.magic_links`,
+		app.Name, app.URI, app.Secret, allowUsers, allowGroups, redirectURIs,
+		app.FrontChannelLogoutURI, app.BackChannelLogoutURI, app.MagicLinks)
+
+	return err
+}
+
+func (s *sqliteStorage) RemoveApp(name string) error {
+	_, err := s.db.Exec("DELETE FROM apps WHERE name = ?", name)
+	return err
+}
+
+const sessionColumns = "id, email, ip, user_agent, created_at, last_seen, app, parent, method"
+
+func scanSession(row scanner) (*config.Session, error) {
+	var (
+		session             config.Session
+		createdAt, lastSeen int64
+	)
+
+	if err := row.Scan(&session.ID, &session.Email, &session.IP, &session.UserAgent, &createdAt, &lastSeen, &session.App, &session.Parent, &session.Method); err != nil {
+		return nil, err
+	}
+
+	session.CreatedAt = time.Unix(0, createdAt)
+	session.LastSeen = time.Unix(0, lastSeen)
+	return &session, nil
+}
+
+func (s *sqliteStorage) ListSessions(email string) ([]*config.Session, error) {
+	rows, err := s.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE ? = '' OR email = ? ORDER BY created_at",
+		email, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*config.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (s *sqliteStorage) GetSession(id string) (*config.Session, error) {
+	session, err := scanSession(s.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *sqliteStorage) SetSession(session *config.Session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			email = excluded.email,
+			ip = excluded.ip,
+			user_agent = excluded.user_agent,
+			created_at = excluded.created_at,
+			last_seen = excluded.last_seen,
+			app = excluded.app,
+			parent = excluded.parent,
+			method = excluded.method`,
+		session.ID, session.Email, session.IP, session.UserAgent,
+		session.CreatedAt.UnixNano(), session.LastSeen.UnixNano(), session.App, session.Parent, session.Method)
+
+	return err
+}
+
+func (s *sqliteStorage) TouchSession(id, ip string, lastSeen time.Time) error {
+	_, err := s.db.Exec("UPDATE sessions SET ip = ?, last_seen = ? WHERE id = ?", ip, lastSeen.UnixNano(), id)
+	return err
+}
+
+func (s *sqliteStorage) RemoveSession(id string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"hawx.me/code/uberich/config"
+)
+
+// stateDelay is how long a change to the state waits before being written, so
+// that changes made close together are written at once.
+const stateDelay = 5 * time.Second
+
+// state is what the TOML storage keeps outside of the settings file.
+type state struct {
+	Sessions []*config.Session         `json:"sessions,omitempty"`
+	Lockouts map[string]config.Lockout `json:"lockouts,omitempty"`
+}
+
+func (s *state) getSession(id string) *config.Session {
+	for _, session := range s.Sessions {
+		if session.ID == id {
+			return session
+		}
+	}
+	return nil
+}
+
+func (s *state) removeSession(id string) {
+	for i, session := range s.Sessions {
+		if session.ID == id {
+			s.Sessions = append(s.Sessions[:i], s.Sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// stateFile keeps the state in a JSON file. The state changes on most requests
+// and matters little if lost, so unlike the settings file it is not backed up
+// and changes are written after stateDelay, rather than straight away.
+//
+// The file can also be changed by uberich-admin, so it is checked before each
+// use and, if changed, read again with the changes not yet written reapplied.
+// An empty path keeps the state in memory only.
+type stateFile struct {
+	path string
+
+	mu    sync.Mutex
+	state state
+
+	// loaded is the file as last read or written. Every write replaces the file,
+	// so a change is seen even if its time and size are the same.
+	loaded os.FileInfo
+
+	// pending are the changes not yet written, timer writes them, and err is the
+	// error from the last write which is returned by the next change.
+	pending []func(*state)
+	timer   *time.Timer
+	err     error
+}
+
+func openState(path string) (*stateFile, error) {
+	f := &stateFile{path: path}
+	if path == "" {
+		return f, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f, f.refresh()
+}
+
+// refresh reads the file again if it has been changed by something else. It
+// must be called with mu held.
+func (f *stateFile) refresh() error {
+	if f.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if f.loaded != nil && os.SameFile(info, f.loaded) && info.ModTime().Equal(f.loaded.ModTime()) && info.Size() == f.loaded.Size() {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var fresh state
+	if err := json.Unmarshal(data, &fresh); err != nil {
+		return err
+	}
+	for _, change := range f.pending {
+		change(&fresh)
+	}
+
+	f.state = fresh
+	f.loaded = info
+	return nil
+}
+
+// read calls view with the current state, which must not be kept or changed.
+func (f *stateFile) read(view func(*state)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.refresh(); err != nil {
+		return err
+	}
+
+	view(&f.state)
+	return nil
+}
+
+// change applies change to the state, and arranges for it to be written. The
+// change may be applied again to the file as read, if something else has
+// written to it, so must not depend on anything but the state it is given.
+func (f *stateFile) change(change func(*state)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.refresh(); err != nil {
+		return err
+	}
+
+	change(&f.state)
+
+	if f.path == "" {
+		return nil
+	}
+
+	f.pending = append(f.pending, change)
+	if f.timer == nil {
+		f.timer = time.AfterFunc(stateDelay, func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			f.err = f.write()
+		})
+	}
+
+	err := f.err
+	f.err = nil
+	return err
+}
+
+// write saves the state to the file, if there are changes to write. It must be
+// called with mu held.
+func (f *stateFile) write() error {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+
+	if len(f.pending) == 0 {
+		return nil
+	}
+
+	if err := f.refresh(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.pending = nil
+	f.loaded = info
+	return nil
+}
+
+// Close writes any changes that are waiting.
+func (f *stateFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.write(); err != nil {
+		return err
+	}
+
+	err := f.err
+	f.err = nil
+	return err
+}
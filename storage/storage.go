@@ -0,0 +1,123 @@
+// Package storage defines where uberich keeps its users, apps, sessions and
+// audit events.
+//
+// Two implementations are provided: one keeps users and apps in the settings
+// file, which was the only option originally, with sessions in a file beside
+// it, the other uses an SQLite database. The one to use is chosen by the
+// "storage" setting. Either way audit events are written to a log file.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"hawx.me/code/uberich/config"
+)
+
+// ErrNotFound is returned when looking up something that does not exist.
+var ErrNotFound = errors.New("storage: not found")
+
+// Event is something that happened that should be recorded for later auditing.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Email     string    `json:"email,omitempty"`
+	App       string    `json:"app,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// The types of Event that are recorded.
+const (
+	// EventLogin is a user signing in, Detail says how.
+	EventLogin = "login"
+	// EventLoginFailed is a password being refused, Detail says why.
+	EventLoginFailed = "login-failed"
+	// EventSecondFactorFailed is a second factor being refused, Detail says why.
+	EventSecondFactorFailed = "second-factor-failed"
+	// EventLockedOut is a user being locked out after too many failed attempts.
+	EventLockedOut = "locked-out"
+	// EventAssertion is a signed assertion, or ID token, being issued to App.
+	EventAssertion = "assertion"
+	// EventLogout is a user signing out.
+	EventLogout = "logout"
+	// EventPasswordChanged is a user changing their password.
+	EventPasswordChanged = "password-changed"
+	// EventPasswordReset is a user resetting their password by emailed link.
+	EventPasswordReset = "password-reset"
+	// EventRegistered is an invited user choosing their password.
+	EventRegistered = "registered"
+	// EventSessionRevoked is a user revoking one of their sessions, Detail is its
+	// ID.
+	EventSessionRevoked = "session-revoked"
+	// EventAdmin is a change made with uberich-admin, Detail is the command.
+	EventAdmin = "admin"
+)
+
+type Storage interface {
+	ListUsers() ([]*config.User, error)
+	GetUser(email string) (*config.User, error)
+	SetUser(user *config.User) error
+	RemoveUser(email string) error
+
+	// UpdateLockout applies update to the lockout of the user with email, and
+	// returns it as changed. Nothing else about the user is changed, and attempts
+	// made at once are each counted as the change is made in one step.
+	UpdateLockout(email string, update func(*config.Lockout)) (config.Lockout, error)
+
+	ListApps() ([]*config.App, error)
+	GetApp(name string) (*config.App, error)
+	SetApp(app *config.App) error
+	RemoveApp(name string) error
+
+	// ListSessions returns the sessions for the user with email, or all sessions
+	// if email is empty.
+	ListSessions(email string) ([]*config.Session, error)
+	GetSession(id string) (*config.Session, error)
+	SetSession(session *config.Session) error
+	RemoveSession(id string) error
+
+	// TouchSession records that the session with id was last seen at lastSeen
+	// from ip. Unlike SetSession it only changes a session that exists, so a
+	// session removed in the meantime stays removed.
+	TouchSession(id, ip string, lastSeen time.Time) error
+
+	// ListEvents returns the events recorded since the time given, only for the
+	// user with email if it is not empty. They are ordered oldest first.
+	ListEvents(email string, since time.Time) ([]*Event, error)
+	AddEvent(event *Event) error
+
+	Close() error
+}
+
+// Open returns the Storage selected by the settings.
+func Open(conf *config.Config) (Storage, error) {
+	auditLog := conf.AuditLog
+	if auditLog == "" {
+		auditLog = filepath.Join(filepath.Dir(conf.Path()), "audit.log")
+	}
+
+	switch conf.Storage {
+	case "", "toml":
+		state := conf.State
+		if state == "" {
+			state = filepath.Join(filepath.Dir(conf.Path()), "state.json")
+		}
+
+		return OpenTOML(conf, state, auditLog)
+
+	case "sqlite":
+		if conf.Database == "" {
+			return nil, errors.New("storage: database must be set to use sqlite")
+		}
+
+		return OpenSQLite(conf, conf.Database, auditLog)
+
+	default:
+		return nil, fmt.Errorf("storage: unknown type %q", conf.Storage)
+	}
+}
@@ -0,0 +1,499 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/config"
+)
+
+func testStorages(t *testing.T, f func(t *testing.T, db Storage)) {
+	for _, typ := range []string{"toml", "sqlite"} {
+		t.Run(typ, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "settings.toml")
+			settings := fmt.Sprintf("storage = %q\ndatabase = %q\n", typ, filepath.Join(dir, "uberich.db"))
+			ioutil.WriteFile(path, []byte(settings), 0600)
+
+			conf, err := config.Read(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := Open(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			f(t, db)
+		})
+	}
+}
+
+func TestUsers(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		_, err := db.GetUser("a@example.com")
+		assert.Equal(ErrNotFound, err)
+
+		assert.Nil(db.SetUser(&config.User{Email: "a@example.com", Hash: "1"}))
+		assert.Nil(db.SetUser(&config.User{Email: "b@example.com", Hash: "2"}))
+		assert.Nil(db.SetUser(&config.User{Email: "a@example.com", Hash: "3"}))
+		assert.Nil(db.SetUser(&config.User{Email: "c@example.com", Invitation: "xyz"}))
+
+		user, err := db.GetUser("a@example.com")
+		assert.Nil(err)
+		assert.Equal("3", user.Hash)
+		assert.False(user.IsPending())
+
+		user, err = db.GetUser("c@example.com")
+		assert.Nil(err)
+		assert.Equal("xyz", user.Invitation)
+		assert.True(user.IsPending())
+
+		users, err := db.ListUsers()
+		assert.Nil(err)
+		assert.Len(users, 3)
+
+		assert.Nil(db.RemoveUser("a@example.com"))
+		_, err = db.GetUser("a@example.com")
+		assert.Equal(ErrNotFound, err)
+	})
+}
+
+func TestUserLockout(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		_, err := db.UpdateLockout("a@example.com", func(lockout *config.Lockout) { lockout.FailedAttempts++ })
+		assert.Equal(ErrNotFound, err)
+
+		assert.Nil(db.SetUser(&config.User{Email: "a@example.com"}))
+		assert.Nil(db.SetUser(&config.User{Email: "b@example.com"}))
+
+		lockout, err := db.UpdateLockout("a@example.com", func(lockout *config.Lockout) {
+			lockout.FailedAttempts = 6
+			lockout.LockedUntil = now
+		})
+		assert.Nil(err)
+		assert.Equal(6, lockout.FailedAttempts)
+
+		_, err = db.UpdateLockout("b@example.com", func(lockout *config.Lockout) {
+			lockout.FailedAttempts = 20
+			lockout.Locked = true
+		})
+		assert.Nil(err)
+
+		user, err := db.GetUser("a@example.com")
+		assert.Nil(err)
+		assert.Equal(6, user.FailedAttempts)
+		assert.True(user.LockedUntil.Equal(now))
+		assert.True(user.IsLocked(now.Add(-time.Second)))
+		assert.False(user.IsLocked(now))
+
+		// Saving a user read before the lockout changed leaves it as it is.
+		stale := &config.User{Email: "b@example.com", Hash: "1"}
+		assert.Nil(db.SetUser(stale))
+
+		user, err = db.GetUser("b@example.com")
+		assert.Nil(err)
+		assert.Equal("1", user.Hash)
+		assert.Equal(20, user.FailedAttempts)
+		assert.True(user.LockedUntil.IsZero())
+		assert.True(user.IsLocked(now))
+
+		lockout, err = db.UpdateLockout("b@example.com", (*config.Lockout).Unlock)
+		assert.Nil(err)
+		assert.False(lockout.IsLocked(now))
+
+		user, err = db.GetUser("b@example.com")
+		assert.Nil(err)
+		assert.Equal(0, user.FailedAttempts)
+		assert.False(user.IsLocked(now))
+
+		users, err := db.ListUsers()
+		assert.Nil(err)
+		if assert.Len(users, 2) {
+			assert.Equal(6, users[0].FailedAttempts)
+		}
+	})
+}
+
+func TestUserLockoutCountsEachAttempt(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		assert.Nil(db.SetUser(&config.User{Email: "a@example.com"}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				db.UpdateLockout("a@example.com", func(lockout *config.Lockout) { lockout.FailedAttempts++ })
+			}()
+		}
+		wg.Wait()
+
+		user, err := db.GetUser("a@example.com")
+		assert.Nil(err)
+		assert.Equal(10, user.FailedAttempts)
+	})
+}
+
+func TestUserTwoFactor(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		assert.Nil(db.SetUser(&config.User{
+			Email:            "a@example.com",
+			TOTPSecret:       "ABC",
+			TOTPStep:         5,
+			RequireTwoFactor: true,
+			RecoveryCodes:    []string{"x", "y"},
+		}))
+
+		user, err := db.GetUser("a@example.com")
+		assert.Nil(err)
+		assert.Equal("ABC", user.TOTPSecret)
+		assert.Equal(int64(5), user.TOTPStep)
+		assert.True(user.RequireTwoFactor)
+		assert.Equal([]string{"x", "y"}, user.RecoveryCodes)
+
+		user.ResetTwoFactor()
+		assert.Nil(db.SetUser(user))
+
+		user, err = db.GetUser("a@example.com")
+		assert.Nil(err)
+		assert.False(user.HasTwoFactor())
+		assert.Len(user.RecoveryCodes, 0)
+	})
+}
+
+func TestUserCredentials(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		now := time.Now().Truncate(time.Second)
+
+		user := &config.User{Email: "a@example.com"}
+		user.SetCredential(config.Credential{ID: "1", Name: "phone", PublicKey: "key", CreatedAt: now})
+		user.SetCredential(config.Credential{ID: "2", Name: "laptop", PublicKey: "key"})
+		user.SetCredential(config.Credential{ID: "1", Name: "phone", PublicKey: "key", SignCount: 3, CreatedAt: now})
+		assert.Nil(db.SetUser(user))
+
+		user, err := db.GetUser("a@example.com")
+		assert.Nil(err)
+		assert.Len(user.Credentials, 2)
+
+		credential, ok := user.GetCredential("1")
+		assert.True(ok)
+		assert.Equal(uint32(3), credential.SignCount)
+		assert.True(now.Equal(credential.CreatedAt))
+
+		user.RemoveCredential("2")
+		assert.Nil(db.SetUser(user))
+
+		user, _ = db.GetUser("a@example.com")
+		assert.Len(user.Credentials, 1)
+	})
+}
+
+func TestApps(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		_, err := db.GetApp("test")
+		assert.Equal(ErrNotFound, err)
+
+		assert.Nil(db.SetApp(&config.App{Name: "test", URI: "http://a", Secret: "s"}))
+		assert.Nil(db.SetApp(&config.App{Name: "test", URI: "http://b", Secret: "t"}))
+
+		app, err := db.GetApp("test")
+		assert.Nil(err)
+		assert.Equal("http://b", app.URI)
+		assert.Equal("t", app.Secret)
+
+		apps, err := db.ListApps()
+		assert.Nil(err)
+		assert.Len(apps, 1)
+
+		assert.Nil(db.RemoveApp("test"))
+		_, err = db.GetApp("test")
+		assert.Equal(ErrNotFound, err)
+	})
+}
+
+func TestAccess(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		user := &config.User{Email: "a@example.com"}
+		user.AddGroup("admins")
+		assert.Nil(db.SetUser(user))
+
+		app := &config.App{Name: "test"}
+		app.AllowUser("b@example.com")
+		app.AllowGroup("admins")
+		assert.Nil(db.SetApp(app))
+
+		user, err := db.GetUser("a@example.com")
+		assert.Nil(err)
+		assert.Equal([]string{"admins"}, user.Groups)
+
+		app, err = db.GetApp("test")
+		assert.Nil(err)
+		assert.Equal([]string{"b@example.com"}, app.AllowUsers)
+		assert.Equal([]string{"admins"}, app.AllowGroups)
+		assert.True(app.Allows(*user))
+	})
+}
+
+func TestAppURIs(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		app := &config.App{
+			Name:                  "test",
+			URI:                   "https://app.example.com",
+			FrontChannelLogoutURI: "https://app.example.com/logout",
+			BackChannelLogoutURI:  "https://app.example.com/backchannel",
+			MagicLinks:            true,
+		}
+		app.AddRedirectURI("https://app.example.com/callback")
+		assert.Nil(db.SetApp(app))
+
+		app, err := db.GetApp("test")
+		assert.Nil(err)
+		assert.Equal([]string{"https://app.example.com/callback"}, app.RedirectURIs)
+		assert.Equal("https://app.example.com/logout", app.FrontChannelLogoutURI)
+		assert.Equal("https://app.example.com/backchannel", app.BackChannelLogoutURI)
+		assert.True(app.MagicLinks)
+		assert.True(app.CanRedirectTo("https://app.example.com/callback"))
+		assert.False(app.CanRedirectTo("https://app.example.com/other"))
+	})
+}
+
+func TestSessions(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		now := time.Now().Truncate(time.Second)
+
+		assert.Nil(db.SetSession(&config.Session{ID: "1", Email: "a@example.com", IP: "127.0.0.1", CreatedAt: now, LastSeen: now}))
+		assert.Nil(db.SetSession(&config.Session{ID: "2", Email: "b@example.com", CreatedAt: now, LastSeen: now, App: "test", Parent: "abc"}))
+		assert.Nil(db.SetSession(&config.Session{ID: "3", Email: "a@example.com", CreatedAt: now, LastSeen: now}))
+
+		session, err := db.GetSession("1")
+		assert.Nil(err)
+		assert.Equal("a@example.com", session.Email)
+		assert.Equal("127.0.0.1", session.IP)
+		assert.True(now.Equal(session.CreatedAt))
+
+		session, err = db.GetSession("2")
+		assert.Nil(err)
+		assert.Equal("test", session.App)
+		assert.Equal("abc", session.Parent)
+
+		sessions, err := db.ListSessions("a@example.com")
+		assert.Nil(err)
+		assert.Len(sessions, 2)
+
+		sessions, err = db.ListSessions("")
+		assert.Nil(err)
+		assert.Len(sessions, 3)
+
+		assert.Nil(db.TouchSession("3", "192.0.2.1", now.Add(time.Hour)))
+		session, err = db.GetSession("3")
+		assert.Nil(err)
+		assert.Equal("192.0.2.1", session.IP)
+		assert.True(now.Add(time.Hour).Equal(session.LastSeen))
+
+		assert.Nil(db.RemoveSession("1"))
+		_, err = db.GetSession("1")
+		assert.Equal(ErrNotFound, err)
+
+		// Touching a session that has been removed doesn't bring it back.
+		assert.Nil(db.TouchSession("1", "192.0.2.1", now.Add(time.Hour)))
+		_, err = db.GetSession("1")
+		assert.Equal(ErrNotFound, err)
+	})
+}
+
+func TestSessionsKeptInStateFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.toml")
+	ioutil.WriteFile(path, []byte{}, 0600)
+
+	conf, _ := config.Read(path)
+	state := filepath.Join(dir, "state.json")
+
+	assert := assert.New(t)
+
+	server, err := OpenTOML(conf, state, "")
+	assert.Nil(err)
+
+	now := time.Now().Truncate(time.Second)
+	assert.Nil(server.SetSession(&config.Session{ID: "1", Email: "a@example.com", CreatedAt: now, LastSeen: now}))
+	assert.Nil(server.SetSession(&config.Session{ID: "2", Email: "a@example.com", CreatedAt: now, LastSeen: now}))
+	assert.Nil(server.SetUser(&config.User{Email: "a@example.com"}))
+
+	// changes are written later, or when closed
+	_, err = os.Stat(state)
+	assert.True(os.IsNotExist(err))
+
+	assert.Nil(server.Close())
+	settings, _ := ioutil.ReadFile(path)
+	assert.False(strings.Contains(string(settings), "session"))
+
+	server, err = OpenTOML(conf, state, "")
+	assert.Nil(err)
+	sessions, err := server.ListSessions("a@example.com")
+	assert.Nil(err)
+	assert.Len(sessions, 2)
+
+	// a session revoked by something else is not brought back by a change
+	// waiting to be written
+	session, _ := server.GetSession("1")
+	session.LastSeen = now.Add(time.Minute)
+	assert.Nil(server.SetSession(session))
+	assert.Nil(server.SetSession(&config.Session{ID: "3", Email: "a@example.com", CreatedAt: now, LastSeen: now}))
+
+	admin, err := OpenTOML(conf, state, "")
+	assert.Nil(err)
+	assert.Nil(admin.RemoveSession("1"))
+	assert.Nil(admin.Close())
+
+	_, err = server.GetSession("1")
+	assert.Equal(ErrNotFound, err)
+	assert.Nil(server.Close())
+
+	server, _ = OpenTOML(conf, state, "")
+	sessions, _ = server.ListSessions("")
+	if assert.Len(sessions, 2) {
+		assert.Equal("2", sessions[0].ID)
+		assert.Equal("3", sessions[1].ID)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	testStorages(t, func(t *testing.T, db Storage) {
+		assert := assert.New(t)
+
+		now := time.Now()
+
+		assert.Nil(db.AddEvent(&Event{Time: now.Add(-time.Hour), Type: "login", Email: "a@example.com"}))
+		assert.Nil(db.AddEvent(&Event{Time: now, Type: "login", Email: "b@example.com"}))
+		assert.Nil(db.AddEvent(&Event{Time: now, Type: "logout", Email: "a@example.com", App: "test", RequestID: "abc"}))
+
+		events, err := db.ListEvents("a@example.com", time.Time{})
+		assert.Nil(err)
+		if assert.Len(events, 2) {
+			assert.Equal("login", events[0].Type)
+			assert.Equal("logout", events[1].Type)
+			assert.Equal("test", events[1].App)
+			assert.Equal("abc", events[1].RequestID)
+		}
+
+		events, err = db.ListEvents("", now.Add(-time.Minute))
+		assert.Nil(err)
+		assert.Len(events, 2)
+	})
+}
+
+func TestSQLiteEventsWrittenToAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.toml")
+	settings := fmt.Sprintf("storage = \"sqlite\"\ndatabase = %q\nauditLogBackups = 1\n", filepath.Join(dir, "uberich.db"))
+	ioutil.WriteFile(path, []byte(settings), 0600)
+
+	conf, err := config.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	assert := assert.New(t)
+
+	assert.Nil(db.AddEvent(&Event{Time: time.Now(), Type: "login", Email: "a@example.com"}))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	assert.Nil(err)
+	assert.True(strings.Contains(string(data), `"email":"a@example.com"`))
+}
+
+func TestAuditLogRotates(t *testing.T) {
+	dir := t.TempDir()
+	log := auditLog{path: filepath.Join(dir, "audit.log"), maxSize: 200, backups: 2}
+
+	assert := assert.New(t)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		assert.Nil(log.add(&Event{Time: start.Add(time.Duration(i) * time.Minute), Type: "login", Email: "a@example.com"}))
+	}
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if assert.Nil(err, name) {
+			assert.True(info.Size() <= 200, name)
+		}
+	}
+	_, err := os.Stat(filepath.Join(dir, "audit.log.3"))
+	assert.True(os.IsNotExist(err))
+
+	// The oldest events have been dropped, the rest are listed in order.
+	events, err := log.list("", time.Time{})
+	assert.Nil(err)
+	assert.True(len(events) > 0 && len(events) < 20)
+	for i := 1; i < len(events); i++ {
+		assert.True(events[i-1].Time.Before(events[i].Time))
+	}
+	assert.True(events[len(events)-1].Time.Equal(start.Add(19 * time.Minute)))
+}
+
+func TestAuditLogLongAndBrokenLines(t *testing.T) {
+	dir := t.TempDir()
+	log := auditLog{path: filepath.Join(dir, "audit.log")}
+
+	assert := assert.New(t)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Nil(log.add(&Event{Time: now, Type: "login", Email: strings.Repeat("c", 70000) + "@example.com", UserAgent: strings.Repeat("a", 70000), Detail: strings.Repeat("é", 1000)}))
+
+	// A line too long to have been written now, and one left half written.
+	file, _ := os.OpenFile(log.path, os.O_APPEND|os.O_WRONLY, 0600)
+	file.WriteString(`{"time":"2020-01-01T00:01:00Z","type":"login","userAgent":"` + strings.Repeat("b", 70000) + "\"}\n")
+	file.WriteString(`{"time":"2020-01-01T00:02:00Z","ty` + "\n")
+	file.Close()
+
+	assert.Nil(log.add(&Event{Time: now.Add(3 * time.Minute), Type: "logout"}))
+
+	events, err := log.list("", time.Time{})
+	assert.Nil(err)
+	if assert.Len(events, 3) {
+		assert.Equal(maxEmail, len(events[0].Email))
+		assert.Equal(maxUserAgent, len(events[0].UserAgent))
+		assert.True(len(events[0].Detail) <= maxDetail)
+		assert.True(strings.HasSuffix(events[0].Detail, "é"))
+		assert.Equal(70000, len(events[1].UserAgent))
+		assert.Equal("logout", events[2].Type)
+	}
+}
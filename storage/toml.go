@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"time"
+
+	"hawx.me/code/uberich/config"
+)
+
+type tomlStorage struct {
+	*eventLog
+
+	conf  *config.Config
+	state *stateFile
+}
+
+// NewTOML returns a Storage that keeps users and apps in the settings file,
+// saving it after each change, and sessions and lockouts in memory. Events are
+// appended as JSON to the file at auditLog, which is rotated as the settings
+// say, or not recorded if it is empty.
+func NewTOML(conf *config.Config, auditLog string) Storage {
+	state, _ := openState("")
+
+	return &tomlStorage{eventLog: &eventLog{conf: conf, path: auditLog}, conf: conf, state: state}
+}
+
+// OpenTOML is like NewTOML, but keeps sessions and lockouts in the file at
+// state so that they last between restarts.
+func OpenTOML(conf *config.Config, state, auditLog string) (Storage, error) {
+	file, err := openState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tomlStorage{eventLog: &eventLog{conf: conf, path: auditLog}, conf: conf, state: file}, nil
+}
+
+func (s *tomlStorage) ListUsers() ([]*config.User, error) {
+	users := s.conf.ListUsers()
+
+	err := s.state.read(func(state *state) {
+		for _, user := range users {
+			user.Lockout = state.Lockouts[user.Email]
+		}
+	})
+
+	return users, err
+}
+
+func (s *tomlStorage) GetUser(email string) (*config.User, error) {
+	user := s.conf.GetUser(email)
+	if user == nil {
+		return nil, ErrNotFound
+	}
+
+	err := s.state.read(func(state *state) {
+		user.Lockout = state.Lockouts[email]
+	})
+
+	return user, err
+}
+
+func (s *tomlStorage) SetUser(user *config.User) error {
+	copied := *user
+	copied.Lockout = config.Lockout{}
+
+	s.conf.SetUser(&copied)
+	return s.conf.Save()
+}
+
+func (s *tomlStorage) RemoveUser(email string) error {
+	s.conf.RemoveUser(email)
+	if err := s.conf.Save(); err != nil {
+		return err
+	}
+
+	return s.state.change(func(state *state) { delete(state.Lockouts, email) })
+}
+
+func (s *tomlStorage) UpdateLockout(email string, update func(*config.Lockout)) (config.Lockout, error) {
+	if s.conf.GetUser(email) == nil {
+		return config.Lockout{}, ErrNotFound
+	}
+
+	var (
+		updated config.Lockout
+		applied bool
+	)
+
+	err := s.state.change(func(state *state) {
+		lockout := state.Lockouts[email]
+		update(&lockout)
+
+		if lockout == (config.Lockout{}) {
+			delete(state.Lockouts, email)
+		} else {
+			if state.Lockouts == nil {
+				state.Lockouts = map[string]config.Lockout{}
+			}
+			state.Lockouts[email] = lockout
+		}
+
+		// The change is applied again if the file is read again, but what is
+		// returned is the lockout as it was changed now.
+		if !applied {
+			updated = lockout
+			applied = true
+		}
+	})
+
+	return updated, err
+}
+
+func (s *tomlStorage) ListApps() ([]*config.App, error) {
+	return s.conf.ListApps(), nil
+}
+
+func (s *tomlStorage) GetApp(name string) (*config.App, error) {
+	if app := s.conf.GetApp(name); app != nil {
+		return app, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *tomlStorage) SetApp(app *config.App) error {
+	s.conf.SetApp(app)
+	return s.conf.Save()
+}
+
+func (s *tomlStorage) RemoveApp(name string) error {
+	s.conf.RemoveApp(name)
+	return s.conf.Save()
+}
+
+func (s *tomlStorage) ListSessions(email string) ([]*config.Session, error) {
+	var sessions []*config.Session
+
+	err := s.state.read(func(state *state) {
+		for _, session := range state.Sessions {
+			if email == "" || session.Email == email {
+				copied := *session
+				sessions = append(sessions, &copied)
+			}
+		}
+	})
+
+	return sessions, err
+}
+
+func (s *tomlStorage) GetSession(id string) (*config.Session, error) {
+	var found *config.Session
+
+	err := s.state.read(func(state *state) {
+		if session := state.getSession(id); session != nil {
+			copied := *session
+			found = &copied
+		}
+	})
+
+	if err == nil && found == nil {
+		return nil, ErrNotFound
+	}
+	return found, err
+}
+
+func (s *tomlStorage) SetSession(session *config.Session) error {
+	copied := *session
+	var existed bool
+
+	return s.state.change(func(state *state) {
+		session := copied
+
+		if existing := state.getSession(session.ID); existing != nil {
+			existed = true
+			*existing = session
+		} else if !existed {
+			state.Sessions = append(state.Sessions, &session)
+		}
+
+		// A session that existed, but has since been removed by something else, is
+		// not added back.
+	})
+}
+
+func (s *tomlStorage) TouchSession(id, ip string, lastSeen time.Time) error {
+	return s.state.change(func(state *state) {
+		if session := state.getSession(id); session != nil {
+			session.IP = ip
+			session.LastSeen = lastSeen
+		}
+	})
+}
+
+func (s *tomlStorage) RemoveSession(id string) error {
+	return s.state.change(func(state *state) { state.removeSession(id) })
+}
+
+func (s *tomlStorage) Close() error {
+	return s.state.Close()
+}
@@ -0,0 +1,138 @@
+// Package totp implements time-based one-time passwords as described in RFC
+// 6238, using the defaults that authenticator apps expect: HMAC-SHA1, six
+// digits and a thirty second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	digits = 6
+	period = 30
+
+	// skew is the number of periods either side of now that a code is accepted
+	// for, to allow for clocks disagreeing and slow typing.
+	skew = 1
+
+	// minSecretLength is the shortest secret, in bytes, that RFC 4226 allows.
+	minSecretLength = 16
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, encoded in base32 as used in
+// otpauth URIs.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	return encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+// Step returns the time step that t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / period
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return code(key, Step(t)), nil
+}
+
+func code(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, value%1000000)
+}
+
+// Check reports whether given is a valid code for secret at time t. To stop a code
+// being used twice, codes for steps at or before last are rejected; the step
+// the code was valid for is returned so that it can be stored as the new last.
+func Check(secret, given string, t time.Time, last int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(key) < minSecretLength {
+		return last, false
+	}
+
+	given = strings.Replace(given, " ", "", -1)
+	if len(given) != digits {
+		return last, false
+	}
+
+	now := Step(t)
+	for step := now - skew; step <= now+skew; step++ {
+		if step <= last {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(code(key, step)), []byte(given)) == 1 {
+			return step, true
+		}
+	}
+
+	return last, false
+}
+
+// URI returns the otpauth URI that authenticator apps use to add secret for
+// account.
+func URI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+
+	return u.String()
+}
+
+// RecoveryCodes returns n random codes that can be used once each in place of
+// a one-time password, for when the authenticator is lost.
+func RecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		encoded := strings.ToLower(encoding.EncodeToString(b))
+		codes[i] = encoded[:4] + "-" + encoded[4:]
+	}
+
+	return codes, nil
+}
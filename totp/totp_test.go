@@ -0,0 +1,81 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+)
+
+// rfcSecret is the SHA1 key used by the test vectors in RFC 6238, the codes
+// below are the last six digits of those given.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	assert := assert.New(t)
+
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, expected := range vectors {
+		code, err := Code(rfcSecret, time.Unix(unix, 0))
+		assert.Nil(err)
+		assert.Equal(expected, code, unix)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1111111109, 0)
+	code, _ := Code(rfcSecret, now)
+
+	step, ok := Check(rfcSecret, code, now, 0)
+	assert.True(ok)
+	assert.Equal(Step(now), step)
+
+	_, ok = Check(rfcSecret, code, now.Add(30*time.Second), 0)
+	assert.True(ok)
+
+	_, ok = Check(rfcSecret, code, now.Add(90*time.Second), 0)
+	assert.False(ok)
+
+	_, ok = Check(rfcSecret, code, now, step)
+	assert.False(ok)
+
+	_, ok = Check(rfcSecret, "000000", now, 0)
+	assert.False(ok)
+
+	_, ok = Check("", code, now, 0)
+	assert.False(ok)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("uberich", "me@example.com", "ABC")
+
+	assert.New(t).Equal("otpauth://totp/uberich:me@example.com?issuer=uberich&secret=ABC", uri)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	assert := assert.New(t)
+
+	codes, err := RecoveryCodes(10)
+	assert.Nil(err)
+	assert.Len(codes, 10)
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		assert.Len(code, 9)
+		assert.True(strings.Contains(code, "-"))
+		assert.False(seen[code])
+		seen[code] = true
+	}
+}
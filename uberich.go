@@ -2,19 +2,34 @@
 package uberich
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
+	"hawx.me/code/uberich/assertion"
+	"hawx.me/code/uberich/jwt"
 )
 
 type Store interface {
 	Set(w http.ResponseWriter, r *http.Request, email string)
 	Get(r *http.Request) string
+
+	// SignedInAt returns when Set was last called for the request's session, so
+	// that sessions started before the user signed out of uberich can be ended.
+	SignedInAt(r *http.Request) time.Time
+
+	// SetState and GetState hold the state parameter for a sign-in that is in
+	// progress, so that the response can be matched to the request.
+	SetState(w http.ResponseWriter, r *http.Request, state string)
+	GetState(r *http.Request) string
 }
 
 type emailStore struct {
@@ -38,10 +53,40 @@ func (s emailStore) Get(r *http.Request) string {
 func (s emailStore) Set(w http.ResponseWriter, r *http.Request, email string) {
 	session, _ := s.store.Get(r, "session")
 	session.Values["email"] = email
+	session.Values["signedInAt"] = time.Now().Unix()
+	session.Save(r, w)
+}
+
+func (s emailStore) SignedInAt(r *http.Request) time.Time {
+	session, _ := s.store.Get(r, "session")
+
+	if v, ok := session.Values["signedInAt"].(int64); ok {
+		return time.Unix(v, 0)
+	}
+
+	return time.Time{}
+}
+
+func (s emailStore) GetState(r *http.Request) string {
+	session, _ := s.store.Get(r, "session")
+
+	if v, ok := session.Values["state"].(string); ok {
+		return v
+	}
+
+	return ""
+}
+
+func (s emailStore) SetState(w http.ResponseWriter, r *http.Request, state string) {
+	session, _ := s.store.Get(r, "session")
+	session.Values["state"] = state
 	session.Save(r, w)
 }
 
-func NewClient(appName, appURL, uberichURL, secret string, store Store) *Client {
+// NewClient creates a Client for the app registered with uberich as appName.
+// Assertions are checked using the public keys published by uberich, so no
+// secret is required.
+func NewClient(appName, appURL, uberichURL string, store Store) *Client {
 	appU, _ := url.Parse(appURL)
 	uberichU, _ := url.Parse(uberichURL)
 
@@ -49,8 +94,10 @@ func NewClient(appName, appURL, uberichURL, secret string, store Store) *Client
 		appName:    appName,
 		appURL:     appU,
 		uberichURL: uberichU,
-		secret:     secret,
 		store:      store,
+		nonces:     assertion.NewNonceCache(),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		signedOut:  map[string]time.Time{},
 	}
 }
 
@@ -58,29 +105,141 @@ type Client struct {
 	appName    string
 	appURL     *url.URL
 	uberichURL *url.URL
-	secret     string
 	store      Store
+	nonces     *assertion.NonceCache
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	issuer    string
+	keys      jwt.KeySet
+	refreshed time.Time
+
+	// signedOut records when users signed out of uberich, any of their sessions
+	// started before then are ignored.
+	signedOut map[string]time.Time
 }
 
-func (c *Client) wasHashedWithSecret(data []byte, verifyMAC []byte) bool {
-	mac := hmac.New(sha256.New, []byte(c.secret))
-	mac.Write(data)
-	expectedMAC := mac.Sum(nil)
-	return hmac.Equal(verifyMAC, expectedMAC)
+const (
+	// refetchInterval limits how often the keys are fetched again when an
+	// assertion is signed by a key that is not known.
+	refetchInterval = time.Minute
+
+	// sessionLifetime is how long a session lasts with the store returned by
+	// NewStore, there is no need to remember that a user signed out for longer.
+	sessionLifetime = 30 * 24 * time.Hour
+)
+
+func (c *Client) getJSON(u *url.URL, v interface{}) error {
+	resp, err := c.httpClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status from " + u.String() + ": " + resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// provider returns the issuer and public keys of uberich, fetching them if they
+// have not been already or refresh is true.
+func (c *Client) provider(refresh bool) (string, jwt.KeySet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.issuer != "" && (!refresh || time.Since(c.refreshed) < refetchInterval) {
+		return c.issuer, c.keys, nil
+	}
+
+	configURL, _ := c.uberichURL.Parse(".well-known/openid-configuration")
+
+	var conf struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := c.getJSON(configURL, &conf); err != nil {
+		return "", jwt.KeySet{}, err
+	}
+
+	keysURL, err := configURL.Parse(conf.JWKSURI)
+	if err != nil {
+		return "", jwt.KeySet{}, err
+	}
+
+	var keys jwt.KeySet
+	if err := c.getJSON(keysURL, &keys); err != nil {
+		return "", jwt.KeySet{}, err
+	}
+
+	c.issuer = conf.Issuer
+	c.keys = keys
+	if refresh {
+		c.refreshed = time.Now()
+	}
+
+	return c.issuer, c.keys, nil
+}
+
+var errState = errors.New("state does not match")
+
+func randomState() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// verify checks that the request is the response to a sign-in started by this
+// user, and contains an assertion issued to this application that has not
+// expired and has not been used before.
+func (c *Client) verify(w http.ResponseWriter, r *http.Request) (string, error) {
+	expected := c.store.GetState(r)
+	c.store.SetState(w, r, "")
+
+	state := r.FormValue("state")
+	if expected == "" || subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
+		return "", errState
+	}
+
+	issuer, keys, err := c.provider(false)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	token := r.FormValue("assertion")
+
+	a, err := assertion.Parse(token, keys, issuer, c.appName, now)
+	if err == jwt.ErrUnknownKey {
+		if issuer, keys, err = c.provider(true); err != nil {
+			return "", err
+		}
+		a, err = assertion.Parse(token, keys, issuer, c.appName, now)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.nonces.Use(a, now); err != nil {
+		return "", err
+	}
+
+	return a.Email, nil
 }
 
 // SignIn returns a handler that prompts the user to sign-in with uberich, on
 // success they will be redirected to redirectURI.
 func (c *Client) SignIn(redirectURI string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if email := r.FormValue("email"); email != "" {
-			verifyMAC, err := base64.URLEncoding.DecodeString(r.FormValue("verify"))
+		if r.FormValue("assertion") != "" {
+			email, err := c.verify(w, r)
 			if err != nil {
-				log.Println(err)
-			}
-
-			if !c.wasHashedWithSecret([]byte(email), verifyMAC) {
-				log.Println("sign-in: response from unverified source")
+				log.Println("sign-in:", err)
+				http.Error(w, "could not sign in", http.StatusForbidden)
 				return
 			}
 
@@ -96,10 +255,19 @@ func (c *Client) SignIn(redirectURI string) http.Handler {
 
 		redirectURI, _ := c.appURL.Parse(path)
 
+		state, err := randomState()
+		if err != nil {
+			log.Println("sign-in:", err)
+			http.Error(w, "could not sign in", http.StatusInternalServerError)
+			return
+		}
+		c.store.SetState(w, r, state)
+
 		u, _ := c.uberichURL.Parse("login")
 		q := u.Query()
 		q.Add("redirect_uri", redirectURI.String())
 		q.Add("application", c.appName)
+		q.Add("state", state)
 		u.RawQuery = q.Encode()
 
 		http.Redirect(w, r, u.String(), http.StatusFound)
@@ -107,19 +275,120 @@ func (c *Client) SignIn(redirectURI string) http.Handler {
 }
 
 // SignOut returns a handler that removes the session cookie for the currently
-// signed-in user. It then redirects to redirectURI.
+// signed-in user, then signs them out of uberich and every other app they used
+// it to sign in to. Finally they are redirected to redirectURI.
 func (c *Client) SignOut(redirectURI string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c.store.Set(w, r, "")
-		http.Redirect(w, r, redirectURI, http.StatusFound)
+
+		next, err := c.appURL.Parse(redirectURI)
+		if err != nil {
+			log.Println("sign-out:", err)
+			http.Error(w, "could not sign out", http.StatusInternalServerError)
+			return
+		}
+
+		u, _ := c.uberichURL.Parse("logout")
+		q := u.Query()
+		q.Add("application", c.appName)
+		q.Add("redirect_uri", next.String())
+		u.RawQuery = q.Encode()
+
+		http.Redirect(w, r, u.String(), http.StatusFound)
 	})
 }
 
+// verifyLogout checks that token is a logout token from uberich for this
+// application.
+func (c *Client) verifyLogout(token string) (assertion.Logout, error) {
+	issuer, keys, err := c.provider(false)
+	if err != nil {
+		return assertion.Logout{}, err
+	}
+
+	now := time.Now()
+
+	logout, err := assertion.ParseLogout(token, keys, issuer, c.appName, now)
+	if err == jwt.ErrUnknownKey {
+		if issuer, keys, err = c.provider(true); err != nil {
+			return assertion.Logout{}, err
+		}
+		logout, err = assertion.ParseLogout(token, keys, issuer, c.appName, now)
+	}
+
+	return logout, err
+}
+
+// SignedOut returns a handler that uberich calls when a user signs out, it
+// should be registered with uberich as both the front-channel and back-channel
+// logout URI for the app.
+//
+// The front-channel request is made from the user's browser, so clears their
+// session cookie. The back-channel request is made by uberich with a signed
+// logout token, so instead any session the user started before the token was
+// issued is ignored from then on.
+func (c *Client) SignedOut() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != "POST" {
+			if iss := r.FormValue("iss"); iss != "" {
+				if issuer, _, err := c.provider(false); err != nil || iss != issuer {
+					http.Error(w, "wrong issuer", http.StatusBadRequest)
+					return
+				}
+			}
+
+			c.store.Set(w, r, "")
+			return
+		}
+
+		logout, err := c.verifyLogout(r.PostFormValue("logout_token"))
+		if err != nil {
+			log.Println("signed-out:", err)
+			http.Error(w, "invalid logout token", http.StatusBadRequest)
+			return
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		for email, at := range c.signedOut {
+			if time.Since(at) > sessionLifetime {
+				delete(c.signedOut, email)
+			}
+		}
+
+		if logout.IssuedAt.After(c.signedOut[logout.Email]) {
+			c.signedOut[logout.Email] = logout.IssuedAt
+		}
+	})
+}
+
+// currentUser returns the email of the signed-in user, unless they have since
+// signed out of uberich.
+func (c *Client) currentUser(r *http.Request) string {
+	email := c.store.Get(r)
+	if email == "" {
+		return ""
+	}
+
+	c.mu.Lock()
+	signedOut, ok := c.signedOut[email]
+	c.mu.Unlock()
+
+	if ok && !c.store.SignedInAt(r).After(signedOut) {
+		return ""
+	}
+
+	return email
+}
+
 // Protect takes two handlers, the first will be used if an entry exists in the
 // store. Otherwise the second handler is used.
 func (c *Client) Protect(handler, errHandler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if email := c.store.Get(r); email != "" {
+		if email := c.currentUser(r); email != "" {
 			handler.ServeHTTP(w, r)
 		} else {
 			errHandler.ServeHTTP(w, r)
@@ -128,5 +397,5 @@ func (c *Client) Protect(handler, errHandler http.Handler) http.Handler {
 }
 
 func (c *Client) CurrentUser(r *http.Request) string {
-	return c.store.Get(r)
+	return c.currentUser(r)
 }
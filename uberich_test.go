@@ -1,27 +1,46 @@
 package uberich
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"hawx.me/code/assert"
+	"hawx.me/code/uberich/assertion"
+	"hawx.me/code/uberich/jwt"
 )
 
+// redirected is what the app saw when redirected to after signing in or out.
+// The user is read by the handler, as the request can't be used once it has
+// returned.
+type redirected struct {
+	path string
+	user string
+}
+
 func TestSignOut(t *testing.T) {
 	cookieSecret := "Cookie Secret"
 
-	client := NewClient("", "", "", "", NewStore(cookieSecret))
+	uberichCh := make(chan *http.Request, 1)
+	uberich := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uberichCh <- r
+		http.Redirect(w, r, r.FormValue("redirect_uri"), http.StatusFound)
+	}))
+	defer uberich.Close()
 
-	redirectCh := make(chan *http.Request, 1)
+	client := NewClient("my-app", "http://app_uri", uberich.URL, NewStore(cookieSecret))
+
+	redirectCh := make(chan redirected, 1)
 	redirectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		redirectCh <- r
+		redirectCh <- redirected{path: r.URL.Path, user: client.CurrentUser(r)}
 	}))
 	defer redirectServer.Close()
 
@@ -38,15 +57,112 @@ func TestSignOut(t *testing.T) {
 
 	assert.Equal(200, resp.StatusCode)
 
+	select {
+	case r := <-uberichCh:
+		assert.Equal("/logout", r.URL.Path)
+		assert.Equal("my-app", r.URL.Query().Get("application"))
+
+	case <-time.After(time.Second):
+		t.Error("timeout")
+	}
+
 	select {
 	case r := <-redirectCh:
-		assert.Equal("", client.CurrentUser(r))
+		assert.Equal("", r.user)
 
 	case <-time.After(time.Second):
 		t.Error("timeout")
 	}
 }
 
+// signedInClient signs email in to a new client using jar, returning the
+// client and a server that responds with the current user.
+func signedInClient(t *testing.T, uberichURL string, key *jwt.Key, email string, jar http.CookieJar) (*Client, *httptest.Server) {
+	client := NewClient("my-app", "http://app_uri", uberichURL, NewStore("Cookie Secret"))
+
+	app := http.NewServeMux()
+	app.Handle("/sign-in", client.SignIn("/"))
+	app.Handle("/signed-out", client.SignedOut())
+	app.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(client.CurrentUser(r)))
+	})
+	server := httptest.NewServer(app)
+
+	state := startSignIn(t, server.URL+"/sign-in", jar)
+	a, _ := assertion.New(email, "my-app", time.Now())
+	finishSignIn(t, server.URL+"/sign-in", jar, assertionQuery(a, key, uberichURL, state))
+
+	return client, server
+}
+
+func currentUser(t *testing.T, serverURL string, jar http.CookieJar) string {
+	resp, err := (&http.Client{Jar: jar}).Get(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	return buf.String()
+}
+
+func TestSignedOutFrontChannel(t *testing.T) {
+	uberich, key := testUberich()
+	defer uberich.Close()
+
+	jar, _ := cookiejar.New(&cookiejar.Options{})
+	_, app := signedInClient(t, uberich.URL, key, "someone@example.com", jar)
+	defer app.Close()
+
+	assert := assert.New(t)
+	assert.Equal("someone@example.com", currentUser(t, app.URL, jar))
+
+	resp, err := (&http.Client{Jar: jar}).Get(app.URL + "/signed-out?iss=http://evil.example.com")
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal("someone@example.com", currentUser(t, app.URL, jar))
+
+	resp, err = (&http.Client{Jar: jar}).Get(app.URL + "/signed-out?iss=" + url.QueryEscape(uberich.URL))
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("", currentUser(t, app.URL, jar))
+}
+
+func TestSignedOutBackChannel(t *testing.T) {
+	uberich, key := testUberich()
+	defer uberich.Close()
+
+	jar, _ := cookiejar.New(&cookiejar.Options{})
+	_, app := signedInClient(t, uberich.URL, key, "someone@example.com", jar)
+	defer app.Close()
+
+	assert := assert.New(t)
+	assert.Equal("someone@example.com", currentUser(t, app.URL, jar))
+
+	post := func(token string) int {
+		resp, err := http.PostForm(app.URL+"/signed-out", url.Values{"logout_token": {token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	a, _ := assertion.New("someone@example.com", "my-app", time.Now())
+	token, _ := a.Sign(key, uberich.URL)
+	assert.Equal(http.StatusBadRequest, post(token))
+
+	logout, _ := assertion.NewLogout("someone@example.com", "other-app", time.Now())
+	token, _ = logout.Sign(key, uberich.URL)
+	assert.Equal(http.StatusBadRequest, post(token))
+	assert.Equal("someone@example.com", currentUser(t, app.URL, jar))
+
+	logout, _ = assertion.NewLogout("someone@example.com", "my-app", time.Now())
+	token, _ = logout.Sign(key, uberich.URL)
+	assert.Equal(http.StatusOK, post(token))
+	assert.Equal("", currentUser(t, app.URL, jar))
+}
+
 func TestSignIn(t *testing.T) {
 	uberichCh := make(chan *http.Request, 1)
 	uberich := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -59,7 +175,7 @@ func TestSignIn(t *testing.T) {
 	appURI := "http://app_uri"
 	somePath := "/cool/a/path"
 
-	client := NewClient(appName, appURI, uberich.URL, "", NewStore(cookieSecret))
+	client := NewClient(appName, appURI, uberich.URL, NewStore(cookieSecret))
 
 	signIn := httptest.NewServer(client.SignIn(""))
 	defer signIn.Close()
@@ -77,6 +193,7 @@ func TestSignIn(t *testing.T) {
 		assert.Equal("/login", r.URL.Path)
 		assert.Equal(appName, r.URL.Query().Get("application"))
 		assert.Equal(appURI+somePath, r.URL.Query().Get("redirect_uri"))
+		assert.NotEqual("", r.URL.Query().Get("state"))
 
 	case <-time.After(time.Second):
 		t.Error("timeout")
@@ -95,7 +212,7 @@ func TestSignInWhenAppURLHasBasePath(t *testing.T) {
 	appURI := "http://app_uri/a/path/"
 	somePath := "cool/a/path"
 
-	client := NewClient(appName, appURI, uberich.URL, "", NewStore(cookieSecret))
+	client := NewClient(appName, appURI, uberich.URL, NewStore(cookieSecret))
 
 	signIn := httptest.NewServer(client.SignIn(""))
 	defer signIn.Close()
@@ -119,48 +236,375 @@ func TestSignInWhenAppURLHasBasePath(t *testing.T) {
 	}
 }
 
-func TestSignInWhenSignedIn(t *testing.T) {
-	redirectCh := make(chan *http.Request, 1)
-	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		redirectCh <- r
+// startSignIn begins a sign-in using jar, returning the state that would have
+// been passed to uberich.
+func startSignIn(t *testing.T, signInURL string, jar http.CookieJar) string {
+	httpClient := http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := httpClient.Get(signInURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return location.Query().Get("state")
+}
+
+// finishSignIn returns to the sign-in handler as uberich would, with query.
+func finishSignIn(t *testing.T, signInURL string, jar http.CookieJar, query url.Values) *http.Response {
+	httpClient := http.Client{Jar: jar}
+
+	resp, err := httpClient.Get(signInURL + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// testUberich serves the configuration and keys that a Client needs to check
+// assertions, returning the key it publishes.
+func testUberich() (*httptest.Server, *jwt.Key) {
+	key, _ := jwt.GenerateKey("test-key")
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   server.URL,
+				"jwks_uri": server.URL + "/.well-known/jwks.json",
+			})
+		case "/.well-known/jwks.json":
+			json.NewEncoder(w).Encode(jwt.KeySet{Keys: []jwt.JWK{key.Public()}})
+		default:
+			http.NotFound(w, r)
+		}
 	}))
-	defer redirect.Close()
+
+	return server, key
+}
+
+func assertionQuery(a assertion.Assertion, key *jwt.Key, issuer, state string) url.Values {
+	token, _ := a.Sign(key, issuer)
+
+	query := url.Values{}
+	query.Add("assertion", token)
+	query.Add("state", state)
+	return query
+}
+
+func TestSignInWhenSignedIn(t *testing.T) {
+	uberich, key := testUberich()
+	defer uberich.Close()
 
 	cookieSecret := "Cookie Secret"
 	appName := "my-app"
 	appURI := "http://app_uri"
-	secret := "rjiwjre my secret"
 	email := "someguy@someplace.something"
 
-	client := NewClient(appName, appURI, "", secret, NewStore(cookieSecret))
+	client := NewClient(appName, appURI, uberich.URL, NewStore(cookieSecret))
+
+	redirectCh := make(chan redirected, 1)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectCh <- redirected{path: r.URL.Path, user: client.CurrentUser(r)}
+	}))
+	defer redirect.Close()
 
 	signIn := httptest.NewServer(client.SignIn(redirect.URL))
 	defer signIn.Close()
 
 	jar, _ := cookiejar.New(&cookiejar.Options{})
-	httpClient := http.Client{Jar: jar}
+	state := startSignIn(t, signIn.URL, jar)
 
-	query := url.Values{}
-	query.Add("email", email)
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write([]byte(email))
-	query.Add("verify", base64.URLEncoding.EncodeToString(mac.Sum(nil)))
-
-	req, _ := http.NewRequest("GET", signIn.URL+"?"+query.Encode(), nil)
-	resp, _ := httpClient.Do(req)
+	a, _ := assertion.New(email, appName, time.Now())
+	resp := finishSignIn(t, signIn.URL, jar, assertionQuery(a, key, uberich.URL, state))
 
 	assert := assert.New(t)
 
+	assert.NotEqual("", state)
 	assert.Equal(200, resp.StatusCode)
 
 	select {
 	case r := <-redirectCh:
-		assert.Equal("/", r.URL.Path)
+		assert.Equal("/", r.path)
+		assert.Equal(email, r.user)
+
+	case <-time.After(time.Second):
+		t.Error("timeout")
+	}
+}
+
+func TestSignInWithBadAssertion(t *testing.T) {
+	uberich, key := testUberich()
+	defer uberich.Close()
+
+	appName := "my-app"
+	email := "someguy@someplace.something"
+
+	otherKey, _ := jwt.GenerateKey(key.ID)
+	unknownKey, _ := jwt.GenerateKey("unknown-key")
+
+	expired, _ := assertion.New(email, appName, time.Now().Add(-time.Hour))
+	otherApp, _ := assertion.New(email, "other-app", time.Now())
+	valid, _ := assertion.New(email, appName, time.Now())
+
+	testCases := map[string]struct {
+		Assertion assertion.Assertion
+		Key       *jwt.Key
+		Issuer    string
+		Tamper    bool
+	}{
+		"expired":      {expired, key, uberich.URL, false},
+		"wrong app":    {otherApp, key, uberich.URL, false},
+		"wrong issuer": {valid, key, "http://someone-else", false},
+		"wrong key":    {valid, otherKey, uberich.URL, false},
+		"unknown key":  {valid, unknownKey, uberich.URL, false},
+		"tampered":     {valid, key, uberich.URL, true},
+	}
+
+	for name, testCase := range testCases {
+		redirectCh := make(chan *http.Request, 1)
+		redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			redirectCh <- r
+		}))
+		defer redirect.Close()
+
+		client := NewClient(appName, "http://app_uri", uberich.URL, NewStore("Cookie Secret"))
+
+		signIn := httptest.NewServer(client.SignIn(redirect.URL))
+		defer signIn.Close()
+
+		jar, _ := cookiejar.New(&cookiejar.Options{})
+		state := startSignIn(t, signIn.URL, jar)
+
+		query := assertionQuery(testCase.Assertion, testCase.Key, testCase.Issuer, state)
+		if testCase.Tamper {
+			parts := strings.Split(query.Get("assertion"), ".")
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			claims = bytes.Replace(claims, []byte(email), []byte("someoneelse@someplace.somethin"), -1)
+			parts[1] = base64.RawURLEncoding.EncodeToString(claims)
+			query.Set("assertion", strings.Join(parts, "."))
+		}
+
+		resp := finishSignIn(t, signIn.URL, jar, query)
 
-		user := client.CurrentUser(r)
-		assert.Equal(email, user)
+		assert := assert.New(t)
+		assert.Equal(403, resp.StatusCode, name)
 
+		select {
+		case <-redirectCh:
+			t.Error("was redirected", name)
+		default:
+		}
+	}
+}
+
+func TestSignInWhenKeyRotated(t *testing.T) {
+	oldKey, _ := jwt.GenerateKey("old-key")
+	newKey, _ := jwt.GenerateKey("new-key")
+	var mu sync.Mutex
+	keys := []jwt.JWK{oldKey.Public()}
+
+	var uberich *httptest.Server
+	uberich = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   uberich.URL,
+				"jwks_uri": "/.well-known/jwks.json",
+			})
+		case "/.well-known/jwks.json":
+			mu.Lock()
+			json.NewEncoder(w).Encode(jwt.KeySet{Keys: keys})
+			mu.Unlock()
+		}
+	}))
+	defer uberich.Close()
+
+	appName := "my-app"
+	email := "someguy@someplace.something"
+
+	client := NewClient(appName, "http://app_uri", uberich.URL, NewStore("Cookie Secret"))
+
+	redirectCh := make(chan redirected, 1)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectCh <- redirected{path: r.URL.Path, user: client.CurrentUser(r)}
+	}))
+	defer redirect.Close()
+
+	signIn := httptest.NewServer(client.SignIn(redirect.URL))
+	defer signIn.Close()
+
+	assert := assert.New(t)
+
+	jar, _ := cookiejar.New(&cookiejar.Options{})
+	state := startSignIn(t, signIn.URL, jar)
+	a, _ := assertion.New(email, appName, time.Now())
+	resp := finishSignIn(t, signIn.URL, jar, assertionQuery(a, oldKey, uberich.URL, state))
+	assert.Equal(200, resp.StatusCode)
+	<-redirectCh
+
+	mu.Lock()
+	keys = append(keys, newKey.Public())
+	mu.Unlock()
+
+	jar, _ = cookiejar.New(&cookiejar.Options{})
+	state = startSignIn(t, signIn.URL, jar)
+	a, _ = assertion.New(email, appName, time.Now())
+	resp = finishSignIn(t, signIn.URL, jar, assertionQuery(a, newKey, uberich.URL, state))
+	assert.Equal(200, resp.StatusCode)
+
+	select {
+	case r := <-redirectCh:
+		assert.Equal(email, r.user)
 	case <-time.After(time.Second):
 		t.Error("timeout")
 	}
 }
+
+func TestSignInWhenAssertionReplayed(t *testing.T) {
+	redirectCh := make(chan *http.Request, 2)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectCh <- r
+	}))
+	defer redirect.Close()
+
+	uberich, key := testUberich()
+	defer uberich.Close()
+
+	appName := "my-app"
+	email := "someguy@someplace.something"
+
+	client := NewClient(appName, "http://app_uri", uberich.URL, NewStore("Cookie Secret"))
+
+	signIn := httptest.NewServer(client.SignIn(redirect.URL))
+	defer signIn.Close()
+
+	a, _ := assertion.New(email, appName, time.Now())
+
+	assert := assert.New(t)
+
+	jar, _ := cookiejar.New(&cookiejar.Options{})
+	state := startSignIn(t, signIn.URL, jar)
+	resp := finishSignIn(t, signIn.URL, jar, assertionQuery(a, key, uberich.URL, state))
+	assert.Equal(200, resp.StatusCode)
+	<-redirectCh
+
+	otherJar, _ := cookiejar.New(&cookiejar.Options{})
+	otherState := startSignIn(t, signIn.URL, otherJar)
+	resp = finishSignIn(t, signIn.URL, otherJar, assertionQuery(a, key, uberich.URL, otherState))
+	assert.Equal(403, resp.StatusCode)
+
+	select {
+	case <-redirectCh:
+		t.Error("was redirected")
+	default:
+	}
+}
+
+func TestSignInWhenAssertionReplayedAfterExpiry(t *testing.T) {
+	redirectCh := make(chan *http.Request, 2)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectCh <- r
+	}))
+	defer redirect.Close()
+
+	uberich, key := testUberich()
+	defer uberich.Close()
+
+	appName := "my-app"
+	email := "someguy@someplace.something"
+
+	client := NewClient(appName, "http://app_uri", uberich.URL, NewStore("Cookie Secret"))
+
+	signIn := httptest.NewServer(client.SignIn(redirect.URL))
+	defer signIn.Close()
+
+	// expired, but still accepted as clocks may disagree
+	a, _ := assertion.New(email, appName, time.Now().Add(-assertion.Lifetime-10*time.Second))
+
+	assert := assert.New(t)
+
+	jar, _ := cookiejar.New(&cookiejar.Options{})
+	state := startSignIn(t, signIn.URL, jar)
+	resp := finishSignIn(t, signIn.URL, jar, assertionQuery(a, key, uberich.URL, state))
+	assert.Equal(200, resp.StatusCode)
+	<-redirectCh
+
+	otherJar, _ := cookiejar.New(&cookiejar.Options{})
+	otherState := startSignIn(t, signIn.URL, otherJar)
+	resp = finishSignIn(t, signIn.URL, otherJar, assertionQuery(a, key, uberich.URL, otherState))
+	assert.Equal(403, resp.StatusCode)
+
+	select {
+	case <-redirectCh:
+		t.Error("was redirected")
+	default:
+	}
+}
+
+func TestSignInWhenStateDoesNotMatch(t *testing.T) {
+	redirectCh := make(chan *http.Request, 1)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectCh <- r
+	}))
+	defer redirect.Close()
+
+	uberich, key := testUberich()
+	defer uberich.Close()
+
+	appName := "my-app"
+	attackerEmail := "attacker@someplace.something"
+
+	client := NewClient(appName, "http://app_uri", uberich.URL, NewStore("Cookie Secret"))
+
+	signIn := httptest.NewServer(client.SignIn(redirect.URL))
+	defer signIn.Close()
+
+	// The attacker signs in with their own account, but stops before returning
+	// to the app so that they have an unused assertion and matching state.
+	attackerJar, _ := cookiejar.New(&cookiejar.Options{})
+	attackerState := startSignIn(t, signIn.URL, attackerJar)
+
+	testCases := map[string]func(jar http.CookieJar) string{
+		"no sign-in started": func(jar http.CookieJar) string {
+			return attackerState
+		},
+		"other sign-in started": func(jar http.CookieJar) string {
+			startSignIn(t, signIn.URL, jar)
+			return attackerState
+		},
+		"state missing": func(jar http.CookieJar) string {
+			startSignIn(t, signIn.URL, jar)
+			return ""
+		},
+	}
+
+	for name, victim := range testCases {
+		a, _ := assertion.New(attackerEmail, appName, time.Now())
+
+		victimJar, _ := cookiejar.New(&cookiejar.Options{})
+		state := victim(victimJar)
+
+		resp := finishSignIn(t, signIn.URL, victimJar, assertionQuery(a, key, uberich.URL, state))
+
+		assert := assert.New(t)
+		assert.Equal(403, resp.StatusCode, name)
+
+		select {
+		case <-redirectCh:
+			t.Error("was redirected", name)
+		default:
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package web
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+const accessDeniedPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Access denied</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <p class="problem">You don't have access to {{.App}}.</p>
+
+    <p>You are signed in as {{.Email}}. If you think you should have access, ask
+      whoever looks after {{.App}} to add you.</p>
+  </body>
+</html>`
+
+var accessDeniedTmpl = template.Must(template.New("accessDenied").Parse(accessDeniedPage))
+
+type accessDeniedCtx struct {
+	App   string
+	Email string
+}
+
+// allowed checks whether the user may sign in to app, if not it shows them a
+// page saying so and returns false.
+func allowed(w http.ResponseWriter, db storage.Storage, logger *log.Logger, app *config.App, email string) bool {
+	// Only look the user up when their groups matter.
+	if app.Allows(config.User{Email: email}) {
+		return true
+	}
+
+	user, err := db.GetUser(email)
+	if err == nil && app.Allows(*user) {
+		return true
+	}
+
+	if err != nil {
+		logger.Println("access:", err)
+	} else {
+		logger.Println("access:", email, "not allowed to use", app.Name)
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	accessDeniedTmpl.Execute(w, accessDeniedCtx{
+		App:   app.Name,
+		Email: email,
+	})
+	return false
+}
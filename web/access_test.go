@@ -0,0 +1,95 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/config"
+)
+
+func TestLoginWhenNotAllowed(t *testing.T) {
+	email := "me@example.com"
+	testApp := &config.App{
+		Name:        "testing",
+		URI:         "http://app.example.com/",
+		AllowGroups: []string{"admins"},
+	}
+
+	conf := savedConf(t, testApp)
+	addUser(conf, email, "password")
+
+	assert := assert.New(t)
+
+	loginServer := httptest.NewServer(testLogin(conf, storeWith(email)))
+	defer loginServer.Close()
+
+	resp, err := httpGet(loginServer.URL, map[string]string{
+		"application":  testApp.Name,
+		"redirect_uri": testApp.URI,
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), "You don't have access to testing"))
+
+	store := emptyStore()
+	postServer := httptest.NewServer(testLogin(conf, store))
+	defer postServer.Close()
+
+	resp, err = httpPost(postServer.URL, map[string]string{
+		"email":        email,
+		"pass":         "password",
+		"application":  testApp.Name,
+		"redirect_uri": testApp.URI,
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+}
+
+func TestLoginWhenAllowedByGroup(t *testing.T) {
+	success, successServer := chanServer()
+	defer successServer.Close()
+
+	email := "me@example.com"
+	testApp := &config.App{
+		Name:        "testing",
+		URI:         successServer.URL,
+		AllowGroups: []string{"admins"},
+	}
+
+	conf := savedConf(t, testApp)
+	addUser(conf, email, "password")
+
+	user := conf.GetUser(email)
+	user.AddGroup("admins")
+	conf.SetUser(user)
+
+	loginServer := httptest.NewServer(testLogin(conf, storeWith(email)))
+	defer loginServer.Close()
+
+	resp, err := httpGet(loginServer.URL, map[string]string{
+		"application":  testApp.Name,
+		"redirect_uri": testApp.URI,
+	})
+
+	assert := assert.New(t)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	select {
+	case r := <-success:
+		a, err := verifyAssertion(conf, testApp, r.URL.Query())
+		assert.Nil(err)
+		assert.Equal(email, a.Email)
+	case <-time.After(time.Second):
+		t.Error("time out")
+	}
+}
@@ -0,0 +1,174 @@
+package web
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
+)
+
+const activityPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Activity</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <h1>Activity</h1>
+
+    <p>Where your account has been used in the last 30 days. If you don't
+      recognise something, <a href="/sessions">revoke your sessions</a> and
+      <a href="/change-password">change your password</a>.</p>
+
+    <ul>
+      {{ range .Events }}
+        <li{{ if .Failed }} class="problem"{{ end }}>
+          {{.Time.Format "2 Jan 15:04"}}: {{.Description}}, {{.Device}}{{ if .IP }} from {{.IP}}{{ end }}
+        </li>
+      {{ else }}
+        <li>Nothing has been recorded.</li>
+      {{ end }}
+    </ul>
+  </body>
+</html>`
+
+var activityTmpl = template.Must(template.New("activity").Parse(activityPage))
+
+const (
+	// activityPeriod is how far back the activity page looks.
+	activityPeriod = 30 * 24 * time.Hour
+
+	// activityLimit is the most events the activity page shows.
+	activityLimit = 100
+)
+
+type activityCtx struct {
+	Events []activityEventCtx
+}
+
+type activityEventCtx struct {
+	Time        time.Time
+	Description string
+	Device      string
+	IP          string
+	Failed      bool
+}
+
+// describeFailure describes why an attempt to sign in was refused, for the
+// reasons that are the same for passwords and second factors.
+func describeFailure(detail string) (string, bool) {
+	switch detail {
+	case "locked out":
+		return "Failed to sign in, your account was locked", true
+	case "rate limit exceeded for user", "rate limit exceeded for ip", "rate limit exceeded for subnet":
+		return "Failed to sign in, there were too many attempts", true
+	}
+	return "", false
+}
+
+// describe returns what event means to the user it is for, and whether it was
+// a failure. It returns an empty description for events that aren't shown.
+func describe(event *storage.Event) (description string, failed bool) {
+	switch event.Type {
+	case storage.EventLogin:
+		switch event.Detail {
+		case "password":
+			return "Signed in with your password", false
+		case "passkey", "verified passkey":
+			return "Signed in with a passkey", false
+		case "magic-link":
+			return "Signed in with an emailed link", false
+		case "two-factor":
+			return "Signed in with your password and authenticator", false
+		}
+		return "Signed in", false
+
+	case storage.EventAssertion:
+		return "Signed in to " + event.App, false
+
+	case storage.EventLoginFailed:
+		switch event.Detail {
+		case "password incorrect":
+			return "Failed to sign in, the password was wrong", true
+		case "not registered":
+			return "Failed to sign in, your account was not registered yet", true
+		}
+		if description, ok := describeFailure(event.Detail); ok {
+			return description, true
+		}
+		return "Failed to sign in", true
+
+	case storage.EventSecondFactorFailed:
+		if event.Detail == "code incorrect" {
+			return "Failed to sign in, the authenticator code was wrong", true
+		}
+		if description, ok := describeFailure(event.Detail); ok {
+			return description, true
+		}
+		return "Failed to sign in", true
+
+	case storage.EventLockedOut:
+		return "Your account was locked after too many failed attempts", true
+	}
+
+	return "", false
+}
+
+type activityHandler struct {
+	db     storage.Storage
+	store  cookies.Store
+	logger *log.Logger
+}
+
+func (h *activityHandler) Get(w http.ResponseWriter, r *http.Request) {
+	current, err := h.store.Session(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	events, err := h.db.ListEvents(current.Email, time.Now().Add(-activityPeriod))
+	if err != nil {
+		h.logger.Println("activity:", err)
+		http.Error(w, "could not list activity", http.StatusInternalServerError)
+		return
+	}
+
+	var ctx activityCtx
+
+	// Events are listed oldest first, but the newest are most interesting.
+	for i := len(events) - 1; i >= 0 && len(ctx.Events) < activityLimit; i-- {
+		event := events[i]
+
+		description, failed := describe(event)
+		if description == "" {
+			continue
+		}
+
+		ctx.Events = append(ctx.Events, activityEventCtx{
+			Time:        event.Time,
+			Description: description,
+			Device:      device(event.UserAgent),
+			IP:          event.IP,
+			Failed:      failed,
+		})
+	}
+
+	activityTmpl.Execute(w, ctx)
+}
+
+// Activity lists the recent sign ins and failed attempts for the signed in
+// user, so that they can see if someone else has been using their account.
+func Activity(db storage.Storage, store cookies.Store, logger *log.Logger) http.Handler {
+	handler := &activityHandler{db, store, logger}
+
+	return mux.Method{
+		"GET": http.HandlerFunc(handler.Get),
+	}
+}
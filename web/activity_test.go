@@ -0,0 +1,86 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+func TestActivity(t *testing.T) {
+	email := "me@example.com"
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	db := storage.NewTOML(conf, filepath.Join(t.TempDir(), "audit.log"))
+
+	now := time.Now()
+	db.SetSession(&config.Session{ID: "current", Email: email, CreatedAt: now, LastSeen: now})
+
+	db.AddEvent(&storage.Event{Time: now.Add(-40 * 24 * time.Hour), Type: storage.EventLogin, Email: email, Detail: "magic-link"})
+	db.AddEvent(&storage.Event{Time: now.Add(-time.Hour), Type: storage.EventLoginFailed, Email: email, IP: "198.51.100.7", Detail: "password incorrect"})
+	db.AddEvent(&storage.Event{Time: now.Add(-time.Minute), Type: storage.EventLogin, Email: email, IP: "192.0.2.1", UserAgent: "Mozilla/5.0 (iPhone) Safari/604.1", Detail: "passkey"})
+	db.AddEvent(&storage.Event{Time: now, Type: storage.EventAssertion, Email: email, App: "testing"})
+	db.AddEvent(&storage.Event{Time: now, Type: storage.EventPasswordChanged, Email: email})
+	db.AddEvent(&storage.Event{Time: now, Type: storage.EventLogin, Email: "other@example.com", IP: "203.0.113.9"})
+
+	server := httptest.NewServer(Activity(db, storeWith(email), discardLogger))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := httpGet(server.URL, nil)
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	page := string(body)
+
+	assert.True(strings.Contains(page, "Signed in to testing"))
+	assert.True(strings.Contains(page, "Signed in with a passkey, Safari on iPhone from 192.0.2.1"))
+	assert.True(strings.Contains(page, "Failed to sign in, the password was wrong"))
+	assert.True(strings.Index(page, "Signed in to testing") < strings.Index(page, "the password was wrong"))
+	assert.False(strings.Contains(page, "emailed link"))
+	assert.False(strings.Contains(page, "203.0.113.9"))
+	assert.True(strings.Contains(page, `href="/sessions"`))
+	assert.True(strings.Contains(page, `href="/change-password"`))
+}
+
+func TestDescribeFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct{ typ, detail, expected string }{
+		{storage.EventLoginFailed, "password incorrect", "Failed to sign in, the password was wrong"},
+		{storage.EventLoginFailed, "not registered", "Failed to sign in, your account was not registered yet"},
+		{storage.EventLoginFailed, "locked out", "Failed to sign in, your account was locked"},
+		{storage.EventLoginFailed, "rate limit exceeded for user", "Failed to sign in, there were too many attempts"},
+		{storage.EventLoginFailed, "rate limit exceeded for ip", "Failed to sign in, there were too many attempts"},
+		{storage.EventLoginFailed, "rate limit exceeded for subnet", "Failed to sign in, there were too many attempts"},
+		{storage.EventLoginFailed, "could not get user", "Failed to sign in"},
+		{storage.EventLoginFailed, "something new", "Failed to sign in"},
+		{storage.EventSecondFactorFailed, "code incorrect", "Failed to sign in, the authenticator code was wrong"},
+		{storage.EventSecondFactorFailed, "locked out", "Failed to sign in, your account was locked"},
+		{storage.EventSecondFactorFailed, "rate limit exceeded for user", "Failed to sign in, there were too many attempts"},
+		{storage.EventSecondFactorFailed, "something new", "Failed to sign in"},
+	} {
+		description, failed := describe(&storage.Event{Type: tc.typ, Detail: tc.detail})
+		assert.Equal(tc.expected, description)
+		assert.True(failed)
+	}
+}
+
+func TestActivityWhenSignedOut(t *testing.T) {
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	db := storage.NewTOML(conf, "")
+
+	server := httptest.NewServer(Activity(db, emptyStore(), discardLogger))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := noRedirectClient().Get(server.URL)
+	assert.Nil(err)
+	assert.Equal("/login", resp.Header.Get("Location"))
+}
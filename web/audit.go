@@ -0,0 +1,120 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
+)
+
+// requestIDHeader identifies a request, so that what happened during it can be
+// found in the audit log.
+const requestIDHeader = "X-Request-Id"
+
+// withRequestID gives each request a new ID, and returns it in the response.
+// Any ID given by the client is replaced so that it can't be used to confuse the
+// audit log.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id := hex.EncodeToString(b)
+
+		r.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// withClientIP sets the RemoteAddr of requests made through a trusted proxy to
+// the address the proxy says it was made from, so that each client behind it is
+// limited, and recorded, separately. Each trusted proxy is passed in turn, from
+// the last, so a client can't choose its address by sending the headers itself.
+func withClientIP(conf *config.Config, logger *log.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxies, err := conf.Proxies()
+		if err != nil {
+			logger.Println("proxies:", err)
+		}
+
+		ip := cookies.ClientIP(r)
+		hops := forwardedFor(r)
+		for len(hops) > 0 && proxies.Trusts(ip) {
+			hop := hops[len(hops)-1]
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			ip, hops = hop, hops[:len(hops)-1]
+			r.RemoteAddr = ip
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor returns the addresses a request was forwarded for, from the
+// Forwarded header or else X-Forwarded-For, in the order they were added. Those
+// that aren't addresses are kept, so that they aren't skipped over.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				if name, value, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(name, "for") {
+					hop = strings.Trim(value, `"`)
+				}
+			}
+
+			if host, _, err := net.SplitHostPort(hop); err == nil {
+				hop = host
+			}
+			hops = append(hops, strings.Trim(hop, "[]"))
+		}
+
+		return hops
+	}
+
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	return hops
+}
+
+// client returns where the request came from, for the checker.
+func client(r *http.Request) auth.Client {
+	return auth.Client{
+		IP:        cookies.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: r.Header.Get(requestIDHeader),
+	}
+}
+
+// record adds event to the audit log, filling in when it happened and who made
+// the request.
+func record(db storage.Storage, logger *log.Logger, r *http.Request, event storage.Event) {
+	c := client(r)
+
+	event.Time = time.Now()
+	event.IP = c.IP
+	event.UserAgent = c.UserAgent
+	event.RequestID = c.RequestID
+
+	if err := db.AddEvent(&event); err != nil {
+		logger.Println("audit:", err)
+	}
+}
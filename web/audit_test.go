@@ -0,0 +1,137 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+func TestLoginIsAudited(t *testing.T) {
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer appServer.Close()
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: appServer.URL})
+	addUser(conf, "me@example.com", "password")
+
+	db := storage.NewTOML(conf, filepath.Join(t.TempDir(), "audit.log"))
+	checker := auth.NewChecker(db, config.RateLimits{}, discardLogger)
+
+	server := httptest.NewServer(withRequestID(Login(conf, db, emptyStore(), checker, discardLogger)))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	for _, pass := range []string{"wrong", "password"} {
+		resp, err := noRedirectClient().PostForm(server.URL, map[string][]string{
+			"email":        {"me@example.com"},
+			"pass":         {pass},
+			"application":  {"testing"},
+			"redirect_uri": {appServer.URL},
+		})
+		assert.Nil(err)
+		assert.NotEqual("", resp.Header.Get(requestIDHeader))
+	}
+
+	events, err := db.ListEvents("me@example.com", time.Time{})
+	assert.Nil(err)
+	if assert.Len(events, 2) {
+		assert.Equal(storage.EventLoginFailed, events[0].Type)
+		assert.Equal("password incorrect", events[0].Detail)
+		assert.Equal(storage.EventLogin, events[1].Type)
+		assert.Equal("password", events[1].Detail)
+		assert.Equal("127.0.0.1", events[1].IP)
+		assert.Equal("Go-http-client/1.1", events[1].UserAgent)
+		assert.NotEqual("", events[1].RequestID)
+		assert.NotEqual(events[0].RequestID, events[1].RequestID)
+	}
+}
+
+func TestClientsBehindTrustedProxy(t *testing.T) {
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.TrustedProxies = []string{"127.0.0.1"}
+	addUser(conf, "me@example.com", "password")
+
+	db := storage.NewTOML(conf, filepath.Join(t.TempDir(), "audit.log"))
+	checker := auth.NewChecker(db, config.RateLimits{Email: 10, IP: 1, Subnet: 10}, discardLogger)
+
+	server := httptest.NewServer(withClientIP(conf, discardLogger, Login(conf, db, emptyStore(), checker, discardLogger)))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	signIn := func(forwardedFor string) {
+		req, _ := http.NewRequest("POST", server.URL, strings.NewReader(url.Values{
+			"email":        {"me@example.com"},
+			"pass":         {"wrong"},
+			"application":  {"testing"},
+			"redirect_uri": {"http://app.example.com/"},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+
+		_, err := noRedirectClient().Do(req)
+		assert.Nil(err)
+	}
+
+	signIn("192.0.2.1")
+	signIn("192.0.2.1")
+	// The proxy adds the address it sees to any given by the client.
+	signIn("192.0.2.1, 198.51.100.1")
+
+	events, err := db.ListEvents("me@example.com", time.Time{})
+	assert.Nil(err)
+	if assert.Len(events, 3) {
+		assert.Equal("192.0.2.1", events[0].IP)
+		assert.Equal("password incorrect", events[0].Detail)
+		assert.Equal("192.0.2.1", events[1].IP)
+		assert.Equal("rate limit exceeded for ip", events[1].Detail)
+		assert.Equal("198.51.100.1", events[2].IP)
+		assert.Equal("password incorrect", events[2].Detail)
+	}
+}
+
+func TestWithClientIP(t *testing.T) {
+	testCases := []struct {
+		remoteAddr, trusted, header, value, expected string
+	}{
+		{"192.0.2.1:1234", "", "X-Forwarded-For", "203.0.113.5", "192.0.2.1"},
+		{"127.0.0.1:1234", "127.0.0.1", "X-Forwarded-For", "203.0.113.5", "203.0.113.5"},
+		{"127.0.0.1:1234", "127.0.0.1", "X-Forwarded-For", "203.0.113.5, 127.0.0.2", "127.0.0.2"},
+		{"127.0.0.1:1234", "10.0.0.0/8", "X-Forwarded-For", "203.0.113.5, 10.0.0.1", "127.0.0.1"},
+		{"10.0.0.2:1234", "10.0.0.0/8", "X-Forwarded-For", "203.0.113.5, 10.0.0.1", "203.0.113.5"},
+		{"127.0.0.1:1234", "127.0.0.1", "X-Forwarded-For", "unknown", "127.0.0.1"},
+		{"127.0.0.1:1234", "127.0.0.1", "Forwarded", `for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`, "2001:db8::1"},
+		{"@", "", "X-Forwarded-For", "203.0.113.5", "@"},
+		{"@", "unix", "X-Forwarded-For", "203.0.113.5", "203.0.113.5"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.remoteAddr+" "+tc.value, func(t *testing.T) {
+			conf := &config.Config{}
+			if tc.trusted != "" {
+				conf.TrustedProxies = []string{tc.trusted}
+			}
+
+			var ip string
+			handler := withClientIP(conf, discardLogger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ip = client(r).IP
+			}))
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			r.Header.Set(tc.header, tc.value)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			assert.New(t).Equal(tc.expected, ip)
+		})
+	}
+}
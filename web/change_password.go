@@ -8,8 +8,10 @@ import (
 	"github.com/justinas/nosurf"
 
 	"hawx.me/code/mux"
+	"hawx.me/code/uberich/auth"
 	"hawx.me/code/uberich/config"
 	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
 )
 
 const changePasswordPage = `<!DOCTYPE html>
@@ -20,17 +22,40 @@ const changePasswordPage = `<!DOCTYPE html>
     <link rel="stylesheet" href="/styles.css">
   </head>
   <body>
-    <form method="post" action="/change-password">
+    {{ if .Changed }}
+      <p>Your password has been changed.{{ if .SignedOutOthers }} You have been signed out everywhere else.{{ end }}</p>
+    {{ end }}
+
+    {{ if .Problem }}
+      <p class="problem">{{.Problem}}</p>
+    {{ end }}
+
+    <form method="post" action="{{.Action}}">
+      {{ if not .ResetToken }}
+        <fieldset>
+          <label for="current">Current Password</label>
+          <input type="password" id="current" name="current" autocomplete="current-password" />
+        </fieldset>
+      {{ end }}
+
       <fieldset>
         <label for="pass">New Password</label>
-        <input type="password" id="pass" name="pass" />
+        <input type="password" id="pass" name="pass" autocomplete="new-password" />
       </fieldset>
 
       <fieldset>
         <label for="pass2">(Confirm)</label>
-        <input type="password" id="pass2" name="pass2" />
+        <input type="password" id="pass2" name="pass2" autocomplete="new-password" />
       </fieldset>
 
+      {{ if .ResetToken }}
+        <input type="hidden" name="token" value="{{.ResetToken}}" />
+      {{ else }}
+        <fieldset>
+          <input type="checkbox" id="sign-out-others" name="sign-out-others" value="yes" />
+          <label for="sign-out-others">Sign out everywhere else</label>
+        </fieldset>
+      {{ end }}
       <input type="hidden" name="csrf_token" value="{{.Token}}" />
 
       <input type="submit" value="Change" />
@@ -41,13 +66,23 @@ const changePasswordPage = `<!DOCTYPE html>
 var changePasswordTmpl = template.Must(template.New("changePassword").Parse(changePasswordPage))
 
 type changePasswordCtx struct {
-	Token string
+	Action  string
+	Token   string
+	Problem string
+
+	Changed         bool
+	SignedOutOthers bool
+
+	// ResetToken is set when the password is being reset from an emailed link.
+	ResetToken string
 }
 
 type changePasswordHandler struct {
-	conf   *config.Config
-	store  cookies.Store
-	logger *log.Logger
+	conf    *config.Config
+	db      storage.Storage
+	store   cookies.Store
+	checker *auth.Checker
+	logger  *log.Logger
 }
 
 func (h *changePasswordHandler) Get(w http.ResponseWriter, r *http.Request) {
@@ -57,51 +92,117 @@ func (h *changePasswordHandler) Get(w http.ResponseWriter, r *http.Request) {
 	}
 
 	changePasswordTmpl.Execute(w, changePasswordCtx{
-		Token: nosurf.Token(r),
+		Action: "/change-password",
+		Token:  nosurf.Token(r),
 	})
 }
 
 func (h *changePasswordHandler) Post(w http.ResponseWriter, r *http.Request) {
-	email, err := h.store.Get(r)
+	current, err := h.store.Session(r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
 	var (
-		pass    = r.PostFormValue("pass")
-		confirm = r.PostFormValue("pass2") == pass
+		email = current.Email
+		pass  = r.PostFormValue("pass")
+		ctx   = changePasswordCtx{Action: "/change-password", Token: nosurf.Token(r)}
 	)
 
-	if !confirm {
-		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	// The checker is rate limited, so a left open browser can't be used to guess
+	// the password.
+	if !h.checker.IsAuthorised(client(r), email, r.PostFormValue("current")) {
+		ctx.Problem = "Your current password is incorrect."
+		changePasswordTmpl.Execute(w, ctx)
 		return
 	}
 
-	user := h.conf.GetUser(email)
-	if user == nil {
-		// This is impossible, really. Does it need checking?
-		http.Redirect(w, r, "/login", http.StatusFound)
+	if problem := checkNewPassword(h.conf, h.logger, email, pass, r.PostFormValue("pass2")); problem != "" {
+		ctx.Problem = problem
+		changePasswordTmpl.Execute(w, ctx)
 		return
 	}
 
-	if err := user.SetPassword(pass); err != nil {
+	user, err := h.db.GetUser(email)
+	if err == nil {
+		err = user.SetPassword(pass)
+	}
+	if err == nil {
+		err = h.db.SetUser(user)
+	}
+	if err != nil {
 		h.logger.Println("change-password:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Problem = "Your password could not be changed, try again later."
+		changePasswordTmpl.Execute(w, ctx)
 		return
 	}
 
-	h.conf.SetUser(user)
+	h.logger.Println("change-password: changed for", email)
+	ctx.Changed = true
+
+	event := storage.Event{Type: storage.EventPasswordChanged, Email: email}
+	if r.PostFormValue("sign-out-others") != "" {
+		ctx.SignedOutOthers = h.signOutOthers(current)
+		if ctx.SignedOutOthers {
+			event.Detail = "signed out other sessions"
+		} else {
+			ctx.Problem = "You could not be signed out everywhere else, try revoking your other sessions from the sessions page."
+		}
+	}
+	record(h.db, h.logger, r, event)
+
+	changePasswordTmpl.Execute(w, ctx)
+}
 
-	if err := h.conf.Save(); err != nil {
+// signOutOthers removes each of the user's sessions other than current,
+// returning false if any could not be.
+func (h *changePasswordHandler) signOutOthers(current *config.Session) bool {
+	sessions, err := h.db.ListSessions(current.Email)
+	if err != nil {
 		h.logger.Println("change-password:", err)
-		return
+		return false
+	}
+
+	ok := true
+	for _, session := range sessions {
+		if session.ID == current.ID {
+			continue
+		}
+		if err := h.db.RemoveSession(session.ID); err != nil {
+			h.logger.Println("change-password:", err)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// checkNewPassword returns a problem to show the user if pass can't be used as
+// their new password, or confirm doesn't match it.
+func checkNewPassword(conf *config.Config, logger *log.Logger, email, pass, confirm string) string {
+	if pass != confirm {
+		return "The passwords do not match."
+	}
+
+	policy, err := conf.PasswordPolicy()
+	if err != nil {
+		logger.Println("password policy:", err)
+		return "The password could not be checked, try again later."
+	}
+
+	if err := policy.Check(email, pass); err != nil {
+		return "The password is not allowed: " + err.Error() + "."
 	}
 
-	h.store.Unset(w)
+	return ""
 }
 
-func ChangePassword(conf *config.Config, store cookies.Store, logger *log.Logger) http.Handler {
-	handler := &changePasswordHandler{conf, store, logger}
+// ChangePassword lets a signed in user change their password, once they have
+// given their current one, and optionally sign out of their other sessions.
+func ChangePassword(conf *config.Config, db storage.Storage, store cookies.Store, checker *auth.Checker, logger *log.Logger) http.Handler {
+	handler := &changePasswordHandler{conf, db, store, checker, logger}
 
 	return mux.Method{
 		"GET":  http.HandlerFunc(handler.Get),
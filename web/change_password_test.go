@@ -0,0 +1,208 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/password"
+	"hawx.me/code/uberich/storage"
+)
+
+// TestChangePasswordWhileLoggingIn is most useful when run with -race.
+func TestChangePasswordWhileLoggingIn(t *testing.T) {
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer appServer.Close()
+
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte{}, 0600)
+
+	testConf := conf(&config.App{Name: "testing", URI: appServer.URL})
+	conf, _ := config.Read(path)
+	conf.SetApp(testConf.Apps[0])
+	conf.AddSigningKey(testConf.SigningKeys[0])
+
+	const users = 5
+	for i := 0; i < users; i++ {
+		addUser(conf, fmt.Sprintf("%d@example.com", i), "password")
+	}
+
+	assert := assert.New(t)
+	assert.Nil(conf.Save())
+
+	db := storage.NewTOML(conf, "")
+	checker := auth.NewChecker(db, config.RateLimits{}, discardLogger)
+
+	loginServer := httptest.NewServer(Login(conf, db, emptyStore(), checker, discardLogger))
+	defer loginServer.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		email := fmt.Sprintf("%d@example.com", i)
+
+		changePasswordServer := httptest.NewServer(ChangePassword(conf, db, storeWith(email), checker, discardLogger))
+		defer changePasswordServer.Close()
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 2; j++ {
+				httpPost(loginServer.URL, map[string]string{
+					"email":        email,
+					"pass":         "password",
+					"application":  "testing",
+					"redirect_uri": appServer.URL,
+				})
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			httpPost(changePasswordServer.URL, map[string]string{
+				"current": "password",
+				"pass":    "new password",
+				"pass2":   "new password",
+			})
+		}()
+	}
+	wg.Wait()
+
+	saved, err := config.Read(path)
+	assert.Nil(err)
+	assert.Len(saved.Users, users)
+
+	for _, user := range saved.Users {
+		assert.True(user.IsPassword("new password"), user.Email)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, "me@example.com", "old password")
+
+	db := storage.NewTOML(conf, "")
+	now := time.Now()
+	db.SetSession(&config.Session{ID: "current", Email: "me@example.com", CreatedAt: now, LastSeen: now})
+	db.SetSession(&config.Session{ID: "phone", Email: "me@example.com", CreatedAt: now, LastSeen: now})
+	db.SetSession(&config.Session{ID: "someone-else", Email: "other@example.com", CreatedAt: now, LastSeen: now})
+
+	store := storeWith("me@example.com")
+	server := httptest.NewServer(ChangePassword(conf, db, store, auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := httpPost(server.URL, map[string]string{
+		"current":         "old password",
+		"pass":            "new password",
+		"pass2":           "new password",
+		"sign-out-others": "yes",
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), "Your password has been changed. You have been signed out everywhere else."))
+
+	user, _ := db.GetUser("me@example.com")
+	assert.True(user.IsPassword("new password"))
+
+	email, err := store.Get(nil)
+	assert.Nil(err)
+	assert.Equal("me@example.com", email)
+
+	_, err = db.GetSession("current")
+	assert.Nil(err)
+	_, err = db.GetSession("phone")
+	assert.Equal(storage.ErrNotFound, err)
+	_, err = db.GetSession("someone-else")
+	assert.Nil(err)
+}
+
+func TestChangePasswordWhenCurrentIsWrong(t *testing.T) {
+	conf := conf(&config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, "me@example.com", "old password")
+
+	db := storage.NewTOML(conf, "")
+	server := httptest.NewServer(ChangePassword(conf, db, storeWith("me@example.com"), auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	for i := 0; i < 4; i++ {
+		resp, err := httpPost(server.URL, map[string]string{
+			"current": "wrong password",
+			"pass":    "new password",
+			"pass2":   "new password",
+		})
+		assert.Nil(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.True(strings.Contains(string(body), "Your current password is incorrect."))
+	}
+
+	// Once the attempts are used up even the right password is refused.
+	resp, err := httpPost(server.URL, map[string]string{
+		"current": "old password",
+		"pass":    "new password",
+		"pass2":   "new password",
+	})
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), "Your current password is incorrect."))
+
+	user, _ := db.GetUser("me@example.com")
+	assert.True(user.IsPassword("old password"))
+}
+
+func TestChangePasswordWhenNotAllowed(t *testing.T) {
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	ioutil.WriteFile(breached, []byte("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\n"), 0600)
+
+	conf := conf(&config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.BreachedPasswords = breached
+	addUser(conf, "me@example.com", "old password")
+
+	db := storage.NewTOML(conf, "")
+
+	testCases := map[string]struct {
+		pass, pass2 string
+		problem     string
+	}{
+		"mismatch":  {"new password", "other password", "The passwords do not match."},
+		"too short": {"short", "short", "password is too short"},
+		"is email":  {"me@example.com", "me@example.com", password.ErrIsEmail.Error()},
+		"breached":  {"password", "password", password.ErrBreached.Error()},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(ChangePassword(conf, db, storeWith("me@example.com"), auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger))
+			defer server.Close()
+
+			assert := assert.New(t)
+
+			resp, err := httpPost(server.URL, map[string]string{
+				"current": "old password",
+				"pass":    tc.pass,
+				"pass2":   tc.pass2,
+			})
+			assert.Nil(err)
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			assert.True(strings.Contains(string(body), tc.problem), string(body))
+
+			user, _ := db.GetUser("me@example.com")
+			assert.True(user.IsPassword("old password"))
+		})
+	}
+}
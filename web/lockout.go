@@ -0,0 +1,43 @@
+package web
+
+import (
+	"fmt"
+	"log"
+
+	"hawx.me/code/uberich/config"
+)
+
+const lockedOutEmail = `There have been %d failed attempts to sign in to your account at %s, so it
+has been locked.
+
+%s
+
+If this wasn't you, someone may be trying to guess your password.
+`
+
+// notifyLockout returns a function that emails users to tell them they have
+// been locked out, if lockoutNotify is set.
+func notifyLockout(conf *config.Config, logger *log.Logger) func(string, config.Lockout) {
+	return func(email string, lockout config.Lockout) {
+		mailer := conf.LockoutMail()
+		if mailer == nil {
+			return
+		}
+
+		until := "Ask an administrator to unlock it."
+		if !lockout.Locked {
+			until = "You can try again after " + lockout.LockedUntil.Format("15:04 MST on 2 January 2006") + "."
+		}
+
+		body := fmt.Sprintf(lockedOutEmail, lockout.FailedAttempts, conf.IssuerURL(), until)
+
+		go func() {
+			if err := mailer.Send(email, "Your account has been locked", body); err != nil {
+				logger.Println("lockout: could not send to", email, err)
+				return
+			}
+
+			logger.Println("lockout: sent to", email)
+		}()
+	}
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+func TestLoginWhenLockedOut(t *testing.T) {
+	conf, mailServer := mailConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.LockoutNotify = true
+	addUser(conf, "me@example.com", "password")
+
+	db := storage.NewTOML(conf, "")
+	store := emptyStore()
+
+	checker := auth.NewChecker(db, config.RateLimits{Email: 10, LockoutAfter: 2, LockoutBackoff: time.Hour}, discardLogger)
+	checker.OnLock(notifyLockout(conf, discardLogger))
+
+	server := httptest.NewServer(Login(conf, db, store, checker, discardLogger))
+	defer server.Close()
+
+	login := func(pass string) string {
+		resp, err := httpPost(server.URL, map[string]string{
+			"email":        "me@example.com",
+			"pass":         pass,
+			"application":  "testing",
+			"redirect_uri": "http://app.example.com/callback",
+		})
+		if err != nil {
+			return ""
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	assert := assert.New(t)
+
+	body := login("wrong")
+	assert.True(strings.Contains(body, "Try again!"))
+	assert.False(strings.Contains(body, "temporarily locked"))
+
+	body = login("wrong")
+	assert.True(strings.Contains(body, "temporarily locked"))
+
+	until := receiveLink(t, mailServer, "me@example.com", regexp.MustCompile(`(You can try again after [^\r\n]+)`))
+	assert.NotEqual("", until)
+
+	// Even the right password is refused while locked out.
+	body = login("password")
+	assert.True(strings.Contains(body, "temporarily locked"))
+	_, err := store.Get(nil)
+	assert.NotNil(err)
+
+	user, _ := db.GetUser("me@example.com")
+	assert.Equal(2, user.FailedAttempts)
+	_, err = db.UpdateLockout("me@example.com", (*config.Lockout).Unlock)
+	assert.Nil(err)
+
+	login("password")
+	email, err := store.Get(nil)
+	assert.Nil(err)
+	assert.Equal("me@example.com", email)
+}
+
+func TestLoginWhenLockedOutWithoutAccount(t *testing.T) {
+	conf := conf(&config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, "me@example.com", "password")
+
+	db := storage.NewTOML(conf, "")
+	checker := auth.NewChecker(db, config.RateLimits{Email: 10, LockoutAfter: 2, LockoutBackoff: time.Hour}, discardLogger)
+
+	server := httptest.NewServer(Login(conf, db, emptyStore(), checker, discardLogger))
+	defer server.Close()
+
+	login := func(email string) string {
+		resp, err := httpPost(server.URL, map[string]string{
+			"email":        email,
+			"pass":         "wrong",
+			"application":  "testing",
+			"redirect_uri": "http://app.example.com/callback",
+		})
+		if err != nil {
+			return ""
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	assert := assert.New(t)
+
+	// The same is shown whether or not there is an account, so it can't be used
+	// to find out.
+	for _, email := range []string{"me@example.com", "nobody@example.com"} {
+		body := login(email)
+		assert.True(strings.Contains(body, "Try again!"))
+		assert.False(strings.Contains(body, "temporarily locked"))
+
+		body = login(email)
+		assert.True(strings.Contains(body, "temporarily locked"))
+	}
+}
@@ -1,17 +1,19 @@
 package web
 
 import (
-	"encoding/base64"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/justinas/nosurf"
 	"hawx.me/code/mux"
+	"hawx.me/code/uberich/assertion"
 	"hawx.me/code/uberich/auth"
 	"hawx.me/code/uberich/config"
 	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
 )
 
 const loginPage = `<!DOCTYPE html>
@@ -23,11 +25,13 @@ const loginPage = `<!DOCTYPE html>
     <link rel="stylesheet" href="/styles.css" />
   </head>
   <body>
-    {{ if .WasProblem }}
+    {{ if .Locked }}
+      <p class="problem">This account is temporarily locked after too many failed attempts to sign in. Try again later.</p>
+    {{ else if .WasProblem }}
       <p class="problem">Try again!</p>
     {{ end }}
 
-    <form method="post" action="/login">
+    <form method="post" action="{{.Action}}">
       <fieldset>
         <label for="email">Email</label>
         <input type="text" id="email" name="email" autofocus />
@@ -38,59 +42,131 @@ const loginPage = `<!DOCTYPE html>
         <input type="password" id="pass" name="pass" />
       </fieldset>
 
-      <input type="hidden" name="application" value="{{.Application}}" />
+      {{ range $name, $value := .Params }}
+        <input type="hidden" name="{{$name}}" value="{{$value}}" />
+      {{ end }}
       <input type="hidden" name="csrf_token" value="{{.Token}}" />
-      <input type="hidden" name="redirect_uri" value="{{.RedirectURI}}" />
 
       <input type="submit" value="Login" />
     </form>
+
+    {{ if .MagicLinks }}
+      <form method="post" action="/login/magic">
+        <fieldset>
+          <label for="magic-email">Email</label>
+          <input type="text" id="magic-email" name="email" />
+        </fieldset>
+
+        {{ range $name, $value := .Params }}
+          <input type="hidden" name="{{$name}}" value="{{$value}}" />
+        {{ end }}
+        <input type="hidden" name="csrf_token" value="{{.Token}}" />
+
+        <input type="submit" value="Email me a sign in link" />
+      </form>
+    {{ end }}
+
+    {{ if .CanResetPassword }}
+      <p><a href="/forgot-password">Forgot your password?</a></p>
+    {{ end }}
+
+    <p class="problem" id="passkey-problem" hidden>Try again!</p>
+    <button type="button" data-passkey="sign-in" data-next="{{.Next}}" hidden>Sign in with a passkey</button>
+
+    <script src="/passkeys.js"></script>
   </body>
 </html>`
 
 var loginTmpl = template.Must(template.New("login").Parse(loginPage))
 
 type loginCtx struct {
-	Application string
-	Token       string
-	RedirectURI string
-	WasProblem  bool
+	Action     string
+	Token      string
+	Params     map[string]string
+	WasProblem bool
+
+	// Locked is true when the problem was that the account is locked out.
+	Locked bool
+
+	// Next is where to go after signing in with a passkey.
+	Next string
+
+	// CanResetPassword is true when an email can be sent to reset a password.
+	CanResetPassword bool
+
+	// MagicLinks is true when the user can be emailed a link to sign in to the
+	// app instead.
+	MagicLinks bool
 }
 
-func redirectWithParams(w http.ResponseWriter, r *http.Request, u *url.URL, params map[string]string) {
-	q := u.Query()
+func withParams(u *url.URL, params map[string]string) string {
+	copied := *u
+	q := copied.Query()
 	for k, v := range params {
 		q.Add(k, v)
 	}
-	u.RawQuery = q.Encode()
-	http.Redirect(w, r, u.String(), http.StatusFound)
+	copied.RawQuery = q.Encode()
+	return copied.String()
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, u *url.URL, params map[string]string) {
+	http.Redirect(w, r, withParams(u, params), http.StatusFound)
 }
 
 type loginHandler struct {
 	conf    *config.Config
+	db      storage.Storage
 	store   cookies.Store
 	logger  *log.Logger
 	checker *auth.Checker
+	nonces  *assertion.NonceCache
 }
 
 func (h *loginHandler) getApp(w http.ResponseWriter, name, redirectURI string) *config.App {
-	app := h.conf.GetApp(name)
+	app, err := h.db.GetApp(name)
 
-	if app == nil {
-		h.logger.Println("login: no such app", name)
+	if err != nil {
+		h.logger.Println("login: no such app", name, err)
 		http.Error(w, "no such app", http.StatusInternalServerError)
+		return nil
 
 	} else if !app.CanRedirectTo(redirectURI) {
 		h.logger.Println("login: cannot redirect to specified URI:", redirectURI)
 		http.Error(w, "no such app", http.StatusInternalServerError)
+		return nil
 	}
 
 	return app
 }
 
+// assert creates a new signed assertion for the user to present to app, making
+// sure that its nonce has not been issued before.
+func (h *loginHandler) assert(session *config.Session, app *config.App) (string, error) {
+	key, err := h.conf.Signer()
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		now := time.Now()
+
+		a, err := assertion.New(session.Email, app.Name, now)
+		if err != nil {
+			return "", err
+		}
+		a.Session = session.Sid()
+
+		if h.nonces.Use(a, now) == nil {
+			return a.Sign(key, h.conf.IssuerURL())
+		}
+	}
+}
+
 func (h *loginHandler) Get(w http.ResponseWriter, r *http.Request) {
 	var (
 		application      = r.FormValue("application")
 		redirectURI, err = url.Parse(r.FormValue("redirect_uri"))
+		state            = r.FormValue("state")
 		wasProblem       = r.FormValue("problem")
 	)
 
@@ -105,20 +181,50 @@ func (h *loginHandler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if email, err := h.store.Get(r); err == nil {
+	// A user signed in by a magic link must give their password for an app that
+	// doesn't allow them.
+	if session, err := h.store.Session(r); err == nil && session.CanSignInTo(app) {
+		email := session.Email
+		if mustEnrol(w, r, h.db, email) || !allowed(w, h.db, h.logger, app, email) {
+			return
+		}
+
+		token, err := h.assert(session, app)
+		if err != nil {
+			h.logger.Println("login: could not create assertion:", err)
+			http.Error(w, "could not create assertion", http.StatusInternalServerError)
+			return
+		}
+
+		if err := h.store.Visit(w, r, app.Name); err != nil {
+			h.logger.Println("login: could not record visit:", err)
+		}
+
+		record(h.db, h.logger, r, storage.Event{Type: storage.EventAssertion, Email: email, App: app.Name})
+
 		redirectWithParams(w, r, redirectURI, map[string]string{
-			"email":  email,
-			"verify": base64.URLEncoding.EncodeToString(app.HashWithSecret([]byte(email))),
+			"assertion": token,
+			"state":     state,
 		})
-
 		return
 	}
 
+	params := map[string]string{
+		"application":  application,
+		"redirect_uri": redirectURI.String(),
+		"state":        state,
+	}
+
 	loginTmpl.Execute(w, loginCtx{
-		Application: application,
-		Token:       nosurf.Token(r),
-		RedirectURI: redirectURI.String(),
-		WasProblem:  wasProblem != "",
+		Action:     "/login",
+		Token:      nosurf.Token(r),
+		Params:     params,
+		WasProblem: wasProblem != "",
+		Locked:     wasProblem == "locked",
+		Next:       withParams(&url.URL{Path: "/login"}, params),
+
+		CanResetPassword: h.conf.Mail() != nil,
+		MagicLinks:       app.MagicLinks && h.conf.Mail() != nil,
 	})
 }
 
@@ -128,6 +234,7 @@ func (h *loginHandler) Post(w http.ResponseWriter, r *http.Request) {
 		pass             = r.PostFormValue("pass")
 		application      = r.PostFormValue("application")
 		redirectURI, err = url.Parse(r.PostFormValue("redirect_uri"))
+		state            = r.PostFormValue("state")
 	)
 
 	if err != nil {
@@ -136,42 +243,61 @@ func (h *loginHandler) Post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	redirectHere := func() {
+	redirectHere := func(problem string) {
 		redirectWithParams(w, r, r.URL, map[string]string{
 			"application":  application,
 			"redirect_uri": redirectURI.String(),
-			"problem":      "yes",
+			"state":        state,
+			"problem":      problem,
 		})
 	}
 
 	app := h.getApp(w, application, redirectURI.String())
 	if app == nil {
 		h.logger.Println("login: no such app", app)
-		redirectHere()
+		redirectHere("yes")
 		return
 	}
 
-	if !h.checker.IsAuthorised(email, pass) {
-		redirectHere()
+	if !h.checker.IsAuthorised(client(r), email, pass) {
+		redirectHere(loginProblem(h.checker, email))
 		return
 	}
 
-	if err := h.store.Set(w, email); err != nil {
-		h.logger.Println("login: could not set cookie:", err)
-		redirectHere()
+	if !allowed(w, h.db, h.logger, app, email) {
 		return
 	}
 
-	redirectWithParams(w, r, r.URL, map[string]string{
+	next := withParams(r.URL, map[string]string{
 		"application":  application,
 		"redirect_uri": redirectURI.String(),
+		"state":        state,
 	})
+
+	location, err := signIn(w, r, h.db, h.store, h.logger, email, "password", next)
+	if err != nil {
+		h.logger.Println("login: could not sign in:", err)
+		redirectHere("yes")
+		return
+	}
+
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// loginProblem returns the problem to show after failing to sign in as email,
+// so that a user who is locked out knows that trying again won't help.
+func loginProblem(checker *auth.Checker, email string) string {
+	if checker.IsLocked(email) {
+		return "locked"
+	}
+
+	return "yes"
 }
 
 // Login handles requests for a user to verify their identity. It displays and
 // handles a standard login form.
-func Login(conf *config.Config, store cookies.Store, logger *log.Logger) http.Handler {
-	handler := &loginHandler{conf, store, logger, auth.NewChecker(conf, logger)}
+func Login(conf *config.Config, db storage.Storage, store cookies.Store, checker *auth.Checker, logger *log.Logger) http.Handler {
+	handler := &loginHandler{conf, db, store, logger, checker, assertion.NewNonceCache()}
 
 	return mux.Method{
 		"GET":  http.HandlerFunc(handler.Get),
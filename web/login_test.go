@@ -7,37 +7,161 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"hawx.me/code/assert"
+	"hawx.me/code/uberich/assertion"
+	"hawx.me/code/uberich/auth"
 	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/jwt"
+	"hawx.me/code/uberich/storage"
 )
 
-type fakeStore struct{ s string }
+type fakeStore struct {
+	mu            sync.Mutex
+	s             string
+	method        string
+	pending       string
+	pendingMethod string
+	visited       []string
+}
 
-func (s *fakeStore) Set(_ http.ResponseWriter, email string) error {
+func (s *fakeStore) Set(_ http.ResponseWriter, _ *http.Request, email, method string) error {
+	s.mu.Lock()
 	s.s = email
+	s.method = method
+	s.mu.Unlock()
 	return nil
 }
 
-func (s *fakeStore) Unset(_ http.ResponseWriter) {}
+func (s *fakeStore) Unset(_ http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	s.s = ""
+	s.visited = nil
+	s.mu.Unlock()
+}
 
 func (s *fakeStore) Get(_ *http.Request) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.s == "" {
 		return "", errors.New("")
 	}
 	return s.s, nil
 }
 
+func (s *fakeStore) Session(r *http.Request) (*config.Session, error) {
+	email, err := s.Get(r)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &config.Session{ID: "current", Email: email, Method: s.method}, nil
+}
+
+func (s *fakeStore) SetPending(_ http.ResponseWriter, email, method string) error {
+	s.mu.Lock()
+	s.pending = email
+	s.pendingMethod = method
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fakeStore) UnsetPending(_ http.ResponseWriter) {
+	s.mu.Lock()
+	s.pending = ""
+	s.mu.Unlock()
+}
+
+func (s *fakeStore) GetPending(_ *http.Request) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == "" {
+		return "", "", errors.New("")
+	}
+	return s.pending, s.pendingMethod, nil
+}
+
+func (s *fakeStore) Visit(_ http.ResponseWriter, _ *http.Request, app string) error {
+	s.mu.Lock()
+	s.visited = append(s.visited, app)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fakeStore) Visited(_ *http.Request) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.visited
+}
+
+func (s *fakeStore) SetForApp(w http.ResponseWriter, r *http.Request, _, email, _ string) error {
+	return s.Set(w, r, email, "")
+}
+
+func (s *fakeStore) GetForApp(r *http.Request, _ string) (string, error) {
+	return s.Get(r)
+}
+
+func storeWith(email string) *fakeStore {
+	return &fakeStore{s: email}
+}
+
 func emptyStore() *fakeStore {
-	return &fakeStore{""}
+	return &fakeStore{}
 }
 
 var discardLogger = log.New(ioutil.Discard, "", 0)
 
+func testLogin(conf *config.Config, store cookies.Store) http.Handler {
+	db := storage.NewTOML(conf, "")
+
+	return Login(conf, db, store, auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger)
+}
+
 func conf(app *config.App) *config.Config {
-	return &config.Config{Apps: []*config.App{app}}
+	key, _ := jwt.GenerateKey("test-key")
+	encoded, _ := key.Encode()
+
+	return &config.Config{
+		Apps:        []*config.App{app},
+		SigningKeys: []*config.Key{{ID: key.ID, Private: encoded}},
+		Issuer:      "https://uberich.example.com",
+	}
+}
+
+// savedConf is like conf, but is read from a file so that changes can be saved.
+func savedConf(t *testing.T, app *config.App) *config.Config {
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte("issuer = \"https://uberich.example.com\"\n"), 0600)
+
+	conf, err := config.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := jwt.GenerateKey("test-key")
+	encoded, _ := key.Encode()
+
+	conf.SetApp(app)
+	conf.AddSigningKey(&config.Key{ID: key.ID, Private: encoded})
+	return conf
+}
+
+// verifyAssertion checks the assertion given in the query was signed by conf.
+func verifyAssertion(conf *config.Config, app *config.App, query url.Values) (assertion.Assertion, error) {
+	key, _ := conf.Signer()
+
+	return assertion.Parse(query.Get("assertion"), jwt.KeySet{Keys: []jwt.JWK{key.Public()}}, conf.IssuerURL(), app.Name, time.Now())
 }
 
 func addUser(conf *config.Config, email, pass string) {
@@ -87,14 +211,16 @@ func TestLogin(t *testing.T) {
 		URI:    successServer.URL,
 		Secret: "i have secrets",
 	}
-	hmac := "bvMYRKcNxmKHedfKB4BU2XO5YGIKomx52O1O3WNhuDw="
 
-	loginServer := httptest.NewServer(Login(conf(testApp), &fakeStore{email}, discardLogger))
+	conf := conf(testApp)
+
+	loginServer := httptest.NewServer(testLogin(conf, storeWith(email)))
 	defer loginServer.Close()
 
 	resp, err := httpGet(loginServer.URL, map[string]string{
 		"application":  testApp.Name,
 		"redirect_uri": testApp.URI,
+		"state":        "some-state",
 	})
 
 	assert := assert.New(t)
@@ -105,8 +231,10 @@ func TestLogin(t *testing.T) {
 	case r := <-success:
 		assert.Equal("GET", r.Method)
 		assert.Equal("/", r.URL.Path)
-		assert.Equal(email, r.URL.Query().Get("email"))
-		assert.Equal(hmac, r.URL.Query().Get("verify"))
+		a, err := verifyAssertion(conf, testApp, r.URL.Query())
+		assert.Nil(err)
+		assert.Equal(email, a.Email)
+		assert.Equal("some-state", r.URL.Query().Get("state"))
 
 	case <-time.After(time.Second):
 		t.Error("time out")
@@ -123,7 +251,7 @@ func TestLoginWhenNoCookie(t *testing.T) {
 		Secret: "i have secrets",
 	}
 
-	loginServer := httptest.NewServer(Login(conf(testApp), emptyStore(), discardLogger))
+	loginServer := httptest.NewServer(testLogin(conf(testApp), emptyStore()))
 	defer loginServer.Close()
 
 	resp, err := httpGet(loginServer.URL, map[string]string{
@@ -150,7 +278,7 @@ func TestLoginWhenNoSuchApp(t *testing.T) {
 		Secret: "i have secrets",
 	}
 
-	loginServer := httptest.NewServer(Login(conf(testApp), &fakeStore{email}, discardLogger))
+	loginServer := httptest.NewServer(testLogin(conf(testApp), storeWith(email)))
 	defer loginServer.Close()
 
 	resp, err := httpGet(loginServer.URL, map[string]string{
@@ -166,6 +294,36 @@ func TestLoginWhenNoSuchApp(t *testing.T) {
 	assert.Equal("no such app\n", string(body))
 }
 
+func TestLoginWhenRedirectNotRegistered(t *testing.T) {
+	testCases := map[string]*config.App{
+		"legacy": {
+			Name: "testing",
+			URI:  "https://app.example.com",
+		},
+		"registered": {
+			Name:         "testing",
+			URI:          "https://app.example.com",
+			RedirectURIs: []string{"https://app.example.com/callback"},
+		},
+	}
+
+	for name, testApp := range testCases {
+		t.Run(name, func(t *testing.T) {
+			loginServer := httptest.NewServer(testLogin(conf(testApp), storeWith("me@example.com")))
+			defer loginServer.Close()
+
+			resp, err := httpGet(loginServer.URL, map[string]string{
+				"application":  testApp.Name,
+				"redirect_uri": "https://app.example.com.evil.net/steal",
+			})
+
+			assert := assert.New(t)
+			assert.Nil(err)
+			assert.Equal(500, resp.StatusCode)
+		})
+	}
+}
+
 func TestLoginWhenPost(t *testing.T) {
 	success, successServer := chanServer()
 	defer successServer.Close()
@@ -177,12 +335,11 @@ func TestLoginWhenPost(t *testing.T) {
 		URI:    successServer.URL,
 		Secret: "i have secrets",
 	}
-	hmac := "bvMYRKcNxmKHedfKB4BU2XO5YGIKomx52O1O3WNhuDw="
 
 	conf := conf(testApp)
 	addUser(conf, email, password)
 
-	loginServer := httptest.NewServer(Login(conf, emptyStore(), discardLogger))
+	loginServer := httptest.NewServer(testLogin(conf, emptyStore()))
 	defer loginServer.Close()
 
 	resp, err := httpPost(loginServer.URL, map[string]string{
@@ -190,6 +347,7 @@ func TestLoginWhenPost(t *testing.T) {
 		"pass":         password,
 		"application":  testApp.Name,
 		"redirect_uri": testApp.URI,
+		"state":        "some-state",
 	})
 
 	assert := assert.New(t)
@@ -200,8 +358,10 @@ func TestLoginWhenPost(t *testing.T) {
 	case r := <-success:
 		assert.Equal("GET", r.Method)
 		assert.Equal("/", r.URL.Path)
-		assert.Equal(email, r.URL.Query().Get("email"))
-		assert.Equal(hmac, r.URL.Query().Get("verify"))
+		a, err := verifyAssertion(conf, testApp, r.URL.Query())
+		assert.Nil(err)
+		assert.Equal(email, a.Email)
+		assert.Equal("some-state", r.URL.Query().Get("state"))
 
 	case <-time.After(time.Second):
 		t.Error("time out")
@@ -233,7 +393,7 @@ func TestLoginWhenPostWithBadCredentials(t *testing.T) {
 		conf := conf(testApp)
 		addUser(conf, email, password)
 
-		loginServer := httptest.NewServer(Login(conf, emptyStore(), discardLogger))
+		loginServer := httptest.NewServer(testLogin(conf, emptyStore()))
 		defer loginServer.Close()
 
 		resp, err := httpPost(loginServer.URL, map[string]string{
@@ -0,0 +1,208 @@
+package web
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/justinas/nosurf"
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/assertion"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
+)
+
+const logoutPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Sign out</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <form method="post" action="/logout">
+      <p>Sign out of uberich, and every app you signed in to with it?</p>
+
+      <input type="hidden" name="application" value="{{.Application}}" />
+      <input type="hidden" name="redirect_uri" value="{{.RedirectURI}}" />
+      <input type="hidden" name="csrf_token" value="{{.Token}}" />
+
+      <input type="submit" value="Sign out" />
+    </form>
+  </body>
+</html>`
+
+const loggedOutPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    {{ if .Continue }}
+      <meta http-equiv="refresh" content="2;url={{.Continue}}" />
+    {{ end }}
+    <title>Signed out</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <p>You have been signed out.</p>
+
+    {{ if .Continue }}
+      <p><a href="{{.Continue}}">Continue</a></p>
+    {{ end }}
+
+    {{ range .Frames }}
+      <iframe src="{{.}}" hidden></iframe>
+    {{ end }}
+  </body>
+</html>`
+
+var (
+	logoutTmpl    = template.Must(template.New("logout").Parse(logoutPage))
+	loggedOutTmpl = template.Must(template.New("loggedOut").Parse(loggedOutPage))
+)
+
+type logoutCtx struct {
+	Application string
+	RedirectURI string
+	Token       string
+}
+
+type loggedOutCtx struct {
+	Continue string
+	Frames   []string
+}
+
+// backChannelTimeout is how long an app has to respond to a logout token.
+const backChannelTimeout = 10 * time.Second
+
+type logoutHandler struct {
+	conf   *config.Config
+	db     storage.Storage
+	store  cookies.Store
+	logger *log.Logger
+	client *http.Client
+}
+
+func (h *logoutHandler) Get(w http.ResponseWriter, r *http.Request) {
+	logoutTmpl.Execute(w, logoutCtx{
+		Application: r.FormValue("application"),
+		RedirectURI: r.FormValue("redirect_uri"),
+		Token:       nosurf.Token(r),
+	})
+}
+
+func (h *logoutHandler) Post(w http.ResponseWriter, r *http.Request) {
+	var (
+		application = r.PostFormValue("application")
+		redirectURI = r.PostFormValue("redirect_uri")
+		ctx         loggedOutCtx
+	)
+
+	if app, err := h.db.GetApp(application); err == nil && app.CanRedirectTo(redirectURI) {
+		ctx.Continue = redirectURI
+	}
+
+	current, err := h.store.Session(r)
+	visited := h.store.Visited(r)
+	h.store.Unset(w, r)
+	h.store.UnsetPending(w)
+
+	if err == nil {
+		email := current.Email
+		h.logger.Println("logout:", email)
+		record(h.db, h.logger, r, storage.Event{Type: storage.EventLogout, Email: email})
+
+		// Apps behind /verify have sessions of their own, which would otherwise
+		// last until they expire, so those started from this session end too.
+		sessions, err := h.db.ListSessions(email)
+		if err != nil {
+			h.logger.Println("logout:", err)
+		}
+		for _, session := range sessions {
+			if session.Parent != current.Sid() {
+				continue
+			}
+			if err := h.db.RemoveSession(session.ID); err != nil {
+				h.logger.Println("logout:", err)
+			}
+		}
+
+		for _, name := range visited {
+			app, err := h.db.GetApp(name)
+			if err != nil {
+				continue
+			}
+
+			if app.FrontChannelLogoutURI != "" {
+				ctx.Frames = append(ctx.Frames, h.frontChannel(app))
+			}
+			if app.BackChannelLogoutURI != "" {
+				go h.backChannel(app, email)
+			}
+		}
+	}
+
+	loggedOutTmpl.Execute(w, ctx)
+}
+
+// frontChannel returns the URI for app to load in a frame, it is given the
+// issuer so that it can check the request is meant for it.
+func (h *logoutHandler) frontChannel(app *config.App) string {
+	u, err := url.Parse(app.FrontChannelLogoutURI)
+	if err != nil {
+		return app.FrontChannelLogoutURI
+	}
+
+	return withParams(u, map[string]string{"iss": h.conf.IssuerURL()})
+}
+
+// backChannel sends app a logout token saying that the user with email has
+// signed out.
+func (h *logoutHandler) backChannel(app *config.App, email string) {
+	key, err := h.conf.Signer()
+	if err != nil {
+		h.logger.Println("logout:", err)
+		return
+	}
+
+	logout, err := assertion.NewLogout(email, app.Name, time.Now())
+	if err != nil {
+		h.logger.Println("logout:", err)
+		return
+	}
+
+	token, err := logout.Sign(key, h.conf.IssuerURL())
+	if err != nil {
+		h.logger.Println("logout:", err)
+		return
+	}
+
+	body := url.Values{"logout_token": {token}}.Encode()
+	resp, err := h.client.Post(app.BackChannelLogoutURI, "application/x-www-form-urlencoded", strings.NewReader(body))
+	if err != nil {
+		h.logger.Println("logout: could not notify", app.Name, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		h.logger.Println("logout: could not notify", app.Name, resp.Status)
+	}
+}
+
+// Logout signs the user out of uberich, ending all of their sessions including
+// those for apps behind /verify, then tells each app they signed in to during
+// the session using the app's front-channel and back-channel logout URIs.
+func Logout(conf *config.Config, db storage.Storage, store cookies.Store, logger *log.Logger) http.Handler {
+	handler := &logoutHandler{conf, db, store, logger, &http.Client{Timeout: backChannelTimeout}}
+
+	return mux.Method{
+		"GET":  http.HandlerFunc(handler.Get),
+		"POST": http.HandlerFunc(handler.Post),
+	}
+}
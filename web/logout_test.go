@@ -0,0 +1,98 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/assertion"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/jwt"
+	"hawx.me/code/uberich/storage"
+)
+
+func TestLogout(t *testing.T) {
+	backChannel := make(chan string, 1)
+	backChannelServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backChannel <- r.PostFormValue("logout_token")
+	}))
+	defer backChannelServer.Close()
+
+	email := "me@example.com"
+	testApp := &config.App{
+		Name:                  "testing",
+		URI:                   "http://app.example.com/",
+		FrontChannelLogoutURI: "http://app.example.com/signed-out",
+		BackChannelLogoutURI:  backChannelServer.URL,
+	}
+	otherApp := &config.App{
+		Name:                  "other",
+		URI:                   "http://other.example.com/",
+		FrontChannelLogoutURI: "http://other.example.com/signed-out",
+	}
+
+	conf := conf(testApp)
+	conf.SetApp(otherApp)
+
+	store := storeWith(email)
+	loginServer := httptest.NewServer(testLogin(conf, store))
+	defer loginServer.Close()
+
+	if _, err := noRedirectClient().Get(loginServer.URL + "?application=testing&redirect_uri=http://app.example.com/"); err != nil {
+		t.Fatal(err)
+	}
+
+	logoutServer := httptest.NewServer(Logout(conf, storage.NewTOML(conf, ""), store, discardLogger))
+	defer logoutServer.Close()
+
+	resp, err := httpPost(logoutServer.URL, map[string]string{
+		"application":  "testing",
+		"redirect_uri": "http://app.example.com/bye",
+	})
+
+	assert := assert.New(t)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), `<iframe src="http://app.example.com/signed-out?iss=https%3A%2F%2Fuberich.example.com" hidden>`))
+	assert.False(strings.Contains(string(body), "other.example.com"))
+	assert.True(strings.Contains(string(body), `<a href="http://app.example.com/bye">`))
+
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+
+	select {
+	case token := <-backChannel:
+		key, _ := conf.Signer()
+		logout, err := assertion.ParseLogout(token, jwt.KeySet{Keys: []jwt.JWK{key.Public()}}, conf.IssuerURL(), "testing", time.Now())
+		assert.Nil(err)
+		assert.Equal(email, logout.Email)
+
+	case <-time.After(time.Second):
+		t.Error("time out")
+	}
+}
+
+func TestLogoutWhenRedirectNotAllowed(t *testing.T) {
+	conf := conf(&config.App{Name: "testing", URI: "http://app.example.com/"})
+
+	logoutServer := httptest.NewServer(Logout(conf, storage.NewTOML(conf, ""), emptyStore(), discardLogger))
+	defer logoutServer.Close()
+
+	resp, err := httpPost(logoutServer.URL, map[string]string{
+		"application":  "testing",
+		"redirect_uri": "http://evil.example.com/",
+	})
+
+	assert := assert.New(t)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.False(strings.Contains(string(body), "evil.example.com"))
+}
@@ -0,0 +1,272 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
+)
+
+const magicLinkPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Sign in</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <p>{{.}}</p>
+  </body>
+</html>`
+
+const magicLinkEmail = `Someone, hopefully you, asked to sign in to %s.
+
+To sign in follow this link, in the same browser, within the next 10 minutes:
+
+  %s
+
+If you did not ask for this you can ignore this email.
+`
+
+var magicLinkTmpl = template.Must(template.New("magicLink").Parse(magicLinkPage))
+
+// magicLinkLifetime is how long a magic link can be used for.
+const magicLinkLifetime = 10 * time.Minute
+
+// magicToken is signed and encrypted into the link sent to the user. It
+// continues the sign in that was started when it was requested.
+type magicToken struct {
+	Email       string
+	Nonce       string
+	Application string
+	RedirectURI string
+	State       string
+}
+
+type magicLinkHandler struct {
+	conf    *config.Config
+	db      storage.Storage
+	store   cookies.Store
+	checker *auth.Checker
+	logger  *log.Logger
+	tokens  *securecookie.SecureCookie
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// app returns the app named if it can be signed in to with a magic link, and
+// redirected to redirectURI.
+func (h *magicLinkHandler) app(name, redirectURI string) (*config.App, bool) {
+	app, err := h.db.GetApp(name)
+	if err != nil || !app.MagicLinks || !app.CanRedirectTo(redirectURI) {
+		return nil, false
+	}
+
+	return app, true
+}
+
+// use marks the nonce as used, returning false if it already had been.
+func (h *magicLinkHandler) use(nonce string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for k, at := range h.used {
+		if now.Sub(at) > magicLinkLifetime {
+			delete(h.used, k)
+		}
+	}
+
+	if _, ok := h.used[nonce]; ok {
+		return false
+	}
+
+	h.used[nonce] = now
+	return true
+}
+
+func (h *magicLinkHandler) Post(w http.ResponseWriter, r *http.Request) {
+	var (
+		email       = r.PostFormValue("email")
+		application = r.PostFormValue("application")
+		redirectURI = r.PostFormValue("redirect_uri")
+		state       = r.PostFormValue("state")
+	)
+
+	mailer := h.conf.Mail()
+	if mailer == nil {
+		http.Error(w, "magic links are not available", http.StatusNotFound)
+		return
+	}
+
+	if _, ok := h.app(application, redirectURI); !ok {
+		h.logger.Println("magic-link: not enabled for", application, redirectURI)
+		http.Error(w, "magic links are not available", http.StatusBadRequest)
+		return
+	}
+
+	if !h.checker.CanMail(client(r), email) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		magicLinkTmpl.Execute(w, "Too many emails have been asked for, try again later.")
+		return
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		h.logger.Println("magic-link:", err)
+		http.Error(w, "could not send link", http.StatusInternalServerError)
+		return
+	}
+
+	// The link only works in the browser that has this cookie, so a link that
+	// is intercepted can't be used elsewhere.
+	encodedNonce, err := h.tokens.Encode("uberich-magic-nonce", nonce)
+	if err != nil {
+		h.logger.Println("magic-link:", err)
+		http.Error(w, "could not send link", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "uberich-magic",
+		Value:    encodedNonce,
+		Path:     "/login/magic",
+		MaxAge:   int(magicLinkLifetime / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.conf.IssuerURL(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Whether or not the user exists the response is the same, so that this
+	// can't be used to find who has an account.
+	if user, err := h.db.GetUser(email); err == nil && !user.IsPending() {
+		token, err := h.tokens.Encode("uberich-magic", magicToken{
+			Email:       user.Email,
+			Nonce:       nonce,
+			Application: application,
+			RedirectURI: redirectURI,
+			State:       state,
+		})
+		if err != nil {
+			h.logger.Println("magic-link:", err)
+			http.Error(w, "could not send link", http.StatusInternalServerError)
+			return
+		}
+
+		link := withParams(&url.URL{Path: "/login/magic"}, map[string]string{"token": token})
+
+		go func() {
+			body := fmt.Sprintf(magicLinkEmail, application, h.conf.IssuerURL()+link)
+
+			if err := mailer.Send(user.Email, "Sign in to "+application, body); err != nil {
+				h.logger.Println("magic-link: could not send to", user.Email, err)
+				return
+			}
+
+			h.logger.Println("magic-link: sent to", user.Email)
+		}()
+	}
+
+	magicLinkTmpl.Execute(w, "If there is an account for that address, an email has been sent to it with a link to sign in. Open it in this browser within the next 10 minutes.")
+}
+
+func (h *magicLinkHandler) Get(w http.ResponseWriter, r *http.Request) {
+	var token magicToken
+	if err := h.tokens.Decode("uberich-magic", r.FormValue("token"), &token); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		magicLinkTmpl.Execute(w, "This link has expired, sign in again to be sent another.")
+		return
+	}
+
+	var nonce string
+	cookie, err := r.Cookie("uberich-magic")
+	if err == nil {
+		err = h.tokens.Decode("uberich-magic-nonce", cookie.Value, &nonce)
+	}
+	if err != nil || subtle.ConstantTimeCompare([]byte(nonce), []byte(token.Nonce)) != 1 {
+		h.logger.Println("magic-link: opened in another browser by", token.Email)
+		w.WriteHeader(http.StatusBadRequest)
+		magicLinkTmpl.Execute(w, "This link must be opened in the browser you asked for it in.")
+		return
+	}
+
+	if !h.use(token.Nonce, time.Now()) {
+		w.WriteHeader(http.StatusBadRequest)
+		magicLinkTmpl.Execute(w, "This link has already been used, sign in again to be sent another.")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   "uberich-magic",
+		Value:  "",
+		Path:   "/login/magic",
+		MaxAge: -1,
+	})
+
+	app, ok := h.app(token.Application, token.RedirectURI)
+	if !ok {
+		h.logger.Println("magic-link: no longer enabled for", token.Application)
+		http.Error(w, "magic links are not available", http.StatusBadRequest)
+		return
+	}
+
+	if !allowed(w, h.db, h.logger, app, token.Email) {
+		return
+	}
+
+	next := withParams(&url.URL{Path: "/login"}, map[string]string{
+		"application":  token.Application,
+		"redirect_uri": token.RedirectURI,
+		"state":        token.State,
+	})
+
+	location, err := signIn(w, r, h.db, h.store, h.logger, token.Email, config.MagicLink, next)
+	if err == errLocked {
+		h.logger.Println("magic-link: locked out", token.Email)
+		w.WriteHeader(http.StatusForbidden)
+		magicLinkTmpl.Execute(w, "This account is temporarily locked after too many failed attempts to sign in. Try again later.")
+		return
+	}
+	if err != nil {
+		h.logger.Println("magic-link: could not sign in:", err)
+		http.Error(w, "could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// MagicLink lets users sign in to apps that allow it by following a link
+// emailed to them, rather than giving their password. Once signed in the user
+// continues to /login, as if they had signed in there.
+func MagicLink(conf *config.Config, db storage.Storage, store cookies.Store, checker *auth.Checker, logger *log.Logger) http.Handler {
+	hashKey, blockKey, _ := conf.Keys()
+
+	handler := &magicLinkHandler{
+		conf:    conf,
+		db:      db,
+		store:   store,
+		checker: checker,
+		logger:  logger,
+		tokens:  securecookie.New(hashKey, blockKey).MaxAge(int(magicLinkLifetime / time.Second)),
+		used:    map[string]time.Time{},
+	}
+
+	return mux.Method{
+		"GET":  http.HandlerFunc(handler.Get),
+		"POST": http.HandlerFunc(handler.Post),
+	}
+}
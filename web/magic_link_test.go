@@ -0,0 +1,209 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+var magicLinkRe = regexp.MustCompile(`https://uberich\.example\.com(/login/magic\?token=\S+)`)
+
+func magicLinkServer(t *testing.T, app *config.App) (*httptest.Server, storage.Storage, *fakeStore, func() string) {
+	conf, mailServer := mailConf(t, app)
+	addUser(conf, "me@example.com", "password")
+
+	db := storage.NewTOML(conf, "")
+	store := emptyStore()
+
+	mux := http.NewServeMux()
+	mux.Handle("/login", testLogin(conf, store))
+	mux.Handle("/login/magic", MagicLink(conf, db, store, auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, db, store, func() string {
+		return receiveLink(t, mailServer, "me@example.com", magicLinkRe)
+	}
+}
+
+func TestMagicLink(t *testing.T) {
+	app := &config.App{Name: "testing", URI: "http://app.example.com/", MagicLinks: true}
+	server, _, store, receive := magicLinkServer(t, app)
+
+	jar, _ := cookiejar.New(nil)
+	browser := noRedirectClient()
+	browser.Jar = jar
+
+	assert := assert.New(t)
+
+	resp, err := browser.Get(server.URL + "/login?application=testing&redirect_uri=http://app.example.com/callback&state=abc")
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), "Email me a sign in link"))
+
+	resp, err = browser.PostForm(server.URL+"/login/magic", url.Values{
+		"email":        {"me@example.com"},
+		"application":  {"testing"},
+		"redirect_uri": {"http://app.example.com/callback"},
+		"state":        {"abc"},
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	link := receive()
+
+	// Another browser can't use the link.
+	resp, err = noRedirectClient().Get(server.URL + link)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+
+	resp, err = browser.Get(server.URL + link)
+	assert.Nil(err)
+	assert.Equal(http.StatusFound, resp.StatusCode)
+
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal("/login", location.Path)
+	assert.Equal("testing", location.Query().Get("application"))
+	assert.Equal("http://app.example.com/callback", location.Query().Get("redirect_uri"))
+	assert.Equal("abc", location.Query().Get("state"))
+
+	email, err := store.Get(nil)
+	assert.Nil(err)
+	assert.Equal("me@example.com", email)
+
+	// The link only works once.
+	store.Unset(nil, nil)
+	resp, err = browser.Get(server.URL + link)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+}
+
+func TestMagicLinkWhenLockedOut(t *testing.T) {
+	app := &config.App{Name: "testing", URI: "http://app.example.com/", MagicLinks: true}
+	server, db, store, receive := magicLinkServer(t, app)
+
+	jar, _ := cookiejar.New(nil)
+	browser := noRedirectClient()
+	browser.Jar = jar
+
+	assert := assert.New(t)
+
+	_, err := browser.PostForm(server.URL+"/login/magic", url.Values{
+		"email":        {"me@example.com"},
+		"application":  {"testing"},
+		"redirect_uri": {"http://app.example.com/callback"},
+	})
+	assert.Nil(err)
+
+	link := receive()
+
+	_, err = db.UpdateLockout("me@example.com", func(lockout *config.Lockout) { lockout.Locked = true })
+	assert.Nil(err)
+
+	resp, err := browser.Get(server.URL + link)
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), "temporarily locked"))
+
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+}
+
+func TestMagicLinkOnlySignsInToAppsAllowingThem(t *testing.T) {
+	app := &config.App{Name: "testing", URI: "http://app.example.com/", MagicLinks: true}
+	server, db, _, receive := magicLinkServer(t, app)
+	db.SetApp(&config.App{Name: "other", URI: "http://other.example.com/"})
+
+	jar, _ := cookiejar.New(nil)
+	browser := noRedirectClient()
+	browser.Jar = jar
+
+	assert := assert.New(t)
+
+	_, err := browser.PostForm(server.URL+"/login/magic", url.Values{
+		"email":        {"me@example.com"},
+		"application":  {"testing"},
+		"redirect_uri": {"http://app.example.com/callback"},
+	})
+	assert.Nil(err)
+
+	resp, err := browser.Get(server.URL + receive())
+	assert.Nil(err)
+	assert.Equal(http.StatusFound, resp.StatusCode)
+
+	resp, err = browser.Get(server.URL + "/login?application=testing&redirect_uri=http://app.example.com/callback")
+	assert.Nil(err)
+	assert.Equal(http.StatusFound, resp.StatusCode)
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal("app.example.com", location.Host)
+	assert.NotEqual("", location.Query().Get("assertion"))
+
+	// The other app needs a password.
+	resp, err = browser.Get(server.URL + "/login?application=other&redirect_uri=http://other.example.com/callback")
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), `name="pass"`))
+}
+
+func TestMagicLinkWhenAppHasNotEnabled(t *testing.T) {
+	app := &config.App{Name: "testing", URI: "http://app.example.com/"}
+	server, _, _, _ := magicLinkServer(t, app)
+
+	assert := assert.New(t)
+
+	resp, err := httpGet(server.URL+"/login", map[string]string{
+		"application":  "testing",
+		"redirect_uri": "http://app.example.com/callback",
+	})
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.False(strings.Contains(string(body), "Email me a sign in link"))
+
+	resp, err = httpPost(server.URL+"/login/magic", map[string]string{
+		"email":        "me@example.com",
+		"application":  "testing",
+		"redirect_uri": "http://app.example.com/callback",
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestMagicLinkIsLimited(t *testing.T) {
+	app := &config.App{Name: "testing", URI: "http://app.example.com/", MagicLinks: true}
+	server, _, _, receive := magicLinkServer(t, app)
+
+	assert := assert.New(t)
+
+	form := map[string]string{
+		"email":        "me@example.com",
+		"application":  "testing",
+		"redirect_uri": "http://app.example.com/callback",
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := httpPost(server.URL+"/login/magic", form)
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		receive()
+	}
+
+	resp, err := httpPost(server.URL+"/login/magic", form)
+	assert.Nil(err)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+}
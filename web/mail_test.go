@@ -0,0 +1,49 @@
+package web
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/mail/mailtest"
+)
+
+// mailConf is like savedConf, but has the keys needed to sign tokens and sends
+// emails to the server returned.
+func mailConf(t *testing.T, app *config.App) (*config.Config, *mailtest.Server) {
+	mailServer, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mailServer.Close)
+
+	conf := savedConf(t, app)
+	conf.HashKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	conf.BlockKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+	conf.SMTPAddr = mailServer.Addr
+
+	return conf, mailServer
+}
+
+// receiveLink waits for an email to be sent to email, and returns the path of
+// the link in it that matches re.
+func receiveLink(t *testing.T, mailServer *mailtest.Server, email string, re *regexp.Regexp) string {
+	select {
+	case msg := <-mailServer.Messages:
+		if len(msg.To) != 1 || msg.To[0] != email {
+			t.Fatal("email sent to", msg.To)
+		}
+
+		match := re.FindStringSubmatch(msg.Data)
+		if len(match) != 2 {
+			t.Fatal("no link in email:", msg.Data)
+		}
+		return match[1]
+
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for email")
+	}
+
+	return ""
+}
@@ -0,0 +1,422 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinas/nosurf"
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/jwt"
+	"hawx.me/code/uberich/storage"
+)
+
+const (
+	codeLifetime        = time.Minute
+	accessTokenLifetime = time.Hour
+	idTokenLifetime     = 10 * time.Minute
+)
+
+// authorizeParams are the parameters of an authorization request that need to
+// be kept while the user logs in.
+var authorizeParams = []string{
+	"response_type",
+	"client_id",
+	"redirect_uri",
+	"scope",
+	"state",
+	"nonce",
+	"code_challenge",
+	"code_challenge_method",
+}
+
+// grant records who authorised what, for both authorization codes and access
+// tokens.
+type grant struct {
+	App         string
+	Email       string
+	RedirectURI string
+	Nonce       string
+	Challenge   string
+	Expires     time.Time
+}
+
+type openIDHandler struct {
+	conf    *config.Config
+	db      storage.Storage
+	store   cookies.Store
+	logger  *log.Logger
+	checker *auth.Checker
+
+	mu     sync.Mutex
+	codes  map[string]grant
+	tokens map[string]grant
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+// put stores g under a new random key in m, removing any grants that have
+// expired.
+func (h *openIDHandler) put(m map[string]grant, g grant) (string, error) {
+	key, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range m {
+		if now.After(v.Expires) {
+			delete(m, k)
+		}
+	}
+
+	m[key] = g
+	return key, nil
+}
+
+func (h *openIDHandler) Discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := h.conf.IssuerURL()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"scopes_supported":                      []string{"openid", "email"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "nonce", "email", "email_verified"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+	})
+}
+
+func (h *openIDHandler) Keys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.conf.Signers()
+	if err != nil {
+		h.logger.Println("keys:", err)
+		http.Error(w, "no keys", http.StatusInternalServerError)
+		return
+	}
+
+	set := jwt.KeySet{Keys: []jwt.JWK{}}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, key.Public())
+	}
+
+	writeJSON(w, http.StatusOK, set)
+}
+
+func (h *openIDHandler) GetAuthorize(w http.ResponseWriter, r *http.Request) {
+	params := map[string]string{}
+	for _, name := range authorizeParams {
+		params[name] = r.FormValue(name)
+	}
+
+	app, err := h.db.GetApp(params["client_id"])
+	if err != nil || !app.CanRedirectTo(params["redirect_uri"]) {
+		h.logger.Println("authorize: no such app or cannot redirect", params["client_id"], params["redirect_uri"])
+		http.Error(w, "no such app", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, err := url.Parse(params["redirect_uri"])
+	if err != nil {
+		h.logger.Println("authorize: could not parse redirect_uri")
+		http.Error(w, "could not parse redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	respond := func(result map[string]string) {
+		if params["state"] != "" {
+			result["state"] = params["state"]
+		}
+		redirectWithParams(w, r, redirectURI, result)
+	}
+
+	if params["response_type"] != "code" {
+		respond(map[string]string{"error": "unsupported_response_type"})
+		return
+	}
+
+	if !hasScope(params["scope"], "openid") {
+		respond(map[string]string{"error": "invalid_scope"})
+		return
+	}
+
+	if params["code_challenge"] == "" || params["code_challenge_method"] != "S256" {
+		respond(map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	session, err := h.store.Session(r)
+	if err != nil || !session.CanSignInTo(app) {
+		if r.FormValue("prompt") == "none" {
+			respond(map[string]string{"error": "login_required"})
+			return
+		}
+
+		loginTmpl.Execute(w, loginCtx{
+			Action:     "/authorize",
+			Token:      nosurf.Token(r),
+			Params:     params,
+			WasProblem: r.FormValue("problem") != "",
+			Locked:     r.FormValue("problem") == "locked",
+			Next:       withParams(&url.URL{Path: "/authorize"}, params),
+
+			CanResetPassword: h.conf.Mail() != nil,
+		})
+		return
+	}
+
+	email := session.Email
+	if mustEnrol(w, r, h.db, email) || !allowed(w, h.db, h.logger, app, email) {
+		return
+	}
+
+	code, err := h.put(h.codes, grant{
+		App:         app.Name,
+		Email:       email,
+		RedirectURI: params["redirect_uri"],
+		Nonce:       params["nonce"],
+		Challenge:   params["code_challenge"],
+		Expires:     time.Now().Add(codeLifetime),
+	})
+	if err != nil {
+		h.logger.Println("authorize:", err)
+		respond(map[string]string{"error": "server_error"})
+		return
+	}
+
+	if err := h.store.Visit(w, r, app.Name); err != nil {
+		h.logger.Println("authorize: could not record visit:", err)
+	}
+
+	respond(map[string]string{"code": code})
+}
+
+func (h *openIDHandler) PostAuthorize(w http.ResponseWriter, r *http.Request) {
+	var (
+		email  = r.PostFormValue("email")
+		pass   = r.PostFormValue("pass")
+		params = map[string]string{}
+	)
+
+	for _, name := range authorizeParams {
+		params[name] = r.PostFormValue(name)
+	}
+
+	if !h.checker.IsAuthorised(client(r), email, pass) {
+		params["problem"] = loginProblem(h.checker, email)
+		redirectWithParams(w, r, r.URL, params)
+		return
+	}
+
+	if app, err := h.db.GetApp(params["client_id"]); err == nil && !allowed(w, h.db, h.logger, app, email) {
+		return
+	}
+
+	location, err := signIn(w, r, h.db, h.store, h.logger, email, "password", withParams(r.URL, params))
+	if err != nil {
+		h.logger.Println("authorize: could not sign in:", err)
+		params["problem"] = "yes"
+		redirectWithParams(w, r, r.URL, params)
+		return
+	}
+
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+func (h *openIDHandler) Token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+
+	// An app without a secret can't authenticate, otherwise anyone could ask for
+	// its tokens by sending an empty one.
+	app, err := h.db.GetApp(clientID)
+	if err != nil || app.Secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(app.Secret)) != 1 {
+		h.logger.Println("token: client authentication failed", clientID)
+		w.Header().Set("WWW-Authenticate", `Basic realm="uberich"`)
+		writeJSONError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeJSONError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	h.mu.Lock()
+	code, ok := h.codes[r.PostFormValue("code")]
+	delete(h.codes, r.PostFormValue("code"))
+	h.mu.Unlock()
+
+	now := time.Now()
+
+	if !ok || now.After(code.Expires) || code.App != app.Name || code.RedirectURI != r.PostFormValue("redirect_uri") {
+		h.logger.Println("token: invalid code for", app.Name)
+		writeJSONError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != code.Challenge {
+		h.logger.Println("token: code_verifier does not match for", app.Name)
+		writeJSONError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	key, err := h.conf.Signer()
+	if err != nil {
+		h.logger.Println("token:", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	idToken, err := key.Sign(jwt.Claims{
+		Issuer:        h.conf.IssuerURL(),
+		Subject:       code.Email,
+		Audience:      app.Name,
+		IssuedAt:      now.Unix(),
+		Expiry:        now.Add(idTokenLifetime).Unix(),
+		Nonce:         code.Nonce,
+		Email:         code.Email,
+		EmailVerified: true,
+	})
+	if err != nil {
+		h.logger.Println("token:", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	record(h.db, h.logger, r, storage.Event{Type: storage.EventAssertion, Email: code.Email, App: app.Name, Detail: "id token"})
+
+	code.Expires = now.Add(accessTokenLifetime)
+	accessToken, err := h.put(h.tokens, code)
+	if err != nil {
+		h.logger.Println("token:", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenLifetime.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func (h *openIDHandler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="uberich"`)
+		writeJSONError(w, http.StatusUnauthorized, "invalid_token")
+		return
+	}
+
+	h.mu.Lock()
+	token, ok := h.tokens[strings.TrimPrefix(header, "Bearer ")]
+	h.mu.Unlock()
+
+	if !ok || time.Now().After(token.Expires) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="uberich", error="invalid_token"`)
+		writeJSONError(w, http.StatusUnauthorized, "invalid_token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":            token.Email,
+		"email":          token.Email,
+		"email_verified": true,
+	})
+}
+
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenIDHandlers are the endpoints that allow uberich to act as an OpenID
+// Connect provider.
+type OpenIDHandlers struct {
+	Discovery http.Handler
+	Keys      http.Handler
+	Authorize http.Handler
+	Token     http.Handler
+	UserInfo  http.Handler
+}
+
+// OpenID implements the authorization code flow of OpenID Connect, using PKCE
+// and with registered apps as the clients. Users log in with the same form and
+// cookie as Login.
+func OpenID(conf *config.Config, db storage.Storage, store cookies.Store, checker *auth.Checker, logger *log.Logger) OpenIDHandlers {
+	handler := &openIDHandler{
+		conf:    conf,
+		db:      db,
+		store:   store,
+		logger:  logger,
+		checker: checker,
+		codes:   map[string]grant{},
+		tokens:  map[string]grant{},
+	}
+
+	return OpenIDHandlers{
+		Discovery: mux.Method{"GET": http.HandlerFunc(handler.Discovery)},
+		Keys:      mux.Method{"GET": http.HandlerFunc(handler.Keys)},
+		Authorize: mux.Method{
+			"GET":  http.HandlerFunc(handler.GetAuthorize),
+			"POST": http.HandlerFunc(handler.PostAuthorize),
+		},
+		Token: mux.Method{"POST": http.HandlerFunc(handler.Token)},
+		UserInfo: mux.Method{
+			"GET":  http.HandlerFunc(handler.UserInfo),
+			"POST": http.HandlerFunc(handler.UserInfo),
+		},
+	}
+}
@@ -0,0 +1,298 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/jwt"
+	"hawx.me/code/uberich/storage"
+)
+
+func openIDServer(t *testing.T, conf *config.Config, store *fakeStore) *httptest.Server {
+	db := storage.NewTOML(conf, "")
+	openID := OpenID(conf, db, store, auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger)
+
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/openid-configuration", openID.Discovery)
+	mux.Handle("/.well-known/jwks.json", openID.Keys)
+	mux.Handle("/authorize", openID.Authorize)
+	mux.Handle("/token", openID.Token)
+	mux.Handle("/userinfo", openID.UserInfo)
+
+	return httptest.NewServer(mux)
+}
+
+func noRedirectClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func authorize(t *testing.T, serverURL string, params map[string]string) url.Values {
+	u, _ := url.Parse(serverURL + "/authorize")
+	q := u.Query()
+	for k, v := range params {
+		q.Add(k, v)
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := noRedirectClient().Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal("expected redirect, got", resp.StatusCode)
+	}
+
+	location, _ := resp.Location()
+	return location.Query()
+}
+
+func pkce(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func exchange(serverURL string, app *config.App, params map[string]string) (*http.Response, map[string]interface{}) {
+	q := url.Values{}
+	for k, v := range params {
+		q.Add(k, v)
+	}
+
+	req, _ := http.NewRequest("POST", serverURL+"/token", strings.NewReader(q.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(app.Name, app.Secret)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp, body
+}
+
+func TestOpenID(t *testing.T) {
+	email := "me@example.com"
+	testApp := &config.App{
+		Name:   "testing",
+		URI:    "https://app.example.com/",
+		Secret: "i have secrets",
+	}
+
+	server := openIDServer(t, conf(testApp), storeWith(email))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	verifier := "a-long-random-string-for-pkce-that-only-the-app-knows"
+	result := authorize(t, server.URL, map[string]string{
+		"response_type":         "code",
+		"client_id":             testApp.Name,
+		"redirect_uri":          testApp.URI + "callback",
+		"scope":                 "openid email",
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        pkce(verifier),
+		"code_challenge_method": "S256",
+	})
+
+	assert.Equal("the-state", result.Get("state"))
+	assert.NotEqual("", result.Get("code"))
+
+	resp, token := exchange(server.URL, testApp, map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          result.Get("code"),
+		"redirect_uri":  testApp.URI + "callback",
+		"code_verifier": verifier,
+	})
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("Bearer", token["token_type"])
+
+	keysResp, _ := http.Get(server.URL + "/.well-known/jwks.json")
+	var keys jwt.KeySet
+	json.NewDecoder(keysResp.Body).Decode(&keys)
+
+	var claims jwt.Claims
+	idToken, _ := token["id_token"].(string)
+	assert.Nil(keys.Verify(idToken, &claims))
+	assert.Nil(claims.Validate("https://uberich.example.com", testApp.Name, time.Now()))
+	assert.Equal(email, claims.Subject)
+	assert.Equal(email, claims.Email)
+	assert.Equal("the-nonce", claims.Nonce)
+
+	req, _ := http.NewRequest("GET", server.URL+"/userinfo", nil)
+	accessToken, _ := token["access_token"].(string)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, _ = http.DefaultClient.Do(req)
+	assert.Equal(200, resp.StatusCode)
+
+	var userInfo map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&userInfo)
+	assert.Equal(email, userInfo["email"])
+
+	// codes can only be used once
+	resp, token = exchange(server.URL, testApp, map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          result.Get("code"),
+		"redirect_uri":  testApp.URI + "callback",
+		"code_verifier": verifier,
+	})
+	assert.Equal(400, resp.StatusCode)
+	assert.Equal("invalid_grant", token["error"])
+}
+
+func TestOpenIDWithBadExchange(t *testing.T) {
+	email := "me@example.com"
+	testApp := &config.App{
+		Name:   "testing",
+		URI:    "https://app.example.com/",
+		Secret: "i have secrets",
+	}
+
+	verifier := "a-long-random-string-for-pkce-that-only-the-app-knows"
+
+	testCases := map[string]struct {
+		Secret, RedirectURI, Verifier string
+		Status                        int
+	}{
+		"wrong verifier":     {testApp.Secret, testApp.URI + "callback", "something else", 400},
+		"wrong redirect_uri": {testApp.Secret, testApp.URI + "other", verifier, 400},
+		"wrong secret":       {"not the secret", testApp.URI + "callback", verifier, 401},
+	}
+
+	for name, testCase := range testCases {
+		server := openIDServer(t, conf(testApp), storeWith(email))
+		defer server.Close()
+
+		result := authorize(t, server.URL, map[string]string{
+			"response_type":         "code",
+			"client_id":             testApp.Name,
+			"redirect_uri":          testApp.URI + "callback",
+			"scope":                 "openid",
+			"code_challenge":        pkce(verifier),
+			"code_challenge_method": "S256",
+		})
+
+		app := *testApp
+		app.Secret = testCase.Secret
+
+		resp, _ := exchange(server.URL, &app, map[string]string{
+			"grant_type":    "authorization_code",
+			"code":          result.Get("code"),
+			"redirect_uri":  testCase.RedirectURI,
+			"code_verifier": testCase.Verifier,
+		})
+
+		assert.New(t).Equal(testCase.Status, resp.StatusCode, name)
+	}
+}
+
+func TestOpenIDWithoutSecret(t *testing.T) {
+	testApp := &config.App{
+		Name: "testing",
+		URI:  "https://app.example.com/",
+	}
+
+	server := openIDServer(t, conf(testApp), storeWith("me@example.com"))
+	defer server.Close()
+
+	verifier := "a-long-random-string-for-pkce-that-only-the-app-knows"
+	result := authorize(t, server.URL, map[string]string{
+		"response_type":         "code",
+		"client_id":             testApp.Name,
+		"redirect_uri":          testApp.URI + "callback",
+		"scope":                 "openid",
+		"code_challenge":        pkce(verifier),
+		"code_challenge_method": "S256",
+	})
+
+	resp, body := exchange(server.URL, testApp, map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          result.Get("code"),
+		"redirect_uri":  testApp.URI + "callback",
+		"code_verifier": verifier,
+	})
+
+	assert := assert.New(t)
+	assert.Equal(401, resp.StatusCode)
+	assert.Equal("invalid_client", body["error"])
+}
+
+func TestOpenIDAuthorizeWithoutPKCE(t *testing.T) {
+	testApp := &config.App{
+		Name:   "testing",
+		URI:    "https://app.example.com/",
+		Secret: "i have secrets",
+	}
+
+	server := openIDServer(t, conf(testApp), storeWith("me@example.com"))
+	defer server.Close()
+
+	result := authorize(t, server.URL, map[string]string{
+		"response_type": "code",
+		"client_id":     testApp.Name,
+		"redirect_uri":  testApp.URI + "callback",
+		"scope":         "openid",
+		"state":         "the-state",
+	})
+
+	assert := assert.New(t)
+	assert.Equal("invalid_request", result.Get("error"))
+	assert.Equal("the-state", result.Get("state"))
+	assert.Equal("", result.Get("code"))
+}
+
+func TestOpenIDAuthorizeWithUnregisteredRedirect(t *testing.T) {
+	testApp := &config.App{
+		Name:   "testing",
+		URI:    "https://app.example.com/",
+		Secret: "i have secrets",
+	}
+
+	server := openIDServer(t, conf(testApp), storeWith("me@example.com"))
+	defer server.Close()
+
+	resp, err := httpGet(server.URL+"/authorize", map[string]string{
+		"response_type":         "code",
+		"client_id":             testApp.Name,
+		"redirect_uri":          "https://evil.example.com/callback",
+		"scope":                 "openid",
+		"code_challenge":        pkce("verifier"),
+		"code_challenge_method": "S256",
+	})
+
+	assert := assert.New(t)
+	assert.Nil(err)
+	assert.Equal(400, resp.StatusCode)
+}
+
+func TestOpenIDDiscovery(t *testing.T) {
+	server := openIDServer(t, conf(&config.App{}), emptyStore())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/.well-known/openid-configuration")
+
+	assert := assert.New(t)
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+
+	var discovery map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&discovery)
+	assert.Equal("https://uberich.example.com", discovery["issuer"])
+	assert.Equal("https://uberich.example.com/token", discovery["token_endpoint"])
+	assert.Equal("https://uberich.example.com/.well-known/jwks.json", discovery["jwks_uri"])
+}
@@ -0,0 +1,405 @@
+package web
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinas/nosurf"
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
+	"hawx.me/code/uberich/webauthn"
+)
+
+const passkeyChallengeLifetime = 5 * time.Minute
+
+const passkeysPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Passkeys</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <h1>Passkeys</h1>
+
+    <p class="problem" id="passkey-problem" hidden>Try again!</p>
+
+    {{ if .Credentials }}
+      <ul>
+        {{ range .Credentials }}
+          <li>
+            <form method="post" action="/passkeys">
+              {{.Name}}, added {{.CreatedAt.Format "2 Jan 2006"}}
+              <input type="hidden" name="remove" value="{{.ID}}" />
+              <input type="hidden" name="csrf_token" value="{{$.Token}}" />
+              <input type="submit" value="Remove" />
+            </form>
+          </li>
+        {{ end }}
+      </ul>
+    {{ else }}
+      <p>You have no passkeys.</p>
+    {{ end }}
+
+    <fieldset>
+      <label for="name">Name</label>
+      <input type="text" id="name" name="name" />
+    </fieldset>
+
+    <input type="hidden" name="csrf_token" value="{{.Token}}" />
+    <button type="button" data-passkey="register" hidden>Add a passkey</button>
+
+    <script src="/passkeys.js"></script>
+  </body>
+</html>`
+
+var passkeysTmpl = template.Must(template.New("passkeys").Parse(passkeysPage))
+
+type passkeysCtx struct {
+	Token       string
+	Credentials []config.Credential
+}
+
+// passkeyChallenge is a ceremony that has been started. For registration it
+// records who the passkey is for, for signing in that is only known at the end.
+type passkeyChallenge struct {
+	Email   string
+	Expires time.Time
+}
+
+type passkeyHandler struct {
+	conf   *config.Config
+	db     storage.Storage
+	store  cookies.Store
+	logger *log.Logger
+
+	mu         sync.Mutex
+	challenges map[string]passkeyChallenge
+}
+
+// relyingParty describes uberich as the site passkeys are registered with, which
+// is wherever its issuer URL points.
+func (h *passkeyHandler) relyingParty() webauthn.RelyingParty {
+	u, _ := url.Parse(h.conf.IssuerURL())
+
+	return webauthn.RelyingParty{
+		ID:     u.Hostname(),
+		Name:   "uberich",
+		Origin: u.Scheme + "://" + u.Host,
+	}
+}
+
+// begin starts a ceremony, removing any that have expired.
+func (h *passkeyHandler) begin(email string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for key, c := range h.challenges {
+		if now.After(c.Expires) {
+			delete(h.challenges, key)
+		}
+	}
+
+	h.challenges[challenge] = passkeyChallenge{
+		Email:   email,
+		Expires: now.Add(passkeyChallengeLifetime),
+	}
+
+	return challenge, nil
+}
+
+// take ends the ceremony for challenge, so that it can't be answered twice.
+func (h *passkeyHandler) take(challenge string) (passkeyChallenge, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, ok := h.challenges[challenge]
+	delete(h.challenges, challenge)
+
+	return c, ok && time.Now().Before(c.Expires)
+}
+
+func (h *passkeyHandler) GetManage(w http.ResponseWriter, r *http.Request) {
+	email, err := h.store.Get(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := h.db.GetUser(email)
+	if err != nil {
+		h.logger.Println("passkeys:", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	passkeysTmpl.Execute(w, passkeysCtx{
+		Token:       nosurf.Token(r),
+		Credentials: user.Credentials,
+	})
+}
+
+func (h *passkeyHandler) PostManage(w http.ResponseWriter, r *http.Request) {
+	email, err := h.store.Get(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := h.db.GetUser(email)
+	if err != nil {
+		h.logger.Println("passkeys:", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user.RemoveCredential(r.PostFormValue("remove"))
+
+	if err := h.db.SetUser(user); err != nil {
+		h.logger.Println("passkeys:", err)
+		http.Error(w, "could not save user", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, r.URL.Path, http.StatusFound)
+}
+
+func (h *passkeyHandler) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	email, err := h.store.Get(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "not_signed_in")
+		return
+	}
+
+	user, err := h.db.GetUser(email)
+	if err != nil {
+		h.logger.Println("passkeys:", err)
+		writeJSONError(w, http.StatusUnauthorized, "not_signed_in")
+		return
+	}
+
+	challenge, err := h.begin(email)
+	if err != nil {
+		h.logger.Println("passkeys:", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	var exclude []string
+	for _, credential := range user.Credentials {
+		exclude = append(exclude, credential.ID)
+	}
+
+	writeJSON(w, http.StatusOK, h.relyingParty().CreationOptions(challenge, email, email, exclude))
+}
+
+func (h *passkeyHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	email, err := h.store.Get(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "not_signed_in")
+		return
+	}
+
+	var body struct {
+		Name       string                       `json:"name"`
+		Credential webauthn.AttestationResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	challenge := body.Credential.Challenge()
+	if c, ok := h.take(challenge); !ok || c.Email != email {
+		h.logger.Println("passkeys: unknown challenge for", email)
+		writeJSONError(w, http.StatusBadRequest, "invalid_challenge")
+		return
+	}
+
+	credential, err := h.relyingParty().Register(body.Credential, challenge)
+	if err != nil {
+		h.logger.Println("passkeys:", err)
+		writeJSONError(w, http.StatusBadRequest, "invalid_credential")
+		return
+	}
+
+	user, err := h.db.GetUser(email)
+	if err != nil {
+		h.logger.Println("passkeys:", err)
+		writeJSONError(w, http.StatusUnauthorized, "not_signed_in")
+		return
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "passkey"
+	}
+
+	user.SetCredential(config.Credential{
+		ID:        credential.ID,
+		Name:      name,
+		PublicKey: credential.PublicKey,
+		SignCount: credential.SignCount,
+		CreatedAt: time.Now().UTC(),
+	})
+
+	if err := h.db.SetUser(user); err != nil {
+		h.logger.Println("passkeys:", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": credential.ID})
+}
+
+func (h *passkeyHandler) BeginLogin(w http.ResponseWriter, r *http.Request) {
+	challenge, err := h.begin("")
+	if err != nil {
+		h.logger.Println("passkeys:", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.relyingParty().RequestOptions(challenge))
+}
+
+// findUser returns the user the credential belongs to. Authenticators return
+// the user ID that was given at registration for discoverable credentials, but
+// if it is missing every user has to be checked.
+func (h *passkeyHandler) findUser(resp webauthn.AssertionResponse) (*config.User, config.Credential, bool) {
+	if email := resp.UserID(); email != "" {
+		user, err := h.db.GetUser(email)
+		if err != nil {
+			return nil, config.Credential{}, false
+		}
+
+		credential, ok := user.GetCredential(resp.ID)
+		return user, credential, ok
+	}
+
+	users, err := h.db.ListUsers()
+	if err != nil {
+		h.logger.Println("passkeys:", err)
+		return nil, config.Credential{}, false
+	}
+
+	for _, user := range users {
+		if credential, ok := user.GetCredential(resp.ID); ok {
+			return user, credential, true
+		}
+	}
+
+	return nil, config.Credential{}, false
+}
+
+func (h *passkeyHandler) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Next       string                     `json:"next"`
+		Credential webauthn.AssertionResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	challenge := body.Credential.Challenge()
+	if c, ok := h.take(challenge); !ok || c.Email != "" {
+		h.logger.Println("passkeys: unknown challenge")
+		writeJSONError(w, http.StatusBadRequest, "invalid_challenge")
+		return
+	}
+
+	user, stored, ok := h.findUser(body.Credential)
+	if !ok {
+		h.logger.Println("passkeys: unknown credential", body.Credential.ID)
+		writeJSONError(w, http.StatusBadRequest, "invalid_credential")
+		return
+	}
+
+	credential, verified, err := h.relyingParty().Verify(body.Credential, challenge, webauthn.Credential{
+		ID:        stored.ID,
+		PublicKey: stored.PublicKey,
+		SignCount: stored.SignCount,
+	})
+	if err != nil {
+		h.logger.Println("passkeys:", user.Email, err)
+		writeJSONError(w, http.StatusBadRequest, "invalid_credential")
+		return
+	}
+
+	stored.SignCount = credential.SignCount
+	user.SetCredential(stored)
+
+	if err := h.db.SetUser(user); err != nil {
+		h.logger.Println("passkeys:", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	method := "passkey"
+	if verified {
+		method = verifiedPasskey
+	}
+
+	location, err := signIn(w, r, h.db, h.store, h.logger, user.Email, method, safeNext(body.Next))
+	if err == errLocked {
+		h.logger.Println("passkeys: locked out", user.Email)
+		writeJSONError(w, http.StatusForbidden, "locked_out")
+		return
+	}
+	if err != nil {
+		h.logger.Println("passkeys: could not sign in:", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": location})
+}
+
+// PasskeyHandlers are the endpoints for managing and signing in with passkeys.
+type PasskeyHandlers struct {
+	Manage             http.Handler
+	BeginRegistration  http.Handler
+	FinishRegistration http.Handler
+	BeginLogin         http.Handler
+	FinishLogin        http.Handler
+}
+
+// Passkeys handles registering passkeys, and signing in with them instead of a
+// password. The ceremonies are run by /passkeys.js, which talks to the begin
+// and finish handlers.
+func Passkeys(conf *config.Config, db storage.Storage, store cookies.Store, logger *log.Logger) PasskeyHandlers {
+	handler := &passkeyHandler{
+		conf:       conf,
+		db:         db,
+		store:      store,
+		logger:     logger,
+		challenges: map[string]passkeyChallenge{},
+	}
+
+	return PasskeyHandlers{
+		Manage: mux.Method{
+			"GET":  http.HandlerFunc(handler.GetManage),
+			"POST": http.HandlerFunc(handler.PostManage),
+		},
+		BeginRegistration:  mux.Method{"POST": http.HandlerFunc(handler.BeginRegistration)},
+		FinishRegistration: mux.Method{"POST": http.HandlerFunc(handler.FinishRegistration)},
+		BeginLogin:         mux.Method{"POST": http.HandlerFunc(handler.BeginLogin)},
+		FinishLogin:        mux.Method{"POST": http.HandlerFunc(handler.FinishLogin)},
+	}
+}
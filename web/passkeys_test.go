@@ -0,0 +1,273 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+	"hawx.me/code/uberich/webauthn"
+	"hawx.me/code/uberich/webauthn/webauthntest"
+)
+
+func passkeyServer(conf *config.Config, store *fakeStore) *httptest.Server {
+	return passkeyServerWith(conf, storage.NewTOML(conf, ""), store)
+}
+
+func passkeyServerWith(conf *config.Config, db storage.Storage, store *fakeStore) *httptest.Server {
+	passkeys := Passkeys(conf, db, store, discardLogger)
+
+	mux := http.NewServeMux()
+	mux.Handle("/passkeys", passkeys.Manage)
+	mux.Handle("/passkeys/register/begin", passkeys.BeginRegistration)
+	mux.Handle("/passkeys/register/finish", passkeys.FinishRegistration)
+	mux.Handle("/passkeys/login/begin", passkeys.BeginLogin)
+	mux.Handle("/passkeys/login/finish", passkeys.FinishLogin)
+
+	return httptest.NewServer(mux)
+}
+
+func postJSON(reqURL string, body interface{}, v interface{}) (*http.Response, error) {
+	data, _ := json.Marshal(body)
+
+	resp, err := http.Post(reqURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp, nil
+}
+
+// registerPasskey runs the registration ceremony against server for whoever
+// the store says is signed in.
+func registerPasskey(t *testing.T, serverURL string, authenticator *webauthntest.Authenticator) {
+	var options webauthn.CreationOptions
+	if _, err := postJSON(serverURL+"/passkeys/register/begin", nil, &options); err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := authenticator.Create(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := postJSON(serverURL+"/passkeys/register/finish", map[string]interface{}{
+		"name":       "phone",
+		"credential": credential,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("could not register passkey:", resp.StatusCode)
+	}
+}
+
+// passkeyLogin runs the sign in ceremony against server, returning the
+// response and where it redirects to.
+func passkeyLogin(t *testing.T, serverURL string, authenticator *webauthntest.Authenticator, next string) (*http.Response, string) {
+	var options webauthn.RequestOptions
+	if _, err := postJSON(serverURL+"/passkeys/login/begin", nil, &options); err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := authenticator.Get(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result map[string]string
+	resp, err := postJSON(serverURL+"/passkeys/login/finish", map[string]interface{}{
+		"next":       next,
+		"credential": credential,
+	}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, result["redirect"]
+}
+
+func TestPasskeys(t *testing.T) {
+	email := "me@example.com"
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, email, "password")
+
+	authenticator := webauthntest.New("https://uberich.example.com")
+
+	registerServer := passkeyServer(conf, storeWith(email))
+	defer registerServer.Close()
+
+	registerPasskey(t, registerServer.URL, authenticator)
+
+	assert := assert.New(t)
+
+	user := conf.GetUser(email)
+	if assert.Len(user.Credentials, 1) {
+		assert.Equal("phone", user.Credentials[0].Name)
+	}
+
+	store := emptyStore()
+	loginServer := passkeyServer(conf, store)
+	defer loginServer.Close()
+
+	resp, redirect := passkeyLogin(t, loginServer.URL, authenticator, "/login?application=testing")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("/login?application=testing", redirect)
+
+	signedIn, _ := store.Get(nil)
+	assert.Equal(email, signedIn)
+	assert.Equal(uint32(1), conf.GetUser(email).Credentials[0].SignCount)
+}
+
+func TestPasskeyLoginWhenNotVerifiedAndTwoFactor(t *testing.T) {
+	email := "me@example.com"
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, email, "password")
+
+	authenticator := webauthntest.New("https://uberich.example.com")
+	authenticator.UserVerified = false
+
+	registerServer := passkeyServer(conf, storeWith(email))
+	defer registerServer.Close()
+
+	registerPasskey(t, registerServer.URL, authenticator)
+
+	user := conf.GetUser(email)
+	user.TOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	conf.SetUser(user)
+
+	store := emptyStore()
+	loginServer := passkeyServer(conf, store)
+	defer loginServer.Close()
+
+	assert := assert.New(t)
+
+	_, redirect := passkeyLogin(t, loginServer.URL, authenticator, "/login")
+	assert.True(strings.HasPrefix(redirect, "/two-factor?"))
+
+	_, err := store.Get(nil)
+	assert.NotNil(err)
+	pending, _, _ := store.GetPending(nil)
+	assert.Equal(email, pending)
+}
+
+func TestPasskeyLoginWhenWrongOrigin(t *testing.T) {
+	email := "me@example.com"
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, email, "password")
+
+	registerServer := passkeyServer(conf, storeWith(email))
+	defer registerServer.Close()
+
+	authenticator := webauthntest.New("https://uberich.example.com")
+	registerPasskey(t, registerServer.URL, authenticator)
+
+	store := emptyStore()
+	loginServer := passkeyServer(conf, store)
+	defer loginServer.Close()
+
+	authenticator.Origin = "https://evil.example.com"
+
+	resp, _ := passkeyLogin(t, loginServer.URL, authenticator, "/login")
+	assert.New(t).Equal(http.StatusBadRequest, resp.StatusCode)
+
+	_, err := store.Get(nil)
+	assert.New(t).NotNil(err)
+}
+
+func TestPasskeyLoginWhenLockedOut(t *testing.T) {
+	email := "me@example.com"
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, email, "password")
+
+	db := storage.NewTOML(conf, "")
+
+	for _, verified := range []bool{true, false} {
+		authenticator := webauthntest.New("https://uberich.example.com")
+		authenticator.UserVerified = verified
+
+		registerServer := passkeyServerWith(conf, db, storeWith(email))
+		registerPasskey(t, registerServer.URL, authenticator)
+		registerServer.Close()
+
+		db.UpdateLockout(email, func(lockout *config.Lockout) { lockout.Locked = true })
+
+		store := emptyStore()
+		loginServer := passkeyServerWith(conf, db, store)
+
+		assert := assert.New(t)
+
+		resp, _ := passkeyLogin(t, loginServer.URL, authenticator, "/login")
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+		_, err := store.Get(nil)
+		assert.NotNil(err)
+
+		db.UpdateLockout(email, (*config.Lockout).Unlock)
+
+		resp, _ = passkeyLogin(t, loginServer.URL, authenticator, "/login")
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		signedIn, _ := store.Get(nil)
+		assert.Equal(email, signedIn)
+
+		loginServer.Close()
+	}
+}
+
+func TestPasskeyLoginWhenVerifiedChecksUser(t *testing.T) {
+	email := "me@example.com"
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, email, "password")
+
+	db := storage.NewTOML(conf, "")
+
+	authenticator := webauthntest.New("https://uberich.example.com")
+
+	registerServer := passkeyServerWith(conf, db, storeWith(email))
+	defer registerServer.Close()
+
+	registerPasskey(t, registerServer.URL, authenticator)
+
+	store := emptyStore()
+	loginServer := passkeyServerWith(conf, db, store)
+	defer loginServer.Close()
+
+	assert := assert.New(t)
+
+	// A user who hasn't registered can't sign in.
+	user, _ := db.GetUser(email)
+	user.Invitation = "xyz"
+	db.SetUser(user)
+
+	resp, _ := passkeyLogin(t, loginServer.URL, authenticator, "/login")
+	assert.NotEqual(http.StatusOK, resp.StatusCode)
+	_, err := store.Get(nil)
+	assert.NotNil(err)
+
+	// Signing in clears any failed attempts.
+	user, _ = db.GetUser(email)
+	user.Invitation = ""
+	db.SetUser(user)
+	db.UpdateLockout(email, func(lockout *config.Lockout) { lockout.FailedAttempts = 2 })
+
+	resp, _ = passkeyLogin(t, loginServer.URL, authenticator, "/login")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	signedIn, _ := store.Get(nil)
+	assert.Equal(email, signedIn)
+
+	user, _ = db.GetUser(email)
+	assert.Equal(0, user.FailedAttempts)
+}
@@ -0,0 +1,206 @@
+package web
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/justinas/nosurf"
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+const registerPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Register</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    {{ if .Registered }}
+      <p>You have registered as {{.Email}}, and can now sign in with uberich.</p>
+    {{ else }}
+      {{ if .Problem }}
+        <p class="problem">{{.Problem}}</p>
+      {{ end }}
+
+      <form method="post" action="/register">
+        <p>Choose a password for {{.Email}}.</p>
+
+        <fieldset>
+          <label for="pass">Password</label>
+          <input type="password" id="pass" name="pass" autofocus />
+        </fieldset>
+
+        <fieldset>
+          <label for="pass2">(Confirm)</label>
+          <input type="password" id="pass2" name="pass2" />
+        </fieldset>
+
+        <input type="hidden" name="token" value="{{.Invitation}}" />
+        <input type="hidden" name="csrf_token" value="{{.Token}}" />
+
+        <input type="submit" value="Register" />
+      </form>
+    {{ end }}
+  </body>
+</html>`
+
+var registerTmpl = template.Must(template.New("register").Parse(registerPage))
+
+type registerCtx struct {
+	Email      string
+	Invitation string
+	Token      string
+	Problem    string
+	Registered bool
+}
+
+// InvitationLifetime is how long an invitation can be used for.
+const InvitationLifetime = 7 * 24 * time.Hour
+
+// invitationToken is signed and encrypted into the URL sent to the invitee.
+type invitationToken struct {
+	Email      string
+	Invitation string
+}
+
+func invitationCodec(conf *config.Config) (*securecookie.SecureCookie, error) {
+	hashKey, blockKey, err := conf.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	return securecookie.New(hashKey, blockKey).MaxAge(int(InvitationLifetime / time.Second)), nil
+}
+
+// InvitationURL returns the URL that the pending user can use to register.
+func InvitationURL(conf *config.Config, user *config.User) (string, error) {
+	codec, err := invitationCodec(conf)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := codec.Encode("uberich-invitation", invitationToken{
+		Email:      user.Email,
+		Invitation: user.Invitation,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(conf.IssuerURL() + "/register")
+	if err != nil {
+		return "", err
+	}
+
+	return withParams(u, map[string]string{"token": token}), nil
+}
+
+type registerHandler struct {
+	conf   *config.Config
+	db     storage.Storage
+	logger *log.Logger
+	tokens *securecookie.SecureCookie
+}
+
+// user returns the pending user that token invites, if it is still valid.
+func (h *registerHandler) user(token string) (*config.User, bool) {
+	var decoded invitationToken
+	if err := h.tokens.Decode("uberich-invitation", token, &decoded); err != nil {
+		return nil, false
+	}
+
+	user, err := h.db.GetUser(decoded.Email)
+	if err != nil || !user.IsPending() {
+		return nil, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(decoded.Invitation), []byte(user.Invitation)) != 1 {
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (h *registerHandler) invalid(w http.ResponseWriter) {
+	http.Error(w, "This invitation has expired, or has already been used.", http.StatusBadRequest)
+}
+
+func (h *registerHandler) Get(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	user, ok := h.user(token)
+	if !ok {
+		h.invalid(w)
+		return
+	}
+
+	registerTmpl.Execute(w, registerCtx{
+		Email:      user.Email,
+		Invitation: token,
+		Token:      nosurf.Token(r),
+	})
+}
+
+func (h *registerHandler) Post(w http.ResponseWriter, r *http.Request) {
+	var (
+		token = r.PostFormValue("token")
+		pass  = r.PostFormValue("pass")
+	)
+
+	user, ok := h.user(token)
+	if !ok {
+		h.invalid(w)
+		return
+	}
+
+	ctx := registerCtx{
+		Email:      user.Email,
+		Invitation: token,
+		Token:      nosurf.Token(r),
+	}
+
+	if problem := checkNewPassword(h.conf, h.logger, user.Email, pass, r.PostFormValue("pass2")); problem != "" {
+		ctx.Problem = problem
+		registerTmpl.Execute(w, ctx)
+		return
+	}
+
+	if err := user.SetPassword(pass); err != nil {
+		h.logger.Println("register:", err)
+		http.Error(w, "could not register", http.StatusInternalServerError)
+		return
+	}
+	user.Invitation = ""
+
+	if err := h.db.SetUser(user); err != nil {
+		h.logger.Println("register:", err)
+		http.Error(w, "could not register", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Println("register:", user.Email)
+	record(h.db, h.logger, r, storage.Event{Type: storage.EventRegistered, Email: user.Email})
+
+	registerTmpl.Execute(w, registerCtx{Email: user.Email, Registered: true})
+}
+
+// Register lets a user who has been invited, with uberich-admin invite, choose
+// their password.
+func Register(conf *config.Config, db storage.Storage, logger *log.Logger) http.Handler {
+	tokens, _ := invitationCodec(conf)
+	handler := &registerHandler{conf, db, logger, tokens}
+
+	return mux.Method{
+		"GET":  http.HandlerFunc(handler.Get),
+		"POST": http.HandlerFunc(handler.Post),
+	}
+}
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/password"
+	"hawx.me/code/uberich/storage"
+)
+
+func TestRegister(t *testing.T) {
+	conf, _ := mailConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.SetUser(&config.User{Email: "new@example.com", Invitation: "first", Groups: []string{"staff"}})
+
+	db := storage.NewTOML(conf, "")
+	server := httptest.NewServer(Register(conf, db, discardLogger))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	link, err := InvitationURL(conf, conf.GetUser("new@example.com"))
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(link, "https://uberich.example.com/register?token="))
+
+	u, _ := url.Parse(link)
+	token := u.Query().Get("token")
+
+	resp, err := httpGet(server.URL, map[string]string{"token": token})
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), "new@example.com"))
+
+	post := func(pass, pass2 string) (int, string) {
+		resp, err := httpPost(server.URL, map[string]string{"token": token, "pass": pass, "pass2": pass2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	_, page := post("a good password", "another password")
+	assert.True(strings.Contains(page, "The passwords do not match."))
+
+	_, page = post("short", "short")
+	assert.True(strings.Contains(page, password.ErrTooShort.Error()))
+	assert.True(conf.GetUser("new@example.com").IsPending())
+
+	code, page := post("a good password", "a good password")
+	assert.Equal(http.StatusOK, code)
+	assert.True(strings.Contains(page, "You have registered"))
+
+	user := conf.GetUser("new@example.com")
+	assert.False(user.IsPending())
+	assert.True(user.IsPassword("a good password"))
+	assert.Equal([]string{"staff"}, user.Groups)
+
+	// The invitation can't be used again.
+	code, _ = post("another password", "another password")
+	assert.Equal(http.StatusBadRequest, code)
+	assert.True(conf.GetUser("new@example.com").IsPassword("a good password"))
+}
+
+func TestRegisterWhenInvitedAgain(t *testing.T) {
+	conf, _ := mailConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.SetUser(&config.User{Email: "new@example.com", Invitation: "first"})
+
+	db := storage.NewTOML(conf, "")
+	server := httptest.NewServer(Register(conf, db, discardLogger))
+	defer server.Close()
+
+	link, _ := InvitationURL(conf, conf.GetUser("new@example.com"))
+	u, _ := url.Parse(link)
+
+	conf.SetUser(&config.User{Email: "new@example.com", Invitation: "second"})
+
+	resp, err := httpGet(server.URL, map[string]string{"token": u.Query().Get("token")})
+
+	assert := assert.New(t)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestSignInWhenPending(t *testing.T) {
+	conf, _ := mailConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.SetUser(&config.User{Email: "new@example.com", Invitation: "first"})
+
+	db := storage.NewTOML(conf, "")
+	store := emptyStore()
+
+	_, err := signIn(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), db, store, discardLogger, "new@example.com", "password", "/")
+
+	assert := assert.New(t)
+	assert.Equal(errPending, err)
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+}
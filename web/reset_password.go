@@ -0,0 +1,284 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/justinas/nosurf"
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
+)
+
+const forgotPasswordPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Forgot Password</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    {{ if .Limited }}
+      <p class="problem">Too many emails have been asked for, try again later.</p>
+    {{ else if .Sent }}
+      <p>If there is an account for that address, an email has been sent to it
+      with a link to reset the password. The link can be used once, within the
+      next hour.</p>
+    {{ else }}
+      <form method="post" action="/forgot-password">
+        <fieldset>
+          <label for="email">Email</label>
+          <input type="text" id="email" name="email" autofocus />
+        </fieldset>
+
+        <input type="hidden" name="csrf_token" value="{{.Token}}" />
+
+        <input type="submit" value="Send reset link" />
+      </form>
+    {{ end }}
+  </body>
+</html>`
+
+const passwordResetPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Reset Password</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <p>{{.}}</p>
+  </body>
+</html>`
+
+const resetPasswordEmail = `Someone, hopefully you, asked to reset the password for your account.
+
+To choose a new password follow this link within the next hour:
+
+  %s
+
+If you did not ask for this you can ignore this email, your password has not
+been changed.
+`
+
+var (
+	forgotPasswordTmpl = template.Must(template.New("forgotPassword").Parse(forgotPasswordPage))
+	passwordResetTmpl  = template.Must(template.New("passwordReset").Parse(passwordResetPage))
+)
+
+type forgotPasswordCtx struct {
+	Token   string
+	Sent    bool
+	Limited bool
+}
+
+// resetLifetime is how long a link to reset a password can be used for.
+const resetLifetime = time.Hour
+
+// resetToken is signed and encrypted into the link sent to the user.
+type resetToken struct {
+	Email string
+
+	// Password identifies the password the user had when the token was issued,
+	// so that once it has been changed the token can't be used again.
+	Password string
+}
+
+// passwordFingerprint identifies the user's current password, without
+// revealing its hash.
+func passwordFingerprint(user *config.User) string {
+	sum := sha256.Sum256([]byte(user.Hash))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type resetPasswordHandler struct {
+	conf    *config.Config
+	db      storage.Storage
+	store   cookies.Store
+	checker *auth.Checker
+	logger  *log.Logger
+	tokens  *securecookie.SecureCookie
+}
+
+// user returns the user that token was issued to, if it is still valid.
+func (h *resetPasswordHandler) user(token string) (*config.User, bool) {
+	var decoded resetToken
+	if err := h.tokens.Decode("uberich-reset", token, &decoded); err != nil {
+		return nil, false
+	}
+
+	user, err := h.db.GetUser(decoded.Email)
+	if err != nil {
+		return nil, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(decoded.Password), []byte(passwordFingerprint(user))) != 1 {
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (h *resetPasswordHandler) GetForgot(w http.ResponseWriter, r *http.Request) {
+	forgotPasswordTmpl.Execute(w, forgotPasswordCtx{
+		Token: nosurf.Token(r),
+	})
+}
+
+func (h *resetPasswordHandler) PostForgot(w http.ResponseWriter, r *http.Request) {
+	mailer := h.conf.Mail()
+	if mailer == nil {
+		http.Error(w, "password reset is not available", http.StatusNotFound)
+		return
+	}
+
+	email := r.PostFormValue("email")
+
+	if !h.checker.CanMail(client(r), email) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		forgotPasswordTmpl.Execute(w, forgotPasswordCtx{Limited: true})
+		return
+	}
+
+	// Whether or not the user exists the response is the same, so that this
+	// can't be used to find who has an account.
+	if user, err := h.db.GetUser(email); err == nil && !user.IsPending() {
+		token, err := h.tokens.Encode("uberich-reset", resetToken{
+			Email:    user.Email,
+			Password: passwordFingerprint(user),
+		})
+		if err != nil {
+			h.logger.Println("forgot-password:", err)
+			http.Error(w, "could not send reset link", http.StatusInternalServerError)
+			return
+		}
+
+		link := withParams(&url.URL{Path: "/reset-password"}, map[string]string{"token": token})
+
+		go func() {
+			body := fmt.Sprintf(resetPasswordEmail, h.conf.IssuerURL()+link)
+
+			if err := mailer.Send(user.Email, "Reset your password", body); err != nil {
+				h.logger.Println("forgot-password: could not send to", user.Email, err)
+				return
+			}
+
+			h.logger.Println("forgot-password: sent reset link to", user.Email)
+		}()
+	}
+
+	forgotPasswordTmpl.Execute(w, forgotPasswordCtx{Sent: true})
+}
+
+func (h *resetPasswordHandler) GetReset(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	if _, ok := h.user(token); !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		passwordResetTmpl.Execute(w, "This link has expired, or has already been used.")
+		return
+	}
+
+	changePasswordTmpl.Execute(w, changePasswordCtx{
+		Action:     "/reset-password",
+		Token:      nosurf.Token(r),
+		ResetToken: token,
+	})
+}
+
+func (h *resetPasswordHandler) PostReset(w http.ResponseWriter, r *http.Request) {
+	var (
+		token = r.PostFormValue("token")
+		pass  = r.PostFormValue("pass")
+	)
+
+	user, ok := h.user(token)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		passwordResetTmpl.Execute(w, "This link has expired, or has already been used.")
+		return
+	}
+
+	if problem := checkNewPassword(h.conf, h.logger, user.Email, pass, r.PostFormValue("pass2")); problem != "" {
+		changePasswordTmpl.Execute(w, changePasswordCtx{
+			Action:     "/reset-password",
+			Token:      nosurf.Token(r),
+			ResetToken: token,
+			Problem:    problem,
+		})
+		return
+	}
+
+	if err := user.SetPassword(pass); err != nil {
+		h.logger.Println("reset-password:", err)
+		http.Error(w, "could not reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetUser(user); err != nil {
+		h.logger.Println("reset-password:", err)
+		http.Error(w, "could not reset password", http.StatusInternalServerError)
+		return
+	}
+
+	// Whoever knew the old password may still be signed in, so every session is
+	// ended.
+	sessions, err := h.db.ListSessions(user.Email)
+	if err != nil {
+		h.logger.Println("reset-password:", err)
+	}
+	for _, session := range sessions {
+		if err := h.db.RemoveSession(session.ID); err != nil {
+			h.logger.Println("reset-password:", err)
+		}
+	}
+
+	h.store.Unset(w, r)
+	h.logger.Println("reset-password: reset for", user.Email)
+	record(h.db, h.logger, r, storage.Event{Type: storage.EventPasswordReset, Email: user.Email})
+
+	passwordResetTmpl.Execute(w, "Your password has been changed, and you have been signed out everywhere.")
+}
+
+// ResetPasswordHandlers let a user who has forgotten their password be emailed
+// a link to choose a new one.
+type ResetPasswordHandlers struct {
+	Forgot http.Handler
+	Reset  http.Handler
+}
+
+func ResetPassword(conf *config.Config, db storage.Storage, store cookies.Store, checker *auth.Checker, logger *log.Logger) ResetPasswordHandlers {
+	hashKey, blockKey, _ := conf.Keys()
+
+	handler := &resetPasswordHandler{
+		conf:    conf,
+		db:      db,
+		store:   store,
+		checker: checker,
+		logger:  logger,
+		tokens:  securecookie.New(hashKey, blockKey).MaxAge(int(resetLifetime / time.Second)),
+	}
+
+	return ResetPasswordHandlers{
+		Forgot: mux.Method{
+			"GET":  http.HandlerFunc(handler.GetForgot),
+			"POST": http.HandlerFunc(handler.PostForgot),
+		},
+		Reset: mux.Method{
+			"GET":  http.HandlerFunc(handler.GetReset),
+			"POST": http.HandlerFunc(handler.PostReset),
+		},
+	}
+}
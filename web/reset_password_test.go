@@ -0,0 +1,205 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/mail/mailtest"
+	"hawx.me/code/uberich/storage"
+)
+
+var resetLinkRe = regexp.MustCompile(`https://uberich\.example\.com(/reset-password\?token=\S+)`)
+
+func TestResetPassword(t *testing.T) {
+	mailServer, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mailServer.Close()
+
+	email := "me@example.com"
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.HashKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	conf.BlockKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+	conf.SMTPAddr = mailServer.Addr
+	addUser(conf, email, "old password")
+
+	db := storage.NewTOML(conf, "")
+	now := time.Now()
+	db.SetSession(&config.Session{ID: "laptop", Email: email, CreatedAt: now, LastSeen: now})
+	db.SetSession(&config.Session{ID: "someone-else", Email: "other@example.com", CreatedAt: now, LastSeen: now})
+
+	store := storeWith(email)
+	resetPassword := ResetPassword(conf, db, store, auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger)
+
+	mux := http.NewServeMux()
+	mux.Handle("/forgot-password", resetPassword.Forgot)
+	mux.Handle("/reset-password", resetPassword.Reset)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := httpPost(server.URL+"/forgot-password", map[string]string{"email": email})
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var link string
+	select {
+	case msg := <-mailServer.Messages:
+		assert.Equal([]string{email}, msg.To)
+
+		match := resetLinkRe.FindStringSubmatch(msg.Data)
+		if assert.Len(match, 2) {
+			link = match[1]
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for email")
+	}
+
+	resp, err = http.Get(server.URL + link)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), `action="/reset-password"`))
+	assert.True(strings.Contains(string(body), `name="token"`))
+
+	u, _ := url.Parse(link)
+	token := u.Query().Get("token")
+
+	_, err = httpPost(server.URL+"/reset-password", map[string]string{
+		"token": token,
+		"pass":  "new password",
+		"pass2": "different",
+	})
+	assert.Nil(err)
+	assert.True(conf.GetUser(email).IsPassword("old password"))
+
+	resp, err = httpPost(server.URL+"/reset-password", map[string]string{
+		"token": token,
+		"pass":  "new password",
+		"pass2": "new password",
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(conf.GetUser(email).IsPassword("new password"))
+
+	_, err = db.GetSession("laptop")
+	assert.Equal(storage.ErrNotFound, err)
+	_, err = db.GetSession("someone-else")
+	assert.Nil(err)
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+
+	// The link can only be used once.
+	resp, err = http.Get(server.URL + link)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = httpPost(server.URL+"/reset-password", map[string]string{
+		"token": token,
+		"pass":  "another password",
+		"pass2": "another password",
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.True(conf.GetUser(email).IsPassword("new password"))
+}
+
+func TestResetPasswordWhenNoSuchUser(t *testing.T) {
+	mailServer, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mailServer.Close()
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.HashKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	conf.BlockKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+	conf.SMTPAddr = mailServer.Addr
+
+	db := storage.NewTOML(conf, "")
+	server := httptest.NewServer(ResetPassword(conf, db, emptyStore(), auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger).Forgot)
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := httpPost(server.URL, map[string]string{"email": "nobody@example.com"})
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	select {
+	case <-mailServer.Messages:
+		t.Error("expected no email to be sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResetPasswordIsLimited(t *testing.T) {
+	mailServer, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mailServer.Close()
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.HashKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	conf.BlockKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+	conf.SMTPAddr = mailServer.Addr
+	addUser(conf, "me@example.com", "password")
+
+	db := storage.NewTOML(conf, "")
+	server := httptest.NewServer(ResetPassword(conf, db, emptyStore(), auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger).Forgot)
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	for i := 0; i < 3; i++ {
+		resp, err := httpPost(server.URL, map[string]string{"email": "me@example.com"})
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		<-mailServer.Messages
+	}
+
+	resp, err := httpPost(server.URL, map[string]string{"email": "me@example.com"})
+	assert.Nil(err)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+
+	select {
+	case <-mailServer.Messages:
+		t.Error("expected no email to be sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResetPasswordWithBadToken(t *testing.T) {
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	conf.HashKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	conf.BlockKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+	addUser(conf, "me@example.com", "password")
+
+	db := storage.NewTOML(conf, "")
+	server := httptest.NewServer(ResetPassword(conf, db, emptyStore(), auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger).Reset)
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := httpPost(server.URL, map[string]string{
+		"token": "not-a-token",
+		"pass":  "new password",
+		"pass2": "new password",
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.True(conf.GetUser("me@example.com").IsPassword("password"))
+}
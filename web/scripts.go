@@ -0,0 +1,115 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// passkeyScript runs the WebAuthn ceremonies in the browser. Buttons marked
+// with data-passkey="register" or data-passkey="sign-in" are shown when the
+// browser supports passkeys; the page must include a csrf_token input.
+const passkeyScript = `
+(function() {
+    if (!window.PublicKeyCredential) {
+        return;
+    }
+
+    function decode(s) {
+        s = s.replace(/-/g, '+').replace(/_/g, '/');
+        while (s.length % 4) {
+            s += '=';
+        }
+        return Uint8Array.from(atob(s), function(c) { return c.charCodeAt(0); });
+    }
+
+    function encode(b) {
+        return btoa(String.fromCharCode.apply(null, new Uint8Array(b)))
+            .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+
+    function post(url, body) {
+        return fetch(url, {
+            method: 'POST',
+            credentials: 'same-origin',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': document.querySelector('input[name=csrf_token]').value
+            },
+            body: JSON.stringify(body || {})
+        }).then(function(resp) {
+            if (!resp.ok) {
+                throw new Error(resp.statusText);
+            }
+            return resp.json();
+        });
+    }
+
+    function problem() {
+        document.getElementById('passkey-problem').hidden = false;
+    }
+
+    function register() {
+        post('/passkeys/register/begin').then(function(options) {
+            options.challenge = decode(options.challenge);
+            options.user.id = decode(options.user.id);
+            (options.excludeCredentials || []).forEach(function(c) { c.id = decode(c.id); });
+
+            return navigator.credentials.create({ publicKey: options });
+        }).then(function(credential) {
+            return post('/passkeys/register/finish', {
+                name: document.getElementById('name').value,
+                credential: {
+                    id: credential.id,
+                    type: credential.type,
+                    response: {
+                        clientDataJSON: encode(credential.response.clientDataJSON),
+                        attestationObject: encode(credential.response.attestationObject)
+                    }
+                }
+            });
+        }).then(function() {
+            window.location.reload();
+        }).catch(problem);
+    }
+
+    function signIn(button) {
+        post('/passkeys/login/begin').then(function(options) {
+            options.challenge = decode(options.challenge);
+
+            return navigator.credentials.get({ publicKey: options });
+        }).then(function(credential) {
+            return post('/passkeys/login/finish', {
+                next: button.dataset.next,
+                credential: {
+                    id: credential.id,
+                    type: credential.type,
+                    response: {
+                        clientDataJSON: encode(credential.response.clientDataJSON),
+                        authenticatorData: encode(credential.response.authenticatorData),
+                        signature: encode(credential.response.signature),
+                        userHandle: credential.response.userHandle ? encode(credential.response.userHandle) : ''
+                    }
+                }
+            });
+        }).then(function(result) {
+            window.location = result.redirect;
+        }).catch(problem);
+    }
+
+    document.querySelectorAll('[data-passkey]').forEach(function(button) {
+        button.hidden = false;
+        button.addEventListener('click', function() {
+            if (button.dataset.passkey === 'register') {
+                register();
+            } else {
+                signIn(button);
+            }
+        });
+    });
+})();
+`
+
+var PasskeyScript = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/javascript")
+	fmt.Fprint(w, passkeyScript)
+})
@@ -0,0 +1,187 @@
+package web
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/justinas/nosurf"
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
+)
+
+const sessionsPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Sessions</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <h1>Sessions</h1>
+
+    <p><a href="/account/activity">See recent activity on your account</a></p>
+
+    <ul>
+      {{ range .Sessions }}
+        <li>
+          <form method="post" action="/sessions">
+            {{.Device}} from {{.IP}}, signed in {{.CreatedAt.Format "2 Jan 15:04"}},
+            {{ if .Current }}
+              this device
+            {{ else }}
+              last seen {{.LastSeen.Format "2 Jan 15:04"}}
+            {{ end }}
+            <input type="hidden" name="revoke" value="{{.ID}}" />
+            <input type="hidden" name="csrf_token" value="{{$.Token}}" />
+            <input type="submit" value="Revoke" />
+          </form>
+        </li>
+      {{ end }}
+    </ul>
+  </body>
+</html>`
+
+var sessionsTmpl = template.Must(template.New("sessions").Parse(sessionsPage))
+
+type sessionsCtx struct {
+	Token    string
+	Sessions []sessionCtx
+}
+
+type sessionCtx struct {
+	ID        string
+	Device    string
+	IP        string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	Current   bool
+}
+
+// device gives a short description of the browser and system a user agent
+// belongs to, good enough for someone to recognise their own devices.
+func device(userAgent string) string {
+	contains := func(s string) bool { return strings.Contains(userAgent, s) }
+
+	browser := "Unknown browser"
+	switch {
+	case contains("Firefox/"):
+		browser = "Firefox"
+	case contains("Edg/"):
+		browser = "Edge"
+	case contains("Chrome/"):
+		browser = "Chrome"
+	case contains("Safari/"):
+		browser = "Safari"
+	}
+
+	system := "unknown system"
+	switch {
+	case contains("iPhone"):
+		system = "iPhone"
+	case contains("iPad"):
+		system = "iPad"
+	case contains("Android"):
+		system = "Android"
+	case contains("Mac OS X"):
+		system = "macOS"
+	case contains("Windows"):
+		system = "Windows"
+	case contains("Linux"):
+		system = "Linux"
+	}
+
+	return browser + " on " + system
+}
+
+type sessionsHandler struct {
+	db     storage.Storage
+	store  cookies.Store
+	logger *log.Logger
+}
+
+func (h *sessionsHandler) Get(w http.ResponseWriter, r *http.Request) {
+	current, err := h.store.Session(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	sessions, err := h.db.ListSessions(current.Email)
+	if err != nil {
+		h.logger.Println("sessions:", err)
+		http.Error(w, "could not list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	ctx := sessionsCtx{Token: nosurf.Token(r)}
+
+	for _, session := range sessions {
+		if session.Expired(now) {
+			continue
+		}
+
+		ctx.Sessions = append(ctx.Sessions, sessionCtx{
+			ID:        session.ID,
+			Device:    device(session.UserAgent),
+			IP:        session.IP,
+			CreatedAt: session.CreatedAt,
+			LastSeen:  session.LastSeen,
+			Current:   session.ID == current.ID,
+		})
+	}
+
+	sort.Slice(ctx.Sessions, func(i, j int) bool {
+		return ctx.Sessions[i].LastSeen.After(ctx.Sessions[j].LastSeen)
+	})
+
+	sessionsTmpl.Execute(w, ctx)
+}
+
+func (h *sessionsHandler) Post(w http.ResponseWriter, r *http.Request) {
+	current, err := h.store.Session(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	session, err := h.db.GetSession(r.PostFormValue("revoke"))
+	if err != nil || session.Email != current.Email {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+		return
+	}
+
+	if err := h.db.RemoveSession(session.ID); err != nil {
+		h.logger.Println("sessions:", err)
+		http.Error(w, "could not revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Println("sessions: revoked", session.ID, "for", session.Email)
+	record(h.db, h.logger, r, storage.Event{Type: storage.EventSessionRevoked, Email: session.Email, Detail: session.ID})
+
+	if session.ID == current.ID {
+		h.store.Unset(w, r)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, r.URL.Path, http.StatusFound)
+}
+
+// Sessions lists the devices that the user is signed in on, and lets them
+// revoke any of them.
+func Sessions(db storage.Storage, store cookies.Store, logger *log.Logger) http.Handler {
+	handler := &sessionsHandler{db, store, logger}
+
+	return mux.Method{
+		"GET":  http.HandlerFunc(handler.Get),
+		"POST": http.HandlerFunc(handler.Post),
+	}
+}
@@ -0,0 +1,48 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+)
+
+func TestSessions(t *testing.T) {
+	email := "me@example.com"
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	db := storage.NewTOML(conf, "")
+
+	now := time.Now()
+	db.SetSession(&config.Session{ID: "current", Email: email, UserAgent: "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0", CreatedAt: now, LastSeen: now})
+	db.SetSession(&config.Session{ID: "phone", Email: email, UserAgent: "Mozilla/5.0 (iPhone) Safari/604.1", IP: "192.0.2.1", CreatedAt: now, LastSeen: now})
+	db.SetSession(&config.Session{ID: "old", Email: email, CreatedAt: now.Add(-24 * time.Hour), LastSeen: now.Add(-24 * time.Hour)})
+	db.SetSession(&config.Session{ID: "someone-else", Email: "other@example.com", CreatedAt: now, LastSeen: now})
+
+	server := httptest.NewServer(Sessions(db, storeWith(email), discardLogger))
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := httpGet(server.URL, nil)
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), "Firefox on Linux"))
+	assert.True(strings.Contains(string(body), "Safari on iPhone from 192.0.2.1"))
+	assert.False(strings.Contains(string(body), `value="old"`))
+	assert.False(strings.Contains(string(body), `value="someone-else"`))
+
+	_, err = httpPost(server.URL, map[string]string{"revoke": "someone-else"})
+	assert.Nil(err)
+	_, err = db.GetSession("someone-else")
+	assert.Nil(err)
+
+	_, err = httpPost(server.URL, map[string]string{"revoke": "phone"})
+	assert.Nil(err)
+	_, err = db.GetSession("phone")
+	assert.Equal(storage.ErrNotFound, err)
+}
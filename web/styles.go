@@ -49,13 +49,17 @@ input[type=text], input[type=password] {
     width: 15rem;
 }
 
-input[type=submit] {
+input[type=submit], button {
     font-family: monospace;
     margin-left: 7rem;
     border: 1px solid;
     background: none;
 }
 
+li input[type=submit] {
+    margin-left: 1rem;
+}
+
 .problem {
     color: rgb(164, 34, 34);
     border: 1px dashed;
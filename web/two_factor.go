@@ -0,0 +1,417 @@
+package web
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/justinas/nosurf"
+	"rsc.io/qr"
+
+	"hawx.me/code/mux"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
+	"hawx.me/code/uberich/totp"
+)
+
+const recoveryCodeCount = 10
+
+const twoFactorPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Two-factor authentication</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    {{ if .Locked }}
+      <p class="problem">This account is temporarily locked after too many failed attempts to sign in. Try again later.</p>
+    {{ else if .WasProblem }}
+      <p class="problem">Try again!</p>
+    {{ end }}
+
+    <form method="post" action="/two-factor">
+      <fieldset>
+        <label for="code">Code</label>
+        <input type="text" id="code" name="code" autocomplete="one-time-code" autofocus />
+      </fieldset>
+
+      <p>Enter the code shown by your authenticator, or one of your recovery codes.</p>
+
+      <input type="hidden" name="next" value="{{.Next}}" />
+      <input type="hidden" name="csrf_token" value="{{.Token}}" />
+
+      <input type="submit" value="Continue" />
+    </form>
+  </body>
+</html>`
+
+const enrolPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Two-factor authentication</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    {{ if .Enabled }}
+      <p>Two-factor authentication is enabled.</p>
+    {{ else }}
+      {{ if .WasProblem }}
+        <p class="problem">Try again!</p>
+      {{ end }}
+
+      <p>Scan the code with your authenticator, or enter the secret by hand.</p>
+
+      <img src="{{.QR}}" alt="{{.URI}}" />
+      <p><code>{{.Secret}}</code></p>
+
+      <form method="post" action="/two-factor">
+        <fieldset>
+          <label for="code">Code</label>
+          <input type="text" id="code" name="code" autocomplete="one-time-code" autofocus />
+        </fieldset>
+
+        <input type="hidden" name="secret" value="{{.Secret}}" />
+        <input type="hidden" name="next" value="{{.Next}}" />
+        <input type="hidden" name="csrf_token" value="{{.Token}}" />
+
+        <input type="submit" value="Enable" />
+      </form>
+    {{ end }}
+  </body>
+</html>`
+
+const recoveryCodesPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Recovery codes</title>
+    <link rel="stylesheet" href="/styles.css" />
+  </head>
+  <body>
+    <p>Two-factor authentication is enabled. Keep these recovery codes somewhere
+      safe, each can be used once if you lose your authenticator.</p>
+
+    <ul>
+      {{ range .Codes }}
+        <li><code>{{.}}</code></li>
+      {{ end }}
+    </ul>
+
+    <a href="{{.Next}}">Continue</a>
+  </body>
+</html>`
+
+var (
+	twoFactorTmpl     = template.Must(template.New("twoFactor").Parse(twoFactorPage))
+	enrolTmpl         = template.Must(template.New("enrol").Parse(enrolPage))
+	recoveryCodesTmpl = template.Must(template.New("recoveryCodes").Parse(recoveryCodesPage))
+)
+
+type twoFactorCtx struct {
+	Token      string
+	Next       string
+	WasProblem bool
+	Locked     bool
+}
+
+type enrolCtx struct {
+	Token      string
+	Next       string
+	Enabled    bool
+	Secret     string
+	URI        string
+	QR         template.URL
+	WasProblem bool
+}
+
+type recoveryCodesCtx struct {
+	Codes []string
+	Next  string
+}
+
+// safeNext returns next if it is a path on this server, so that it can't be
+// used to send users elsewhere.
+func safeNext(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(next, "/") ||
+		strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return "/two-factor"
+	}
+
+	return next
+}
+
+var (
+	errPending = errors.New("user has not registered")
+	errLocked  = errors.New("user is locked out")
+)
+
+// verifiedPasskey is the method for signing in with a passkey that verified the
+// user, with a PIN or biometric. That is two factors already, so there is no
+// need to ask for another.
+const verifiedPasskey = "verified passkey"
+
+// signIn is called once a user has given the correct password, used a passkey
+// or followed a magic link. If they have an authenticator, or must enrol one,
+// they need to do that before being signed in, unless method is
+// verifiedPasskey; either way they end up at next. It returns where to send the
+// user. The sign in is recorded with method, to say how it was made, and any
+// failed attempts are cleared.
+//
+// A user who is locked out can't sign in by any method, so errLocked is
+// returned for them and the attempt recorded.
+func signIn(w http.ResponseWriter, r *http.Request, db storage.Storage, store cookies.Store, logger *log.Logger, email, method, next string) (string, error) {
+	user, err := db.GetUser(email)
+	if err != nil {
+		return "", err
+	}
+
+	if user.IsPending() {
+		return "", errPending
+	}
+
+	if user.IsLocked(time.Now()) {
+		record(db, logger, r, storage.Event{Type: storage.EventLoginFailed, Email: email, Detail: "locked out"})
+		return "", errLocked
+	}
+
+	if method != verifiedPasskey && (user.HasTwoFactor() || user.RequireTwoFactor) {
+		if err := store.SetPending(w, email, method); err != nil {
+			return "", err
+		}
+
+		return withParams(&url.URL{Path: "/two-factor"}, map[string]string{"next": next}), nil
+	}
+
+	if err := store.Set(w, r, email, method); err != nil {
+		return "", err
+	}
+
+	if user.FailedAttempts != 0 {
+		if _, err := db.UpdateLockout(email, (*config.Lockout).Unlock); err != nil {
+			logger.Println("sign-in: could not clear failed attempts:", err)
+		}
+	}
+
+	record(db, logger, r, storage.Event{Type: storage.EventLogin, Email: email, Detail: method})
+	return next, nil
+}
+
+// mustEnrol redirects the user to enrol an authenticator if they are required
+// to and haven't yet, returning true if it did. This catches users who were
+// already signed in when the requirement was added.
+func mustEnrol(w http.ResponseWriter, r *http.Request, db storage.Storage, email string) bool {
+	user, err := db.GetUser(email)
+	if err != nil || !user.MustEnrolTwoFactor() {
+		return false
+	}
+
+	redirectWithParams(w, r, &url.URL{Path: "/two-factor"}, map[string]string{"next": r.URL.RequestURI()})
+	return true
+}
+
+type twoFactorHandler struct {
+	conf    *config.Config
+	db      storage.Storage
+	store   cookies.Store
+	checker *auth.Checker
+	logger  *log.Logger
+}
+
+// user returns the email of the user making the request, and whether they have
+// yet to give their second factor.
+func (h *twoFactorHandler) user(r *http.Request) (email string, pending bool) {
+	if email, _, err := h.store.GetPending(r); err == nil {
+		return email, true
+	}
+	if email, err := h.store.Get(r); err == nil {
+		return email, false
+	}
+	return "", false
+}
+
+// complete signs in the pending user, with the method they started with, as
+// the second factor doesn't stand in for a password.
+func (h *twoFactorHandler) complete(w http.ResponseWriter, r *http.Request, email string) error {
+	_, method, _ := h.store.GetPending(r)
+	if err := h.store.Set(w, r, email, method); err != nil {
+		return err
+	}
+
+	h.store.UnsetPending(w)
+	record(h.db, h.logger, r, storage.Event{Type: storage.EventLogin, Email: email, Detail: "two-factor"})
+	return nil
+}
+
+func (h *twoFactorHandler) enrol(w http.ResponseWriter, r *http.Request, email, secret, next string, wasProblem bool) {
+	issuer := "uberich"
+	if u, err := url.Parse(h.conf.IssuerURL()); err == nil && u.Host != "" {
+		issuer = u.Host
+	}
+
+	uri := totp.URI(issuer, email, secret)
+
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		h.logger.Println("two-factor:", err)
+		http.Error(w, "could not create QR code", http.StatusInternalServerError)
+		return
+	}
+
+	enrolTmpl.Execute(w, enrolCtx{
+		Token:      nosurf.Token(r),
+		Next:       next,
+		Secret:     secret,
+		URI:        uri,
+		QR:         template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())),
+		WasProblem: wasProblem,
+	})
+}
+
+func (h *twoFactorHandler) Get(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.FormValue("next"))
+
+	email, pending := h.user(r)
+	if email == "" {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := h.db.GetUser(email)
+	if err != nil {
+		h.logger.Println("two-factor:", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if user.HasTwoFactor() {
+		if pending {
+			twoFactorTmpl.Execute(w, twoFactorCtx{
+				Token:      nosurf.Token(r),
+				Next:       next,
+				WasProblem: r.FormValue("problem") != "",
+			})
+		} else {
+			enrolTmpl.Execute(w, enrolCtx{Enabled: true})
+		}
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.logger.Println("two-factor:", err)
+		http.Error(w, "could not create secret", http.StatusInternalServerError)
+		return
+	}
+
+	h.enrol(w, r, email, secret, next, false)
+}
+
+func (h *twoFactorHandler) Post(w http.ResponseWriter, r *http.Request) {
+	var (
+		code = r.PostFormValue("code")
+		next = safeNext(r.PostFormValue("next"))
+	)
+
+	email, pending := h.user(r)
+	if email == "" {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := h.db.GetUser(email)
+	if err != nil {
+		h.logger.Println("two-factor:", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if user.HasTwoFactor() {
+		if !pending {
+			http.Redirect(w, r, next, http.StatusFound)
+			return
+		}
+
+		if !h.checker.IsSecondFactor(client(r), email, code) {
+			redirectWithParams(w, r, &url.URL{Path: r.URL.Path}, map[string]string{
+				"next":    next,
+				"problem": loginProblem(h.checker, email),
+			})
+			return
+		}
+
+		if err := h.complete(w, r, email); err != nil {
+			h.logger.Println("two-factor: could not set cookie:", err)
+			http.Error(w, "could not sign in", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+
+	secret := r.PostFormValue("secret")
+
+	step, ok := totp.Check(secret, code, time.Now(), 0)
+	if !ok {
+		h.enrol(w, r, email, secret, next, true)
+		return
+	}
+
+	codes, err := totp.RecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		h.logger.Println("two-factor:", err)
+		http.Error(w, "could not create recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	user.TOTPSecret = secret
+	user.TOTPStep = step
+	if err := user.SetRecoveryCodes(codes); err != nil {
+		h.logger.Println("two-factor:", err)
+		http.Error(w, "could not create recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetUser(user); err != nil {
+		h.logger.Println("two-factor:", err)
+		http.Error(w, "could not save user", http.StatusInternalServerError)
+		return
+	}
+
+	if pending {
+		if err := h.complete(w, r, email); err != nil {
+			h.logger.Println("two-factor: could not set cookie:", err)
+			http.Error(w, "could not sign in", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recoveryCodesTmpl.Execute(w, recoveryCodesCtx{
+		Codes: codes,
+		Next:  next,
+	})
+}
+
+// TwoFactor handles the second step of signing in for users with an
+// authenticator, and lets users enrol one.
+func TwoFactor(conf *config.Config, db storage.Storage, store cookies.Store, checker *auth.Checker, logger *log.Logger) http.Handler {
+	handler := &twoFactorHandler{conf, db, store, checker, logger}
+
+	return mux.Method{
+		"GET":  http.HandlerFunc(handler.Get),
+		"POST": http.HandlerFunc(handler.Post),
+	}
+}
@@ -0,0 +1,190 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/storage"
+	"hawx.me/code/uberich/totp"
+)
+
+func twoFactorServer(conf *config.Config, store *fakeStore) *httptest.Server {
+	db := storage.NewTOML(conf, "")
+	checker := auth.NewChecker(db, config.RateLimits{}, discardLogger)
+
+	mux := http.NewServeMux()
+	mux.Handle("/login", Login(conf, db, store, checker, discardLogger))
+	mux.Handle("/two-factor", TwoFactor(conf, db, store, checker, discardLogger))
+
+	return httptest.NewServer(mux)
+}
+
+func postNoRedirect(reqURL string, params map[string]string) (*http.Response, error) {
+	q := url.Values{}
+	for k, v := range params {
+		q.Add(k, v)
+	}
+
+	return noRedirectClient().PostForm(reqURL, q)
+}
+
+func TestLoginWithTwoFactor(t *testing.T) {
+	email := "me@example.com"
+	testApp := &config.App{Name: "testing", URI: "http://app.example.com/"}
+
+	secret, _ := totp.GenerateSecret()
+
+	conf := savedConf(t, testApp)
+	addUser(conf, email, "password")
+	user := conf.GetUser(email)
+	user.TOTPSecret = secret
+	conf.SetUser(user)
+
+	store := emptyStore()
+	server := twoFactorServer(conf, store)
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := postNoRedirect(server.URL+"/login", map[string]string{
+		"email":        email,
+		"pass":         "password",
+		"application":  testApp.Name,
+		"redirect_uri": testApp.URI,
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusFound, resp.StatusCode)
+
+	location, _ := resp.Location()
+	assert.Equal("/two-factor", location.Path)
+	next := location.Query().Get("next")
+	assert.True(strings.HasPrefix(next, "/login?"))
+
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+	pending, _, _ := store.GetPending(nil)
+	assert.Equal(email, pending)
+
+	resp, err = postNoRedirect(server.URL+"/two-factor", map[string]string{
+		"code": "000000",
+		"next": next,
+	})
+	assert.Nil(err)
+	location, _ = resp.Location()
+	assert.Equal("yes", location.Query().Get("problem"))
+	_, err = store.Get(nil)
+	assert.NotNil(err)
+
+	code, _ := totp.Code(secret, time.Now())
+	resp, err = postNoRedirect(server.URL+"/two-factor", map[string]string{
+		"code": code,
+		"next": next,
+	})
+	assert.Nil(err)
+	location, _ = resp.Location()
+	assert.Equal(next, location.RequestURI())
+
+	signedIn, _ := store.Get(nil)
+	assert.Equal(email, signedIn)
+	_, _, err = store.GetPending(nil)
+	assert.NotNil(err)
+
+	assert.Equal(totp.Step(time.Now()), conf.GetUser(email).TOTPStep)
+}
+
+func TestLoginWithRecoveryCode(t *testing.T) {
+	email := "me@example.com"
+	secret, _ := totp.GenerateSecret()
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, email, "password")
+	user := conf.GetUser(email)
+	user.TOTPSecret = secret
+	user.SetRecoveryCodes([]string{"abcd-efgh", "ijkl-mnop"})
+	conf.SetUser(user)
+
+	store := emptyStore()
+	store.SetPending(nil, email, "password")
+
+	server := twoFactorServer(conf, store)
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := postNoRedirect(server.URL+"/two-factor", map[string]string{
+		"code": "IJKL-MNOP",
+		"next": "/login",
+	})
+	assert.Nil(err)
+	location, _ := resp.Location()
+	assert.Equal("/login", location.RequestURI())
+
+	signedIn, _ := store.Get(nil)
+	assert.Equal(email, signedIn)
+	assert.Len(conf.GetUser(email).RecoveryCodes, 1)
+}
+
+func TestLoginWhenTwoFactorRequired(t *testing.T) {
+	email := "me@example.com"
+
+	conf := savedConf(t, &config.App{Name: "testing", URI: "http://app.example.com/"})
+	addUser(conf, email, "password")
+	user := conf.GetUser(email)
+	user.RequireTwoFactor = true
+	conf.SetUser(user)
+
+	store := storeWith(email)
+	server := twoFactorServer(conf, store)
+	defer server.Close()
+
+	assert := assert.New(t)
+
+	resp, err := noRedirectClient().Get(server.URL + "/login?application=testing&redirect_uri=http://app.example.com/")
+	assert.Nil(err)
+	location, _ := resp.Location()
+	assert.Equal("/two-factor", location.Path)
+
+	resp, err = http.Get(server.URL + "/two-factor")
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(strings.Contains(string(body), "data:image/png;base64,"))
+
+	secret, _ := totp.GenerateSecret()
+	code, _ := totp.Code(secret, time.Now())
+
+	resp, err = postNoRedirect(server.URL+"/two-factor", map[string]string{
+		"secret": secret,
+		"code":   "000000",
+	})
+	assert.Nil(err)
+	assert.False(conf.GetUser(email).HasTwoFactor())
+
+	resp, err = postNoRedirect(server.URL+"/two-factor", map[string]string{
+		"secret": secret,
+		"code":   code,
+	})
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	user = conf.GetUser(email)
+	assert.Equal(secret, user.TOTPSecret)
+	assert.Len(user.RecoveryCodes, recoveryCodeCount)
+}
+
+func TestSafeNext(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("/login?a=b", safeNext("/login?a=b"))
+	assert.Equal("/two-factor", safeNext("https://evil.example.com/"))
+	assert.Equal("/two-factor", safeNext("//evil.example.com/"))
+	assert.Equal("/two-factor", safeNext("/\\evil.example.com/"))
+	assert.Equal("/two-factor", safeNext(""))
+}
@@ -0,0 +1,325 @@
+package web
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"hawx.me/code/uberich/assertion"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/jwt"
+	"hawx.me/code/uberich/storage"
+)
+
+// forwardPrefix is where the proxy in front of an app must send requests to
+// uberich's start and callback endpoints, on the app's own host, so that a
+// cookie can be set for it.
+const forwardPrefix = "/_uberich/"
+
+// forwardStateLifetime is how long a user has to sign in once sent to uberich
+// by the proxy.
+const forwardStateLifetime = 5 * time.Minute
+
+const unauthorisedPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8" />
+    <meta http-equiv="refresh" content="0;url={{.}}" />
+    <title>Sign in</title>
+  </head>
+  <body>
+    <p><a href="{{.}}">Sign in</a> to continue.</p>
+  </body>
+</html>`
+
+var unauthorisedTmpl = template.Must(template.New("unauthorised").Parse(unauthorisedPage))
+
+var errNoForwardedApp = errors.New("no app registered for forwarded URL")
+
+// forwardState is kept in a cookie while the user signs in, it is checked when
+// they return to make sure the sign in was started by them.
+type forwardState struct {
+	State string
+	App   string
+	Next  string
+}
+
+type forwardAuthHandler struct {
+	conf   *config.Config
+	db     storage.Storage
+	store  cookies.Store
+	logger *log.Logger
+	states *securecookie.SecureCookie
+	nonces *assertion.NonceCache
+}
+
+// forwardedURL reconstructs the URL that was requested from the proxy, using
+// the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Uri headers if they
+// are given.
+func forwardedURL(r *http.Request) *url.URL {
+	u := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+
+	if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		u.Scheme = proto
+	}
+	if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+		u.Host = host
+	}
+
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	if ref, err := url.ParseRequestURI(uri); err == nil {
+		u.Path = ref.Path
+		u.RawPath = ref.RawPath
+		u.RawQuery = ref.RawQuery
+	}
+
+	return u
+}
+
+// firstValue returns the first of a comma separated list of values, as given
+// when a request has passed through more than one proxy.
+func firstValue(s string) string {
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// app finds the app that can be redirected to uri. If the request names an app
+// then only that app is considered.
+func (h *forwardAuthHandler) app(r *http.Request, uri string) (*config.App, error) {
+	if name := r.URL.Query().Get("app"); name != "" {
+		app, err := h.db.GetApp(name)
+		if err != nil {
+			return nil, err
+		}
+		if !app.CanRedirectTo(uri) {
+			return nil, errNoForwardedApp
+		}
+		return app, nil
+	}
+
+	apps, err := h.db.ListApps()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range apps {
+		if app.CanRedirectTo(uri) {
+			return app, nil
+		}
+	}
+
+	return nil, errNoForwardedApp
+}
+
+// Verify is called by the proxy for each request to an app. It responds with
+// 200 and X-Uberich-Email and X-Uberich-Groups headers if the user can use the
+// app, 403 if they can't, or 401 with a Location to send them to sign in.
+func (h *forwardAuthHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	u := forwardedURL(r)
+
+	app, err := h.app(r, u.String())
+	if err != nil {
+		h.logger.Println("verify:", u, err)
+		http.Error(w, "no such app", http.StatusForbidden)
+		return
+	}
+
+	email, err := h.store.GetForApp(r, app.Name)
+	if err != nil {
+		// A user signed in by a magic link is sent to give their password if the
+		// app doesn't allow them.
+		if session, sessionErr := h.store.Session(r); sessionErr == nil && session.CanSignInTo(app) {
+			email, err = session.Email, nil
+		}
+	}
+	if err != nil {
+		h.unauthorised(w, u)
+		return
+	}
+
+	user, err := h.db.GetUser(email)
+	if err != nil {
+		h.unauthorised(w, u)
+		return
+	}
+
+	if !app.Allows(*user) {
+		h.logger.Println("verify:", email, "not allowed to use", app.Name)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("X-Uberich-Email", user.Email)
+	w.Header().Set("X-Uberich-Groups", strings.Join(user.Groups, ","))
+	w.WriteHeader(http.StatusOK)
+}
+
+// unauthorised tells the proxy to send the user to sign in, and then back to u.
+// Some proxies copy the response to the user rather than redirecting, so the
+// body also takes them there.
+func (h *forwardAuthHandler) unauthorised(w http.ResponseWriter, u *url.URL) {
+	start := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: forwardPrefix + "start"}
+	location := withParams(start, map[string]string{"rd": u.String()})
+
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	unauthorisedTmpl.Execute(w, location)
+}
+
+// Start is reached through the proxy, on the app's host. It remembers where the
+// user was going then sends them to sign in.
+func (h *forwardAuthHandler) Start(w http.ResponseWriter, r *http.Request) {
+	u := forwardedURL(r)
+
+	next, err := url.Parse(r.FormValue("rd"))
+	if err != nil || next.Scheme != u.Scheme || next.Host != u.Host {
+		h.logger.Println("verify: bad rd for", u.Host)
+		http.Error(w, "bad redirect", http.StatusBadRequest)
+		return
+	}
+
+	app, err := h.app(r, next.String())
+	if err != nil {
+		h.logger.Println("verify:", next, err)
+		http.Error(w, "no such app", http.StatusForbidden)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		h.logger.Println("verify:", err)
+		http.Error(w, "could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	encoded, err := h.states.Encode("uberich-state", forwardState{
+		State: state,
+		App:   app.Name,
+		Next:  next.String(),
+	})
+	if err != nil {
+		h.logger.Println("verify:", err)
+		http.Error(w, "could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "uberich-state",
+		Value:    encoded,
+		Path:     forwardPrefix,
+		MaxAge:   int(forwardStateLifetime / time.Second),
+		HttpOnly: true,
+		Secure:   u.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	callback := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: forwardPrefix + "callback"}
+	login, _ := url.Parse(h.conf.IssuerURL() + "/login")
+
+	redirectWithParams(w, r, login, map[string]string{
+		"application":  app.Name,
+		"redirect_uri": callback.String(),
+		"state":        state,
+	})
+}
+
+// Callback is reached through the proxy, on the app's host, once the user has
+// signed in. It checks the assertion then sets a cookie for the app.
+func (h *forwardAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	u := forwardedURL(r)
+
+	var state forwardState
+	cookie, err := r.Cookie("uberich-state")
+	if err == nil {
+		err = h.states.Decode("uberich-state", cookie.Value, &state)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   "uberich-state",
+		Value:  "",
+		Path:   forwardPrefix,
+		MaxAge: -1,
+	})
+
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.State), []byte(r.FormValue("state"))) != 1 {
+		h.logger.Println("verify: state does not match for", u.Host)
+		http.Error(w, "could not sign in", http.StatusForbidden)
+		return
+	}
+
+	signers, err := h.conf.Signers()
+	if err != nil {
+		h.logger.Println("verify:", err)
+		http.Error(w, "could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	keys := jwt.KeySet{}
+	for _, key := range signers {
+		keys.Keys = append(keys.Keys, key.Public())
+	}
+
+	now := time.Now()
+
+	a, err := assertion.Parse(r.FormValue("assertion"), keys, h.conf.IssuerURL(), state.App, now)
+	if err == nil {
+		err = h.nonces.Use(a, now)
+	}
+	if err != nil {
+		h.logger.Println("verify:", err)
+		http.Error(w, "could not sign in", http.StatusForbidden)
+		return
+	}
+
+	if err := h.store.SetForApp(w, r, state.App, a.Email, a.Session); err != nil {
+		h.logger.Println("verify:", err)
+		http.Error(w, "could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, state.Next, http.StatusFound)
+}
+
+// ForwardAuthHandlers are the endpoints used by a proxy that asks uberich
+// whether each request to an app should be allowed, such as nginx with
+// auth_request, or Traefik and Caddy with forward auth.
+type ForwardAuthHandlers struct {
+	Verify   http.Handler
+	Start    http.Handler
+	Callback http.Handler
+}
+
+func ForwardAuth(conf *config.Config, db storage.Storage, store cookies.Store, logger *log.Logger) ForwardAuthHandlers {
+	hashKey, blockKey, _ := conf.Keys()
+
+	handler := &forwardAuthHandler{
+		conf:   conf,
+		db:     db,
+		store:  store,
+		logger: logger,
+		states: securecookie.New(hashKey, blockKey).MaxAge(int(forwardStateLifetime / time.Second)),
+		nonces: assertion.NewNonceCache(),
+	}
+
+	return ForwardAuthHandlers{
+		Verify:   http.HandlerFunc(handler.Verify),
+		Start:    http.HandlerFunc(handler.Start),
+		Callback: http.HandlerFunc(handler.Callback),
+	}
+}
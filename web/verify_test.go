@@ -0,0 +1,671 @@
+package web
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/auth"
+	"hawx.me/code/uberich/config"
+	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/jwt"
+	"hawx.me/code/uberich/storage"
+)
+
+// forwardAuthProxy acts like the proxies configured in examples/forward-auth,
+// as read by exampleProxy: it asks uberich at verifyPath about each request,
+// and sends requests under prefix straight to uberich.
+type forwardAuthProxy struct {
+	uberich string
+	app     http.Handler
+
+	verifyPath string
+	prefix     string
+
+	// verifyHeaders and prefixHeaders are the X-Forwarded headers sent with
+	// requests to verifyPath and under prefix.
+	verifyHeaders []string
+	prefixHeaders []string
+
+	// authHeaders are copied from uberich's response to the request to the app.
+	authHeaders []string
+
+	// redirectOn401 is true for proxies configured to redirect to the Location
+	// uberich gives, rather than passing its response on.
+	redirectOn401 bool
+}
+
+func (p *forwardAuthProxy) forward(req *http.Request, r *http.Request, headers []string) {
+	req.Header = r.Header.Clone()
+
+	values := map[string]string{
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  r.Host,
+		"X-Forwarded-Uri":   r.URL.RequestURI(),
+	}
+	for _, header := range headers {
+		req.Header.Set(header, values[header])
+	}
+}
+
+func (p *forwardAuthProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, p.prefix) {
+		req, _ := http.NewRequest(r.Method, p.uberich+r.URL.RequestURI(), r.Body)
+		p.forward(req, r, p.prefixHeaders)
+		p.pass(w, req)
+		return
+	}
+
+	req, _ := http.NewRequest("GET", p.uberich+p.verifyPath, nil)
+	p.forward(req, r, p.verifyHeaders)
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		for _, header := range p.authHeaders {
+			r.Header.Set(header, resp.Header.Get(header))
+		}
+		p.app.ServeHTTP(w, r)
+
+	case resp.StatusCode == http.StatusUnauthorized && p.redirectOn401:
+		http.Redirect(w, r, resp.Header.Get("Location"), http.StatusFound)
+
+	default:
+		copyResponse(w, resp)
+	}
+}
+
+func (p *forwardAuthProxy) pass(w http.ResponseWriter, req *http.Request) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyResponse(w, resp)
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// forwardedHeaders are sent by Traefik and Caddy without being configured.
+var forwardedHeaders = []string{"X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Uri"}
+
+// exampleProxy reads the parts of the config named from examples/forward-auth
+// that decide how the proxy talks to uberich. It is not a full parser of any
+// of them, so fails the test on anything it doesn't expect.
+func exampleProxy(t *testing.T, name string) *forwardAuthProxy {
+	data, err := ioutil.ReadFile(filepath.Join("..", "examples", "forward-auth", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var proxy *forwardAuthProxy
+	switch name {
+	case "nginx.conf":
+		proxy = nginxProxy(t, parseDirectives(string(data), false))
+	case "Caddyfile":
+		proxy = caddyProxy(t, parseDirectives(string(data), true))
+	case "traefik.yml":
+		proxy = traefikProxy(t, parseYAML(t, string(data)))
+	default:
+		t.Fatal("unknown example", name)
+	}
+
+	if proxy.prefix != forwardPrefix {
+		t.Fatalf("%s: passes %q to uberich, not %q", name, proxy.prefix, forwardPrefix)
+	}
+	return proxy
+}
+
+// directive is a line of an nginx config or Caddyfile, with the directives in
+// the block following it.
+type directive struct {
+	name  string
+	args  []string
+	block []*directive
+}
+
+// parseDirectives reads directives ended by ";" or, when lineEnds is true, by
+// the end of the line. Braces only open and close blocks when on their own.
+func parseDirectives(src string, lineEnds bool) []*directive {
+	var tokens []string
+	for _, line := range strings.Split(src, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, field := range strings.Fields(line) {
+			if field != ";" && strings.HasSuffix(field, ";") {
+				tokens = append(tokens, strings.TrimSuffix(field, ";"), ";")
+			} else {
+				tokens = append(tokens, field)
+			}
+		}
+		if lineEnds {
+			tokens = append(tokens, ";")
+		}
+	}
+
+	var parse func() []*directive
+	parse = func() []*directive {
+		var (
+			directives []*directive
+			current    *directive
+		)
+
+		for len(tokens) > 0 {
+			token := tokens[0]
+			tokens = tokens[1:]
+
+			switch {
+			case token == ";":
+				current = nil
+			case token == "{":
+				if current == nil {
+					current = &directive{}
+					directives = append(directives, current)
+				}
+				current.block = parse()
+				current = nil
+			case token == "}":
+				return directives
+			case current == nil:
+				current = &directive{name: token}
+				directives = append(directives, current)
+			default:
+				current.args = append(current.args, token)
+			}
+		}
+
+		return directives
+	}
+
+	return parse()
+}
+
+// find returns the first directive called name with args starting with those
+// given.
+func find(directives []*directive, name string, args ...string) *directive {
+outer:
+	for _, d := range directives {
+		if d.name != name || len(d.args) < len(args) {
+			continue
+		}
+		for i, arg := range args {
+			if d.args[i] != arg {
+				continue outer
+			}
+		}
+		return d
+	}
+
+	return nil
+}
+
+func must(t *testing.T, d *directive, what string) *directive {
+	if d == nil {
+		t.Fatal("example has no", what)
+	}
+	return d
+}
+
+func nginxProxy(t *testing.T, directives []*directive) *forwardAuthProxy {
+	server := must(t, find(directives, "server"), "server").block
+	authRequest := must(t, find(server, "auth_request"), "auth_request").args[0]
+
+	// Variables set from uberich's response.
+	fromUpstream := map[string]string{}
+	for _, d := range server {
+		if d.name == "auth_request_set" && strings.HasPrefix(d.args[1], "$upstream_http_") {
+			header := strings.ReplaceAll(strings.TrimPrefix(d.args[1], "$upstream_http_"), "_", "-")
+			fromUpstream[d.args[0]] = http.CanonicalHeaderKey(header)
+		}
+	}
+
+	forwarded := func(block []*directive) []string {
+		values := map[string]string{
+			"X-Forwarded-Proto": "$scheme",
+			"X-Forwarded-Host":  "$host",
+			"X-Forwarded-Uri":   "$request_uri",
+		}
+
+		var headers []string
+		for _, d := range block {
+			if d.name == "proxy_set_header" && values[d.args[0]] != "" {
+				if d.args[1] != values[d.args[0]] {
+					t.Fatalf("nginx.conf: sets %s to %s", d.args[0], d.args[1])
+				}
+				headers = append(headers, d.args[0])
+			}
+		}
+		return headers
+	}
+
+	verify := must(t, find(server, "location", "=", authRequest), "location for auth_request").block
+	verifyURL, err := url.Parse(must(t, find(verify, "proxy_pass"), "proxy_pass for auth_request").args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &forwardAuthProxy{
+		verifyPath:    verifyURL.Path,
+		verifyHeaders: forwarded(verify),
+	}
+
+	for _, d := range server {
+		if d.name != "location" || len(d.args) != 1 || d.args[0] == "/" || strings.HasPrefix(d.args[0], "@") {
+			continue
+		}
+
+		passURL, err := url.Parse(must(t, find(d.block, "proxy_pass"), "proxy_pass for "+d.args[0]).args[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if passURL.Host != verifyURL.Host || passURL.Path != "" {
+			t.Fatalf("nginx.conf: location %s is not passed unchanged to uberich", d.args[0])
+		}
+
+		proxy.prefix = d.args[0]
+		proxy.prefixHeaders = forwarded(d.block)
+	}
+
+	app := must(t, find(server, "location", "/"), "location /").block
+	for _, d := range app {
+		if d.name == "proxy_set_header" {
+			if header, ok := fromUpstream[d.args[1]]; ok {
+				if http.CanonicalHeaderKey(d.args[0]) != header {
+					t.Fatalf("nginx.conf: sets %s to uberich's %s", d.args[0], header)
+				}
+				proxy.authHeaders = append(proxy.authHeaders, header)
+			}
+		}
+	}
+
+	if errorPage := find(server, "error_page", "401", "="); errorPage != nil {
+		signIn := must(t, find(server, "location", errorPage.args[2]), "location "+errorPage.args[2]).block
+		if ret := find(signIn, "return", "302"); ret != nil && fromUpstream[ret.args[1]] == "Location" {
+			proxy.redirectOn401 = true
+		}
+	}
+
+	return proxy
+}
+
+func caddyProxy(t *testing.T, directives []*directive) *forwardAuthProxy {
+	if len(directives) != 1 {
+		t.Fatal("Caddyfile: expected one site")
+	}
+	site := directives[0].block
+
+	proxy := &forwardAuthProxy{
+		verifyHeaders: forwardedHeaders,
+		prefixHeaders: forwardedHeaders,
+	}
+
+	var upstream string
+	for _, d := range site {
+		if d.name != "handle" {
+			continue
+		}
+
+		if len(d.args) == 1 {
+			if !strings.HasSuffix(d.args[0], "/*") {
+				t.Fatal("Caddyfile: handle", d.args[0], "is not for a prefix")
+			}
+			proxy.prefix = strings.TrimSuffix(d.args[0], "*")
+			upstream = must(t, find(d.block, "reverse_proxy"), "reverse_proxy to uberich").args[0]
+			continue
+		}
+
+		forwardAuth := must(t, find(d.block, "forward_auth"), "forward_auth")
+		if forwardAuth.args[0] != upstream {
+			t.Fatal("Caddyfile: forward_auth is not to uberich at", upstream)
+		}
+
+		proxy.verifyPath = must(t, find(forwardAuth.block, "uri"), "forward_auth uri").args[0]
+		proxy.authHeaders = must(t, find(forwardAuth.block, "copy_headers"), "copy_headers").args
+
+		for _, matcher := range forwardAuth.block {
+			if strings.HasPrefix(matcher.name, "@") && len(matcher.args) == 2 && matcher.args[0] == "status" && matcher.args[1] == "401" {
+				handle := find(forwardAuth.block, "handle_response", matcher.name)
+				if handle != nil && find(handle.block, "redir", "{rp.header.Location}") != nil {
+					proxy.redirectOn401 = true
+				}
+			}
+		}
+	}
+
+	return proxy
+}
+
+// parseYAML reads the maps and lists of strings used by traefik.yml.
+func parseYAML(t *testing.T, src string) map[string]interface{} {
+	type line struct {
+		indent int
+		text   string
+	}
+
+	var lines []line
+	for _, text := range strings.Split(src, "\n") {
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lines = append(lines, line{len(text) - len(trimmed), strings.TrimRight(trimmed, " ")})
+	}
+
+	var parse func(indent int) interface{}
+	parse = func(indent int) interface{} {
+		if strings.HasPrefix(lines[0].text, "- ") {
+			var list []string
+			for len(lines) > 0 && lines[0].indent == indent && strings.HasPrefix(lines[0].text, "- ") {
+				list = append(list, strings.TrimPrefix(lines[0].text, "- "))
+				lines = lines[1:]
+			}
+			return list
+		}
+
+		m := map[string]interface{}{}
+		for len(lines) > 0 && lines[0].indent == indent {
+			i := strings.Index(lines[0].text, ":")
+			if i < 0 {
+				t.Fatal("traefik.yml: can't read", lines[0].text)
+			}
+			key, value := lines[0].text[:i], strings.TrimSpace(lines[0].text[i+1:])
+			lines = lines[1:]
+
+			if value != "" {
+				m[key] = value
+			} else if len(lines) > 0 && lines[0].indent > indent {
+				m[key] = parse(lines[0].indent)
+			}
+		}
+		return m
+	}
+
+	return parse(0).(map[string]interface{})
+}
+
+func traefikProxy(t *testing.T, conf map[string]interface{}) *forwardAuthProxy {
+	get := func(v interface{}, keys ...string) interface{} {
+		for _, key := range keys {
+			m, ok := v.(map[string]interface{})
+			if !ok || m[key] == nil {
+				t.Fatal("traefik.yml: has no", strings.Join(keys, "."))
+			}
+			v = m[key]
+		}
+		return v
+	}
+
+	var (
+		routers  = get(conf, "http", "routers").(map[string]interface{})
+		services = get(conf, "http", "services").(map[string]interface{})
+	)
+
+	proxy := &forwardAuthProxy{
+		verifyHeaders: forwardedHeaders,
+		prefixHeaders: forwardedHeaders,
+	}
+
+	var verifyURL *url.URL
+	for name, middleware := range get(conf, "http", "middlewares").(map[string]interface{}) {
+		address, err := url.Parse(get(middleware, "forwardAuth", "address").(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifyURL = address
+		proxy.verifyPath = address.Path
+		proxy.authHeaders = get(middleware, "forwardAuth", "authResponseHeaders").([]string)
+
+		used := false
+		for _, router := range routers {
+			if list, ok := router.(map[string]interface{})["middlewares"].([]string); ok {
+				for _, m := range list {
+					used = used || m == name
+				}
+			}
+		}
+		if !used {
+			t.Fatal("traefik.yml: middleware", name, "is not used")
+		}
+	}
+
+	pathPrefix := regexp.MustCompile("PathPrefix\\(`([^`]+)`\\)")
+	for _, router := range routers {
+		match := pathPrefix.FindStringSubmatch(get(router, "rule").(string))
+		if match == nil {
+			continue
+		}
+
+		service := get(router, "service").(string)
+		servers := get(services, service, "loadBalancer", "servers").([]string)
+		if len(servers) != 1 || servers[0] != "url: "+verifyURL.Scheme+"://"+verifyURL.Host {
+			t.Fatal("traefik.yml:", match[1], "is not passed to uberich")
+		}
+		proxy.prefix = match[1]
+	}
+
+	return proxy
+}
+
+// forwardAuthServers starts uberich, and an app behind a proxy, on different
+// hosts so that they don't share cookies.
+func forwardAuthServers(t *testing.T, proxy *forwardAuthProxy, allowGroup string) (uberichServer, proxyServer *httptest.Server) {
+	var handler http.Handler
+	uberichServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	uberichURL := strings.Replace(uberichServer.URL, "127.0.0.1", "localhost", 1)
+
+	proxy.uberich = uberichURL
+	proxy.app = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Uberich-Email")+" "+r.Header.Get("X-Uberich-Groups"))
+	})
+	proxyServer = httptest.NewServer(proxy)
+
+	path := filepath.Join(t.TempDir(), "settings.toml")
+	ioutil.WriteFile(path, []byte(`issuer = "`+uberichURL+`"
+hashKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+blockKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+`), 0600)
+
+	conf, err := config.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := jwt.GenerateKey("test-key")
+	encoded, _ := key.Encode()
+	conf.AddSigningKey(&config.Key{ID: key.ID, Private: encoded})
+
+	app := &config.App{Name: "tool", URI: proxyServer.URL, RedirectURIs: []string{proxyServer.URL + "/*"}}
+	if allowGroup != "" {
+		app.AllowGroup(allowGroup)
+	}
+	conf.SetApp(app)
+
+	addUser(conf, "me@example.com", "password")
+	user := conf.GetUser("me@example.com")
+	user.AddGroup("staff")
+	conf.SetUser(user)
+
+	db := storage.NewTOML(conf, "")
+	hashKey, blockKey, _ := conf.Keys()
+	store := cookies.New("", false, hashKey, blockKey, db)
+
+	forwardAuth := ForwardAuth(conf, db, store, discardLogger)
+
+	mux := http.NewServeMux()
+	mux.Handle("/login", Login(conf, db, store, auth.NewChecker(db, config.RateLimits{}, discardLogger), discardLogger))
+	mux.Handle("/logout", Logout(conf, db, store, discardLogger))
+	mux.Handle("/sessions", Sessions(db, store, discardLogger))
+	mux.Handle("/verify", forwardAuth.Verify)
+	mux.Handle(forwardPrefix+"start", forwardAuth.Start)
+	mux.Handle(forwardPrefix+"callback", forwardAuth.Callback)
+	handler = mux
+
+	return uberichServer, proxyServer
+}
+
+// browse makes a request like a browser would, following the Location of a 401
+// as the page's refresh would.
+func browse(t *testing.T, client *http.Client, method, u string, form url.Values) *http.Response {
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	if method == "POST" {
+		resp, err = client.PostForm(u, form)
+	} else {
+		resp, err = client.Get(u)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		location := resp.Header.Get("Location")
+		body, _ := ioutil.ReadAll(resp.Body)
+		if !strings.Contains(string(body), `<meta http-equiv="refresh"`) {
+			t.Fatal("expected 401 to refresh to", location)
+		}
+		return browse(t, client, "GET", location, nil)
+	}
+
+	return resp
+}
+
+// TestForwardAuthWithExamples uses a proxy that talks to uberich as each of the
+// example configs says to, rather than running the proxies themselves.
+func TestForwardAuthWithExamples(t *testing.T) {
+	for _, name := range []string{"nginx.conf", "traefik.yml", "Caddyfile"} {
+		t.Run(name, func(t *testing.T) {
+			uberichServer, proxyServer := forwardAuthServers(t, exampleProxy(t, name), "staff")
+			defer uberichServer.Close()
+			defer proxyServer.Close()
+
+			jar, _ := cookiejar.New(nil)
+			client := &http.Client{Jar: jar}
+
+			assert := assert.New(t)
+
+			resp := browse(t, client, "GET", proxyServer.URL+"/secret?a=b", nil)
+			assert.Equal(http.StatusOK, resp.StatusCode)
+			assert.True(strings.HasPrefix(resp.Request.URL.String(), strings.Replace(uberichServer.URL, "127.0.0.1", "localhost", 1)+"/login?"))
+
+			form := url.Values{"email": {"me@example.com"}, "pass": {"password"}}
+			for k, v := range resp.Request.URL.Query() {
+				form[k] = v
+			}
+
+			resp = browse(t, client, "POST", resp.Request.URL.String(), form)
+			assert.Equal(http.StatusOK, resp.StatusCode)
+			assert.Equal(proxyServer.URL+"/secret?a=b", resp.Request.URL.String())
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal("me@example.com staff", string(body))
+
+			// The app's own cookie is enough from now on.
+			resp = browse(t, client, "GET", proxyServer.URL+"/other", nil)
+			body, _ = ioutil.ReadAll(resp.Body)
+			assert.Equal("me@example.com staff", string(body))
+		})
+	}
+}
+
+func TestForwardAuthAfterLogout(t *testing.T) {
+	uberichServer, proxyServer := forwardAuthServers(t, exampleProxy(t, "nginx.conf"), "")
+	defer uberichServer.Close()
+	defer proxyServer.Close()
+
+	assert := assert.New(t)
+
+	signIn := func() *http.Client {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		resp := browse(t, client, "GET", proxyServer.URL+"/secret", nil)
+
+		form := url.Values{"email": {"me@example.com"}, "pass": {"password"}}
+		for k, v := range resp.Request.URL.Query() {
+			form[k] = v
+		}
+
+		resp = browse(t, client, "POST", resp.Request.URL.String(), form)
+		assert.Equal(proxyServer.URL+"/secret", resp.Request.URL.String())
+		return client
+	}
+
+	client := signIn()
+	other := signIn()
+
+	uberichURL := strings.Replace(uberichServer.URL, "127.0.0.1", "localhost", 1)
+	resp := browse(t, client, "POST", uberichURL+"/logout", url.Values{})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// The app's cookie remains, but its session has ended.
+	resp = browse(t, client, "GET", proxyServer.URL+"/secret", nil)
+	assert.True(strings.HasPrefix(resp.Request.URL.String(), uberichURL+"/login?"))
+
+	// Whereas the user is still signed in elsewhere.
+	resp = browse(t, other, "GET", proxyServer.URL+"/secret", nil)
+	assert.Equal(proxyServer.URL+"/secret", resp.Request.URL.String())
+	resp = browse(t, other, "GET", uberichURL+"/sessions", nil)
+	assert.Equal(uberichURL+"/sessions", resp.Request.URL.String())
+}
+
+func TestForwardAuthWhenNotAllowed(t *testing.T) {
+	uberichServer, proxyServer := forwardAuthServers(t, exampleProxy(t, "nginx.conf"), "admins")
+	defer uberichServer.Close()
+	defer proxyServer.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	resp := browse(t, client, "GET", proxyServer.URL+"/secret", nil)
+
+	form := url.Values{"email": {"me@example.com"}, "pass": {"password"}}
+	for k, v := range resp.Request.URL.Query() {
+		form[k] = v
+	}
+
+	resp = browse(t, client, "POST", resp.Request.URL.String(), form)
+	assert.New(t).Equal(http.StatusForbidden, resp.StatusCode)
+}
+
+func TestForwardAuthWhenNoApp(t *testing.T) {
+	uberichServer, proxyServer := forwardAuthServers(t, exampleProxy(t, "nginx.conf"), "")
+	defer uberichServer.Close()
+	defer proxyServer.Close()
+
+	req, _ := http.NewRequest("GET", uberichServer.URL+"/verify", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/")
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.New(t).Nil(err)
+	assert.New(t).Equal(http.StatusForbidden, resp.StatusCode)
+}
@@ -7,11 +7,13 @@ import (
 
 	"github.com/gorilla/context"
 	"github.com/justinas/nosurf"
+	"hawx.me/code/uberich/auth"
 	"hawx.me/code/uberich/config"
 	"hawx.me/code/uberich/cookies"
+	"hawx.me/code/uberich/storage"
 )
 
-func New(conf *config.Config) (http.Handler, error) {
+func New(conf *config.Config, db storage.Storage) (http.Handler, error) {
 	mux := http.NewServeMux()
 
 	hashKey, blockKey, err := conf.Keys()
@@ -19,13 +21,58 @@ func New(conf *config.Config) (http.Handler, error) {
 		return mux, err
 	}
 
-	store := cookies.New(conf.Domain, conf.Secure, hashKey, blockKey)
+	if _, err := conf.Signers(); err != nil {
+		return mux, err
+	}
+
+	limits, err := conf.RateLimits()
+	if err != nil {
+		return mux, err
+	}
+
+	store := cookies.New(conf.Domain, conf.Secure, hashKey, blockKey, db)
 
 	logger := log.New(os.Stdout, "", log.LstdFlags)
+	checker := auth.NewChecker(db, limits, logger)
+	checker.OnLock(notifyLockout(conf, logger))
 
-	mux.Handle("/login", nosurf.New(Login(conf, store, logger)))
-	mux.Handle("/change-password", nosurf.New(ChangePassword(conf, store, logger)))
+	mux.Handle("/login", nosurf.New(Login(conf, db, store, checker, logger)))
+	mux.Handle("/login/magic", nosurf.New(MagicLink(conf, db, store, checker, logger)))
+	mux.Handle("/logout", nosurf.New(Logout(conf, db, store, logger)))
+	mux.Handle("/sessions", nosurf.New(Sessions(db, store, logger)))
+	mux.Handle("/account/activity", nosurf.New(Activity(db, store, logger)))
+	mux.Handle("/change-password", nosurf.New(ChangePassword(conf, db, store, checker, logger)))
+	mux.Handle("/register", nosurf.New(Register(conf, db, logger)))
+
+	resetPassword := ResetPassword(conf, db, store, checker, logger)
+	mux.Handle("/forgot-password", nosurf.New(resetPassword.Forgot))
+	mux.Handle("/reset-password", nosurf.New(resetPassword.Reset))
+	mux.Handle("/two-factor", nosurf.New(TwoFactor(conf, db, store, checker, logger)))
 	mux.Handle("/styles.css", Styles)
+	mux.Handle("/passkeys.js", PasskeyScript)
+
+	passkeys := Passkeys(conf, db, store, logger)
+	mux.Handle("/passkeys", nosurf.New(passkeys.Manage))
+	mux.Handle("/passkeys/register/begin", nosurf.New(passkeys.BeginRegistration))
+	mux.Handle("/passkeys/register/finish", nosurf.New(passkeys.FinishRegistration))
+	mux.Handle("/passkeys/login/begin", nosurf.New(passkeys.BeginLogin))
+	mux.Handle("/passkeys/login/finish", nosurf.New(passkeys.FinishLogin))
+
+	forwardAuth := ForwardAuth(conf, db, store, logger)
+	mux.Handle("/verify", forwardAuth.Verify)
+	mux.Handle(forwardPrefix+"start", forwardAuth.Start)
+	mux.Handle(forwardPrefix+"callback", forwardAuth.Callback)
+
+	openID := OpenID(conf, db, store, checker, logger)
+	mux.Handle("/.well-known/openid-configuration", openID.Discovery)
+	mux.Handle("/.well-known/jwks.json", openID.Keys)
+	mux.Handle("/authorize", nosurf.New(openID.Authorize))
+	mux.Handle("/token", openID.Token)
+	mux.Handle("/userinfo", openID.UserInfo)
+
+	if _, err := conf.Proxies(); err != nil {
+		return mux, err
+	}
 
-	return context.ClearHandler(mux), nil
+	return withRequestID(withClientIP(conf, logger, context.ClearHandler(mux))), nil
 }
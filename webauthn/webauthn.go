@@ -0,0 +1,451 @@
+// Package webauthn implements the small part of Web Authentication that uberich
+// needs: registering passkeys that sign with ES256, without attestation, and
+// checking the assertions they make.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+var (
+	ErrMalformed    = errors.New("webauthn: malformed response")
+	ErrType         = errors.New("webauthn: wrong type of response")
+	ErrChallenge    = errors.New("webauthn: challenge does not match")
+	ErrOrigin       = errors.New("webauthn: origin does not match")
+	ErrRelyingParty = errors.New("webauthn: relying party does not match")
+	ErrUserPresence = errors.New("webauthn: user was not present")
+	ErrAttestation  = errors.New("webauthn: unsupported attestation")
+	ErrAlgorithm    = errors.New("webauthn: unsupported algorithm")
+	ErrCredential   = errors.New("webauthn: credential does not match")
+	ErrSignature    = errors.New("webauthn: invalid signature")
+	ErrSignCount    = errors.New("webauthn: sign count did not increase")
+)
+
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+
+	// algES256 is the COSE identifier for ECDSA using P-256 and SHA-256.
+	algES256 = -7
+
+	// timeout is how long, in milliseconds, the browser should wait for the user.
+	timeout = 60000
+)
+
+var encoding = base64.RawURLEncoding
+
+// NewChallenge returns a random challenge for a ceremony.
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// RelyingParty is the site that credentials are registered with. The ID is the
+// domain credentials are scoped to, and the Origin is where the ceremonies take
+// place.
+type RelyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+// Credential is a registered public key.
+type Credential struct {
+	ID        string
+	PublicKey string
+	SignCount uint32
+}
+
+// Entity describes the relying party or user in CreationOptions.
+type Entity struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// Parameter is a kind of credential that can be created.
+type Parameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// Descriptor identifies a credential.
+type Descriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// Selection restricts the authenticators that can be used.
+type Selection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are given to navigator.credentials.create to register a new
+// credential. Binary values are encoded as unpadded base64url.
+type CreationOptions struct {
+	Challenge              string       `json:"challenge"`
+	RP                     Entity       `json:"rp"`
+	User                   Entity       `json:"user"`
+	PubKeyCredParams       []Parameter  `json:"pubKeyCredParams"`
+	Timeout                int          `json:"timeout"`
+	Attestation            string       `json:"attestation"`
+	ExcludeCredentials     []Descriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection Selection    `json:"authenticatorSelection"`
+}
+
+// RequestOptions are given to navigator.credentials.get to sign in with a
+// credential. Binary values are encoded as unpadded base64url.
+type RequestOptions struct {
+	Challenge        string       `json:"challenge"`
+	RPID             string       `json:"rpId"`
+	Timeout          int          `json:"timeout"`
+	UserVerification string       `json:"userVerification"`
+	AllowCredentials []Descriptor `json:"allowCredentials,omitempty"`
+}
+
+// CreationOptions returns the options for registering a discoverable credential
+// for the user identified by userID, excluding any they already have.
+func (rp RelyingParty) CreationOptions(challenge, userID, name string, exclude []string) CreationOptions {
+	options := CreationOptions{
+		Challenge:        challenge,
+		RP:               Entity{ID: rp.ID, Name: rp.Name},
+		User:             Entity{ID: encoding.EncodeToString([]byte(userID)), Name: name, DisplayName: name},
+		PubKeyCredParams: []Parameter{{Type: "public-key", Alg: algES256}},
+		Timeout:          timeout,
+		Attestation:      "none",
+		AuthenticatorSelection: Selection{
+			ResidentKey:      "required",
+			UserVerification: "preferred",
+		},
+	}
+
+	for _, id := range exclude {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, Descriptor{Type: "public-key", ID: id})
+	}
+
+	return options
+}
+
+// RequestOptions returns the options for signing in with any discoverable
+// credential.
+func (rp RelyingParty) RequestOptions(challenge string) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          timeout,
+		UserVerification: "preferred",
+	}
+}
+
+// AttestationData is the authenticator's part of an AttestationResponse.
+type AttestationData struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// AttestationResponse is the result of navigator.credentials.create. Binary
+// values are encoded as unpadded base64url.
+type AttestationResponse struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Response AttestationData `json:"response"`
+}
+
+// AssertionData is the authenticator's part of an AssertionResponse.
+type AssertionData struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+// AssertionResponse is the result of navigator.credentials.get. Binary values
+// are encoded as unpadded base64url.
+type AssertionResponse struct {
+	ID       string        `json:"id"`
+	Type     string        `json:"type"`
+	Response AssertionData `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func parseClientData(encoded string) (clientData, []byte, error) {
+	var data clientData
+
+	raw, err := encoding.DecodeString(encoded)
+	if err != nil {
+		return data, nil, ErrMalformed
+	}
+
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return data, nil, ErrMalformed
+	}
+
+	return data, raw, nil
+}
+
+// Challenge returns the challenge that the response claims to answer, so that
+// the ceremony it belongs to can be found. It is not verified.
+func (r AttestationResponse) Challenge() string {
+	data, _, _ := parseClientData(r.Response.ClientDataJSON)
+	return data.Challenge
+}
+
+// Challenge returns the challenge that the response claims to answer, so that
+// the ceremony it belongs to can be found. It is not verified.
+func (r AssertionResponse) Challenge() string {
+	data, _, _ := parseClientData(r.Response.ClientDataJSON)
+	return data.Challenge
+}
+
+// UserID returns the ID of the user the credential was registered for, as given
+// to CreationOptions. It is empty if the authenticator did not return it, and
+// is not verified.
+func (r AssertionResponse) UserID() string {
+	id, _ := encoding.DecodeString(r.Response.UserHandle)
+	return string(id)
+}
+
+func (rp RelyingParty) checkClientData(data clientData, typ, challenge string) error {
+	if data.Type != typ {
+		return ErrType
+	}
+	if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return ErrChallenge
+	}
+	if data.Origin != rp.Origin {
+		return ErrOrigin
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func (rp RelyingParty) parseAuthenticatorData(b []byte) (authenticatorData, error) {
+	var data authenticatorData
+
+	if len(b) < 37 {
+		return data, ErrMalformed
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(b[:32], rpIDHash[:]) {
+		return data, ErrRelyingParty
+	}
+
+	data.flags = b[32]
+	data.signCount = binary.BigEndian.Uint32(b[33:37])
+
+	if data.flags&flagUserPresent == 0 {
+		return data, ErrUserPresence
+	}
+
+	if data.flags&flagAttestedCredentialData != 0 {
+		rest := b[37:]
+		if len(rest) < 18 {
+			return data, ErrMalformed
+		}
+
+		// skip the 16 byte AAGUID, which is only useful with attestation
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return data, ErrMalformed
+		}
+		data.credentialID, rest = rest[:idLength], rest[idLength:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return data, ErrMalformed
+		}
+		data.publicKey = rest[:len(rest)-len(after)]
+	}
+
+	return data, nil
+}
+
+// parsePublicKey reads a COSE encoded key, which must be for ES256.
+func parsePublicKey(b []byte) (*ecdsa.PublicKey, error) {
+	decoded, _, err := decodeCBOR(b)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	if kty != 2 || alg != algES256 || crv != 1 {
+		return nil, ErrAlgorithm
+	}
+
+	x, _ := m[int64(-2)].([]byte)
+	y, _ := m[int64(-3)].([]byte)
+	if len(x) != 32 || len(y) != 32 {
+		return nil, ErrMalformed
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, ErrMalformed
+	}
+
+	return key, nil
+}
+
+// Register checks the response to a registration ceremony that was started with
+// challenge, returning the new credential.
+func (rp RelyingParty) Register(r AttestationResponse, challenge string) (Credential, error) {
+	if r.Type != "public-key" {
+		return Credential{}, ErrType
+	}
+
+	data, _, err := parseClientData(r.Response.ClientDataJSON)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := rp.checkClientData(data, "webauthn.create", challenge); err != nil {
+		return Credential{}, err
+	}
+
+	rawObject, err := encoding.DecodeString(r.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, ErrMalformed
+	}
+
+	decoded, _, err := decodeCBOR(rawObject)
+	if err != nil {
+		return Credential{}, ErrMalformed
+	}
+
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return Credential{}, ErrMalformed
+	}
+
+	if format, _ := object["fmt"].(string); format != "none" {
+		return Credential{}, ErrAttestation
+	}
+
+	rawAuthData, ok := object["authData"].([]byte)
+	if !ok {
+		return Credential{}, ErrMalformed
+	}
+
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if authData.credentialID == nil {
+		return Credential{}, ErrMalformed
+	}
+
+	if _, err := parsePublicKey(authData.publicKey); err != nil {
+		return Credential{}, err
+	}
+
+	id := encoding.EncodeToString(authData.credentialID)
+	if id != r.ID {
+		return Credential{}, ErrCredential
+	}
+
+	return Credential{
+		ID:        id,
+		PublicKey: encoding.EncodeToString(authData.publicKey),
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// Verify checks the response to a sign in ceremony that was started with
+// challenge was made by credential. It returns the credential with its sign
+// count updated, which should be saved, and whether the authenticator verified
+// the user, with a PIN or biometric, as well as checking they were present.
+func (rp RelyingParty) Verify(r AssertionResponse, challenge string, credential Credential) (Credential, bool, error) {
+	if r.Type != "public-key" {
+		return credential, false, ErrType
+	}
+	if r.ID != credential.ID {
+		return credential, false, ErrCredential
+	}
+
+	data, rawClientData, err := parseClientData(r.Response.ClientDataJSON)
+	if err != nil {
+		return credential, false, err
+	}
+	if err := rp.checkClientData(data, "webauthn.get", challenge); err != nil {
+		return credential, false, err
+	}
+
+	rawAuthData, err := encoding.DecodeString(r.Response.AuthenticatorData)
+	if err != nil {
+		return credential, false, ErrMalformed
+	}
+
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return credential, false, err
+	}
+
+	rawPublicKey, err := encoding.DecodeString(credential.PublicKey)
+	if err != nil {
+		return credential, false, ErrMalformed
+	}
+
+	key, err := parsePublicKey(rawPublicKey)
+	if err != nil {
+		return credential, false, err
+	}
+
+	signature, err := encoding.DecodeString(r.Response.Signature)
+	if err != nil {
+		return credential, false, ErrMalformed
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := sha256.Sum256(append(append([]byte(nil), rawAuthData...), clientDataHash[:]...))
+	if !ecdsa.VerifyASN1(key, signed[:], signature) {
+		return credential, false, ErrSignature
+	}
+
+	// Authenticators that don't count always give zero, otherwise the count must
+	// increase or the credential may have been cloned.
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return credential, false, ErrSignCount
+	}
+
+	credential.SignCount = authData.signCount
+	return credential, authData.flags&flagUserVerified != 0, nil
+}
@@ -0,0 +1,114 @@
+package webauthn_test
+
+import (
+	"testing"
+
+	"hawx.me/code/assert"
+	"hawx.me/code/uberich/webauthn"
+	"hawx.me/code/uberich/webauthn/webauthntest"
+)
+
+var rp = webauthn.RelyingParty{
+	ID:     "uberich.example.com",
+	Name:   "uberich",
+	Origin: "https://uberich.example.com",
+}
+
+func register(t *testing.T, authenticator *webauthntest.Authenticator) webauthn.Credential {
+	challenge, _ := webauthn.NewChallenge()
+
+	resp, err := authenticator.Create(rp.CreationOptions(challenge, "me@example.com", "me@example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := rp.Register(resp, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return credential
+}
+
+func TestRegisterAndVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	authenticator := webauthntest.New(rp.Origin)
+	credential := register(t, authenticator)
+
+	challenge, _ := webauthn.NewChallenge()
+	resp, err := authenticator.Get(rp.RequestOptions(challenge))
+	assert.Nil(err)
+	assert.Equal(challenge, resp.Challenge())
+	assert.Equal("me@example.com", resp.UserID())
+
+	updated, verified, err := rp.Verify(resp, challenge, credential)
+	assert.Nil(err)
+	assert.True(verified)
+	assert.Equal(uint32(1), updated.SignCount)
+
+	_, _, err = rp.Verify(resp, challenge, updated)
+	assert.Equal(webauthn.ErrSignCount, err)
+}
+
+func TestRegisterWhenWrongChallenge(t *testing.T) {
+	challenge, _ := webauthn.NewChallenge()
+	other, _ := webauthn.NewChallenge()
+
+	resp, _ := webauthntest.New(rp.Origin).Create(rp.CreationOptions(challenge, "me@example.com", "me@example.com", nil))
+
+	_, err := rp.Register(resp, other)
+	assert.New(t).Equal(webauthn.ErrChallenge, err)
+}
+
+func TestRegisterWhenWrongOrigin(t *testing.T) {
+	challenge, _ := webauthn.NewChallenge()
+
+	resp, _ := webauthntest.New("https://evil.example.com").Create(rp.CreationOptions(challenge, "me@example.com", "me@example.com", nil))
+
+	_, err := rp.Register(resp, challenge)
+	assert.New(t).Equal(webauthn.ErrOrigin, err)
+}
+
+func TestVerifyWhenWrongRelyingParty(t *testing.T) {
+	authenticator := webauthntest.New(rp.Origin)
+	credential := register(t, authenticator)
+
+	other := rp
+	other.ID = "evil.example.com"
+
+	challenge, _ := webauthn.NewChallenge()
+	resp, _ := authenticator.Get(rp.RequestOptions(challenge))
+
+	_, _, err := other.Verify(resp, challenge, credential)
+	assert.New(t).Equal(webauthn.ErrRelyingParty, err)
+}
+
+func TestVerifyWhenWrongKey(t *testing.T) {
+	authenticator := webauthntest.New(rp.Origin)
+	credential := register(t, authenticator)
+	other := register(t, webauthntest.New(rp.Origin))
+
+	challenge, _ := webauthn.NewChallenge()
+	resp, _ := authenticator.Get(rp.RequestOptions(challenge))
+
+	credential.PublicKey = other.PublicKey
+
+	_, _, err := rp.Verify(resp, challenge, credential)
+	assert.New(t).Equal(webauthn.ErrSignature, err)
+}
+
+func TestVerifyWhenUserNotVerified(t *testing.T) {
+	assert := assert.New(t)
+
+	authenticator := webauthntest.New(rp.Origin)
+	authenticator.UserVerified = false
+	credential := register(t, authenticator)
+
+	challenge, _ := webauthn.NewChallenge()
+	resp, _ := authenticator.Get(rp.RequestOptions(challenge))
+
+	_, verified, err := rp.Verify(resp, challenge, credential)
+	assert.Nil(err)
+	assert.False(verified)
+}
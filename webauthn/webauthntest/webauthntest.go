@@ -0,0 +1,214 @@
+// Package webauthntest provides a software authenticator, so that WebAuthn
+// ceremonies can be run in tests without a browser.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"hawx.me/code/uberich/webauthn"
+)
+
+var encoding = base64.RawURLEncoding
+
+// Authenticator holds discoverable credentials, acting as a browser at Origin
+// would.
+type Authenticator struct {
+	Origin string
+
+	// UserVerified is reported in the flags of each assertion.
+	UserVerified bool
+
+	mu          sync.Mutex
+	credentials []*credential
+}
+
+type credential struct {
+	id        []byte
+	rpID      string
+	userID    string
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+// New returns an authenticator that will answer ceremonies as if they were run
+// at origin.
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+func (a *Authenticator) clientData(typ, challenge string) string {
+	data, _ := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": challenge,
+		"origin":    a.Origin,
+	})
+
+	return encoding.EncodeToString(data)
+}
+
+func (a *Authenticator) authData(rpID string, signCount uint32, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	flags := byte(0x01)
+	if a.UserVerified {
+		flags |= 0x04
+	}
+	if attested != nil {
+		flags |= 0x40
+	}
+
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+	return append(data, attested...)
+}
+
+// Create registers a new credential, as navigator.credentials.create would.
+func (a *Authenticator) Create(options webauthn.CreationOptions) (webauthn.AttestationResponse, error) {
+	userID, err := encoding.DecodeString(options.User.ID)
+	if err != nil {
+		return webauthn.AttestationResponse{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return webauthn.AttestationResponse{}, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return webauthn.AttestationResponse{}, err
+	}
+
+	publicKey := encodeCBOR(map[interface{}]interface{}{
+		1:  2,
+		3:  -7,
+		-1: 1,
+		-2: padded(key.X.Bytes()),
+		-3: padded(key.Y.Bytes()),
+	})
+
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, publicKey...)
+
+	object := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(options.RP.ID, 0, attested),
+	})
+
+	a.mu.Lock()
+	a.credentials = append(a.credentials, &credential{
+		id:     id,
+		rpID:   options.RP.ID,
+		userID: string(userID),
+		key:    key,
+	})
+	a.mu.Unlock()
+
+	return webauthn.AttestationResponse{
+		ID:   encoding.EncodeToString(id),
+		Type: "public-key",
+		Response: webauthn.AttestationData{
+			ClientDataJSON:    a.clientData("webauthn.create", options.Challenge),
+			AttestationObject: encoding.EncodeToString(object),
+		},
+	}, nil
+}
+
+// Get signs in with the most recently created credential for the relying
+// party, as navigator.credentials.get would.
+func (a *Authenticator) Get(options webauthn.RequestOptions) (webauthn.AssertionResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var found *credential
+	for _, c := range a.credentials {
+		if c.rpID == options.RPID {
+			found = c
+		}
+	}
+	if found == nil {
+		return webauthn.AssertionResponse{}, errors.New("webauthntest: no credential for " + options.RPID)
+	}
+
+	found.signCount++
+
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	rawClientData, _ := encoding.DecodeString(clientData)
+	clientDataHash := sha256.Sum256(rawClientData)
+
+	authData := a.authData(found.rpID, found.signCount, nil)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, found.key, signed[:])
+	if err != nil {
+		return webauthn.AssertionResponse{}, err
+	}
+
+	return webauthn.AssertionResponse{
+		ID:   encoding.EncodeToString(found.id),
+		Type: "public-key",
+		Response: webauthn.AssertionData{
+			ClientDataJSON:    clientData,
+			AuthenticatorData: encoding.EncodeToString(authData),
+			Signature:         encoding.EncodeToString(signature),
+			UserHandle:        encoding.EncodeToString([]byte(found.userID)),
+		},
+	}, nil
+}
+
+func padded(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// encodeCBOR encodes the small subset of CBOR that the authenticator needs:
+// ints, strings, byte strings and maps.
+func encodeCBOR(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+
+	case map[interface{}]interface{}:
+		b := cborHead(5, uint64(len(v)))
+		for key, value := range v {
+			b = append(b, encodeCBOR(key)...)
+			b = append(b, encodeCBOR(value)...)
+		}
+		return b
+	}
+
+	panic("webauthntest: cannot encode value")
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+}